@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"text/template"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"go.hollow.sh/metadataservice/internal/fieldcrypt"
+	"go.hollow.sh/metadataservice/internal/models"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+// renderTemplateCmd represents the render-template command
+var renderTemplateCmd = &cobra.Command{
+	Use:   "render-template",
+	Short: "renders a template field against an instance's stored metadata",
+	Long: `Renders a golang template, like the ones used for --api-url, --phone-home-url,
+and --user-state-url, against the metadata stored for an instance, and prints
+the result. Use it to preview a template before deploying it.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		instanceID, _ := cmd.Flags().GetString("instance")
+		templateText, _ := cmd.Flags().GetString("template")
+
+		rendered, err := renderTemplate(cmd.Context(), instanceID, templateText)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(cmd.OutOrStdout(), rendered)
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(renderTemplateCmd)
+
+	renderTemplateCmd.Flags().String("instance", "", "ID of the instance whose stored metadata the template is rendered against")
+	renderTemplateCmd.Flags().String("template", "", "the golang template to render, like 'https://api.example.com/{{ .id }}'")
+
+	_ = renderTemplateCmd.MarkFlagRequired("instance")
+	_ = renderTemplateCmd.MarkFlagRequired("template")
+}
+
+// renderTemplate parses the template the same way template fields are parsed
+// by the server, and renders it against the metadata stored for the instance.
+func renderTemplate(ctx context.Context, instanceID, templateText string) (string, error) {
+	tmpl, err := template.New("render-template").Option(templateMissingKeyOption()).Parse(templateText)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template: %w", err)
+	}
+
+	// Encrypted fields have to be decrypted before they can be rendered.
+	if err := fieldcrypt.Configure(viper.GetString("crypto.key"), viper.GetStringSlice("crypto.encrypted_fields")); err != nil {
+		return "", fmt.Errorf("invalid metadata encryption options: %w", err)
+	}
+
+	db := initDB()
+	defer db.Close()
+
+	metadata, err := models.FindInstanceMetadatum(ctx, db, instanceID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("no metadata stored for instance %s: %w", instanceID, err)
+		}
+
+		return "", fmt.Errorf("failed to load metadata for instance %s: %w", instanceID, err)
+	}
+
+	decrypted, err := fieldcrypt.DecryptMetadata(metadata.Metadata)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt metadata for instance %s: %w", instanceID, err)
+	}
+
+	rendered, err := v1api.RenderTemplateField(tmpl, decrypted)
+	if err != nil {
+		return "", fmt.Errorf("failed to render template: %w", err)
+	}
+
+	return rendered, nil
+}
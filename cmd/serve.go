@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"os"
 	"text/template"
 	"time"
 
@@ -19,9 +21,15 @@ import (
 	"go.uber.org/zap"
 	"golang.org/x/oauth2/clientcredentials"
 
+	"go.hollow.sh/metadataservice/internal/audit"
 	"go.hollow.sh/metadataservice/internal/config"
+	"go.hollow.sh/metadataservice/internal/fieldcrypt"
 	"go.hollow.sh/metadataservice/internal/httpsrv"
 	"go.hollow.sh/metadataservice/internal/lookup"
+	"go.hollow.sh/metadataservice/internal/middleware"
+	"go.hollow.sh/metadataservice/internal/upserter"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+	"go.hollow.sh/metadataservice/pkg/api/v1/ec2"
 )
 
 const (
@@ -32,6 +40,16 @@ const (
 	dbTxTimoutDefault         = 15 * time.Second
 
 	shutdownGracePeriod = 10 * time.Second
+
+	writeRateBurstDefault  = 10
+	publicRateBurstDefault = 20
+
+	accessLogSlowThresholdDefault = 1 * time.Second
+
+	lookupMaxRPSWaitDefault   = 1 * time.Second
+	lookupMaxRetriesDefault   = 2
+	identifyIPCacheTTLDefault = 30 * time.Second
+	preloadConcurrencyDefault = 4
 )
 
 // serveCmd represents the serve command
@@ -60,9 +78,39 @@ func init() {
 	serveCmd.Flags().Duration("db-retry-max-interval", dbRetryMaxIntervalDefault, "maximum number of seconds to sleep between db transaction retries (includes random jitter)")
 	viperBindFlag("crdb.retry_interval", serveCmd.Flags().Lookup("db-retry-max-interval"))
 
+	serveCmd.Flags().Duration("db-retry-budget", 0, "maximum time a single request may spend retrying failed db transactions, across all of its upsert and delete transactions. No retry is started which would begin after the budget runs out. Zero means no limit.")
+	viperBindFlag("crdb.retry_budget", serveCmd.Flags().Lookup("db-retry-budget"))
+
+	serveCmd.Flags().Int("db-retry-budget-attempts", 0, "maximum number of failed db transaction retries a single request may make, across all of its upsert and delete transactions. Zero means no limit.")
+	viperBindFlag("crdb.retry_budget_attempts", serveCmd.Flags().Lookup("db-retry-budget-attempts"))
+
 	serveCmd.Flags().Duration("db-tx-timeout", dbTxTimoutDefault, "maximum number of seconds to allow db transactions to run for")
 	viperBindFlag("crdb.tx_timeout", serveCmd.Flags().Lookup("db-tx-timeout"))
 
+	serveCmd.Flags().String("db-isolation-level", "", "isolation level for db write transactions (upserts and deletes). One of 'serializable', 'repeatable_read', or 'read_committed'. When unset, the database default is used (SERIALIZABLE for CockroachDB). Non-serializable levels must be enabled on the CockroachDB cluster.")
+	viperBindFlag("crdb.isolation_level", serveCmd.Flags().Lookup("db-isolation-level"))
+
+	serveCmd.Flags().Bool("db-ip-conflict-require-newer", false, "only take IP addresses associated to another instance when the incoming metadata is newer than that instance's stored metadata. When not newer, the conflicting IPs are left associated to the other instance.")
+	viperBindFlag("crdb.ip_conflict_require_newer", serveCmd.Flags().Lookup("db-ip-conflict-require-newer"))
+
+	serveCmd.Flags().String("db-ip-conflict-policy", upserter.IPConflictPolicyKeep, "What an upsert does when --db-ip-conflict-require-newer stops it from taking an IP address from another instance. 'keep' proceeds without the IP address, leaving it associated to the other instance. 'reject' fails the whole upsert with a 409.")
+	viperBindFlag("crdb.ip_conflict_policy", serveCmd.Flags().Lookup("db-ip-conflict-policy"))
+
+	serveCmd.Flags().Bool("db-ip-conflict-delete-orphans", false, "when an upsert takes the last IP address associated to another instance, also delete that instance's stored metadata and userdata, as it's been deprovisioned.")
+	viperBindFlag("crdb.ip_conflict_delete_orphans", serveCmd.Flags().Lookup("db-ip-conflict-delete-orphans"))
+
+	serveCmd.Flags().String("db-ip-association-mode", upserter.IPAssociationModeReplace, "How an instance's IP addresses are updated by metadata and userdata upserts. 'replace' replaces them with the upsert's IP addresses, so the last write wins. 'union' only removes IP addresses missing from an upsert when the instance has no stored record of the other type, so the IP addresses pushed with its metadata and userdata don't clobber each other.")
+	viperBindFlag("crdb.ip_association_mode", serveCmd.Flags().Lookup("db-ip-association-mode"))
+
+	serveCmd.Flags().StringSlice("db-allowed-ip-cidrs", []string{}, "If set, reject metadata and userdata upserts with a 400 when any of their IP addresses aren't within one of these CIDRs.")
+	viperBindFlag("crdb.allowed_ip_cidrs", serveCmd.Flags().Lookup("db-allowed-ip-cidrs"))
+
+	serveCmd.Flags().Bool("db-lock-ips-in-chunks", false, "select and lock conflicting IP address rows within the upsert transaction, 25 addresses at a time, so conflicts are still detected reliably for instances with a very large number of IPs.")
+	viperBindFlag("crdb.lock_ips_in_chunks", serveCmd.Flags().Lookup("db-lock-ips-in-chunks"))
+
+	serveCmd.Flags().Duration("db-max-future-updated-at", 0, "If set, reject metadata upserts with a 400 when their updatedAt is more than this far ahead of the server's clock, so a buggy producer can't block later updates. 0 disables the check.")
+	viperBindFlag("crdb.max_future_updated_at", serveCmd.Flags().Lookup("db-max-future-updated-at"))
+
 	// OIDC Flags
 	serveCmd.Flags().Bool("oidc", true, "use oidc auth")
 	viperBindFlag("oidc.enabled", serveCmd.Flags().Lookup("oidc"))
@@ -104,6 +152,70 @@ func init() {
 	serveCmd.Flags().StringSlice("lookup-oidc-scopes", []string{"metadata:read:metadata", "metadata:read:userdata"}, "OIDC JWT scopes for lookup service")
 	viperBindFlag("lookup.oidc.scopes", serveCmd.Flags().Lookup("lookup-oidc-scopes"))
 
+	serveCmd.Flags().StringSlice("lookup-skip-cidrs", []string{}, "Comma-separated list of CIDRs, like `\"10.0.0.0/8,fd00::/8\"`. Requests from IP addresses within these ranges never call the lookup service, and get a 404 when the metadata or userdata isn't already stored.")
+	viperBindFlag("lookup.skip_cidrs", serveCmd.Flags().Lookup("lookup-skip-cidrs"))
+
+	serveCmd.Flags().Float64("lookup-max-rps", 0, "Maximum number of requests per second sent to the lookup service, across all incoming requests. Zero means no limit.")
+	viperBindFlag("lookup.max_rps", serveCmd.Flags().Lookup("lookup-max-rps"))
+
+	serveCmd.Flags().Duration("lookup-max-rps-wait", lookupMaxRPSWaitDefault, "How long a lookup waits for the --lookup-max-rps limiter before failing as if the lookup service had returned an error.")
+	viperBindFlag("lookup.max_rps_wait", serveCmd.Flags().Lookup("lookup-max-rps-wait"))
+
+	serveCmd.Flags().String("lookup-forward-client-ip-header", "", "Request header, like 'X-Forwarded-For', used to pass the requesting instance's IP address to the lookup service when looking up an instance by ID. Unset doesn't forward it.")
+	viperBindFlag("lookup.forward_client_ip_header", serveCmd.Flags().Lookup("lookup-forward-client-ip-header"))
+
+	serveCmd.Flags().Int("lookup-max-retries", lookupMaxRetriesDefault, "Number of times a lookup service request is retried after a network error or a 429, 502, 503, or 504 response. Zero disables retries.")
+	viperBindFlag("lookup.max_retries", serveCmd.Flags().Lookup("lookup-max-retries"))
+
+	serveCmd.Flags().Duration("lookup-retry-base-interval", lookup.DefaultRetryBaseInterval, "How long to wait before the first retry of a failed lookup service request. The wait doubles after each retry, and retries stop once the wait would outlast the incoming request.")
+	viperBindFlag("lookup.retry_base_interval", serveCmd.Flags().Lookup("lookup-retry-base-interval"))
+
+	serveCmd.Flags().Duration("lookup-request-timeout", 0, "Maximum time each attempt at a lookup service request may take. Attempts which time out are retried like network errors, up to --lookup-max-retries. Zero means lookups are only limited by the incoming request's own timeout.")
+	viperBindFlag("lookup.request_timeout", serveCmd.Flags().Lookup("lookup-request-timeout"))
+
+	serveCmd.Flags().Duration("lookup-sync-timeout", lookup.DefaultSyncTimeout, "Maximum time a lookup shared by concurrent requests for the same instance may take, including storing its result. It isn't cut short when the request which started it is canceled, so the other requests waiting on it still get its result.")
+	viperBindFlag("lookup.sync_timeout", serveCmd.Flags().Lookup("lookup-sync-timeout"))
+
+	serveCmd.Flags().Duration("cache-ttl", 0, "How long stored metadata and userdata are considered fresh after they were last updated. Once stale, they're refreshed from the lookup service when requested by an instance, if it's enabled, and the stored copy is served if the refresh fails. Also reported by the /device-metadata/:instance-id/freshness endpoint. Zero means stored data never goes stale, and a negative value means it always is.")
+	viperBindFlag("cache_ttl", serveCmd.Flags().Lookup("cache-ttl"))
+
+	serveCmd.Flags().String("preload-file", "", "File of instance IDs, one per line, whose metadata is fetched from the lookup service and stored on startup. The readiness check reports the server as down until the preload finishes. Requires --lookup-enabled.")
+	viperBindFlag("preload.file", serveCmd.Flags().Lookup("preload-file"))
+
+	serveCmd.Flags().Int("preload-concurrency", preloadConcurrencyDefault, "Maximum number of concurrent lookups made while preloading the instances in --preload-file.")
+	viperBindFlag("preload.concurrency", serveCmd.Flags().Lookup("preload-concurrency"))
+
+	// Instance Identification Flags
+	serveCmd.Flags().Bool("identify-instance-id-header-enabled", false, "Identify instances making requests to the public endpoints by the instance ID in the --identify-instance-id-header header first. The header is only honoured on requests from the --gin-trusted-proxies, which must always set (or remove) it, as clients could otherwise claim to be any instance.")
+	viperBindFlag("identify.instance_id_header_enabled", serveCmd.Flags().Lookup("identify-instance-id-header-enabled"))
+
+	serveCmd.Flags().String("identify-instance-id-header", "X-Instance-ID", "Request header holding the ID of the instance making the request, used with --identify-instance-id-header-enabled.")
+	viperBindFlag("identify.instance_id_header", serveCmd.Flags().Lookup("identify-instance-id-header"))
+
+	serveCmd.Flags().Bool("identify-mac-header-enabled", false, "Identify instances making requests to the public endpoints by the MAC address in the --identify-mac-header header, matched against the 'mac' of the stored metadata's network interfaces, after the instance ID header. The header is only honoured on requests from the --gin-trusted-proxies, which must always set (or remove) it.")
+	viperBindFlag("identify.mac_header_enabled", serveCmd.Flags().Lookup("identify-mac-header-enabled"))
+
+	serveCmd.Flags().String("identify-mac-header", "X-Instance-MAC", "Request header holding the MAC address of the instance making the request, used with --identify-mac-header-enabled.")
+	viperBindFlag("identify.mac_header", serveCmd.Flags().Lookup("identify-mac-header"))
+
+	serveCmd.Flags().Bool("identify-ip-enabled", true, "Identify instances making requests to the public endpoints by their IP address, after any enabled headers.")
+	viperBindFlag("identify.ip_enabled", serveCmd.Flags().Lookup("identify-ip-enabled"))
+
+	serveCmd.Flags().Int("identify-ip-cache-size", 0, "Number of request IP addresses whose instance is cached in memory, sparing a database query when identifying instances by their IP address. Entries are evicted when this server writes the instance's IP addresses, but not when another replica does, so keep --identify-ip-cache-ttl short when running several. Zero disables the cache.")
+	viperBindFlag("identify.ip_cache_size", serveCmd.Flags().Lookup("identify-ip-cache-size"))
+
+	serveCmd.Flags().Duration("identify-ip-cache-ttl", identifyIPCacheTTLDefault, "How long an instance identified by its IP address is cached for, with --identify-ip-cache-size.")
+	viperBindFlag("identify.ip_cache_ttl", serveCmd.Flags().Lookup("identify-ip-cache-ttl"))
+
+	serveCmd.Flags().Bool("identify-ip-verify-ownership", false, "Only serve instances identified by their IP address when the request IP is also listed in the network.addresses of their stored metadata. Other requests receive a 404. Userdata is only served to instances with stored metadata.")
+	viperBindFlag("identify.ip_verify_ownership", serveCmd.Flags().Lookup("identify-ip-verify-ownership"))
+
+	serveCmd.Flags().String("identify-fingerprint-header", "", "If set, along with --identify-fingerprint-field, only serve metadata to requests presenting the instance's fingerprint (like a hash of a TPM-backed identity) in this header. Other requests receive a 403.")
+	viperBindFlag("identify.fingerprint_header", serveCmd.Flags().Lookup("identify-fingerprint-header"))
+
+	serveCmd.Flags().String("identify-fingerprint-field", "", "Dot-separated path of the metadata field holding the instance's fingerprint, like `customdata.fingerprint`, used with --identify-fingerprint-header.")
+	viperBindFlag("identify.fingerprint_field", serveCmd.Flags().Lookup("identify-fingerprint-field"))
+
 	// Misc serve flags
 	serveCmd.Flags().StringSlice("gin-trusted-proxies", []string{}, "Comma-separated list of IP addresses, like `\"192.168.1.1,10.0.0.1\"`. When running the Metadata Service behind something like a reverse proxy or load balancer, you may need to set this so that gin's `(*Context).ClientIP()` method returns a value provided by the proxy in a header like `X-Forwarded-For`.")
 	viperBindFlag("gin.trustedproxies", serveCmd.Flags().Lookup("gin-trusted-proxies"))
@@ -117,13 +229,217 @@ func init() {
 	serveCmd.Flags().String("user-state-url", "", "An optional golang template string used to build a URL which instances can use for sending user state events. This template string will be evaluated against the instance metadata, and appended as a 'user_state_url' field on the metadata document served to instances. If no template string is specified, the 'user_state_url' field will not be added to the metadata document.")
 	viperBindFlag("metadata.user_state_url", serveCmd.Flags().Lookup("user-state-url"))
 
+	serveCmd.Flags().StringToString("template-field-conditions", map[string]string{}, "Optional conditions for templated metadata fields, like `phone_home_url={{ if .spot }}true{{ end }}`. A field is only added to an instance's metadata when its condition, a golang template evaluated against the metadata, renders something other than an empty string, 'false', or '0'.")
+	viperBindFlag("metadata.template_field_conditions", serveCmd.Flags().Lookup("template-field-conditions"))
+
+	serveCmd.Flags().String("template-missing-key-mode", "", "How a templated metadata field (like 'api_url') is rendered when its template references a metadata key the instance doesn't have. One of 'drop' (omit the field), 'empty' (render an empty string), or 'default' (render the configured default value). When unset, missing keys are rendered as '<no value>'.")
+	viperBindFlag("metadata.template_missing_key_mode", serveCmd.Flags().Lookup("template-missing-key-mode"))
+
+	serveCmd.Flags().String("template-missing-key-default", "", "The value rendered for templated metadata fields referencing a missing metadata key, when --template-missing-key-mode is 'default'.")
+	viperBindFlag("metadata.template_missing_key_default", serveCmd.Flags().Lookup("template-missing-key-default"))
+
+	serveCmd.Flags().StringToString("template-missing-key-defaults", map[string]string{}, "Per-field values rendered for templated metadata fields referencing a missing metadata key, like `api_url=https://metadata.example.com`, when --template-missing-key-mode is 'default'. Takes precedence over --template-missing-key-default.")
+	viperBindFlag("metadata.template_missing_key_defaults", serveCmd.Flags().Lookup("template-missing-key-defaults"))
+
+	serveCmd.Flags().Bool("empty-metadata-not-found", false, "Respond with a 404 instead of a 200 with '{}' when an instance's stored metadata is an empty JSON object. Applies to both the public and internal metadata endpoints.")
+	viperBindFlag("metadata.empty_not_found", serveCmd.Flags().Lookup("empty-metadata-not-found"))
+
+	serveCmd.Flags().String("metadata-ip-mismatch-mode", "", "What to do when metadata being stored lists IP addresses in 'network.addresses' which aren't in the request's 'ipAddresses' (so /metadata won't resolve them to the instance): 'warn' logs a warning, and 'error' rejects the request with a 400. Unset skips the check.")
+	viperBindFlag("metadata.ip_mismatch_mode", serveCmd.Flags().Lookup("metadata-ip-mismatch-mode"))
+
+	serveCmd.Flags().Bool("metadata-include-debug-fields", false, "Add a '_debug' object to /metadata responses containing the request IP and whether the metadata was served from the database or the upstream lookup service. Intended for diagnostics only; the EC2-style endpoints are unaffected.")
+	viperBindFlag("metadata.include_debug_fields", serveCmd.Flags().Lookup("metadata-include-debug-fields"))
+
+	serveCmd.Flags().StringToString("metadata-field-renames", map[string]string{}, "Rename top-level metadata keys in the JSON metadata responses, like `id=instance_id,ssh_keys=ssh-keys`. Stored data and the EC2-style endpoints are unaffected.")
+	viperBindFlag("metadata.field_renames", serveCmd.Flags().Lookup("metadata-field-renames"))
+
+	serveCmd.Flags().StringToString("metadata-fallback-instances", map[string]string{}, "Maps CIDRs to the ID of an instance whose metadata is served to requests from IP addresses within the CIDR that don't match any instance, like `10.70.16.0/20=316ed337-feee-48c6-a11b-3d4738e3cd6d`. The most specific matching CIDR wins.")
+	viperBindFlag("metadata.fallback_instances", serveCmd.Flags().Lookup("metadata-fallback-instances"))
+
+	serveCmd.Flags().StringSlice("metadata-allowed-keys", []string{}, "If set, reject metadata upserts with a 400 when the metadata has top-level keys outside this list.")
+	viperBindFlag("metadata.allowed_keys", serveCmd.Flags().Lookup("metadata-allowed-keys"))
+
+	serveCmd.Flags().Bool("metadata-trim-string-values", false, "Trim the surrounding whitespace from top-level string values of metadata before it's stored, like a hostname with a trailing newline. Userdata is never modified.")
+	viperBindFlag("metadata.trim_string_values", serveCmd.Flags().Lookup("metadata-trim-string-values"))
+
+	serveCmd.Flags().Bool("metadata-history", false, "Record every version of each instance's metadata (and its deletion), so the version current at a given time can be read with GET /device-metadata/:instance-id?as_of=<timestamp>.")
+	viperBindFlag("metadata.history_enabled", serveCmd.Flags().Lookup("metadata-history"))
+
+	serveCmd.Flags().String("userdata-generate-template", "", "An optional golang template string used to generate userdata for instances which have metadata but no stored userdata. The template is evaluated against the instance metadata.")
+	viperBindFlag("userdata.generate_template", serveCmd.Flags().Lookup("userdata-generate-template"))
+
+	serveCmd.Flags().String("userdata-default-file", "", "An optional file containing default userdata (like a baseline cloud-config) served to instances which have metadata but no stored userdata. Instances without metadata still get a 404. --userdata-generate-template takes precedence on the /userdata endpoint.")
+	viperBindFlag("userdata.default_file", serveCmd.Flags().Lookup("userdata-default-file"))
+
+	serveCmd.Flags().Int("userdata-compress-threshold", 0, "Userdata larger than this many bytes is gzip'd before it's stored, and transparently decompressed when it's read. Userdata which was pushed gzip'd is stored as-is. Zero disables compression.")
+	viperBindFlag("userdata.compress_threshold", serveCmd.Flags().Lookup("userdata-compress-threshold"))
+
+	serveCmd.Flags().String("userdata-maintenance-file", "", "An optional file containing maintenance userdata (like instructions for instances to hold) which can be served by the public userdata endpoints in place of the stored userdata during maintenance. It's toggled with PUT /api/v1/device-userdata-maintenance or --userdata-maintenance-enabled. The internal endpoints still serve the stored userdata.")
+	viperBindFlag("userdata.maintenance_file", serveCmd.Flags().Lookup("userdata-maintenance-file"))
+
+	serveCmd.Flags().Bool("userdata-maintenance-enabled", false, "Start serving the userdata in --userdata-maintenance-file in place of the stored userdata on startup.")
+	viperBindFlag("userdata.maintenance_enabled", serveCmd.Flags().Lookup("userdata-maintenance-enabled"))
+
+	serveCmd.Flags().Bool("userdata-require-utf8", false, "Reject userdata upserts with a 400 when the userdata isn't valid UTF-8. gzip'd userdata is still accepted.")
+	viperBindFlag("userdata.require_utf8", serveCmd.Flags().Lookup("userdata-require-utf8"))
+
+	serveCmd.Flags().Bool("userdata-gzip-passthrough", false, "Serve userdata that was stored gzip'd with a 'Content-Encoding: gzip' header to instances that accept gzip, and decompressed to instances that don't. When unset, stored userdata is always served as it was pushed.")
+	viperBindFlag("userdata.gzip_passthrough", serveCmd.Flags().Lookup("userdata-gzip-passthrough"))
+
+	serveCmd.Flags().String("userdata-normalize-line-endings", "", "Convert CRLF line endings in userdata to LF, either when it's pushed ('store') or when it's served to instances ('serve'). gzip'd and other non-UTF-8 userdata is left untouched. Unset leaves line endings as they were pushed.")
+	viperBindFlag("userdata.normalize_line_endings", serveCmd.Flags().Lookup("userdata-normalize-line-endings"))
+
 	serveCmd.Flags().Duration("shutdown-grace-period", shutdownGracePeriod, "The grace period for requests to finish before forcibly exiting.")
 	viperBindFlag("shutdown_grace_period", serveCmd.Flags().Lookup("shutdown-grace-period"))
+
+	serveCmd.Flags().Duration("http-keepalive-period", 0, "The TCP keep-alive period for connections accepted by the server. Set this below any NAT or load balancer idle timeout to prevent idle connections from being reset. Zero uses the Go default (15s), and a negative value disables keep-alives.")
+	viperBindFlag("http.keepalive_period", serveCmd.Flags().Lookup("http-keepalive-period"))
+
+	serveCmd.Flags().Duration("http-notfound-retry-after", 0, "If set, 404 responses from the public metadata and userdata endpoints will include a Retry-After header with this duration (rounded up to whole seconds). This helps instances that request their data before the provisioning system has pushed it back off and retry instead of failing.")
+	viperBindFlag("http.notfound_retry_after", serveCmd.Flags().Lookup("http-notfound-retry-after"))
+
+	serveCmd.Flags().Int("http-unresolved-client-ip-status", http.StatusNotFound, "The status returned by the public metadata and userdata endpoints when the request's client IP address can't be resolved (usually a proxy misconfiguration). Either 404 or 400.")
+	viperBindFlag("http.unresolved_client_ip_status", serveCmd.Flags().Lookup("http-unresolved-client-ip-status"))
+
+	serveCmd.Flags().String("http-notfound-message", v1api.DefaultInstanceNotFoundMessage, "The message returned in 404 responses from the public metadata and userdata endpoints when there's no data for the requesting instance. This lets clients distinguish 'no data' from 'no such route'.")
+	viperBindFlag("http.notfound_message", serveCmd.Flags().Lookup("http-notfound-message"))
+
+	serveCmd.Flags().Float64("http-write-rate-limit", 0, "If set, limits each authenticated client (by JWT subject) to this many requests per second on the internal POST and DELETE endpoints. Requests over the limit receive a 429. Zero disables the limit.")
+	viperBindFlag("http.write_rate_limit", serveCmd.Flags().Lookup("http-write-rate-limit"))
+
+	serveCmd.Flags().Int("http-write-rate-burst", writeRateBurstDefault, "The burst size allowed by --http-write-rate-limit.")
+	viperBindFlag("http.write_rate_burst", serveCmd.Flags().Lookup("http-write-rate-burst"))
+
+	serveCmd.Flags().Float64("ratelimit-requests-per-second", 0, "If set, limits each client IP address to this many requests per second across the public metadata and userdata endpoints. Requests over the limit receive a 429 with a Retry-After header. Zero disables the limit.")
+	viperBindFlag("ratelimit.requests_per_second", serveCmd.Flags().Lookup("ratelimit-requests-per-second"))
+
+	serveCmd.Flags().Int("ratelimit-burst", publicRateBurstDefault, "The burst size allowed by --ratelimit-requests-per-second.")
+	viperBindFlag("ratelimit.burst", serveCmd.Flags().Lookup("ratelimit-burst"))
+
+	serveCmd.Flags().Int("http-delete-batch-max-size", v1api.DefaultDeleteBatchMaxSize, "The maximum number of instance IDs accepted by a single request to the batch delete endpoint. Larger batches receive a 400.")
+	viperBindFlag("http.delete_batch_max_size", serveCmd.Flags().Lookup("http-delete-batch-max-size"))
+
+	serveCmd.Flags().Int("http-max-authorization-header-size", v1api.DefaultMaxAuthorizationHeaderSize, "The maximum size, in bytes, of the Authorization header accepted by the internal endpoints. Requests with larger headers receive a 431 before their token is parsed.")
+	viperBindFlag("http.max_authorization_header_size", serveCmd.Flags().Lookup("http-max-authorization-header-size"))
+
+	serveCmd.Flags().String("http-signed-url-secret", "", "If set, serve metadata from /metadata/signed/:instance-id to requests signed with this secret (an HMAC-SHA256 of the instance ID and the 'exp' expiry timestamp, in the 'sig' query parameter) until they expire, without identifying the instance by its IP address. Prefer setting METADATASERVICE_HTTP_SIGNED_URL_SECRET over the flag.")
+	viperBindFlag("http.signed_url_secret", serveCmd.Flags().Lookup("http-signed-url-secret"))
+
+	serveCmd.Flags().Duration("http-signed-url-max-lifetime", v1api.DefaultSignedURLMaxLifetime, "How far in the future a signed metadata URL may expire. Requests with URLs expiring later receive a 403, so a leaked URL can't be used indefinitely.")
+	viperBindFlag("http.signed_url_max_lifetime", serveCmd.Flags().Lookup("http-signed-url-max-lifetime"))
+
+	serveCmd.Flags().StringToString("http-route-timeouts", map[string]string{}, "Per-route request timeouts, like `/metadata=2s,/device-metadata=30s`. Routes are given as registered (for example '/device-metadata/:instance-id'), and timeouts for routes of the latest API version also apply under /api/v1. Requests exceeding their route's timeout get a 504.")
+	viperBindFlag("http.route_timeouts", serveCmd.Flags().Lookup("http-route-timeouts"))
+
+	serveCmd.Flags().Bool("http-expose-errors", false, "Include the underlying error in 500 responses, including those for recovered panics, for debugging. Otherwise they only have a generic message. Stack traces are never included.")
+	viperBindFlag("http.expose_errors", serveCmd.Flags().Lookup("http-expose-errors"))
+
+	serveCmd.Flags().Bool("http-status-auth-required", false, "Require requests to the /status endpoint, which reports the build and DB migration versions, to be authenticated.")
+	viperBindFlag("http.status_auth_required", serveCmd.Flags().Lookup("http-status-auth-required"))
+
+	serveCmd.Flags().Bool("http-server-timing", false, "Add a Server-Timing header to the responses from the public metadata and userdata endpoints, breaking down the time spent identifying the instance, querying the database, calling the lookup service, and rendering templates.")
+	viperBindFlag("http.server_timing", serveCmd.Flags().Lookup("http-server-timing"))
+
+	serveCmd.Flags().Int("access-log-sample-rate", 1, "Only log 1 in every N successful (2xx) requests in the access log. Unsuccessful requests, errors, and requests slower than --access-log-slow-threshold are always logged. 1 logs every request.")
+	viperBindFlag("logging.access_sample_rate", serveCmd.Flags().Lookup("access-log-sample-rate"))
+
+	serveCmd.Flags().Duration("access-log-slow-threshold", accessLogSlowThresholdDefault, "Requests taking at least this long are always logged in the access log, regardless of --access-log-sample-rate. 0 disables the exemption.")
+	viperBindFlag("logging.access_slow_threshold", serveCmd.Flags().Lookup("access-log-slow-threshold"))
+
+	// EC2 Flags
+	serveCmd.Flags().String("ec2-schema-version", ec2.SchemaVersionV1, "metadata schema version used to render the EC2-style endpoints for records that don't declare their own 'schema_version'")
+	viperBindFlag("ec2.schema_version", serveCmd.Flags().Lookup("ec2-schema-version"))
+
+	serveCmd.Flags().StringToString("ec2-facility-placements", map[string]string{}, "Maps facility codes to the AWS-style placement reported by the EC2-style endpoints, like `da11=us-central/us-central-da11` (region/availability-zone). Instances in facilities without a placement don't expose the 'placement' items.")
+	viperBindFlag("ec2.facility_placements", serveCmd.Flags().Lookup("ec2-facility-placements"))
+
+	serveCmd.Flags().StringSlice("ec2-always-advertised-items", []string{}, "Top-level EC2-style item names, like 'public-keys', listed for every instance even when the instance has no value for them. Requests for an empty item still return a 404.")
+	viperBindFlag("ec2.always_advertised_items", serveCmd.Flags().Lookup("ec2-always-advertised-items"))
+
+	// Audit Flags
+	serveCmd.Flags().Bool("audit-enabled", false, "Record every successful create, update, and delete made through the internal endpoints in a separate, append-only audit log, with the time, JWT subject, instance ID, and action.")
+	viperBindFlag("audit.enabled", serveCmd.Flags().Lookup("audit-enabled"))
+
+	serveCmd.Flags().String("audit-file", "stdout", "The file the audit log is appended to, when --audit-enabled is set. 'stdout' and 'stderr' are also supported.")
+	viperBindFlag("audit.file", serveCmd.Flags().Lookup("audit-file"))
+
+	// Encryption Flags
+	serveCmd.Flags().String("crypto-key", "", "Base64-encoded AES key (16, 24, or 32 bytes) used to encrypt the metadata fields in --crypto-encrypted-fields before they're stored, and to decrypt them before they're served.")
+	viperBindFlag("crypto.key", serveCmd.Flags().Lookup("crypto-key"))
+
+	serveCmd.Flags().StringSlice("crypto-encrypted-fields", []string{}, "Comma-separated list of metadata fields to encrypt at rest, as dot-separated paths through nested objects, like `license_key,customdata.join_token`. Requires --crypto-key.")
+	viperBindFlag("crypto.encrypted_fields", serveCmd.Flags().Lookup("crypto-encrypted-fields"))
 }
 
 func serve(ctx context.Context) {
 	setupTracing(logger)
 
+	if _, err := upserter.TxOptions(); err != nil {
+		logger.Fatalw("invalid db transaction options", "error", err)
+	}
+
+	if _, err := upserter.IPAssociationMode(); err != nil {
+		logger.Fatalw("invalid IP association mode", "error", err)
+	}
+
+	if _, err := upserter.IPConflictPolicy(); err != nil {
+		logger.Fatalw("invalid IP conflict policy", "error", err)
+	}
+
+	allowedIPCIDRs, err := v1api.ParseAllowedIPCIDRs(viper.GetStringSlice("crdb.allowed_ip_cidrs"))
+	if err != nil {
+		logger.Fatalw("invalid allowed IP CIDRs", "error", err)
+	}
+
+	if err := v1api.ValidateUnresolvedClientIPStatus(viper.GetInt("http.unresolved_client_ip_status")); err != nil {
+		logger.Fatalw("invalid unresolved client IP status", "error", err)
+	}
+
+	placements, err := ec2.ParseFacilityPlacements(viper.GetStringMapString("ec2.facility_placements"))
+	if err != nil {
+		logger.Fatalw("invalid EC2 facility placements", "error", err)
+	}
+
+	ec2.SetFacilityPlacements(placements)
+
+	metadataFallbacks, err := v1api.ParseMetadataFallbacks(viper.GetStringMapString("metadata.fallback_instances"))
+	if err != nil {
+		logger.Fatalw("invalid metadata fallback instances", "error", err)
+	}
+
+	if err := v1api.ValidateTemplateMissingKeyMode(viper.GetString("metadata.template_missing_key_mode")); err != nil {
+		logger.Fatalw("invalid metadata template options", "error", err)
+	}
+
+	if err := v1api.ValidateMetadataIPMismatchMode(viper.GetString("metadata.ip_mismatch_mode")); err != nil {
+		logger.Fatalw("invalid metadata IP mismatch mode", "error", err)
+	}
+
+	if err := v1api.ValidateUserdataLineEndingsMode(viper.GetString("userdata.normalize_line_endings")); err != nil {
+		logger.Fatalw("invalid userdata line endings normalization mode", "error", err)
+	}
+
+	if err := ec2.ValidateSchemaVersion(viper.GetString("ec2.schema_version")); err != nil {
+		logger.Fatalw("invalid EC2 metadata schema version", "error", err)
+	}
+
+	if err := fieldcrypt.Configure(viper.GetString("crypto.key"), viper.GetStringSlice("crypto.encrypted_fields")); err != nil {
+		logger.Fatalw("invalid metadata encryption options", "error", err)
+	}
+
+	instanceIDHeader, macHeader := getIdentifyHeaders()
+	if instanceIDHeader == "" && macHeader == "" && !viper.GetBool("identify.ip_enabled") {
+		logger.Fatalw("invalid instance identification options", "error", "at least one way of identifying instances must be enabled")
+	}
+
+	if (instanceIDHeader != "" || macHeader != "") && len(viper.GetStringSlice("gin.trustedproxies")) == 0 {
+		logger.Fatalw("invalid instance identification options", "error", "identifying instances by request headers requires --gin-trusted-proxies, as the headers are only honoured on requests from trusted proxies")
+	}
+
+	if (viper.GetString("identify.fingerprint_header") == "") != (viper.GetString("identify.fingerprint_field") == "") {
+		logger.Fatalw("invalid instance fingerprint options", "error", "both a fingerprint header and a fingerprint field are required")
+	}
+
 	db := initDB()
 
 	logger.Infow("starting metadata server", "address", viper.GetString("listen"))
@@ -133,6 +449,13 @@ func serve(ctx context.Context) {
 		logger.Fatalw("error getting lookup service client", "error", err)
 	}
 
+	lookup.SetMaxRPS(viper.GetFloat64("lookup.max_rps"), viper.GetDuration("lookup.max_rps_wait"))
+	lookup.SetSyncTimeout(viper.GetDuration("lookup.sync_timeout"))
+	middleware.SetInstanceIPCache(middleware.NewIPCache(viper.GetInt("identify.ip_cache_size"), viper.GetDuration("identify.ip_cache_ttl")))
+
+	auditLogger := getAuditLogger()
+	defer auditLogger.Sync() //nolint:errcheck // nothing left to report the error to
+
 	hs := &httpsrv.Server{
 		Logger: logger.Desugar(),
 		Listen: viper.GetString("listen"),
@@ -147,11 +470,59 @@ func serve(ctx context.Context) {
 			RolesClaim:    viper.GetString("oidc.claims.roles"),
 			UsernameClaim: viper.GetString("oidc.claims.username"),
 		},
-		TrustedProxies:  viper.GetStringSlice("gin.trustedproxies"),
-		LookupEnabled:   viper.GetBool("lookup.enabled"),
-		LookupClient:    lookupClient,
-		TemplateFields:  getTemplateFields(),
-		ShutdownTimeout: viper.GetDuration("shutdown_grace_period"),
+		TrustedProxies:                 viper.GetStringSlice("gin.trustedproxies"),
+		LookupEnabled:                  viper.GetBool("lookup.enabled"),
+		LookupClient:                   lookupClient,
+		LookupSkipCIDRs:                getLookupSkipCIDRs(),
+		AllowedIPCIDRs:                 allowedIPCIDRs,
+		AuditLogger:                    auditLogger,
+		TemplateFields:                 getTemplateFields(),
+		TemplateFieldConditions:        getTemplateFieldConditions(),
+		TemplateMissingKeyMode:         viper.GetString("metadata.template_missing_key_mode"),
+		TemplateMissingKeyDefaults:     viper.GetStringMapString("metadata.template_missing_key_defaults"),
+		TemplateMissingKeyDefaultValue: viper.GetString("metadata.template_missing_key_default"),
+		UserdataTemplate:               getUserdataTemplate(),
+		DefaultUserdata:                getDefaultUserdata(),
+		MaintenanceUserdata:            getMaintenanceUserdata(),
+		UserdataMaintenance:            viper.GetBool("userdata.maintenance_enabled"),
+		UserdataGzipPassthrough:        viper.GetBool("userdata.gzip_passthrough"),
+		ShutdownTimeout:                viper.GetDuration("shutdown_grace_period"),
+		KeepAlivePeriod:                viper.GetDuration("http.keepalive_period"),
+		NotFoundRetryAfter:             viper.GetDuration("http.notfound_retry_after"),
+		NotFoundMessage:                viper.GetString("http.notfound_message"),
+		IncludeDebugFields:             viper.GetBool("metadata.include_debug_fields"),
+		FieldRenames:                   viper.GetStringMapString("metadata.field_renames"),
+		MetadataFallbacks:              metadataFallbacks,
+		EC2SchemaVersion:               viper.GetString("ec2.schema_version"),
+		EC2AlwaysAdvertisedItems:       viper.GetStringSlice("ec2.always_advertised_items"),
+		EmptyMetadataNotFound:          viper.GetBool("metadata.empty_not_found"),
+		UnresolvedClientIPStatus:       viper.GetInt("http.unresolved_client_ip_status"),
+		WriteRateLimit:                 viper.GetFloat64("http.write_rate_limit"),
+		WriteRateBurst:                 viper.GetInt("http.write_rate_burst"),
+		PublicRateLimit:                viper.GetFloat64("ratelimit.requests_per_second"),
+		PublicRateBurst:                viper.GetInt("ratelimit.burst"),
+		DeleteBatchMaxSize:             viper.GetInt("http.delete_batch_max_size"),
+		MaxAuthorizationHeaderSize:     viper.GetInt("http.max_authorization_header_size"),
+		SignedURLSecret:                viper.GetString("http.signed_url_secret"),
+		SignedURLMaxLifetime:           viper.GetDuration("http.signed_url_max_lifetime"),
+		UserdataRequireUTF8:            viper.GetBool("userdata.require_utf8"),
+		MetadataAllowedKeys:            viper.GetStringSlice("metadata.allowed_keys"),
+		MetadataIPMismatchMode:         viper.GetString("metadata.ip_mismatch_mode"),
+		UserdataLineEndingsMode:        viper.GetString("userdata.normalize_line_endings"),
+		MetadataTrimStringValues:       viper.GetBool("metadata.trim_string_values"),
+		RouteTimeouts:                  getRouteTimeouts(),
+		ExposeErrors:                   viper.GetBool("http.expose_errors"),
+		StatusAuthRequired:             viper.GetBool("http.status_auth_required"),
+		ServerTiming:                   viper.GetBool("http.server_timing"),
+		InstanceIDHeader:               instanceIDHeader,
+		MACHeader:                      macHeader,
+		DisableIPIdentification:        !viper.GetBool("identify.ip_enabled"),
+		VerifyIPOwnership:              viper.GetBool("identify.ip_verify_ownership"),
+		FingerprintHeader:              viper.GetString("identify.fingerprint_header"),
+		FingerprintField:               viper.GetString("identify.fingerprint_field"),
+		AccessLogSampleRate:            viper.GetInt("logging.access_sample_rate"),
+		AccessLogSlowThreshold:         viper.GetDuration("logging.access_slow_threshold"),
+		Preloaded:                      startPreload(ctx, db, lookupClient),
 	}
 
 	if err := hs.Run(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
@@ -196,12 +567,98 @@ func getLookupClient(ctx context.Context) (*lookup.ServiceClient, error) {
 			EndpointParams: url.Values{"audience": []string{viper.GetString("lookup.oidc.audience")}},
 		}
 
-		return lookup.NewClient(logger.Desugar(), viper.GetString("lookup.service.url"), oauthConfig.Client(ctx))
+		client, err := lookup.NewClient(logger.Desugar(), viper.GetString("lookup.service.url"), oauthConfig.Client(ctx))
+		if err != nil {
+			return nil, err
+		}
+
+		client.ForwardClientIPHeader = viper.GetString("lookup.forward_client_ip_header")
+		client.MaxRetries = viper.GetInt("lookup.max_retries")
+		client.RetryBaseInterval = viper.GetDuration("lookup.retry_base_interval")
+		client.RequestTimeout = viper.GetDuration("lookup.request_timeout")
+
+		return client, nil
 	}
 
 	return nil, nil
 }
 
+// startPreload starts preloading the instances listed in the configured
+// preload file in the background, returning a channel which is closed once
+// it's done. It returns nil if there's nothing to preload.
+func startPreload(ctx context.Context, db *sqlx.DB, lookupClient *lookup.ServiceClient) <-chan struct{} {
+	path := viper.GetString("preload.file")
+	if path == "" {
+		return nil
+	}
+
+	if lookupClient == nil {
+		logger.Fatalw("preloading requires the lookup service to be enabled", "file", path)
+	}
+
+	ids, err := lookup.ReadPreloadFile(path)
+	if err != nil {
+		logger.Fatalw("failed to read preload file", "file", path, "error", err)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		logger.Infow("preloading instance metadata", "file", path, "instances", len(ids))
+
+		preloaded := lookup.Preload(ctx, db, logger.Desugar(), lookupClient, ids, viper.GetInt("preload.concurrency"))
+
+		logger.Infow("finished preloading instance metadata", "preloaded", preloaded, "failed", len(ids)-preloaded)
+	}()
+
+	return done
+}
+
+func getAuditLogger() *audit.Logger {
+	if !viper.GetBool("audit.enabled") {
+		return nil
+	}
+
+	auditLogger, err := audit.NewLogger(viper.GetString("audit.file"))
+	if err != nil {
+		logger.Fatalw("failed to open audit log", "file", viper.GetString("audit.file"), "error", err)
+	}
+
+	return auditLogger
+}
+
+func getLookupSkipCIDRs() []netip.Prefix {
+	var prefixes []netip.Prefix
+
+	for _, cidr := range viper.GetStringSlice("lookup.skip_cidrs") {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			logger.Fatalw("failed to parse lookup skip CIDR", "cidr", cidr, "error", err)
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes
+}
+
+func getRouteTimeouts() map[string]time.Duration {
+	timeouts := make(map[string]time.Duration)
+
+	for route, value := range viper.GetStringMapString("http.route_timeouts") {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			logger.Fatalw("invalid route timeout", "route", route, "timeout", value, "error", err)
+		}
+
+		timeouts[route] = timeout
+	}
+
+	return timeouts
+}
+
 func getTemplateFields() map[string]template.Template {
 	templates := make(map[string]template.Template)
 
@@ -209,8 +666,10 @@ func getTemplateFields() map[string]template.Template {
 	phoneHomeURL := viper.GetString("metadata.phone_home_url")
 	userStateURL := viper.GetString("metadata.user_state_url")
 
+	missingKeyOption := templateMissingKeyOption()
+
 	if len(apiURL) > 0 {
-		apiURLTempl, err := template.New("apiURL").Parse(apiURL)
+		apiURLTempl, err := template.New("apiURL").Option(missingKeyOption).Parse(apiURL)
 		if err != nil {
 			logger.Fatalf("failed to parse API URL template (%s)", apiURL, "error", err)
 		}
@@ -219,7 +678,7 @@ func getTemplateFields() map[string]template.Template {
 	}
 
 	if len(phoneHomeURL) > 0 {
-		phoneHomeTempl, err := template.New("phoneHomeURL").Parse(phoneHomeURL)
+		phoneHomeTempl, err := template.New("phoneHomeURL").Option(missingKeyOption).Parse(phoneHomeURL)
 		if err != nil {
 			logger.Fatalf("failed to parse phone home URL template (%s)", phoneHomeURL, "error", err)
 		}
@@ -228,7 +687,7 @@ func getTemplateFields() map[string]template.Template {
 	}
 
 	if len(userStateURL) > 0 {
-		userStateTempl, err := template.New("userStateURL").Parse(userStateURL)
+		userStateTempl, err := template.New("userStateURL").Option(missingKeyOption).Parse(userStateURL)
 		if err != nil {
 			logger.Fatalf("failed to parse user state URL template (%s)", userStateURL, "error", err)
 		}
@@ -238,3 +697,89 @@ func getTemplateFields() map[string]template.Template {
 
 	return templates
 }
+
+// templateMissingKeyOption returns the option template fields are parsed
+// with. When a missing key mode is configured, templates need to report
+// missing keys so the router can handle them.
+func templateMissingKeyOption() string {
+	if viper.GetString("metadata.template_missing_key_mode") != "" {
+		return "missingkey=error"
+	}
+
+	return "missingkey=default"
+}
+
+func getTemplateFieldConditions() map[string]template.Template {
+	conditions := make(map[string]template.Template)
+
+	for field, condition := range viper.GetStringMapString("metadata.template_field_conditions") {
+		tmpl, err := template.New(field + "Condition").Parse(condition)
+		if err != nil {
+			logger.Fatalf("failed to parse template field condition for %s (%s)", field, condition, "error", err)
+		}
+
+		conditions[field] = *tmpl
+	}
+
+	return conditions
+}
+
+func getDefaultUserdata() []byte {
+	defaultFile := viper.GetString("userdata.default_file")
+	if defaultFile == "" {
+		return nil
+	}
+
+	userdata, err := os.ReadFile(defaultFile)
+	if err != nil {
+		logger.Fatalw("failed to read default userdata file", "file", defaultFile, "error", err)
+	}
+
+	return userdata
+}
+
+func getMaintenanceUserdata() []byte {
+	maintenanceFile := viper.GetString("userdata.maintenance_file")
+	if maintenanceFile == "" {
+		if viper.GetBool("userdata.maintenance_enabled") {
+			logger.Fatalw("enabling the maintenance userdata requires a maintenance userdata file")
+		}
+
+		return nil
+	}
+
+	userdata, err := os.ReadFile(maintenanceFile)
+	if err != nil {
+		logger.Fatalw("failed to read maintenance userdata file", "file", maintenanceFile, "error", err)
+	}
+
+	return userdata
+}
+
+func getUserdataTemplate() *template.Template {
+	userdataTemplate := viper.GetString("userdata.generate_template")
+	if userdataTemplate == "" {
+		return nil
+	}
+
+	tmpl, err := template.New("userdata").Parse(userdataTemplate)
+	if err != nil {
+		logger.Fatalf("failed to parse userdata template (%s)", userdataTemplate, "error", err)
+	}
+
+	return tmpl
+}
+
+// getIdentifyHeaders returns the request headers instances are identified by,
+// or empty strings for the headers that aren't enabled.
+func getIdentifyHeaders() (instanceIDHeader, macHeader string) {
+	if viper.GetBool("identify.instance_id_header_enabled") {
+		instanceIDHeader = viper.GetString("identify.instance_id_header")
+	}
+
+	if viper.GetBool("identify.mac_header_enabled") {
+		macHeader = viper.GetString("identify.mac_header")
+	}
+
+	return instanceIDHeader, macHeader
+}
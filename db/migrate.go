@@ -3,9 +3,43 @@ package db
 
 import (
 	"embed"
+	"io/fs"
+	"strconv"
+	"strings"
 )
 
 // Migrations contain an embedded filesystem with all the sql migration files
 //
 //go:embed migrations/*.sql
 var Migrations embed.FS
+
+// LatestVersion returns the version of the newest embedded migration, which is
+// the migration version this build of the service expects the DB to be at.
+// Migration versions are the numeric prefixes of their file names, like the 6
+// in "00006_add_instance_metadata_history_table.sql".
+func LatestVersion() (int64, error) {
+	entries, err := fs.ReadDir(Migrations, "migrations")
+	if err != nil {
+		return 0, err
+	}
+
+	var latest int64
+
+	for _, entry := range entries {
+		prefix, _, ok := strings.Cut(entry.Name(), "_")
+		if !ok {
+			continue
+		}
+
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if version > latest {
+			latest = version
+		}
+	}
+
+	return latest, nil
+}
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+
+CREATE TABLE instance_metadata_history (
+  id UUID PRIMARY KEY NOT NULL DEFAULT gen_random_uuid(),
+  instance_id UUID NOT NULL,
+  metadata json,
+  recorded_at TIMESTAMPTZ NOT NULL
+);
+
+COMMENT ON COLUMN instance_metadata_history.instance_id is 'The instance ID';
+COMMENT ON COLUMN instance_metadata_history.metadata is 'The metadata version, or NULL if the metadata was deleted';
+
+CREATE INDEX index_instance_metadata_history_instance_id_recorded_at ON instance_metadata_history (instance_id, recorded_at DESC);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP TABLE instance_metadata_history;
+
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+
+ALTER TABLE instance_userdata ADD COLUMN compressed BOOL NOT NULL DEFAULT false;
+
+COMMENT ON COLUMN instance_userdata.compressed is 'Whether the userdata was gzip compressed by the service before being stored';
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+ALTER TABLE instance_userdata DROP COLUMN compressed;
+
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+
+CREATE TABLE instance_userdata_variants (
+  instance_id UUID NOT NULL,
+  variant STRING NOT NULL,
+  userdata bytes,
+  compressed BOOL NOT NULL DEFAULT false,
+  created_at TIMESTAMPTZ NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY (instance_id, variant)
+);
+
+COMMENT ON COLUMN instance_userdata_variants.instance_id is 'The instance ID';
+COMMENT ON COLUMN instance_userdata_variants.variant is 'The name the variant is requested by, like ignition. The default userdata is stored in instance_userdata';
+COMMENT ON COLUMN instance_userdata_variants.compressed is 'Whether the userdata was gzip compressed by the service before being stored';
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP TABLE instance_userdata_variants;
+
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+
+CREATE INVERTED INDEX index_instance_metadata_network_interfaces ON instance_metadata ((metadata->'network'->'interfaces'));
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP INDEX index_instance_metadata_network_interfaces;
+
+-- +goose StatementEnd
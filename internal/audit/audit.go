@@ -0,0 +1,69 @@
+package audit
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Actions recorded in the audit log
+const (
+	ActionMetadataCreate = "metadata.create"
+	ActionMetadataUpdate = "metadata.update"
+	ActionMetadataDelete = "metadata.delete"
+	ActionUserdataCreate = "userdata.create"
+	ActionUserdataUpdate = "userdata.update"
+	ActionUserdataDelete = "userdata.delete"
+)
+
+// Logger writes one JSON entry per write operation to its own sink. A nil
+// *Logger is valid, and discards everything.
+type Logger struct {
+	logger *zap.Logger
+}
+
+// NewLogger returns a Logger appending to the file at path. The special paths
+// "stdout" and "stderr" are also supported.
+func NewLogger(path string) (*Logger, error) {
+	cfg := zap.Config{
+		Level:       zap.NewAtomicLevelAt(zap.InfoLevel),
+		Encoding:    "json",
+		OutputPaths: []string{path},
+		EncoderConfig: zapcore.EncoderConfig{
+			TimeKey:        "timestamp",
+			MessageKey:     "message",
+			LineEnding:     zapcore.DefaultLineEnding,
+			EncodeTime:     zapcore.RFC3339NanoTimeEncoder,
+			EncodeDuration: zapcore.StringDurationEncoder,
+		},
+		ErrorOutputPaths: []string{"stderr"},
+	}
+
+	logger, err := cfg.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Logger{logger: logger}, nil
+}
+
+// Log records that subject performed action against the given instance.
+func (l *Logger) Log(action, subject, instanceID string) {
+	if l == nil {
+		return
+	}
+
+	l.logger.Info("audit",
+		zap.String("action", action),
+		zap.String("subject", subject),
+		zap.String("instance_id", instanceID),
+	)
+}
+
+// Sync flushes any buffered audit log entries.
+func (l *Logger) Sync() error {
+	if l == nil {
+		return nil
+	}
+
+	return l.logger.Sync()
+}
@@ -0,0 +1,70 @@
+package audit_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hollow.sh/metadataservice/internal/audit"
+)
+
+func TestLoggerAppendsEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	// Entries already in the file are kept
+	require.NoError(t, os.WriteFile(path, []byte(`{"message":"audit","action":"metadata.create"}`+"\n"), 0o600))
+
+	logger, err := audit.NewLogger(path)
+	require.NoError(t, err)
+
+	logger.Log(audit.ActionMetadataUpdate, "some-subject", "22bc79fc-3834-40b8-b734-30bef9634939")
+	logger.Log(audit.ActionUserdataDelete, "other-subject", "1f36c15b-b3ef-45da-b7e8-f434287e2f03")
+	require.NoError(t, logger.Sync())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	var entries []map[string]string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry map[string]string
+
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+
+		entries = append(entries, entry)
+	}
+
+	require.Len(t, entries, 3)
+
+	assert.Equal(t, audit.ActionMetadataCreate, entries[0]["action"])
+
+	assert.Equal(t, audit.ActionMetadataUpdate, entries[1]["action"])
+	assert.Equal(t, "some-subject", entries[1]["subject"])
+	assert.Equal(t, "22bc79fc-3834-40b8-b734-30bef9634939", entries[1]["instance_id"])
+
+	timestamp, err := time.Parse(time.RFC3339Nano, entries[1]["timestamp"])
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), timestamp, time.Minute)
+
+	assert.Equal(t, audit.ActionUserdataDelete, entries[2]["action"])
+	assert.Equal(t, "other-subject", entries[2]["subject"])
+	assert.Equal(t, "1f36c15b-b3ef-45da-b7e8-f434287e2f03", entries[2]["instance_id"])
+}
+
+func TestNilLogger(t *testing.T) {
+	var logger *audit.Logger
+
+	assert.NotPanics(t, func() {
+		logger.Log(audit.ActionMetadataCreate, "subject", "id")
+	})
+	assert.NoError(t, logger.Sync())
+}
@@ -0,0 +1,3 @@
+// Package audit provides the logger used to keep an append-only record of
+// write operations, separate from the application log.
+package audit // import go.hollow.sh/metadataservice/internal/audit
@@ -78,5 +78,7 @@ func cleanDB() {
 	models.InstanceMetadata().DeleteAll(ctx, testDB)
 	models.InstanceUserdata().DeleteAll(ctx, testDB)
 	models.InstanceIPAddresses().DeleteAll(ctx, testDB)
+	testDB.Exec("DELETE FROM instance_metadata_history;")
+	testDB.Exec("DELETE FROM instance_userdata_variants;")
 	testDB.Exec("SET sql_safe_updates = true;")
 }
@@ -0,0 +1,4 @@
+// Package fieldcrypt encrypts configured metadata fields before they're
+// stored, and decrypts them again before they're served, so secrets in the
+// metadata aren't kept in plaintext in the database.
+package fieldcrypt // import go.hollow.sh/metadataservice/internal/fieldcrypt
@@ -0,0 +1,249 @@
+package fieldcrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"github.com/volatiletech/sqlboiler/v4/types"
+)
+
+// encryptedPrefix marks a metadata value as encrypted. The rest of the value
+// is the base64-encoded nonce and ciphertext of the value's JSON encoding.
+// Values without it are plaintext, so rows stored before a field was
+// configured for encryption can still be read. Only the values of the
+// configured fields are ever decrypted, so plaintext values elsewhere which
+// happen to start with it are left alone.
+const encryptedPrefix = "enc:v1:"
+
+var (
+	// ErrInvalidKey is returned when the configured key isn't a base64-encoded
+	// 16, 24, or 32 byte AES key.
+	ErrInvalidKey = errors.New("encryption key must be a base64-encoded 16, 24, or 32 byte AES key")
+
+	// ErrMissingKey is returned when fields are configured for encryption, but
+	// no key is configured.
+	ErrMissingKey = errors.New("no encryption key is configured")
+
+	// ErrInvalidCiphertext is returned when an encrypted value can't be
+	// decrypted with the configured key.
+	ErrInvalidCiphertext = errors.New("invalid encrypted metadata value")
+
+	config atomic.Pointer[fieldConfig]
+)
+
+type fieldConfig struct {
+	aead  cipher.AEAD
+	paths [][]string
+}
+
+// Configure sets the key used to encrypt and decrypt metadata values, and the
+// fields to encrypt. Fields are dot-separated paths through nested JSON
+// objects, like "customdata.join_token". An empty key disables encryption,
+// though stored values which were encrypted can then no longer be read.
+func Configure(key string, fields []string) error {
+	if key == "" {
+		if len(fields) > 0 {
+			return ErrMissingKey
+		}
+
+		config.Store(nil)
+
+		return nil
+	}
+
+	rawKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return ErrInvalidKey
+	}
+
+	block, err := aes.NewCipher(rawKey)
+	if err != nil {
+		return ErrInvalidKey
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	paths := make([][]string, 0, len(fields))
+	for _, field := range fields {
+		paths = append(paths, strings.Split(field, "."))
+	}
+
+	config.Store(&fieldConfig{aead: aead, paths: paths})
+
+	return nil
+}
+
+// EncryptMetadata returns the metadata with the values of the configured
+// fields encrypted. Metadata without any of the fields, or which isn't a JSON
+// object, is returned unchanged. The incoming metadata is always plaintext, so
+// values which already look encrypted are encrypted too, rather than being
+// stored as they are and later decrypted.
+func EncryptMetadata(metadata types.JSON) (types.JSON, error) {
+	cfg := config.Load()
+	if cfg == nil || len(cfg.paths) == 0 {
+		return metadata, nil
+	}
+
+	doc, err := decode(metadata)
+	if err != nil {
+		return metadata, nil //nolint:nilerr // only JSON objects have fields to encrypt
+	}
+
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		return metadata, nil
+	}
+
+	encrypted := false
+
+	for _, path := range cfg.paths {
+		parent, key, ok := lookupField(obj, path)
+		if !ok {
+			continue
+		}
+
+		value, err := cfg.encrypt(parent[key])
+		if err != nil {
+			return nil, err
+		}
+
+		parent[key] = value
+		encrypted = true
+	}
+
+	if !encrypted {
+		return metadata, nil
+	}
+
+	return json.Marshal(obj)
+}
+
+// DecryptMetadata returns the metadata with the encrypted values of the
+// configured fields decrypted. Values of other fields are never decrypted,
+// even if they look encrypted, so values stored for a field before it was
+// configured, or after it was no longer configured, are returned as stored.
+// Metadata without encrypted values is returned unchanged.
+func DecryptMetadata(metadata types.JSON) (types.JSON, error) {
+	cfg := config.Load()
+	if cfg == nil || len(cfg.paths) == 0 || !bytes.Contains(metadata, []byte(encryptedPrefix)) {
+		return metadata, nil
+	}
+
+	doc, err := decode(metadata)
+	if err != nil {
+		return metadata, nil //nolint:nilerr // there's nothing to decrypt in invalid JSON
+	}
+
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		return metadata, nil
+	}
+
+	decrypted := false
+
+	// Fields are decrypted in the reverse of the order they're encrypted in,
+	// so a field nested in another encrypted field is only decrypted if it
+	// was encrypted itself.
+	for i := len(cfg.paths) - 1; i >= 0; i-- {
+		parent, key, ok := lookupField(obj, cfg.paths[i])
+		if !ok {
+			continue
+		}
+
+		s, ok := parent[key].(string)
+		if !ok || !strings.HasPrefix(s, encryptedPrefix) {
+			continue
+		}
+
+		value, err := cfg.decrypt(s)
+		if err != nil {
+			return nil, err
+		}
+
+		parent[key] = value
+		decrypted = true
+	}
+
+	if !decrypted {
+		return metadata, nil
+	}
+
+	return json.Marshal(obj)
+}
+
+func (cfg *fieldConfig) encrypt(value interface{}) (string, error) {
+	plaintext, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, cfg.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := cfg.aead.Seal(nonce, nonce, plaintext, nil)
+
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (cfg *fieldConfig) decrypt(value string) (interface{}, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil || len(sealed) < cfg.aead.NonceSize() {
+		return nil, ErrInvalidCiphertext
+	}
+
+	nonce, ciphertext := sealed[:cfg.aead.NonceSize()], sealed[cfg.aead.NonceSize():]
+
+	plaintext, err := cfg.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCiphertext, err)
+	}
+
+	return decode(plaintext)
+}
+
+// lookupField follows the path through nested objects, returning the object
+// holding the last key of the path.
+func lookupField(obj map[string]interface{}, path []string) (map[string]interface{}, string, bool) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := obj[key].(map[string]interface{})
+		if !ok {
+			return nil, "", false
+		}
+
+		obj = next
+	}
+
+	key := path[len(path)-1]
+	if _, ok := obj[key]; !ok {
+		return nil, "", false
+	}
+
+	return obj, key, true
+}
+
+// decode unmarshals JSON, keeping numbers as they were written.
+func decode(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
@@ -0,0 +1,175 @@
+package fieldcrypt_test
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/volatiletech/sqlboiler/v4/types"
+
+	"go.hollow.sh/metadataservice/internal/fieldcrypt"
+)
+
+func testKey(t *testing.T) string {
+	t.Helper()
+
+	key := make([]byte, 32)
+
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestConfigure(t *testing.T) {
+	defer fieldcrypt.Configure("", nil) //nolint:errcheck // resetting to the default can't fail
+
+	type testCase struct {
+		testName      string
+		key           string
+		fields        []string
+		expectedError error
+	}
+
+	testCases := []testCase{
+		{"disabled", "", nil, nil},
+		{"valid key", testKey(t), []string{"license_key"}, nil},
+		{"fields without a key", "", []string{"license_key"}, fieldcrypt.ErrMissingKey},
+		{"key which isn't base64", "not base64!", nil, fieldcrypt.ErrInvalidKey},
+		{"key with the wrong length", base64.StdEncoding.EncodeToString([]byte("short")), nil, fieldcrypt.ErrInvalidKey},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			err := fieldcrypt.Configure(testcase.key, testcase.fields)
+			assert.ErrorIs(t, err, testcase.expectedError)
+		})
+	}
+}
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+	require.NoError(t, fieldcrypt.Configure(testKey(t), []string{"license_key", "customdata.join_token", "customdata.limits", "missing.field"}))
+	defer fieldcrypt.Configure("", nil) //nolint:errcheck // resetting to the default can't fail
+
+	metadata := types.JSON(`{"hostname":"instance-a","license_key":"abc-123","customdata":{"join_token":"s3cr3t","limits":{"cpus":8},"region":"da"}}`)
+
+	encrypted, err := fieldcrypt.EncryptMetadata(metadata)
+	require.NoError(t, err)
+
+	assert.NotContains(t, string(encrypted), "abc-123")
+	assert.NotContains(t, string(encrypted), "s3cr3t")
+	assert.NotContains(t, string(encrypted), "cpus")
+
+	var stored map[string]interface{}
+	require.NoError(t, json.Unmarshal(encrypted, &stored))
+	assert.Equal(t, "instance-a", stored["hostname"])
+	assert.True(t, strings.HasPrefix(stored["license_key"].(string), "enc:v1:"))
+	assert.Equal(t, "da", stored["customdata"].(map[string]interface{})["region"])
+
+	decrypted, err := fieldcrypt.DecryptMetadata(encrypted)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(metadata), string(decrypted))
+}
+
+func TestDecryptPlaintextMetadata(t *testing.T) {
+	require.NoError(t, fieldcrypt.Configure(testKey(t), []string{"license_key"}))
+	defer fieldcrypt.Configure("", nil) //nolint:errcheck // resetting to the default can't fail
+
+	// Rows stored before the field was encrypted are returned unchanged.
+	metadata := types.JSON(`{"hostname": "instance-a", "license_key": "abc-123"}`)
+
+	decrypted, err := fieldcrypt.DecryptMetadata(metadata)
+	require.NoError(t, err)
+	assert.Equal(t, metadata, decrypted)
+}
+
+func TestEncryptUnconfigured(t *testing.T) {
+	require.NoError(t, fieldcrypt.Configure("", nil))
+
+	metadata := types.JSON(`{"license_key": "abc-123"}`)
+
+	encrypted, err := fieldcrypt.EncryptMetadata(metadata)
+	require.NoError(t, err)
+	assert.Equal(t, metadata, encrypted)
+}
+
+func TestEncryptNonObjectMetadata(t *testing.T) {
+	require.NoError(t, fieldcrypt.Configure(testKey(t), []string{"license_key"}))
+	defer fieldcrypt.Configure("", nil) //nolint:errcheck // resetting to the default can't fail
+
+	metadata := types.JSON(`["license_key"]`)
+
+	encrypted, err := fieldcrypt.EncryptMetadata(metadata)
+	require.NoError(t, err)
+	assert.Equal(t, metadata, encrypted)
+}
+
+func TestDecryptWithoutTheKey(t *testing.T) {
+	require.NoError(t, fieldcrypt.Configure(testKey(t), []string{"license_key"}))
+
+	encrypted, err := fieldcrypt.EncryptMetadata(types.JSON(`{"license_key": "abc-123"}`))
+	require.NoError(t, err)
+
+	// A different key can't decrypt the value.
+	require.NoError(t, fieldcrypt.Configure(testKey(t), []string{"license_key"}))
+
+	_, err = fieldcrypt.DecryptMetadata(encrypted)
+	assert.ErrorIs(t, err, fieldcrypt.ErrInvalidCiphertext)
+
+	// Without any key, nothing is decrypted, and the values are returned as
+	// stored.
+	require.NoError(t, fieldcrypt.Configure("", nil))
+
+	decrypted, err := fieldcrypt.DecryptMetadata(encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, encrypted, decrypted)
+}
+
+func TestDecryptOnlyConfiguredFields(t *testing.T) {
+	require.NoError(t, fieldcrypt.Configure(testKey(t), []string{"license_key"}))
+	defer fieldcrypt.Configure("", nil) //nolint:errcheck // resetting to the default can't fail
+
+	// A plaintext value elsewhere which looks encrypted isn't decrypted.
+	metadata := types.JSON(`{"hostname": "enc:v1:not-really", "tags": ["enc:v1:nor-this"]}`)
+
+	decrypted, err := fieldcrypt.DecryptMetadata(metadata)
+	require.NoError(t, err)
+	assert.Equal(t, metadata, decrypted)
+}
+
+func TestEncryptValuesWhichLookEncrypted(t *testing.T) {
+	require.NoError(t, fieldcrypt.Configure(testKey(t), []string{"license_key"}))
+	defer fieldcrypt.Configure("", nil) //nolint:errcheck // resetting to the default can't fail
+
+	// A producer can't skip encryption by sending a value which looks
+	// encrypted: it's encrypted like any other, and comes back unchanged.
+	metadata := types.JSON(`{"license_key": "enc:v1:abc-123"}`)
+
+	encrypted, err := fieldcrypt.EncryptMetadata(metadata)
+	require.NoError(t, err)
+	assert.NotContains(t, string(encrypted), "abc-123")
+
+	decrypted, err := fieldcrypt.DecryptMetadata(encrypted)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(metadata), string(decrypted))
+}
+
+func TestEncryptNestedFields(t *testing.T) {
+	require.NoError(t, fieldcrypt.Configure(testKey(t), []string{"customdata", "customdata.join_token"}))
+	defer fieldcrypt.Configure("", nil) //nolint:errcheck // resetting to the default can't fail
+
+	// The join token is inside the encrypted customdata, so it's left as it
+	// is when customdata is decrypted, even though it looks encrypted.
+	metadata := types.JSON(`{"customdata": {"join_token": "enc:v1:s3cr3t"}}`)
+
+	encrypted, err := fieldcrypt.EncryptMetadata(metadata)
+	require.NoError(t, err)
+
+	decrypted, err := fieldcrypt.DecryptMetadata(encrypted)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(metadata), string(decrypted))
+}
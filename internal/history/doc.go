@@ -0,0 +1,3 @@
+// Package history records every version of an instance's metadata, so the
+// version that was current at a given time can be read back later.
+package history // import go.hollow.sh/metadataservice/internal/history
@@ -0,0 +1,60 @@
+package history
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"github.com/volatiletech/sqlboiler/v4/types"
+)
+
+// Enabled reports whether metadata history is recorded, as configured by
+// metadata.history_enabled.
+func Enabled() bool {
+	return viper.GetBool("metadata.history_enabled")
+}
+
+// RecordMetadata records a version of an instance's metadata as of recordedAt,
+// if history is enabled. A nil metadata records that the instance's metadata
+// was deleted. It should be called within the transaction making the change.
+func RecordMetadata(ctx context.Context, exec boil.ContextExecutor, instanceID string, metadata types.JSON, recordedAt time.Time) error {
+	if !Enabled() {
+		return nil
+	}
+
+	var value interface{}
+	if metadata != nil {
+		value = []byte(metadata)
+	}
+
+	_, err := exec.ExecContext(ctx,
+		"INSERT INTO instance_metadata_history (instance_id, metadata, recorded_at) VALUES ($1, $2, $3)",
+		instanceID, value, recordedAt,
+	)
+
+	return err
+}
+
+// MetadataAsOf returns the version of an instance's metadata that was current
+// at asOf. If the instance had no metadata at that time (either none had been
+// recorded yet, or it had been deleted), sql.ErrNoRows is returned.
+func MetadataAsOf(ctx context.Context, exec boil.ContextExecutor, instanceID string, asOf time.Time) (types.JSON, error) {
+	var metadata []byte
+
+	row := exec.QueryRowContext(ctx,
+		"SELECT metadata FROM instance_metadata_history WHERE instance_id = $1 AND recorded_at <= $2 ORDER BY recorded_at DESC LIMIT 1",
+		instanceID, asOf,
+	)
+
+	if err := row.Scan(&metadata); err != nil {
+		return nil, err
+	}
+
+	if metadata == nil {
+		return nil, sql.ErrNoRows
+	}
+
+	return types.JSON(metadata), nil
+}
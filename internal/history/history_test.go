@@ -0,0 +1,87 @@
+package history_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/volatiletech/sqlboiler/v4/types"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/history"
+)
+
+func TestMetadataAsOf(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	viper.Set("metadata.history_enabled", true)
+	defer viper.Set("metadata.history_enabled", false)
+
+	ctx := context.TODO()
+	instanceID := "6b0d9e2a-4c1f-4a3b-8e5d-7f9a1b2c3d4e"
+	start := time.Date(2023, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	versions := []struct {
+		metadata   types.JSON
+		recordedAt time.Time
+	}{
+		{types.JSON(`{"hostname": "v1"}`), start},
+		{types.JSON(`{"hostname": "v2"}`), start.Add(time.Hour)},
+		{types.JSON(`{"hostname": "v3"}`), start.Add(2 * time.Hour)},
+		{nil, start.Add(3 * time.Hour)},
+	}
+
+	for _, version := range versions {
+		require.NoError(t, history.RecordMetadata(ctx, testDB, instanceID, version.metadata, version.recordedAt))
+	}
+
+	type testCase struct {
+		testName         string
+		asOf             time.Time
+		expectedMetadata string
+		expectedErr      error
+	}
+
+	testCases := []testCase{
+		{"before the first version", start.Add(-time.Minute), "", sql.ErrNoRows},
+		{"at the first version", start, `{"hostname": "v1"}`, nil},
+		{"between the first and second versions", start.Add(30 * time.Minute), `{"hostname": "v1"}`, nil},
+		{"at the second version", start.Add(time.Hour), `{"hostname": "v2"}`, nil},
+		{"between the third version and deletion", start.Add(150 * time.Minute), `{"hostname": "v3"}`, nil},
+		{"after deletion", start.Add(4 * time.Hour), "", sql.ErrNoRows},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			metadata, err := history.MetadataAsOf(ctx, testDB, instanceID, testcase.asOf)
+
+			if testcase.expectedErr != nil {
+				assert.ErrorIs(t, err, testcase.expectedErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.JSONEq(t, testcase.expectedMetadata, string(metadata))
+		})
+	}
+
+	// Other instances' versions aren't returned.
+	_, err := history.MetadataAsOf(ctx, testDB, "7c1e0f3b-5d2a-4b4c-9f6e-8a0b2c3d4e5f", start.Add(time.Hour))
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func TestRecordMetadataDisabled(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	ctx := context.TODO()
+	instanceID := "6b0d9e2a-4c1f-4a3b-8e5d-7f9a1b2c3d4e"
+
+	require.NoError(t, history.RecordMetadata(ctx, testDB, instanceID, types.JSON(`{"hostname": "v1"}`), time.Now()))
+
+	_, err := history.MetadataAsOf(ctx, testDB, instanceID, time.Now())
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
@@ -0,0 +1,79 @@
+package httpsrv
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// sampleAccessLog wraps the access logger so that only 1 in every sampleRate
+// successful (2xx) requests is logged. Other requests, requests taking at
+// least slowThreshold, and errors are always logged. A sampleRate of 1 or
+// less logs every request.
+func sampleAccessLog(logger *zap.Logger, sampleRate int, slowThreshold time.Duration) *zap.Logger {
+	if sampleRate <= 1 {
+		return logger
+	}
+
+	counter := &atomic.Uint64{}
+
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &accessLogSamplingCore{Core: core, counter: counter, sampleRate: uint64(sampleRate), slowThreshold: slowThreshold}
+	}))
+}
+
+// accessLogSamplingCore decides whether to write an access log entry from its
+// "status" and "latency" fields, as set by ginzap.
+type accessLogSamplingCore struct {
+	zapcore.Core
+
+	counter       *atomic.Uint64
+	sampleRate    uint64
+	slowThreshold time.Duration
+}
+
+func (s *accessLogSamplingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &accessLogSamplingCore{Core: s.Core.With(fields), counter: s.counter, sampleRate: s.sampleRate, slowThreshold: s.slowThreshold}
+}
+
+func (s *accessLogSamplingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if s.Enabled(entry.Level) {
+		return checked.AddCore(entry, s)
+	}
+
+	return checked
+}
+
+func (s *accessLogSamplingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	if s.alwaysLog(entry, fields) || (s.counter.Add(1)-1)%s.sampleRate == 0 {
+		return s.Core.Write(entry, fields)
+	}
+
+	return nil
+}
+
+// alwaysLog reports whether an entry is exempt from sampling: anything but an
+// info level entry for a 2xx response that took less than the slow threshold.
+func (s *accessLogSamplingCore) alwaysLog(entry zapcore.Entry, fields []zapcore.Field) bool {
+	if entry.Level != zapcore.InfoLevel {
+		return true
+	}
+
+	successful := false
+
+	for _, field := range fields {
+		switch {
+		case field.Key == "status" && field.Type == zapcore.Int64Type:
+			successful = field.Integer >= http.StatusOK && field.Integer < http.StatusMultipleChoices
+		case field.Key == "latency" && field.Type == zapcore.DurationType:
+			if s.slowThreshold > 0 && time.Duration(field.Integer) >= s.slowThreshold {
+				return true
+			}
+		}
+	}
+
+	return !successful
+}
@@ -3,9 +3,12 @@ package httpsrv
 import (
 	"context"
 	"errors"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"path"
 	"syscall"
 	"text/template"
 	"time"
@@ -21,22 +24,157 @@ import (
 	"go.opentelemetry.io/otel"
 	"go.uber.org/zap"
 
+	"go.hollow.sh/metadataservice/internal/audit"
 	"go.hollow.sh/metadataservice/internal/lookup"
+	"go.hollow.sh/metadataservice/internal/middleware"
 	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
 )
 
 // Server contains the HTTP server configuration
 type Server struct {
-	Logger          *zap.Logger
-	Listen          string
-	Debug           bool
-	DB              *sqlx.DB
-	AuthConfig      ginjwt.AuthConfig
-	TrustedProxies  []string
-	LookupEnabled   bool
-	LookupClient    lookup.Client
+	Logger         *zap.Logger
+	Listen         string
+	Debug          bool
+	DB             *sqlx.DB
+	AuthConfig     ginjwt.AuthConfig
+	TrustedProxies []string
+	LookupEnabled  bool
+	LookupClient   lookup.Client
+	// LookupSkipCIDRs is passed along to the v1 router to skip the upstream
+	// lookup for requests from these IP ranges.
+	LookupSkipCIDRs []netip.Prefix
+	// AllowedIPCIDRs is passed along to the v1 router to reject upserts with
+	// IP addresses outside of these CIDRs.
+	AllowedIPCIDRs []netip.Prefix
+	// AuditLogger is passed along to the v1 router to record writes to the
+	// internal endpoints.
+	AuditLogger     *audit.Logger
 	TemplateFields  map[string]template.Template
 	ShutdownTimeout time.Duration
+	// TemplateFieldConditions is passed along to the v1 router to only add
+	// template fields to the metadata of instances meeting their conditions.
+	TemplateFieldConditions map[string]template.Template
+	// TemplateMissingKeyMode, TemplateMissingKeyDefaults, and
+	// TemplateMissingKeyDefaultValue are passed along to the v1 router to
+	// control how template fields referencing missing metadata keys are
+	// rendered.
+	TemplateMissingKeyMode         string
+	TemplateMissingKeyDefaults     map[string]string
+	TemplateMissingKeyDefaultValue string
+	// UserdataTemplate is passed along to the v1 router to generate userdata
+	// for instances without stored userdata.
+	UserdataTemplate *template.Template
+	// DefaultUserdata is passed along to the v1 router to serve to instances
+	// without stored userdata.
+	DefaultUserdata []byte
+	// MaintenanceUserdata is passed along to the v1 router to serve in place
+	// of the instances' userdata during maintenance, which starts enabled
+	// when UserdataMaintenance is set.
+	MaintenanceUserdata []byte
+	UserdataMaintenance bool
+	// KeepAlivePeriod is the TCP keep-alive period applied to connections
+	// accepted by the listener. Zero uses the Go default, and a negative value
+	// disables keep-alives.
+	KeepAlivePeriod time.Duration
+	// NotFoundRetryAfter is passed along to the v1 router to set a
+	// Retry-After header on 404 responses from the public endpoints.
+	NotFoundRetryAfter time.Duration
+	// NotFoundMessage is passed along to the v1 router as the message for 404
+	// responses from the public endpoints.
+	NotFoundMessage string
+	// IncludeDebugFields is passed along to the v1 router to add debug fields
+	// to /metadata responses.
+	IncludeDebugFields bool
+	// FieldRenames is passed along to the v1 router to rename metadata keys
+	// in the JSON metadata responses.
+	FieldRenames map[string]string
+	// MetadataFallbacks is passed along to the v1 router to serve a fallback
+	// instance's metadata to unknown IP addresses within its prefix.
+	MetadataFallbacks []v1api.MetadataFallback
+	// EC2SchemaVersion is passed along to the v1 router as the default
+	// metadata schema version for the EC2 endpoints.
+	EC2SchemaVersion string
+	// EC2AlwaysAdvertisedItems is passed along to the v1 router as the EC2
+	// item names listed even when empty.
+	EC2AlwaysAdvertisedItems []string
+	// EmptyMetadataNotFound is passed along to the v1 router to serve empty
+	// metadata objects as 404s.
+	EmptyMetadataNotFound bool
+	// UnresolvedClientIPStatus is passed along to the v1 router as the status
+	// for public requests without a resolvable client IP address.
+	UnresolvedClientIPStatus int
+	// UserdataGzipPassthrough is passed along to the v1 router to serve gzip'd
+	// userdata with a Content-Encoding header to clients that accept it.
+	UserdataGzipPassthrough bool
+	// WriteRateLimit and WriteRateBurst are passed along to the v1 router to
+	// rate limit the internal write endpoints by JWT subject.
+	WriteRateLimit float64
+	WriteRateBurst int
+	// PublicRateLimit and PublicRateBurst are passed along to the v1 router
+	// to rate limit the public endpoints by client IP address.
+	PublicRateLimit float64
+	PublicRateBurst int
+	// DeleteBatchMaxSize is passed along to the v1 router to cap the number of
+	// instances deleted by a single batch delete request.
+	DeleteBatchMaxSize int
+	// MaxAuthorizationHeaderSize is passed along to the v1 router to reject
+	// internal requests with oversized Authorization headers.
+	MaxAuthorizationHeaderSize int
+	// SignedURLSecret is passed along to the v1 router to enable the signed
+	// metadata URLs.
+	SignedURLSecret string
+	// SignedURLMaxLifetime is passed along to the v1 router to cap how far in
+	// the future signed metadata URLs may expire.
+	SignedURLMaxLifetime time.Duration
+	// UserdataRequireUTF8 is passed along to the v1 router to reject userdata
+	// upserts that aren't valid UTF-8.
+	UserdataRequireUTF8 bool
+	// MetadataAllowedKeys is passed along to the v1 router to reject metadata
+	// upserts with other top-level keys.
+	MetadataAllowedKeys []string
+	// MetadataIPMismatchMode is passed along to the v1 router to check the IP
+	// addresses listed in upserted metadata against the request's.
+	MetadataIPMismatchMode string
+	// UserdataLineEndingsMode is passed along to the v1 router to normalize
+	// userdata line endings when it's pushed or served.
+	UserdataLineEndingsMode string
+	// MetadataTrimStringValues is passed along to the v1 router to trim the
+	// whitespace around top-level metadata string values when it's stored.
+	MetadataTrimStringValues bool
+	// RouteTimeouts limits how long requests to each route may take, keyed by
+	// the route as registered, like "/metadata". Timeouts for the latest API
+	// version's routes also apply to the same routes under /api/v1.
+	RouteTimeouts map[string]time.Duration
+	// Preloaded, when set, is closed once the startup preload of instance
+	// metadata has finished. The readiness check reports the server as down
+	// until then.
+	Preloaded <-chan struct{}
+	// ExposeErrors, if set, includes the underlying error in 500 responses,
+	// including those for recovered panics. Stack traces are never included.
+	ExposeErrors bool
+	// StatusAuthRequired, if set, requires the /status endpoint's requests to
+	// be authenticated, like the internal endpoints.
+	StatusAuthRequired bool
+	// ServerTiming is passed along to the v1 router to add Server-Timing
+	// headers to the public read responses.
+	ServerTiming bool
+	// InstanceIDHeader, MACHeader, DisableIPIdentification, and
+	// VerifyIPOwnership are passed along to the v1 router to pick how
+	// instances are identified.
+	InstanceIDHeader        string
+	MACHeader               string
+	DisableIPIdentification bool
+	VerifyIPOwnership       bool
+	// FingerprintHeader and FingerprintField are passed along to the v1
+	// router to require requests to present the instance's fingerprint.
+	FingerprintHeader string
+	FingerprintField  string
+	// AccessLogSampleRate, if greater than 1, only logs 1 in every
+	// AccessLogSampleRate successful (2xx) requests in the access log.
+	// Unsuccessful requests, errors, and requests taking at least
+	// AccessLogSlowThreshold are always logged.
+	AccessLogSampleRate    int
+	AccessLogSlowThreshold time.Duration
 }
 
 var (
@@ -86,14 +224,16 @@ func (s *Server) setup() *gin.Engine {
 
 	p.Use(r)
 
-	r.Use(ginzap.Logger(s.Logger.With(zap.String("component", "httpsrv")), ginzap.WithTimeFormat(time.RFC3339),
+	accessLogger := sampleAccessLog(s.Logger.With(zap.String("component", "httpsrv")), s.AccessLogSampleRate, s.AccessLogSlowThreshold)
+
+	r.Use(ginzap.Logger(accessLogger, ginzap.WithTimeFormat(time.RFC3339),
 		ginzap.WithUTC(true),
 		ginzap.WithCustomFields(
 			func(c *gin.Context) zap.Field { return zap.String("jwt_subject", ginjwt.GetSubject(c)) },
 			func(c *gin.Context) zap.Field { return zap.String("jwt_user", ginjwt.GetUser(c)) },
 		),
 	))
-	r.Use(ginzap.RecoveryWithZap(s.Logger.With(zap.String("component", "httpsrv")), true))
+	r.Use(middleware.Recovery(s.Logger.With(zap.String("component", "httpsrv")), s.ExposeErrors))
 
 	tp := otel.GetTracerProvider()
 	if tp != nil {
@@ -105,15 +245,76 @@ func (s *Server) setup() *gin.Engine {
 		r.Use(otelgin.Middleware(hostname, otelgin.WithTracerProvider(tp)))
 	}
 
+	if len(s.RouteTimeouts) > 0 {
+		r.Use(middleware.RouteTimeouts(s.routeTimeouts()))
+	}
+
 	// Version endpoint returns build information
 	r.GET("/version", s.version)
 
+	// Status endpoint returns the build and DB migration versions
+	if s.StatusAuthRequired {
+		r.GET("/status", authMW.AuthRequired(), s.status)
+	} else {
+		r.GET("/status", s.status)
+	}
+
 	// Health endpoints
 	r.GET("/healthz", s.livenessCheck)
 	r.GET("/healthz/liveness", s.livenessCheck)
 	r.GET("/healthz/readiness", s.readinessCheck)
+	r.GET("/ping", s.ping)
 
-	v1Rtr := v1api.Router{AuthMW: authMW, DB: s.DB, Logger: s.Logger, LookupEnabled: s.LookupEnabled, LookupClient: s.LookupClient, TemplateFields: s.TemplateFields}
+	var lookupClient lookup.Client
+	if s.LookupEnabled {
+		lookupClient = s.LookupClient
+	}
+
+	v1Rtr := v1api.NewRouter(s.Logger, s.DB, authMW, lookupClient)
+	v1Rtr.LookupSkipCIDRs = s.LookupSkipCIDRs
+	v1Rtr.AllowedIPCIDRs = s.AllowedIPCIDRs
+	v1Rtr.AuditLogger = s.AuditLogger
+	v1Rtr.TemplateFields = s.TemplateFields
+	v1Rtr.TemplateFieldConditions = s.TemplateFieldConditions
+	v1Rtr.TemplateMissingKeyMode = s.TemplateMissingKeyMode
+	v1Rtr.TemplateMissingKeyDefaults = s.TemplateMissingKeyDefaults
+	v1Rtr.TemplateMissingKeyDefaultValue = s.TemplateMissingKeyDefaultValue
+	v1Rtr.UserdataTemplate = s.UserdataTemplate
+	v1Rtr.DefaultUserdata = s.DefaultUserdata
+	v1Rtr.MaintenanceUserdata = s.MaintenanceUserdata
+	v1Rtr.SetUserdataMaintenance(s.UserdataMaintenance)
+	v1Rtr.UserdataGzipPassthrough = s.UserdataGzipPassthrough
+	v1Rtr.NotFoundRetryAfter = s.NotFoundRetryAfter
+	v1Rtr.NotFoundMessage = s.NotFoundMessage
+	v1Rtr.IncludeDebugFields = s.IncludeDebugFields
+	v1Rtr.FieldRenames = s.FieldRenames
+	v1Rtr.MetadataFallbacks = s.MetadataFallbacks
+	v1Rtr.EC2SchemaVersion = s.EC2SchemaVersion
+	v1Rtr.EC2AlwaysAdvertisedItems = s.EC2AlwaysAdvertisedItems
+	v1Rtr.EmptyMetadataNotFound = s.EmptyMetadataNotFound
+	v1Rtr.UnresolvedClientIPStatus = s.UnresolvedClientIPStatus
+	v1Rtr.WriteRateLimit = s.WriteRateLimit
+	v1Rtr.PublicRateLimit = s.PublicRateLimit
+	v1Rtr.PublicRateBurst = s.PublicRateBurst
+	v1Rtr.WriteRateBurst = s.WriteRateBurst
+	v1Rtr.DeleteBatchMaxSize = s.DeleteBatchMaxSize
+	v1Rtr.MaxAuthorizationHeaderSize = s.MaxAuthorizationHeaderSize
+	v1Rtr.SignedURLSecret = s.SignedURLSecret
+	v1Rtr.SignedURLMaxLifetime = s.SignedURLMaxLifetime
+	v1Rtr.ExposeErrors = s.ExposeErrors
+	v1Rtr.ServerTiming = s.ServerTiming
+	v1Rtr.InstanceIDHeader = s.InstanceIDHeader
+	v1Rtr.MACHeader = s.MACHeader
+	v1Rtr.TrustedProxies = s.TrustedProxies
+	v1Rtr.DisableIPIdentification = s.DisableIPIdentification
+	v1Rtr.VerifyIPOwnership = s.VerifyIPOwnership
+	v1Rtr.FingerprintHeader = s.FingerprintHeader
+	v1Rtr.FingerprintField = s.FingerprintField
+	v1Rtr.MetadataTrimStringValues = s.MetadataTrimStringValues
+	v1Rtr.UserdataLineEndingsMode = s.UserdataLineEndingsMode
+	v1Rtr.MetadataIPMismatchMode = s.MetadataIPMismatchMode
+	v1Rtr.MetadataAllowedKeys = s.MetadataAllowedKeys
+	v1Rtr.UserdataRequireUTF8 = s.UserdataRequireUTF8
 
 	// Host our latest version of the API under / in addition to /api/v*
 	latest := r.Group("/")
@@ -131,6 +332,11 @@ func (s *Server) setup() *gin.Engine {
 		v1Rtr.Ec2Routes(ec2)
 	}
 
+	openstack := r.Group(v1api.OpenstackURI)
+	{
+		v1Rtr.OpenstackRoutes(openstack)
+	}
+
 	r.NoRoute(func(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"message": "invalid request - route not found"})
 	})
@@ -138,6 +344,25 @@ func (s *Server) setup() *gin.Engine {
 	return r
 }
 
+// routeTimeouts returns the configured route timeouts, along with the same
+// timeouts for the latest API version's routes under /api/v1.
+func (s *Server) routeTimeouts() map[string]time.Duration {
+	timeouts := make(map[string]time.Duration, 2*len(s.RouteTimeouts))
+
+	for route, timeout := range s.RouteTimeouts {
+		timeouts[route] = timeout
+	}
+
+	for route, timeout := range s.RouteTimeouts {
+		v1Route := path.Join(v1api.V1URI, route)
+		if _, ok := timeouts[v1Route]; !ok {
+			timeouts[v1Route] = timeout
+		}
+	}
+
+	return timeouts
+}
+
 // NewServer returns a configured server
 func (s *Server) NewServer() *http.Server {
 	if !s.Debug {
@@ -163,10 +388,19 @@ func (s *Server) Run(ctx context.Context) error {
 		Handler: s.setup(),
 	}
 
+	lc := net.ListenConfig{KeepAlive: s.KeepAlivePeriod}
+
+	ln, err := lc.Listen(ctx, "tcp", s.Listen)
+	if err != nil {
+		s.Logger.Error("failed to listen", zap.Error(err))
+
+		return err
+	}
+
 	exit := make(chan error, 1)
 
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
+		if err := srv.Serve(ln); err != nil {
 			exit <- err
 		}
 	}()
@@ -205,6 +439,13 @@ func (s *Server) Run(ctx context.Context) error {
 }
 
 // livenessCheck ensures that the server is up and responding
+// ping responds with a plain "pong". Unlike the readiness check, it never
+// touches the database, so load balancer health checks aren't affected by DB
+// latency.
+func (s *Server) ping(c *gin.Context) {
+	c.String(http.StatusOK, "pong")
+}
+
 func (s *Server) livenessCheck(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"status": "UP",
@@ -213,8 +454,16 @@ func (s *Server) livenessCheck(c *gin.Context) {
 
 // readinessCheck ensures that the server is up and that we are able to process
 // requests. Currently our only dependency is the DB so we just ensure that it
-// is responding.
+// is responding, once any startup preload has finished.
 func (s *Server) readinessCheck(c *gin.Context) {
+	if !s.preloaded() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "DOWN",
+		})
+
+		return
+	}
+
 	startTime := time.Now()
 
 	ctx, cancel := context.WithTimeout(c.Request.Context(), dbPingTimeout)
@@ -235,6 +484,21 @@ func (s *Server) readinessCheck(c *gin.Context) {
 	})
 }
 
+// preloaded reports whether the startup preload has finished, or there isn't
+// one.
+func (s *Server) preloaded() bool {
+	if s.Preloaded == nil {
+		return true
+	}
+
+	select {
+	case <-s.Preloaded:
+		return true
+	default:
+		return false
+	}
+}
+
 // version returns the metadataservice build information
 func (s *Server) version(c *gin.Context) {
 	c.JSON(http.StatusOK, version.String())
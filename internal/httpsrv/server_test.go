@@ -2,15 +2,20 @@ package httpsrv_test
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.hollow.sh/toolbox/ginjwt"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 
+	dbm "go.hollow.sh/metadataservice/db"
 	"go.hollow.sh/metadataservice/internal/dbtools"
 	"go.hollow.sh/metadataservice/internal/httpsrv"
 )
@@ -45,6 +50,20 @@ func TestHealthzRoute(t *testing.T) {
 	assert.Equal(t, `{"status":"UP"}`, w.Body.String())
 }
 
+func TestPingRoute(t *testing.T) {
+	// No DB is configured, so this also checks that ping doesn't need one.
+	hs := httpsrv.Server{Logger: zap.NewNop(), AuthConfig: serverAuthConfig}
+	s := hs.NewServer()
+	router := s.Handler
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), "GET", "/ping", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "pong", w.Body.String())
+}
+
 func TestLivenessRoute(t *testing.T) {
 	hs := httpsrv.Server{Logger: zap.NewNop(), AuthConfig: serverAuthConfig}
 	s := hs.NewServer()
@@ -73,6 +92,40 @@ func TestReadinessRouteDown(t *testing.T) {
 	assert.Equal(t, `{"status":"DOWN"}`, w.Body.String())
 }
 
+func TestReadinessRoutePreloading(t *testing.T) {
+	preloaded := make(chan struct{})
+
+	// The preload hasn't finished, so the DB isn't even checked.
+	hs := httpsrv.Server{Logger: zap.NewNop(), AuthConfig: serverAuthConfig, Preloaded: preloaded}
+	s := hs.NewServer()
+	router := s.Handler
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), "GET", "/healthz/readiness", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 503, w.Code)
+	assert.Equal(t, `{"status":"DOWN"}`, w.Body.String())
+}
+
+func TestReadinessRoutePreloaded(t *testing.T) {
+	db := dbtools.DatabaseTest(t)
+
+	preloaded := make(chan struct{})
+	close(preloaded)
+
+	hs := httpsrv.Server{Logger: zap.NewNop(), AuthConfig: serverAuthConfig, DB: db, Preloaded: preloaded}
+	s := hs.NewServer()
+	router := s.Handler
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), "GET", "/healthz/readiness", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `{"status":"UP"}`, w.Body.String())
+}
+
 func TestReadinessRouteUp(t *testing.T) {
 	db := dbtools.DatabaseTest(t)
 
@@ -87,3 +140,94 @@ func TestReadinessRouteUp(t *testing.T) {
 	assert.Equal(t, 200, w.Code)
 	assert.Equal(t, `{"status":"UP"}`, w.Body.String())
 }
+
+func TestAccessLogSampling(t *testing.T) {
+	type testCase struct {
+		testName      string
+		sampleRate    int
+		slowThreshold time.Duration
+		path          string
+		expectedLogs  int
+	}
+
+	testCases := []testCase{
+		{"no sampling", 0, 0, "/healthz", 6},
+		{"successful requests are sampled", 3, 0, "/healthz", 2},
+		{"unsuccessful requests are always logged", 3, 0, "/a/route/that/doesnt/exist", 6},
+		{"slow requests are always logged", 3, time.Nanosecond, "/healthz", 6},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			core, logs := observer.New(zap.InfoLevel)
+
+			hs := httpsrv.Server{
+				Logger:                 zap.New(core),
+				AuthConfig:             serverAuthConfig,
+				AccessLogSampleRate:    testcase.sampleRate,
+				AccessLogSlowThreshold: testcase.slowThreshold,
+			}
+			s := hs.NewServer()
+			router := s.Handler
+
+			for i := 0; i < 6; i++ {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequestWithContext(context.TODO(), "GET", testcase.path, nil)
+				router.ServeHTTP(w, req)
+			}
+
+			assert.Equal(t, testcase.expectedLogs, logs.FilterMessage(testcase.path).Len())
+		})
+	}
+}
+
+func TestStatusRoute(t *testing.T) {
+	expected, err := dbm.LatestVersion()
+	require.NoError(t, err)
+
+	// No DB is configured, so there's no migration version to report.
+	hs := httpsrv.Server{Logger: zap.NewNop(), AuthConfig: serverAuthConfig}
+	s := hs.NewServer()
+	router := s.Handler
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), "GET", "/status", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+
+	resp := httpsrv.StatusResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+	assert.NotEmpty(t, resp.Version)
+	assert.Nil(t, resp.MigrationVersion)
+	assert.Equal(t, expected, resp.ExpectedMigrationVersion)
+	assert.Greater(t, resp.ExpectedMigrationVersion, int64(0))
+	assert.False(t, resp.DBEnabled)
+	assert.False(t, resp.LookupEnabled)
+}
+
+func TestStatusRouteMigrationVersion(t *testing.T) {
+	db := dbtools.DatabaseTest(t)
+
+	expected, err := dbm.LatestVersion()
+	require.NoError(t, err)
+
+	hs := httpsrv.Server{Logger: zap.NewNop(), AuthConfig: serverAuthConfig, DB: db}
+	s := hs.NewServer()
+	router := s.Handler
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), "GET", "/status", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+
+	resp := httpsrv.StatusResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+	// The test DB is migrated with the embedded migrations.
+	require.NotNil(t, resp.MigrationVersion)
+	assert.Equal(t, expected, *resp.MigrationVersion)
+	assert.True(t, resp.DBEnabled)
+}
@@ -0,0 +1,60 @@
+package httpsrv
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.hollow.sh/toolbox/version"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/db"
+)
+
+// migrationVersionQuery returns the version of the most recently applied goose
+// migration.
+const migrationVersionQuery = `SELECT version_id FROM goose_db_version WHERE is_applied ORDER BY id DESC LIMIT 1`
+
+// StatusResponse is the body of a /status response. MigrationVersion is the
+// migration version the DB is at, and is null when there's no DB or it can't
+// be queried. ExpectedMigrationVersion is the version of the newest migration
+// built into the service.
+type StatusResponse struct {
+	Version                  string `json:"version"`
+	MigrationVersion         *int64 `json:"migrationVersion"`
+	ExpectedMigrationVersion int64  `json:"expectedMigrationVersion"`
+	DBEnabled                bool   `json:"dbEnabled"`
+	LookupEnabled            bool   `json:"lookupEnabled"`
+}
+
+// status returns the build version, along with the DB migration version and
+// which backends are enabled, so a deployment can be verified in one request.
+func (s *Server) status(c *gin.Context) {
+	resp := StatusResponse{
+		Version:       version.String(),
+		DBEnabled:     s.DB != nil,
+		LookupEnabled: s.LookupEnabled && s.LookupClient != nil,
+	}
+
+	expected, err := db.LatestVersion()
+	if err != nil {
+		s.Logger.Warn("failed to read the embedded migrations", zap.Error(err))
+	}
+
+	resp.ExpectedMigrationVersion = expected
+
+	if s.DB != nil {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), dbPingTimeout)
+		defer cancel()
+
+		var migrationVersion int64
+
+		if err := s.DB.GetContext(ctx, &migrationVersion, migrationVersionQuery); err != nil {
+			s.Logger.Warn("failed to query the DB migration version", zap.Error(err))
+		} else {
+			resp.MigrationVersion = &migrationVersion
+		}
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
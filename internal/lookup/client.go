@@ -8,15 +8,31 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"time"
 
 	"go.hollow.sh/toolbox/version"
 	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
 )
 
+// DefaultRetryBaseInterval is the wait before the first retry of a failed
+// lookup service request when the client's RetryBaseInterval isn't set.
+const DefaultRetryBaseInterval = 100 * time.Millisecond
+
 var (
 	errBaseURLParse = errors.New("could not parse base URL")
 	errNoBaseURL    = errors.New("failed to initialize: no lookup service base URL provided")
 	userAgentString = fmt.Sprintf("go-hollow-metadataservice-lookup-client (%s)", version.String())
+
+	// retryableStatuses are the lookup service response statuses indicating
+	// a transient failure, which are retried.
+	retryableStatuses = map[int]struct{}{
+		http.StatusTooManyRequests:    {},
+		http.StatusBadGateway:         {},
+		http.StatusServiceUnavailable: {},
+		http.StatusGatewayTimeout:     {},
+	}
 )
 
 // MetadataLookupResponse represents the data we expect to receive from a call
@@ -48,6 +64,49 @@ type ServiceClient struct {
 	BaseURL *url.URL
 	client  *http.Client
 	Logger  *zap.Logger
+	// ForwardClientIPHeader, if set, is the request header used to pass the
+	// IP address of the instance whose request triggered a lookup by ID (as
+	// carried by WithClientIP) to the lookup service.
+	ForwardClientIPHeader string
+	// MaxRetries is the number of times a request failing with a network
+	// error or a transient status, like 503, is retried. Zero disables
+	// retries.
+	MaxRetries int
+	// RetryBaseInterval is the wait before the first retry, doubling after
+	// each one. Zero means DefaultRetryBaseInterval.
+	RetryBaseInterval time.Duration
+	// RequestTimeout, if set, limits how long each attempt at a lookup may
+	// take. Attempts which time out are retried like network errors, and
+	// lookups whose last attempt timed out fail with ErrLookupTimeout.
+	RequestTimeout time.Duration
+}
+
+// clientIPContextKey is the context key for the IP address set by
+// WithClientIP.
+type clientIPContextKey struct{}
+
+// WithClientIP returns a copy of ctx carrying the IP address of the instance
+// whose request triggered a lookup, so it can be forwarded to the lookup
+// service. An empty IP address returns ctx unchanged.
+func WithClientIP(ctx context.Context, clientIP string) context.Context {
+	if clientIP == "" {
+		return ctx
+	}
+
+	return context.WithValue(ctx, clientIPContextKey{}, clientIP)
+}
+
+// ClientIPFromContext returns the IP address set by WithClientIP, if any.
+func ClientIPFromContext(ctx context.Context) (string, bool) {
+	clientIP, ok := ctx.Value(clientIPContextKey{}).(string)
+
+	return clientIP, ok
+}
+
+// ForwardsClientIP reports whether the client forwards the requesting
+// instance's IP address with lookups by ID.
+func (c *ServiceClient) ForwardsClientIP() bool {
+	return c.ForwardClientIPHeader != ""
 }
 
 // ErrorResponse represents an error response record received from the lookup
@@ -78,11 +137,13 @@ func NewClient(logger *zap.Logger, baseURL string, httpClient *http.Client) (*Se
 	return c, nil
 }
 
-// GetMetadataByID is used to look up metadata by instance ID
+// GetMetadataByID is used to look up metadata by instance ID. If the context
+// carries the requesting instance's IP address, it's forwarded in the
+// ForwardClientIPHeader.
 func (c *ServiceClient) GetMetadataByID(ctx context.Context, instanceID string) (*MetadataLookupResponse, error) {
 	path := path.Join("device-metadata", instanceID)
 
-	resp, err := c.getMetadata(ctx, path)
+	resp, err := c.getMetadata(ctx, path, true)
 	if err != nil {
 		if errors.Is(err, ErrNotFound) {
 			c.Logger.Sugar().Warnf("Metadata for instance ID %s was not found in the Lookup Service", instanceID)
@@ -96,7 +157,7 @@ func (c *ServiceClient) GetMetadataByID(ctx context.Context, instanceID string)
 func (c *ServiceClient) GetMetadataByIP(ctx context.Context, instanceIP string) (*MetadataLookupResponse, error) {
 	path := fmt.Sprintf("device-metadata?ip_address=%s", instanceIP)
 
-	resp, err := c.getMetadata(ctx, path)
+	resp, err := c.getMetadata(ctx, path, false)
 	if err != nil {
 		if errors.Is(err, ErrNotFound) {
 			c.Logger.Sugar().Warnf("Metadata for IP Address %s was not found in the Lookup Service", instanceIP)
@@ -106,11 +167,13 @@ func (c *ServiceClient) GetMetadataByIP(ctx context.Context, instanceIP string)
 	return resp, err
 }
 
-// GetUserdataByID is used to look up userdata by instance ID
+// GetUserdataByID is used to look up userdata by instance ID. If the context
+// carries the requesting instance's IP address, it's forwarded in the
+// ForwardClientIPHeader.
 func (c *ServiceClient) GetUserdataByID(ctx context.Context, instanceID string) (*UserdataLookupResponse, error) {
 	path := path.Join("device-userdata", instanceID)
 
-	resp, err := c.getUserdata(ctx, path)
+	resp, err := c.getUserdata(ctx, path, true)
 	if err != nil {
 		if errors.Is(err, ErrNotFound) {
 			c.Logger.Sugar().Warnf("Userdata for instance ID %s was not found in the Lookup Service", instanceID)
@@ -124,7 +187,7 @@ func (c *ServiceClient) GetUserdataByID(ctx context.Context, instanceID string)
 func (c *ServiceClient) GetUserdataByIP(ctx context.Context, instanceIP string) (*UserdataLookupResponse, error) {
 	path := fmt.Sprintf("device-userdata?ip_address=%s", instanceIP)
 
-	resp, err := c.getUserdata(ctx, path)
+	resp, err := c.getUserdata(ctx, path, false)
 	if err != nil {
 		if errors.Is(err, ErrNotFound) {
 			c.Logger.Sugar().Warnf("Userdata for IP Address %s was not found in the Lookup Service", instanceIP)
@@ -148,12 +211,16 @@ func newGetRequest(ctx context.Context, baseURL string, path string) (*http.Requ
 	return req, err
 }
 
-func (c *ServiceClient) getMetadata(ctx context.Context, path string) (*MetadataLookupResponse, error) {
+func (c *ServiceClient) getMetadata(ctx context.Context, path string, forwardClientIP bool) (*MetadataLookupResponse, error) {
 	req, err := newGetRequest(ctx, c.BaseURL.String(), path)
 	if err != nil {
 		return nil, err
 	}
 
+	if forwardClientIP {
+		c.setForwardedClientIP(ctx, req)
+	}
+
 	metadata := &MetadataLookupResponse{}
 
 	err = c.get(req, metadata)
@@ -164,12 +231,16 @@ func (c *ServiceClient) getMetadata(ctx context.Context, path string) (*Metadata
 	return metadata, nil
 }
 
-func (c *ServiceClient) getUserdata(ctx context.Context, path string) (*UserdataLookupResponse, error) {
+func (c *ServiceClient) getUserdata(ctx context.Context, path string, forwardClientIP bool) (*UserdataLookupResponse, error) {
 	req, err := newGetRequest(ctx, c.BaseURL.String(), path)
 	if err != nil {
 		return nil, err
 	}
 
+	if forwardClientIP {
+		c.setForwardedClientIP(ctx, req)
+	}
+
 	userdata := &UserdataLookupResponse{}
 
 	err = c.get(req, userdata)
@@ -180,16 +251,108 @@ func (c *ServiceClient) getUserdata(ctx context.Context, path string) (*Userdata
 	return userdata, nil
 }
 
+// attemptContext returns the context for a single attempt at a request,
+// limited to the RequestTimeout, if it's set.
+func (c *ServiceClient) attemptContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.RequestTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, c.RequestTimeout)
+}
+
+// timeoutError returns ErrLookupTimeout wrapping err if the attempt failed
+// because the RequestTimeout fired, rather than the request's own context
+// being done, and nil otherwise.
+func (c *ServiceClient) timeoutError(ctx, attemptCtx context.Context, err error) error {
+	if ctx.Err() != nil || !errors.Is(attemptCtx.Err(), context.DeadlineExceeded) {
+		return nil
+	}
+
+	middleware.MetricLookupTimeouts.Inc()
+
+	return fmt.Errorf("%w after %s: %w", ErrLookupTimeout, c.RequestTimeout, err)
+}
+
+// setForwardedClientIP sets the ForwardClientIPHeader on the request, if it's
+// configured and the context carries a client IP address.
+func (c *ServiceClient) setForwardedClientIP(ctx context.Context, req *http.Request) {
+	if c.ForwardClientIPHeader == "" {
+		return
+	}
+
+	if clientIP, ok := ClientIPFromContext(ctx); ok {
+		req.Header.Set(c.ForwardClientIPHeader, clientIP)
+	}
+}
+
+// get sends the request and decodes the JSON response body into v. Transient
+// failures, which are network errors and the retryableStatuses, are retried
+// up to MaxRetries times, waiting RetryBaseInterval and doubling it after
+// each attempt. Retrying stops early if the request's context is done, or if
+// its deadline would pass before the next attempt.
 func (c *ServiceClient) get(req *http.Request, v interface{}) error {
-	resp, err := c.client.Do(req)
+	ctx := req.Context()
+	interval := c.RetryBaseInterval
+
+	if interval <= 0 {
+		interval = DefaultRetryBaseInterval
+	}
+
+	for attempt := 0; ; attempt++ {
+		retryable, err := c.do(req, v)
+		if err == nil || !retryable || attempt >= c.MaxRetries {
+			return err
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(interval).After(deadline) {
+			return err
+		}
+
+		c.Logger.Sugar().Warnf("Lookup Service request failed, retrying in %s (retry %d of %d): %v", interval, attempt+1, c.MaxRetries, err)
+
+		timer := time.NewTimer(interval)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+
+		// Retries count against the lookup rate limit like any other request
+		// to the lookup service.
+		if err = waitForRateLimit(ctx); err != nil {
+			return err
+		}
+
+		interval *= 2
+	}
+}
+
+// do sends the request once, limited to the RequestTimeout, and reports
+// whether a failure is worth retrying.
+func (c *ServiceClient) do(req *http.Request, v interface{}) (bool, error) {
+	ctx := req.Context()
+
+	attemptCtx, cancel := c.attemptContext(ctx)
+	defer cancel()
+
+	resp, err := c.client.Do(req.WithContext(attemptCtx))
 	if err != nil {
-		return err
+		if timeoutErr := c.timeoutError(ctx, attemptCtx, err); timeoutErr != nil {
+			return true, timeoutErr
+		}
+
+		// The request's context being done isn't transient; there's no time
+		// left to retry in.
+		return ctx.Err() == nil, err
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNotFound {
-		return ErrNotFound
+		return false, ErrNotFound
 	}
 
 	if resp.StatusCode != http.StatusOK {
@@ -204,8 +367,18 @@ func (c *ServiceClient) get(req *http.Request, v interface{}) error {
 			}
 		}
 
-		return fmt.Errorf("%w: %d", ErrUnexpectedStatus, resp.StatusCode)
+		_, retryable := retryableStatuses[resp.StatusCode]
+
+		return retryable, fmt.Errorf("%w: %d", ErrUnexpectedStatus, resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		if timeoutErr := c.timeoutError(ctx, attemptCtx, err); timeoutErr != nil {
+			return true, timeoutErr
+		}
+
+		return false, err
 	}
 
-	return json.NewDecoder(resp.Body).Decode(v)
+	return false, nil
 }
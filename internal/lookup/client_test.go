@@ -6,12 +6,18 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 
 	"go.hollow.sh/metadataservice/internal/lookup"
+	"go.hollow.sh/metadataservice/internal/middleware"
 )
 
 func lookupMetadataServerMock(instance testInstance) *httptest.Server {
@@ -320,3 +326,237 @@ func TestGetUserdataByIP(t *testing.T) {
 		})
 	}
 }
+
+func TestForwardClientIPHeader(t *testing.T) {
+	const header = "X-Forwarded-For"
+
+	var receivedIP string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedIP = r.Header.Get(header)
+
+		if strings.HasPrefix(r.URL.Path, "/device-userdata") {
+			_ = json.NewEncoder(w).Encode(testInstances[0].UserdataResponse())
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(testInstances[0].MetadataResponse())
+	}))
+	defer srv.Close()
+
+	type testCase struct {
+		testName   string
+		headerName string
+		clientIP   string
+		lookup     func(ctx context.Context, client *lookup.ServiceClient) error
+		expectedIP string
+	}
+
+	metadataByID := func(ctx context.Context, client *lookup.ServiceClient) error {
+		_, err := client.GetMetadataByID(ctx, testInstances[0].ID)
+		return err
+	}
+
+	userdataByID := func(ctx context.Context, client *lookup.ServiceClient) error {
+		_, err := client.GetUserdataByID(ctx, testInstances[0].ID)
+		return err
+	}
+
+	metadataByIP := func(ctx context.Context, client *lookup.ServiceClient) error {
+		_, err := client.GetMetadataByIP(ctx, testInstances[0].IPAddresses[0])
+		return err
+	}
+
+	testCases := []testCase{
+		{"metadata by ID", header, "10.1.2.3", metadataByID, "10.1.2.3"},
+		{"userdata by ID", header, "10.1.2.3", userdataByID, "10.1.2.3"},
+		{"no client IP in the context", header, "", metadataByID, ""},
+		{"header not configured", "", "10.1.2.3", metadataByID, ""},
+		{"lookups by IP don't forward it", header, "10.1.2.3", metadataByIP, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			receivedIP = ""
+
+			client, err := lookup.NewClient(zap.NewNop(), srv.URL, http.DefaultClient)
+			require.NoError(t, err)
+
+			client.ForwardClientIPHeader = tc.headerName
+
+			ctx := lookup.WithClientIP(context.TODO(), tc.clientIP)
+
+			require.NoError(t, tc.lookup(ctx, client))
+			assert.Equal(t, tc.expectedIP, receivedIP)
+		})
+	}
+}
+
+// lookupServerFailingMock returns a server responding with the failure status
+// to the first failures requests, and the instance's metadata after that, and
+// a counter of the requests it received.
+func lookupServerFailingMock(instance testInstance, status int, failures int32) (*httptest.Server, *atomic.Int32) {
+	calls := &atomic.Int32{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.WriteHeader(status)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(instance.MetadataResponse())
+	}))
+
+	return srv, calls
+}
+
+func TestRetries(t *testing.T) {
+	type testCase struct {
+		testName      string
+		status        int
+		failures      int32
+		maxRetries    int
+		timeout       time.Duration
+		expectedError error
+		expectedCalls int32
+	}
+
+	testCases := []testCase{
+		{"succeeds after retrying 503s", http.StatusServiceUnavailable, 2, 3, 0, nil, 3},
+		{"retries 429s", http.StatusTooManyRequests, 1, 3, 0, nil, 2},
+		{"retries 502s", http.StatusBadGateway, 1, 3, 0, nil, 2},
+		{"retries 504s", http.StatusGatewayTimeout, 1, 3, 0, nil, 2},
+		{"gives up after the max retries", http.StatusServiceUnavailable, 5, 2, 0, lookup.ErrUnexpectedStatus, 3},
+		{"no retries by default", http.StatusServiceUnavailable, 1, 0, 0, lookup.ErrUnexpectedStatus, 1},
+		{"doesn't retry 404s", http.StatusNotFound, 1, 3, 0, lookup.ErrNotFound, 1},
+		{"doesn't retry 500s", http.StatusInternalServerError, 1, 3, 0, lookup.ErrUnexpectedStatus, 1},
+		{"doesn't retry 403s", http.StatusForbidden, 1, 3, 0, lookup.ErrUnexpectedStatus, 1},
+		{"stops before the context deadline", http.StatusServiceUnavailable, 2, 3, 5 * time.Millisecond, lookup.ErrUnexpectedStatus, 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			srv, calls := lookupServerFailingMock(testInstances[0], tc.status, tc.failures)
+			defer srv.Close()
+
+			client, err := lookup.NewClient(zap.NewNop(), srv.URL, http.DefaultClient)
+			require.NoError(t, err)
+
+			client.MaxRetries = tc.maxRetries
+			client.RetryBaseInterval = time.Millisecond
+
+			ctx := context.Background()
+
+			if tc.timeout > 0 {
+				// The first retry would start after the deadline.
+				client.RetryBaseInterval = time.Second
+
+				var cancel context.CancelFunc
+
+				ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+				defer cancel()
+			}
+
+			resp, err := client.GetMetadataByID(ctx, testInstances[0].ID)
+
+			if tc.expectedError != nil {
+				assert.ErrorIs(t, err, tc.expectedError)
+				assert.Nil(t, resp)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, testInstances[0].ID, resp.ID)
+			}
+
+			assert.Equal(t, tc.expectedCalls, calls.Load())
+		})
+	}
+}
+
+func TestRetriesNetworkErrors(t *testing.T) {
+	srv, _ := lookupServerFailingMock(testInstances[0], http.StatusOK, 0)
+	srv.Close()
+
+	client, err := lookup.NewClient(zap.NewNop(), srv.URL, http.DefaultClient)
+	require.NoError(t, err)
+
+	client.MaxRetries = 2
+	client.RetryBaseInterval = time.Millisecond
+
+	// The server is closed, so every attempt fails to connect.
+	start := time.Now()
+	_, err = client.GetMetadataByID(context.Background(), testInstances[0].ID)
+
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, lookup.ErrUnexpectedStatus)
+	assert.GreaterOrEqual(t, time.Since(start), 3*time.Millisecond)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	client, err := lookup.NewClient(zap.NewNop(), srv.URL, http.DefaultClient)
+	require.NoError(t, err)
+
+	client.RequestTimeout = 10 * time.Millisecond
+
+	timeoutsBefore := testutil.ToFloat64(middleware.MetricLookupTimeouts)
+
+	_, err = client.GetMetadataByID(context.Background(), testInstances[0].ID)
+	assert.ErrorIs(t, err, lookup.ErrLookupTimeout)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NotErrorIs(t, err, lookup.ErrUnexpectedStatus)
+	assert.Equal(t, timeoutsBefore+1, testutil.ToFloat64(middleware.MetricLookupTimeouts))
+
+	_, err = client.GetUserdataByIP(context.Background(), testInstances[0].IPAddresses[0])
+	assert.ErrorIs(t, err, lookup.ErrLookupTimeout)
+
+	// The caller's own context expiring first isn't reported as a lookup
+	// timeout.
+	client.RequestTimeout = time.Minute
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = client.GetMetadataByID(ctx, testInstances[0].ID)
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, lookup.ErrLookupTimeout)
+}
+
+func TestRequestTimeoutPerAttempt(t *testing.T) {
+	var calls atomic.Int32
+
+	// The first attempt hangs, and the retry succeeds.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			<-r.Context().Done()
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(testInstances[0].MetadataResponse())
+	}))
+	defer srv.Close()
+
+	client, err := lookup.NewClient(zap.NewNop(), srv.URL, http.DefaultClient)
+	require.NoError(t, err)
+
+	client.RequestTimeout = 50 * time.Millisecond
+	client.MaxRetries = 1
+	client.RetryBaseInterval = time.Millisecond
+
+	timeoutsBefore := testutil.ToFloat64(middleware.MetricLookupTimeouts)
+
+	resp, err := client.GetMetadataByID(context.Background(), testInstances[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, testInstances[0].ID, resp.ID)
+	assert.Equal(t, int32(2), calls.Load())
+	assert.Equal(t, timeoutsBefore+1, testutil.ToFloat64(middleware.MetricLookupTimeouts))
+}
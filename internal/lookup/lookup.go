@@ -3,11 +3,14 @@ package lookup
 import (
 	"context"
 	"errors"
+	"sync/atomic"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/volatiletech/null/v8"
 	"github.com/volatiletech/sqlboiler/v4/types"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 
 	"go.hollow.sh/metadataservice/internal/middleware"
 	"go.hollow.sh/metadataservice/internal/models"
@@ -26,9 +29,109 @@ var (
 	// IP address we specified was not known by the upstream service.
 	ErrNotFound = errors.New("notFoundError")
 
+	// ErrLookupTimeout indicates to the caller that the upstream lookup service
+	// didn't respond within the client's RequestTimeout.
+	ErrLookupTimeout = errors.New("lookupTimeoutError")
+
 	errNilClient = errors.New("client can't be nil")
+
+	// syncGroup coalesces concurrent lookups for the same key, so that a burst
+	// of cache misses for one instance results in a single upstream call and
+	// database upsert. Callers waiting on an in-flight lookup share its result,
+	// including any error. See syncDo.
+	syncGroup singleflight.Group
+
+	// syncTimeout limits how long a shared lookup may run, since it isn't
+	// bound to any one caller's context. Set by SetSyncTimeout.
+	syncTimeout atomic.Int64
 )
 
+// DefaultSyncTimeout is the limit on how long a shared lookup (the upstream
+// call and database upsert) may run when SetSyncTimeout hasn't been called.
+const DefaultSyncTimeout = 30 * time.Second
+
+// SetSyncTimeout limits how long a shared lookup may run. A timeout of zero
+// or less restores DefaultSyncTimeout.
+func SetSyncTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultSyncTimeout
+	}
+
+	syncTimeout.Store(int64(timeout))
+}
+
+func getSyncTimeout() time.Duration {
+	if timeout := time.Duration(syncTimeout.Load()); timeout > 0 {
+		return timeout
+	}
+
+	return DefaultSyncTimeout
+}
+
+// syncDo runs fn once for all concurrent callers with the same key. fn runs
+// on a context detached from the callers' cancellation (keeping values such
+// as the client IP) and limited to the sync timeout, so one caller giving up
+// doesn't fail the lookup for everyone else waiting on it. Each caller stops
+// waiting when its own context is done, and gets its own copy of the result,
+// made by clone.
+func syncDo[T any](ctx context.Context, key string, fn func(ctx context.Context) (*T, error), clone func(*T) *T) (*T, error) {
+	ch := syncGroup.DoChan(key, func() (interface{}, error) {
+		syncCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), getSyncTimeout())
+		defer cancel()
+
+		return fn(syncCtx)
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+
+		return clone(res.Val.(*T)), nil
+	}
+}
+
+// clientIPForwarder is implemented by clients which can forward the client IP
+// carried by the context (see WithClientIP) with lookups by ID.
+type clientIPForwarder interface {
+	ForwardsClientIP() bool
+}
+
+// idKey returns the syncGroup key for a lookup by instance ID. When client
+// forwards the requesting instance's IP address, the upstream request
+// differs by IP address, so only lookups from the same IP address are
+// coalesced.
+func idKey(ctx context.Context, client Client, kind, id string) string {
+	key := kind + "/id/" + id
+
+	if f, ok := client.(clientIPForwarder); !ok || !f.ForwardsClientIP() {
+		return key
+	}
+
+	if clientIP, ok := ClientIPFromContext(ctx); ok {
+		key += "/" + clientIP
+	}
+
+	return key
+}
+
+func cloneMetadata(m *models.InstanceMetadatum) *models.InstanceMetadatum {
+	c := *m
+	c.Metadata = append(types.JSON(nil), m.Metadata...)
+
+	return &c
+}
+
+func cloneUserdata(u *models.InstanceUserdatum) *models.InstanceUserdatum {
+	c := *u
+	c.Userdata = null.NewBytes(append([]byte(nil), u.Userdata.Bytes...), u.Userdata.Valid)
+
+	return &c
+}
+
 // MetadataSyncByID calls out to the metadata lookup service and
 // attempts to locate metadata for the instance with the given ID. If found,
 // it will create new records in the database for the instance IP addresses
@@ -38,15 +141,21 @@ func MetadataSyncByID(ctx context.Context, db *sqlx.DB, logger *zap.Logger, clie
 		return nil, errNilClient
 	}
 
-	middleware.MetricMetadataLookupRequestCount.Inc()
+	return syncDo(ctx, idKey(ctx, client, "metadata", id), func(ctx context.Context) (*models.InstanceMetadatum, error) {
+		if err := waitForRateLimit(ctx); err != nil {
+			return nil, err
+		}
 
-	resp, err := client.GetMetadataByID(ctx, id)
-	if err != nil {
-		middleware.MetricLookupErrors.Inc()
-		return nil, err
-	}
+		middleware.MetricMetadataLookupRequestCount.Inc()
+
+		resp, err := client.GetMetadataByID(ctx, id)
+		if err != nil {
+			middleware.MetricLookupErrors.Inc()
+			return nil, err
+		}
 
-	return storeMetadata(ctx, db, logger, resp)
+		return storeMetadata(ctx, db, logger, resp)
+	}, cloneMetadata)
 }
 
 // MetadataSyncByIP calls out to the metadata lookup service and
@@ -58,15 +167,21 @@ func MetadataSyncByIP(ctx context.Context, db *sqlx.DB, logger *zap.Logger, clie
 		return nil, errNilClient
 	}
 
-	middleware.MetricMetadataLookupRequestCount.Inc()
+	return syncDo(ctx, "metadata/ip/"+ipAddress, func(ctx context.Context) (*models.InstanceMetadatum, error) {
+		if err := waitForRateLimit(ctx); err != nil {
+			return nil, err
+		}
 
-	resp, err := client.GetMetadataByIP(ctx, ipAddress)
-	if err != nil {
-		middleware.MetricLookupErrors.Inc()
-		return nil, err
-	}
+		middleware.MetricMetadataLookupRequestCount.Inc()
 
-	return storeMetadata(ctx, db, logger, resp)
+		resp, err := client.GetMetadataByIP(ctx, ipAddress)
+		if err != nil {
+			middleware.MetricLookupErrors.Inc()
+			return nil, err
+		}
+
+		return storeMetadata(ctx, db, logger, resp)
+	}, cloneMetadata)
 }
 
 // UserdataSyncByID calls out to the metadata lookup service and
@@ -78,15 +193,21 @@ func UserdataSyncByID(ctx context.Context, db *sqlx.DB, logger *zap.Logger, clie
 		return nil, errNilClient
 	}
 
-	middleware.MetricUserdataLookupRequestCount.Inc()
+	return syncDo(ctx, idKey(ctx, client, "userdata", id), func(ctx context.Context) (*models.InstanceUserdatum, error) {
+		if err := waitForRateLimit(ctx); err != nil {
+			return nil, err
+		}
 
-	resp, err := client.GetUserdataByID(ctx, id)
-	if err != nil {
-		middleware.MetricUserdataLookupErrors.Inc()
-		return nil, err
-	}
+		middleware.MetricUserdataLookupRequestCount.Inc()
+
+		resp, err := client.GetUserdataByID(ctx, id)
+		if err != nil {
+			middleware.MetricUserdataLookupErrors.Inc()
+			return nil, err
+		}
 
-	return storeUserdata(ctx, db, logger, resp)
+		return storeUserdata(ctx, db, logger, resp)
+	}, cloneUserdata)
 }
 
 // UserdataSyncByIP calls out to the metadata lookup service and
@@ -98,15 +219,21 @@ func UserdataSyncByIP(ctx context.Context, db *sqlx.DB, logger *zap.Logger, clie
 		return nil, errNilClient
 	}
 
-	middleware.MetricUserdataLookupRequestCount.Inc()
+	return syncDo(ctx, "userdata/ip/"+ipAddress, func(ctx context.Context) (*models.InstanceUserdatum, error) {
+		if err := waitForRateLimit(ctx); err != nil {
+			return nil, err
+		}
 
-	resp, err := client.GetUserdataByID(ctx, ipAddress)
-	if err != nil {
-		middleware.MetricUserdataLookupErrors.Inc()
-		return nil, err
-	}
+		middleware.MetricUserdataLookupRequestCount.Inc()
+
+		resp, err := client.GetUserdataByIP(ctx, ipAddress)
+		if err != nil {
+			middleware.MetricUserdataLookupErrors.Inc()
+			return nil, err
+		}
 
-	return storeUserdata(ctx, db, logger, resp)
+		return storeUserdata(ctx, db, logger, resp)
+	}, cloneUserdata)
 }
 
 func storeMetadata(ctx context.Context, db *sqlx.DB, logger *zap.Logger, lookupResp *MetadataLookupResponse) (*models.InstanceMetadatum, error) {
@@ -115,7 +242,7 @@ func storeMetadata(ctx context.Context, db *sqlx.DB, logger *zap.Logger, lookupR
 		Metadata: types.JSON(lookupResp.Metadata),
 	}
 
-	err := upserter.UpsertMetadata(ctx, db, logger, lookupResp.ID, lookupResp.IPAddresses, newInstanceMetadata)
+	_, err := upserter.UpsertMetadata(ctx, db, logger, lookupResp.ID, lookupResp.IPAddresses, newInstanceMetadata)
 	if err != nil {
 		middleware.MetricMetadataStoreErrors.Inc()
 		return nil, err
@@ -132,7 +259,7 @@ func storeUserdata(ctx context.Context, db *sqlx.DB, logger *zap.Logger, lookupR
 		Userdata: null.NewBytes(lookupResp.Userdata, true),
 	}
 
-	err := upserter.UpsertUserdata(ctx, db, logger, lookupResp.ID, lookupResp.IPAddresses, newInstanceUserdata)
+	_, err := upserter.UpsertUserdata(ctx, db, logger, lookupResp.ID, lookupResp.IPAddresses, newInstanceUserdata)
 	if err != nil {
 		middleware.MetricUserdataStoreErrors.Inc()
 		return nil, err
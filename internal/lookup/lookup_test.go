@@ -2,15 +2,20 @@ package lookup_test
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 
 	"go.hollow.sh/metadataservice/internal/dbtools"
 	"go.hollow.sh/metadataservice/internal/lookup"
+	"go.hollow.sh/metadataservice/internal/middleware"
+	"go.hollow.sh/metadataservice/internal/models"
 )
 
 type mockLookupClient struct {
@@ -304,3 +309,234 @@ func TestFetchUserdataByIPAndStore(t *testing.T) {
 		}
 	}
 }
+
+// blockingLookupClient counts the upstream calls it receives, and holds each
+// one until release is closed.
+type blockingLookupClient struct {
+	mockLookupClient
+	calls           atomic.Int32
+	release         chan struct{}
+	forwardClientIP bool
+}
+
+func (m *blockingLookupClient) ForwardsClientIP() bool {
+	return m.forwardClientIP
+}
+
+func (m *blockingLookupClient) GetMetadataByID(ctx context.Context, id string) (*lookup.MetadataLookupResponse, error) {
+	m.calls.Add(1)
+	<-m.release
+
+	return m.mockLookupClient.GetMetadataByID(ctx, id)
+}
+
+func (m *blockingLookupClient) GetMetadataByIP(ctx context.Context, ip string) (*lookup.MetadataLookupResponse, error) {
+	m.calls.Add(1)
+	<-m.release
+
+	return m.mockLookupClient.GetMetadataByIP(ctx, ip)
+}
+
+func TestFetchMetadataCoalescesConcurrentLookups(t *testing.T) {
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	testDB := dbtools.DatabaseTest(t)
+
+	type testCase struct {
+		testName string
+		sync     func(ctx context.Context, client lookup.Client) (*models.InstanceMetadatum, error)
+		// clientIPs, if set, are the requesting instances' IP addresses,
+		// assigned to the concurrent requests in turn.
+		clientIPs []string
+	}
+
+	byIP := func(ctx context.Context, client lookup.Client) (*models.InstanceMetadatum, error) {
+		return lookup.MetadataSyncByIP(ctx, testDB, zap.NewNop(), client, testInstances[0].IPAddresses[0])
+	}
+
+	byID := func(ctx context.Context, client lookup.Client) (*models.InstanceMetadatum, error) {
+		return lookup.MetadataSyncByID(ctx, testDB, zap.NewNop(), client, testInstances[0].ID)
+	}
+
+	testCases := []testCase{
+		{
+			testName: "by IP",
+			sync:     byIP,
+		},
+		{
+			testName: "by ID",
+			sync:     byID,
+		},
+		{
+			// As when called by the router, which always sets the client
+			// IP. It isn't forwarded, so doesn't split the lookups.
+			testName:  "by ID from different client IPs",
+			sync:      byID,
+			clientIPs: []string{"1.2.3.4", "5.6.7.8"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			mockClient := &blockingLookupClient{
+				mockLookupClient: mockLookupClient{MetadataResponse: testInstances[0].MetadataResponse()},
+				release:          make(chan struct{}),
+			}
+
+			const concurrentRequests = 10
+
+			var wg sync.WaitGroup
+
+			results := make([]*models.InstanceMetadatum, concurrentRequests)
+			errs := make([]error, concurrentRequests)
+
+			for i := 0; i < concurrentRequests; i++ {
+				ctx := context.TODO()
+				if len(tc.clientIPs) > 0 {
+					ctx = lookup.WithClientIP(ctx, tc.clientIPs[i%len(tc.clientIPs)])
+				}
+
+				wg.Add(1)
+
+				go func(i int) {
+					defer wg.Done()
+
+					results[i], errs[i] = tc.sync(ctx, mockClient)
+				}(i)
+			}
+
+			// Give the goroutines a chance to pile up behind the first lookup
+			// before letting it complete.
+			time.Sleep(100 * time.Millisecond)
+			close(mockClient.release)
+			wg.Wait()
+
+			assert.Equal(t, int32(1), mockClient.calls.Load())
+
+			for i := 0; i < concurrentRequests; i++ {
+				assert.Nil(t, errs[i])
+				assert.NotNil(t, results[i])
+				assert.Equal(t, testInstances[0].ID, results[i].ID)
+			}
+
+			// Each caller gets its own copy of the shared result
+			assert.NotSame(t, results[0], results[1])
+
+			results[0].Metadata[0] = 'x'
+			assert.JSONEq(t, testInstances[0].Metadata, string(results[1].Metadata))
+		})
+	}
+}
+
+func TestFetchMetadataRateLimited(t *testing.T) {
+	lookup.SetMaxRPS(1, 10*time.Millisecond)
+	defer lookup.SetMaxRPS(0, 0)
+
+	mockClient := mockLookupClient{Error: lookup.ErrNotFound}
+	throttledBefore := testutil.ToFloat64(middleware.MetricLookupsThrottled)
+
+	// The first lookup gets through to the (mock) lookup service
+	_, err := lookup.MetadataSyncByID(context.TODO(), nil, zap.NewNop(), &mockClient, "abc123")
+	assert.ErrorIs(t, err, lookup.ErrNotFound)
+
+	// The second can't get a token within the timeout, so fails as an
+	// upstream error without reaching the lookup service
+	_, err = lookup.MetadataSyncByIP(context.TODO(), nil, zap.NewNop(), &mockClient, "1.2.3.4")
+	assert.ErrorIs(t, err, lookup.ErrUnexpectedStatus)
+	assert.Equal(t, throttledBefore+1, testutil.ToFloat64(middleware.MetricLookupsThrottled))
+}
+
+func TestFetchMetadataCanceledWaiter(t *testing.T) {
+	mockClient := &blockingLookupClient{
+		mockLookupClient: mockLookupClient{Error: lookup.ErrNotFound},
+		release:          make(chan struct{}),
+	}
+
+	firstCtx, cancel := context.WithCancel(context.Background())
+
+	var (
+		wg       sync.WaitGroup
+		firstErr error
+		otherErr error
+	)
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+
+		_, firstErr = lookup.MetadataSyncByIP(firstCtx, nil, zap.NewNop(), mockClient, "1.2.3.4")
+	}()
+
+	// Let the first caller start the shared lookup before the second joins it
+	time.Sleep(50 * time.Millisecond)
+
+	go func() {
+		defer wg.Done()
+
+		_, otherErr = lookup.MetadataSyncByIP(context.TODO(), nil, zap.NewNop(), mockClient, "1.2.3.4")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	// The first caller giving up doesn't fail the lookup the other is
+	// waiting on
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	close(mockClient.release)
+	wg.Wait()
+
+	assert.ErrorIs(t, firstErr, context.Canceled)
+	assert.ErrorIs(t, otherErr, lookup.ErrNotFound)
+	assert.Equal(t, int32(1), mockClient.calls.Load())
+}
+
+func TestFetchMetadataByIDCoalescesPerClientIP(t *testing.T) {
+	mockClient := &blockingLookupClient{
+		mockLookupClient: mockLookupClient{Error: lookup.ErrNotFound},
+		release:          make(chan struct{}),
+		forwardClientIP:  true,
+	}
+
+	var wg sync.WaitGroup
+
+	for _, clientIP := range []string{"1.2.3.4", "5.6.7.8"} {
+		wg.Add(1)
+
+		go func(clientIP string) {
+			defer wg.Done()
+
+			ctx := lookup.WithClientIP(context.TODO(), clientIP)
+
+			_, err := lookup.MetadataSyncByID(ctx, nil, zap.NewNop(), mockClient, "abc123")
+			assert.ErrorIs(t, err, lookup.ErrNotFound)
+		}(clientIP)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	close(mockClient.release)
+	wg.Wait()
+
+	// Lookups by ID forward the client IP, so requests from different IP
+	// addresses each reach the lookup service
+	assert.Equal(t, int32(2), mockClient.calls.Load())
+}
+
+// byIPOnlyLookupClient fails lookups by instance ID, to catch lookups by IP
+// address sent to the wrong endpoint.
+type byIPOnlyLookupClient struct {
+	mockLookupClient
+}
+
+func (m *byIPOnlyLookupClient) GetUserdataByID(_ context.Context, _ string) (*lookup.UserdataLookupResponse, error) {
+	return nil, lookup.ErrUnexpectedStatus
+}
+
+func TestFetchUserdataByIPUsesIPLookup(t *testing.T) {
+	mockClient := &byIPOnlyLookupClient{mockLookupClient{Error: lookup.ErrNotFound}}
+
+	_, err := lookup.UserdataSyncByIP(context.TODO(), nil, zap.NewNop(), mockClient, "1.2.3.4")
+	assert.ErrorIs(t, err, lookup.ErrNotFound)
+}
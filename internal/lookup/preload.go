@@ -0,0 +1,89 @@
+package lookup
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// ReadPreloadFile reads the instance IDs to preload from the given file, one
+// per line. Blank lines and lines starting with '#' are skipped.
+func ReadPreloadFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ids []string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		ids = append(ids, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// Preload fetches the metadata for each of the given instance IDs from the
+// lookup service and stores it in the database, with at most concurrency
+// lookups in flight at once. Failed lookups are logged and skipped, so one
+// unknown instance doesn't hold up the rest. It returns the number of
+// instances which were preloaded.
+func Preload(ctx context.Context, db *sqlx.DB, logger *zap.Logger, client Client, ids []string, concurrency int) int {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		wg        sync.WaitGroup
+		preloaded atomic.Int32
+	)
+
+	sem := make(chan struct{}, concurrency)
+
+	for _, id := range ids {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+
+			return int(preloaded.Load())
+		}
+
+		wg.Add(1)
+
+		go func(id string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if _, err := MetadataSyncByID(ctx, db, logger, client, id); err != nil {
+				logger.Warn("failed to preload instance metadata", zap.String("instance_id", id), zap.Error(err))
+				return
+			}
+
+			preloaded.Add(1)
+		}(id)
+	}
+
+	wg.Wait()
+
+	return int(preloaded.Load())
+}
@@ -0,0 +1,81 @@
+package lookup_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/lookup"
+)
+
+// concurrencyLookupClient tracks the most metadata lookups it has seen in
+// flight at once. Every lookup fails, so no database is needed.
+type concurrencyLookupClient struct {
+	mockLookupClient
+	calls    atomic.Int32
+	inFlight atomic.Int32
+	maxSeen  atomic.Int32
+}
+
+func (m *concurrencyLookupClient) GetMetadataByID(ctx context.Context, id string) (*lookup.MetadataLookupResponse, error) {
+	m.calls.Add(1)
+
+	current := m.inFlight.Add(1)
+	defer m.inFlight.Add(-1)
+
+	for {
+		seen := m.maxSeen.Load()
+		if current <= seen || m.maxSeen.CompareAndSwap(seen, current) {
+			break
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	return nil, lookup.ErrNotFound
+}
+
+func TestReadPreloadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "preload")
+
+	err := os.WriteFile(path, []byte("# instances to warm up\nabc123\n\n  def456  \n#ghi789\n"), 0o600)
+	require.NoError(t, err)
+
+	ids, err := lookup.ReadPreloadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"abc123", "def456"}, ids)
+
+	_, err = lookup.ReadPreloadFile(filepath.Join(t.TempDir(), "missing"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestPreloadBoundedConcurrency(t *testing.T) {
+	mockClient := &concurrencyLookupClient{}
+
+	ids := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+
+	preloaded := lookup.Preload(context.TODO(), nil, zap.NewNop(), mockClient, ids, 3)
+
+	assert.Equal(t, 0, preloaded)
+	assert.Equal(t, int32(len(ids)), mockClient.calls.Load())
+	assert.LessOrEqual(t, mockClient.maxSeen.Load(), int32(3))
+}
+
+func TestPreloadCanceled(t *testing.T) {
+	mockClient := &concurrencyLookupClient{}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+
+	preloaded := lookup.Preload(ctx, nil, zap.NewNop(), mockClient, []string{"a", "b", "c", "d"}, 1)
+
+	assert.Equal(t, 0, preloaded)
+	assert.LessOrEqual(t, mockClient.calls.Load(), int32(1))
+}
@@ -0,0 +1,57 @@
+package lookup
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+)
+
+type rateLimiter struct {
+	limiter *rate.Limiter
+	timeout time.Duration
+}
+
+// lookupRateLimiter caps the rate of requests sent to the upstream lookup
+// service, across all callers. It's nil (unlimited) unless SetMaxRPS is called.
+var lookupRateLimiter atomic.Pointer[rateLimiter]
+
+// SetMaxRPS caps the number of requests per second sent to the upstream
+// lookup service. Lookups wait up to timeout for the limiter before failing
+// with ErrUnexpectedStatus, as if the lookup service had returned an error.
+// A maxRPS of zero or less removes the limit.
+func SetMaxRPS(maxRPS float64, timeout time.Duration) {
+	if maxRPS <= 0 {
+		lookupRateLimiter.Store(nil)
+		return
+	}
+
+	lookupRateLimiter.Store(&rateLimiter{
+		limiter: rate.NewLimiter(rate.Limit(maxRPS), int(math.Max(1, math.Ceil(maxRPS)))),
+		timeout: timeout,
+	})
+}
+
+// waitForRateLimit blocks until the rate limiter (if any) allows another
+// upstream lookup, or its timeout expires.
+func waitForRateLimit(ctx context.Context) error {
+	rl := lookupRateLimiter.Load()
+	if rl == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rl.timeout)
+	defer cancel()
+
+	if err := rl.limiter.Wait(ctx); err != nil {
+		middleware.MetricLookupsThrottled.Inc()
+		return fmt.Errorf("%w: lookup rate limit exceeded: %s", ErrUnexpectedStatus, err)
+	}
+
+	return nil
+}
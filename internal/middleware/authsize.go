@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LimitAuthorizationHeaderSize returns a middleware which rejects requests
+// whose Authorization header is longer than maxSize bytes with a 431, before
+// the auth middleware spends any time parsing and validating the token.
+func LimitAuthorizationHeaderSize(maxSize int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(c.GetHeader("Authorization")) > maxSize {
+			MetricOversizedAuthorizationCount.Inc()
+			c.AbortWithStatusJSON(http.StatusRequestHeaderFieldsTooLarge, &errorResponse{
+				Message: "authorization header too large",
+				Errors:  []string{fmt.Sprintf("the Authorization header must be at most %d bytes", maxSize)},
+			})
+
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,58 @@
+package middleware_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+)
+
+func TestLimitAuthorizationHeaderSize(t *testing.T) {
+	r := gin.New()
+	r.GET("/", middleware.LimitAuthorizationHeaderSize(32), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	type testCase struct {
+		testName       string
+		authorization  string
+		expectedStatus int
+	}
+
+	testCases := []testCase{
+		{"no header", "", http.StatusOK},
+		{"small header", "Bearer " + strings.Repeat("a", 25), http.StatusOK},
+		{"oversized header", "Bearer " + strings.Repeat("a", 26), http.StatusRequestHeaderFieldsTooLarge},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			rejected := testutil.ToFloat64(middleware.MetricOversizedAuthorizationCount)
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, "/", nil)
+			if testcase.authorization != "" {
+				req.Header.Set("Authorization", testcase.authorization)
+			}
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+
+			if testcase.expectedStatus == http.StatusRequestHeaderFieldsTooLarge {
+				assert.JSONEq(t, `{"message":"authorization header too large","errors":["the Authorization header must be at most 32 bytes"]}`, w.Body.String())
+				assert.Equal(t, rejected+1, testutil.ToFloat64(middleware.MetricOversizedAuthorizationCount))
+			} else {
+				assert.Equal(t, rejected, testutil.ToFloat64(middleware.MetricOversizedAuthorizationCount))
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimiters exposes rateLimiters to the external test package.
+type RateLimiters = rateLimiters
+
+// NewRateLimiters exposes newRateLimiters to the external test package.
+func NewRateLimiters(limit rate.Limit, burst int) *RateLimiters {
+	return newRateLimiters(limit, burst)
+}
+
+// Get exposes get to the external test package.
+func (l *rateLimiters) Get(key string, now time.Time) *rate.Limiter {
+	return l.get(key, now)
+}
+
+// Len returns the number of keys with a limiter.
+func (l *rateLimiters) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.limiters)
+}
+
+// RateLimitSweepInterval exposes rateLimitSweepInterval to the external test
+// package.
+const RateLimitSweepInterval = rateLimitSweepInterval
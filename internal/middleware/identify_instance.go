@@ -2,10 +2,15 @@ package middleware
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	"github.com/volatiletech/sqlboiler/v4/queries/qm"
 	"go.uber.org/zap"
@@ -23,34 +28,60 @@ const ContextKeyInstanceID = "instance-id"
 // metadata or userdata.
 const ContextKeyRequestorIP = "requestor-ip-address"
 
+// ContextKeyIdentifiedByIP is the magic string set in the gin.Context
+// key/value store when the instance making the request was identified by its
+// IP address, rather than by a request header.
+const ContextKeyIdentifiedByIP = "identified-by-ip"
+
+// IPMatchTypeHeader is the response header set when the request IP matched a
+// known instance, reporting whether it matched one of the instance's IP
+// addresses exactly (IPMatchTypeExact) or fell within one of its CIDRs
+// (IPMatchTypeCIDR).
+const IPMatchTypeHeader = "X-IP-Match-Type"
+
+const (
+	// IPMatchTypeExact is the IPMatchTypeHeader value for requests from one
+	// of an instance's IP addresses.
+	IPMatchTypeExact = "exact"
+	// IPMatchTypeCIDR is the IPMatchTypeHeader value for requests from within
+	// one of an instance's CIDRs.
+	IPMatchTypeCIDR = "cidr"
+)
+
 // When a request comes in to the /metadata or /userdata endpoints (or the 2009-04-04/* variants)
-// we need to identify the instance making the request.
-// There's 2 ways to do this:
-// a) (pending) if the request was made with the special auth header that tells
-// us the request is being proxied for the instance through another system
-// (like a switch), use the auth header info to get the instance ID.
-// OR
-// b) via the request ip from the instance making the request.
+// we need to identify the instance making the request. The v1 router tries
+// these InstanceIdentifiers in order, stopping at the first that finds it:
+// a) IdentifyByInstanceIDHeader, if configured: a trusted proxy (like a
+// switch) passes the instance ID in a request header.
+// b) IdentifyByMACHeader, if configured: a trusted proxy passes one of the
+// instance's MAC addresses in a request header, which we look up in the
+// stored metadata.
+// c) IdentifyByIP, unless disabled: we look up the request IP in our
+// instance_ip_addresses table.
 //
-// For case (a), we'll know the instance ID, and can check if we have metadata
-// or userdata stored for that ID. If not, we need to fetch it from an external
-// system.
-// For case (b), we'll look up the instance ID from our instance_ip_addresses
-// table. If there's no rows matching the request IP, we'll know we need to
-// fetch it from an external system.
+// If we don't have metadata or userdata stored for the identified instance, or
+// can't identify it at all, the handlers may fetch it from an external system.
+
+// InstanceIdentifier tries to identify the instance making a request,
+// returning its ID, or an empty string if it can't. An error means the
+// identifier couldn't do its job, rather than that the instance is unknown.
+type InstanceIdentifier func(c *gin.Context) (string, error)
 
 // IdentifyInstanceByIP is used to determine the ID of the instance making the
 // request by looking at the request IP.
 // If a row in the instance_ip_addresses table is found with a matching IP
 // address, we set the instance ID in the context.
 func IdentifyInstanceByIP(logger *zap.Logger, db *sqlx.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		var (
-			address           string
-			instanceIPAddress *models.InstanceIPAddress
-			err               error
-		)
+	return IdentifyInstance(logger, IdentifyByIP(db))
+}
 
+// IdentifyInstance is used to determine the ID of the instance making the
+// request by trying each of the identifiers in order, until one of them
+// identifies the instance. The instance ID is then set in the context.
+// The request IP is always set in the context when it can be resolved, no
+// matter which identifier identifies the instance, normalized by normalizeIP.
+func IdentifyInstance(logger *zap.Logger, identifiers ...InstanceIdentifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
 		// When trusted proxies are configured in gin, ClientIP() will use the
 		// X-Forwarded-For or X-Real-Ip headers (if present) to report the remote
 		// IP. If trusted proxies are not configured, these headers will be ignored
@@ -61,20 +92,208 @@ func IdentifyInstanceByIP(logger *zap.Logger, db *sqlx.DB) gin.HandlerFunc {
 		// Use the `gin-trusted-proxies` flag
 		// (or METADATASERVICE_GIN_TRUSTED_PROXIES envvar) when starting the server
 		// to provide the list of trusted proxy IP's to use.
-		address = c.ClientIP()
+		address := c.ClientIP()
+
+		// A misconfigured proxy setup can leave us without a usable client IP.
+		// Querying with it would only error, so leave the requestor IP unset
+		// and let the handler decide how to respond.
+		if addr, err := netip.ParseAddr(address); err != nil {
+			logger.Warn("unable to resolve client IP address", zap.String("client_ip", address), zap.String("remote_addr", c.Request.RemoteAddr))
+			MetricUnresolvedClientIP.Inc()
+		} else {
+			c.Set(ContextKeyRequestorIP, normalizeIP(addr))
+		}
+
+		for _, identify := range identifiers {
+			instanceID, err := identify(c)
+			if err != nil {
+				logger.Error("error identifying instance", zap.Error(err))
+
+				c.AbortWithStatus(http.StatusInternalServerError)
+
+				return
+			}
+
+			if instanceID != "" {
+				MetricRequestInstanceResolved.Inc()
+
+				// We found the instance, set the instance ID into the gin context.
+				c.Set(ContextKeyInstanceID, instanceID)
+
+				return
+			}
+		}
+
+		if c.GetString(ContextKeyRequestorIP) != "" {
+			MetricRequestInstanceUnresolved.Inc()
+		}
+	}
+}
+
+// IdentifyByIP returns an InstanceIdentifier which identifies the instance by
+// the request IP, using the instance_ip_addresses table, or the
+// InstanceIPCache if it's enabled and has the request IP. It also sets the
+// IPMatchTypeHeader and ContextKeyIdentifiedByIP when a match is found.
+//
+// Stored addresses are matched with the inet "contains or equals" operator
+// (address >>= request IP), which compares the request IP against the
+// network part of the stored address only: the stored prefix length is
+// applied to both, and any host bits set in the stored address are ignored.
+// So a stored "2604:1380:4641:1f00::9/127" matches requests from both
+// 2604:1380:4641:1f00::8 and 2604:1380:4641:1f00::9, no matter which of
+// the two the instance was assigned, and a stored address without a prefix
+// length only matches that exact IP address. Addresses of different families
+// never match, which is why the request IP is normalized by IdentifyInstance
+// first.
+func IdentifyByIP(db *sqlx.DB) InstanceIdentifier {
+	return func(c *gin.Context) (string, error) {
+		address := c.GetString(ContextKeyRequestorIP)
+		if address == "" {
+			return "", nil
+		}
+
+		cache := InstanceIPCache()
+
+		instanceID, matchedAddress, ok := cache.Get(address)
+		if !ok {
+			instanceIPAddress, err := models.InstanceIPAddresses(qm.Where("address >>= ?::inet", address)).One(c, db)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return "", nil
+				}
+
+				return "", fmt.Errorf("looking up instance address: %w", err)
+			}
+
+			instanceID, matchedAddress = instanceIPAddress.InstanceID, instanceIPAddress.Address
+
+			cache.Set(address, instanceID, matchedAddress)
+		}
+
+		c.Header(IPMatchTypeHeader, ipMatchType(matchedAddress))
+		c.Set(ContextKeyIdentifiedByIP, true)
+
+		return instanceID, nil
+	}
+}
 
-		c.Set(ContextKeyRequestorIP, address)
+// ParseTrustedProxies parses the IP addresses and CIDRs of trusted proxies,
+// in the form accepted by gin's SetTrustedProxies.
+func ParseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
 
-		instanceIPAddress, err = models.InstanceIPAddresses(qm.Where("address >>= ?::inet", address)).One(c, db)
-		if err != nil && !errors.Is(err, sql.ErrNoRows) {
-			logger.Error("error looking up instance address", zap.Error(err))
+	for _, proxy := range proxies {
+		prefix, err := parseAddressPrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
+
+// IdentifyByInstanceIDHeader returns an InstanceIdentifier which takes the
+// instance ID from the given request header, as set by a trusted proxy. The
+// header is ignored unless the request came straight from one of the
+// trustedProxies, and holds a UUID.
+func IdentifyByInstanceIDHeader(header string, trustedProxies []netip.Prefix) InstanceIdentifier {
+	return func(c *gin.Context) (string, error) {
+		if !fromTrustedProxy(c, trustedProxies) {
+			return "", nil
+		}
+
+		instanceID, err := uuid.Parse(c.GetHeader(header))
+		if err != nil {
+			return "", nil //nolint:nilerr // a missing or invalid header just doesn't identify the instance
+		}
+
+		return instanceID.String(), nil
+	}
+}
+
+// macLookupLimit is the number of instances looked up by MAC address, which
+// is enough to tell whether the address belongs to a single instance.
+const macLookupLimit = 2
+
+// IdentifyByMACHeader returns an InstanceIdentifier which identifies the
+// instance by the MAC address in the given request header, as set by a
+// trusted proxy, by matching it against the "mac" of the interfaces in the
+// stored metadata's "network.interfaces". A MAC address stored for more than
+// one instance doesn't identify either of them. Like with
+// IdentifyByInstanceIDHeader, the header is ignored unless the request came
+// straight from one of the trustedProxies.
+// The lookup is served by the inverted index on the stored metadata's
+// "network.interfaces".
+func IdentifyByMACHeader(db *sqlx.DB, header string, trustedProxies []netip.Prefix) InstanceIdentifier {
+	return func(c *gin.Context) (string, error) {
+		if !fromTrustedProxy(c, trustedProxies) {
+			return "", nil
+		}
+
+		mac, err := net.ParseMAC(c.GetHeader(header))
+		if err != nil {
+			return "", nil //nolint:nilerr // a missing or invalid header just doesn't identify the instance
+		}
 
-			c.AbortWithStatus(http.StatusInternalServerError)
+		interfaces, err := json.Marshal([]map[string]string{{"mac": mac.String()}})
+		if err != nil {
+			return "", err
 		}
 
-		if instanceIPAddress != nil {
-			// We found the row, set the instnace ID into the gin context.
-			c.Set(ContextKeyInstanceID, instanceIPAddress.InstanceID)
+		instances, err := models.InstanceMetadata(
+			qm.Select(models.InstanceMetadatumColumns.ID),
+			qm.Where("metadata->'network'->'interfaces' @> ?::jsonb", string(interfaces)),
+			qm.Limit(macLookupLimit),
+		).All(c, db)
+		if err != nil {
+			return "", fmt.Errorf("looking up instance by MAC address: %w", err)
 		}
+
+		if len(instances) != 1 {
+			return "", nil
+		}
+
+		return instances[0].ID, nil
 	}
 }
+
+// fromTrustedProxy reports whether the request's peer, rather than the client
+// IP it may be forwarding for, is one of the trustedProxies.
+func fromTrustedProxy(c *gin.Context, trustedProxies []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(c.RemoteIP())
+	if err != nil {
+		return false
+	}
+
+	addr = addr.Unmap().WithZone("")
+
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizeIP returns the canonical form of a request IP address, as
+// compared against the stored addresses. IPv4-mapped IPv6 addresses, like
+// "::ffff:10.0.0.1", which a proxy may report for an IPv4 client, are
+// unmapped to their IPv4 address, and IPv6 addresses are written in their
+// shortest, lowercase form. Zones are dropped.
+func normalizeIP(addr netip.Addr) string {
+	return addr.Unmap().WithZone("").String()
+}
+
+// ipMatchType returns how a request IP matched the given stored address: the
+// stored address is either a single IP address, or a CIDR containing it.
+func ipMatchType(address string) string {
+	prefix, err := netip.ParsePrefix(address)
+	if err != nil || prefix.Bits() == prefix.Addr().BitLen() {
+		return IPMatchTypeExact
+	}
+
+	return IPMatchTypeCIDR
+}
@@ -7,13 +7,21 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"github.com/volatiletech/sqlboiler/v4/types"
 	"go.uber.org/zap"
 
 	"go.hollow.sh/metadataservice/internal/dbtools"
 	"go.hollow.sh/metadataservice/internal/middleware"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/upserter"
 )
 
 func TestIdentifyInstanceByIP(t *testing.T) {
@@ -92,11 +100,22 @@ func TestIdentifyInstanceByIP(t *testing.T) {
 				c.JSON(http.StatusOK, "ok")
 			})
 
+			resolvedBefore := testutil.ToFloat64(middleware.MetricRequestInstanceResolved)
+			unresolvedBefore := testutil.ToFloat64(middleware.MetricRequestInstanceUnresolved)
+
 			w := httptest.NewRecorder()
 			ctx := context.TODO()
 			req, _ := http.NewRequestWithContext(ctx, "GET", "http://test/", nil)
 			req.RemoteAddr = net.JoinHostPort(testcase.clientIP, "0")
 			r.ServeHTTP(w, req)
+
+			if testcase.shouldFindInstance {
+				assert.Equal(t, resolvedBefore+1, testutil.ToFloat64(middleware.MetricRequestInstanceResolved))
+				assert.Equal(t, unresolvedBefore, testutil.ToFloat64(middleware.MetricRequestInstanceUnresolved))
+			} else {
+				assert.Equal(t, resolvedBefore, testutil.ToFloat64(middleware.MetricRequestInstanceResolved))
+				assert.Equal(t, unresolvedBefore+1, testutil.ToFloat64(middleware.MetricRequestInstanceUnresolved))
+			}
 		})
 	}
 }
@@ -133,3 +152,365 @@ func TestIdentifyInstanceByIPWithTrustedProxies(t *testing.T) {
 	req.Header.Add("X-Forwarded-For", hostAIP)
 	r.ServeHTTP(w, req)
 }
+
+func TestIdentifyInstanceByIPUnresolvedClientIP(t *testing.T) {
+	// The database is never queried when the client IP can't be resolved, so
+	// no test database is needed.
+	r := gin.New()
+	r.Use(middleware.IdentifyInstanceByIP(zap.NewNop(), nil))
+	r.GET("/", func(c *gin.Context) {
+		_, found := c.Get(middleware.ContextKeyRequestorIP)
+		assert.False(t, found)
+
+		_, found = c.Get(middleware.ContextKeyInstanceID)
+		assert.False(t, found)
+
+		c.Status(http.StatusOK)
+	})
+
+	before := testutil.ToFloat64(middleware.MetricUnresolvedClientIP)
+	unresolvedBefore := testutil.ToFloat64(middleware.MetricRequestInstanceUnresolved)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), "GET", "http://test/", nil)
+	req.RemoteAddr = ""
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, before+1, testutil.ToFloat64(middleware.MetricUnresolvedClientIP))
+	assert.Equal(t, unresolvedBefore, testutil.ToFloat64(middleware.MetricRequestInstanceUnresolved))
+}
+
+func TestIdentifyInstanceByIPMatchType(t *testing.T) {
+	testdb := dbtools.DatabaseTest(t)
+
+	type testCase struct {
+		testName          string
+		clientIP          string
+		expectedMatchType string
+	}
+
+	// Instance A is associated to 139.178.82.3 itself, and to the
+	// 10.70.17.8/31 and 2604:1380:4641:1f00::8/127 CIDRs.
+	testCases := []testCase{
+		{"exact IPv4 address", "139.178.82.3", middleware.IPMatchTypeExact},
+		{"IPv4 address within a CIDR", "10.70.17.9", middleware.IPMatchTypeCIDR},
+		{"IPv6 address within a CIDR", "2604:1380:4641:1f00::8", middleware.IPMatchTypeCIDR},
+		{"unknown address", "1.2.3.4", ""},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			r := gin.New()
+			r.Use(middleware.IdentifyInstanceByIP(zap.NewNop(), testdb))
+			r.GET("/", func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(context.TODO(), "GET", "http://test/", nil)
+			req.RemoteAddr = net.JoinHostPort(testcase.clientIP, "0")
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedMatchType, w.Header().Get(middleware.IPMatchTypeHeader))
+		})
+	}
+}
+
+func TestIdentifyInstanceChain(t *testing.T) {
+	testdb := dbtools.DatabaseTest(t)
+
+	// The fixtures all share the same MAC addresses, so add an instance with
+	// one of its own.
+	macInstanceID := "5f1c2d3e-4b5a-4c6d-8e7f-9a0b1c2d3e4f"
+
+	macInstance := &models.InstanceMetadatum{
+		ID:       macInstanceID,
+		Metadata: types.JSON(`{"network": {"interfaces": [{"name": "eth0", "mac": "52:54:00:aa:bb:01"}]}}`),
+	}
+	require.NoError(t, macInstance.Insert(context.TODO(), testdb, boil.Infer()))
+
+	headerInstanceID := "0e9d8c7b-6a5f-4e3d-9c2b-1a0f9e8d7c6b"
+	instanceAIP := dbtools.FixtureInstanceA.HostIPs[0]
+
+	type testCase struct {
+		testName           string
+		clientIP           string
+		instanceIDHeader   string
+		macHeader          string
+		expectedInstanceID string
+	}
+
+	testCases := []testCase{
+		{"IP only", instanceAIP, "", "", dbtools.FixtureInstanceA.InstanceID},
+		{"instance ID header", instanceAIP, headerInstanceID, "", headerInstanceID},
+		{"invalid instance ID header falls back to the IP", instanceAIP, "not-a-uuid", "", dbtools.FixtureInstanceA.InstanceID},
+		{"MAC header", instanceAIP, "", "52-54-00-AA-BB-01", macInstanceID},
+		{"instance ID header before the MAC header", instanceAIP, headerInstanceID, "52:54:00:aa:bb:01", headerInstanceID},
+		{"MAC address shared by instances falls back to the IP", instanceAIP, "", "40:a6:b7:74:9f:10", dbtools.FixtureInstanceA.InstanceID},
+		{"unknown MAC address and IP", "1.2.3.4", "", "52:54:00:aa:bb:02", ""},
+	}
+
+	// The headers are set by the proxy, which forwards the client IP.
+	proxyIP := "10.0.0.1"
+
+	trustedProxies, err := middleware.ParseTrustedProxies([]string{proxyIP})
+	require.NoError(t, err)
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			r := gin.New()
+			require.NoError(t, r.SetTrustedProxies([]string{proxyIP}))
+			r.Use(middleware.IdentifyInstance(zap.NewNop(),
+				middleware.IdentifyByInstanceIDHeader("X-Instance-ID", trustedProxies),
+				middleware.IdentifyByMACHeader(testdb, "X-Instance-MAC", trustedProxies),
+				middleware.IdentifyByIP(testdb),
+			))
+			r.GET("/", func(c *gin.Context) {
+				assert.Equal(t, testcase.clientIP, c.GetString(middleware.ContextKeyRequestorIP))
+				assert.Equal(t, testcase.expectedInstanceID, c.GetString(middleware.ContextKeyInstanceID))
+
+				c.Status(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(context.TODO(), "GET", "http://test/", nil)
+			req.RemoteAddr = net.JoinHostPort(proxyIP, "0")
+			req.Header.Set("X-Forwarded-For", testcase.clientIP)
+
+			if testcase.instanceIDHeader != "" {
+				req.Header.Set("X-Instance-ID", testcase.instanceIDHeader)
+			}
+
+			if testcase.macHeader != "" {
+				req.Header.Set("X-Instance-MAC", testcase.macHeader)
+			}
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+	}
+}
+
+func TestIdentifyInstanceWithoutIP(t *testing.T) {
+	trustedProxies, err := middleware.ParseTrustedProxies([]string{"10.0.0.0/24"})
+	require.NoError(t, err)
+
+	// Only the instance ID header is used, so no test database is needed.
+	r := gin.New()
+	r.Use(middleware.IdentifyInstance(zap.NewNop(), middleware.IdentifyByInstanceIDHeader("X-Instance-ID", trustedProxies)))
+	r.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString(middleware.ContextKeyInstanceID))
+	})
+
+	instanceID := "0e9d8c7b-6a5f-4e3d-9c2b-1a0f9e8d7c6b"
+
+	type testCase struct {
+		testName   string
+		remoteIP   string
+		header     string
+		expectedID string
+	}
+
+	testCases := []testCase{
+		{"trusted proxy", "10.0.0.1", instanceID, instanceID},
+		{"trusted proxy with an IPv4-mapped address", "::ffff:10.0.0.1", instanceID, instanceID},
+		{"trusted proxy without the header", "10.0.0.1", "", ""},
+		{"untrusted peer", "1.2.3.4", instanceID, ""},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(context.TODO(), "GET", "http://test/", nil)
+			req.RemoteAddr = net.JoinHostPort(testcase.remoteIP, "0")
+			req.Header.Set("X-Instance-ID", testcase.header)
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedID, w.Body.String())
+		})
+	}
+}
+
+func TestIdentifyInstanceWithoutTrustedProxies(t *testing.T) {
+	// Without trusted proxies, the header is never honoured.
+	r := gin.New()
+	r.Use(middleware.IdentifyInstance(zap.NewNop(), middleware.IdentifyByInstanceIDHeader("X-Instance-ID", nil)))
+	r.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString(middleware.ContextKeyInstanceID))
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), "GET", "http://test/", nil)
+	req.RemoteAddr = net.JoinHostPort("10.0.0.1", "0")
+	req.Header.Set("X-Instance-ID", "0e9d8c7b-6a5f-4e3d-9c2b-1a0f9e8d7c6b")
+	r.ServeHTTP(w, req)
+
+	assert.Empty(t, w.Body.String())
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	prefixes, err := middleware.ParseTrustedProxies([]string{"10.0.0.1", "10.1.0.0/16", "2001:db8::/64"})
+	require.NoError(t, err)
+	assert.Len(t, prefixes, 3)
+
+	_, err = middleware.ParseTrustedProxies([]string{"10.0.0.1", "proxy.example.com"})
+	assert.Error(t, err)
+}
+
+func TestIdentifyInstanceByIPCached(t *testing.T) {
+	instanceID := "0e9d8c7b-6a5f-4e3d-9c2b-1a0f9e8d7c6b"
+
+	cache := middleware.NewIPCache(10, time.Minute)
+	cache.Set("10.70.17.9", instanceID, "10.70.17.8/31")
+
+	middleware.SetInstanceIPCache(cache)
+	t.Cleanup(func() { middleware.SetInstanceIPCache(nil) })
+
+	// Cached IP addresses never query the database, so no test database is
+	// needed.
+	r := gin.New()
+	r.Use(middleware.IdentifyInstanceByIP(zap.NewNop(), nil))
+	r.GET("/", func(c *gin.Context) {
+		assert.True(t, c.GetBool(middleware.ContextKeyIdentifiedByIP))
+		c.String(http.StatusOK, c.GetString(middleware.ContextKeyInstanceID))
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), "GET", "http://test/", nil)
+	req.RemoteAddr = net.JoinHostPort("10.70.17.9", "0")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, instanceID, w.Body.String())
+	assert.Equal(t, middleware.IPMatchTypeCIDR, w.Header().Get(middleware.IPMatchTypeHeader))
+}
+
+func TestIdentifyInstanceByIPCacheInvalidation(t *testing.T) {
+	testdb := dbtools.DatabaseTest(t)
+
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	middleware.SetInstanceIPCache(middleware.NewIPCache(10, time.Minute))
+	t.Cleanup(func() { middleware.SetInstanceIPCache(nil) })
+
+	r := gin.New()
+	r.Use(middleware.IdentifyInstanceByIP(zap.NewNop(), testdb))
+	r.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString(middleware.ContextKeyInstanceID))
+	})
+
+	clientIP := "139.178.82.3"
+
+	identify := func() string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequestWithContext(context.TODO(), "GET", "http://test/", nil)
+		req.RemoteAddr = net.JoinHostPort(clientIP, "0")
+		r.ServeHTTP(w, req)
+
+		return w.Body.String()
+	}
+
+	assert.Equal(t, dbtools.FixtureInstanceA.InstanceID, identify())
+
+	// Remove the IP address behind the cache's back. The second request is
+	// still identified, so it can't have queried the database.
+	_, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.Address.EQ(clientIP)).DeleteAll(context.TODO(), testdb)
+	require.NoError(t, err)
+
+	assert.Equal(t, dbtools.FixtureInstanceA.InstanceID, identify())
+
+	// Upserting another instance with the IP address evicts it from the cache.
+	newInstanceID := "3f8a1c2e-5b6d-4e7f-8a9b-0c1d2e3f4a5b"
+
+	_, err = upserter.UpsertMetadata(context.TODO(), testdb, zap.NewNop(), newInstanceID, []string{clientIP}, &models.InstanceMetadatum{
+		ID:       newInstanceID,
+		Metadata: types.JSON(`{}`),
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, newInstanceID, identify())
+}
+
+func TestIdentifyInstanceNormalizesClientIP(t *testing.T) {
+	proxyIP := "192.0.2.1"
+
+	// No identifiers are used, so no test database is needed.
+	r := gin.New()
+	require.NoError(t, r.SetTrustedProxies([]string{proxyIP}))
+
+	r.Use(middleware.IdentifyInstance(zap.NewNop()))
+	r.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString(middleware.ContextKeyRequestorIP))
+	})
+
+	type testCase struct {
+		testName     string
+		forwardedFor string
+		expectedIP   string
+	}
+
+	testCases := []testCase{
+		{"IPv4 address", "10.70.17.9", "10.70.17.9"},
+		{"IPv4-mapped IPv6 address", "::ffff:10.70.17.9", "10.70.17.9"},
+		{"expanded IPv6 address", "2604:1380:4641:1F00:0:0:0:9", "2604:1380:4641:1f00::9"},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(context.TODO(), "GET", "http://test/", nil)
+			req.RemoteAddr = net.JoinHostPort(proxyIP, "0")
+			req.Header.Set("X-Forwarded-For", testcase.forwardedFor)
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedIP, w.Body.String())
+		})
+	}
+}
+
+func TestIdentifyInstanceByIPv6CIDR(t *testing.T) {
+	testdb := dbtools.DatabaseTest(t)
+
+	// A point-to-point /127, stored by its first address. The instance may
+	// source its traffic from either address in the block.
+	instanceID := "7c2e4a91-3d5b-4f6e-8a1c-9b0d2e3f4a5c"
+
+	instanceIPAddress := &models.InstanceIPAddress{
+		InstanceID: instanceID,
+		Address:    "2001:db8:10::/127",
+	}
+	require.NoError(t, instanceIPAddress.Insert(context.TODO(), testdb, boil.Infer()))
+
+	type testCase struct {
+		testName           string
+		clientIP           string
+		expectedInstanceID string
+		expectedMatchType  string
+	}
+
+	testCases := []testCase{
+		{"first address in the block", "2001:db8:10::", instanceID, middleware.IPMatchTypeCIDR},
+		{"second address in the block", "2001:db8:10::1", instanceID, middleware.IPMatchTypeCIDR},
+		{"address after the block", "2001:db8:10::2", "", ""},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			r := gin.New()
+			r.Use(middleware.IdentifyInstanceByIP(zap.NewNop(), testdb))
+			r.GET("/", func(c *gin.Context) {
+				c.String(http.StatusOK, c.GetString(middleware.ContextKeyInstanceID))
+			})
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(context.TODO(), "GET", "http://test/", nil)
+			req.RemoteAddr = net.JoinHostPort(testcase.clientIP, "0")
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedInstanceID, w.Body.String())
+			assert.Equal(t, testcase.expectedMatchType, w.Header().Get(middleware.IPMatchTypeHeader))
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package middleware
+
+import (
+	"container/list"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IPCache is an in-process LRU cache of the instances identified by request
+// IP addresses, sparing IdentifyByIP a DB query for repeat requests from the
+// same IP address. Only IP addresses matching an instance are cached. Entries
+// expire after the cache's TTL, and are evicted early by Invalidate when the
+// instance_ip_addresses rows they were found with change.
+// A nil *IPCache is a valid, always empty, cache.
+type IPCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type ipCacheEntry struct {
+	ip         string
+	instanceID string
+	address    string
+	expiresAt  time.Time
+}
+
+// NewIPCache returns a cache holding up to size IP addresses, each for up to
+// ttl, or until evicted if ttl is zero or less. A size of zero or less
+// returns nil, which caches nothing.
+func NewIPCache(size int, ttl time.Duration) *IPCache {
+	if size <= 0 {
+		return nil
+	}
+
+	return &IPCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element, size),
+		order:   list.New(),
+	}
+}
+
+// Get returns the ID of the instance identified by the IP address, and the
+// stored address (an IP address or CIDR) it matched, if they're cached and
+// haven't expired.
+func (c *IPCache) Get(ip string) (instanceID, address string, ok bool) {
+	if c == nil {
+		return "", "", false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[ip]
+	if !ok {
+		return "", "", false
+	}
+
+	entry := elem.Value.(*ipCacheEntry)
+
+	if c.ttl > 0 && time.Now().After(entry.expiresAt) {
+		c.remove(elem)
+		return "", "", false
+	}
+
+	c.order.MoveToFront(elem)
+
+	return entry.instanceID, entry.address, true
+}
+
+// Set caches the ID of the instance identified by the IP address, along with
+// the stored address it matched, evicting the least recently used IP address
+// if the cache is full.
+func (c *IPCache) Set(ip, instanceID, address string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &ipCacheEntry{
+		ip:         ip,
+		instanceID: instanceID,
+		address:    address,
+		expiresAt:  time.Now().Add(c.ttl),
+	}
+
+	if elem, ok := c.entries[ip]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+
+		return
+	}
+
+	c.entries[ip] = c.order.PushFront(entry)
+
+	if c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// Invalidate evicts the IP addresses identifying the instance, and the IP
+// addresses within any of the given addresses (IP addresses or CIDRs), so
+// that they're looked up again after the instance's IP addresses change, or
+// the addresses are taken by another instance. It scans the whole cache, so
+// it's meant to be called on writes, not on every request.
+func (c *IPCache) Invalidate(instanceID string, addresses ...string) {
+	if c == nil {
+		return
+	}
+
+	prefixes := make([]netip.Prefix, 0, len(addresses))
+
+	for _, address := range addresses {
+		if prefix, err := parseAddressPrefix(address); err == nil {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for elem := c.order.Front(); elem != nil; {
+		next := elem.Next()
+		entry := elem.Value.(*ipCacheEntry)
+
+		if entry.instanceID == instanceID || prefixesContain(prefixes, entry.ip) {
+			c.remove(elem)
+		}
+
+		elem = next
+	}
+}
+
+// Len returns the number of cached IP addresses, including any which have
+// expired but haven't been evicted yet.
+func (c *IPCache) Len() int {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+func (c *IPCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*ipCacheEntry).ip)
+}
+
+// parseAddressPrefix parses an instance_ip_addresses address, which is either
+// a single IP address or a CIDR.
+func parseAddressPrefix(address string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(address); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(address)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return prefix.Masked(), nil
+}
+
+func prefixesContain(prefixes []netip.Prefix, ip string) bool {
+	if len(prefixes) == 0 {
+		return false
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// instanceIPCache is the cache used by IdentifyByIP. It's nil (disabled)
+// unless SetInstanceIPCache is called.
+var instanceIPCache atomic.Pointer[IPCache]
+
+// SetInstanceIPCache sets the cache used by IdentifyByIP to identify
+// instances by their IP address. A nil cache disables caching.
+// The cache is only invalidated by writes made by this process, so with
+// several replicas, a replica may identify an instance by an IP address
+// moved to another instance through a different replica until the entry
+// expires.
+func SetInstanceIPCache(cache *IPCache) {
+	instanceIPCache.Store(cache)
+}
+
+// InstanceIPCache returns the cache set by SetInstanceIPCache, which is nil
+// if caching is disabled. Writes to the instance_ip_addresses table should
+// call its Invalidate once they've been committed.
+func InstanceIPCache() *IPCache {
+	return instanceIPCache.Load()
+}
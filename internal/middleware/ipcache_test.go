@@ -0,0 +1,96 @@
+package middleware_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+)
+
+func TestIPCache(t *testing.T) {
+	cache := middleware.NewIPCache(2, time.Minute)
+
+	cache.Set("10.0.0.1", "instance-a", "10.0.0.1")
+	cache.Set("10.0.1.1", "instance-b", "10.0.1.0/24")
+
+	instanceID, address, ok := cache.Get("10.0.1.1")
+	assert.True(t, ok)
+	assert.Equal(t, "instance-b", instanceID)
+	assert.Equal(t, "10.0.1.0/24", address)
+
+	_, _, ok = cache.Get("10.0.0.2")
+	assert.False(t, ok)
+
+	// 10.0.0.1 is now the least recently used, so it's evicted to make room.
+	cache.Set("10.0.2.1", "instance-c", "10.0.2.1")
+	assert.Equal(t, 2, cache.Len())
+
+	_, _, ok = cache.Get("10.0.0.1")
+	assert.False(t, ok)
+
+	_, _, ok = cache.Get("10.0.1.1")
+	assert.True(t, ok)
+}
+
+func TestIPCacheExpiry(t *testing.T) {
+	cache := middleware.NewIPCache(10, time.Millisecond)
+
+	cache.Set("10.0.0.1", "instance-a", "10.0.0.1")
+	time.Sleep(5 * time.Millisecond)
+
+	_, _, ok := cache.Get("10.0.0.1")
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestIPCacheInvalidate(t *testing.T) {
+	type testCase struct {
+		testName     string
+		instanceID   string
+		addresses    []string
+		remainingIPs []string
+	}
+
+	testCases := []testCase{
+		{"by instance ID", "instance-a", nil, []string{"10.0.1.1", "2001:db8::1"}},
+		{"by IP address", "instance-x", []string{"10.0.1.1"}, []string{"10.0.0.1", "10.0.0.2", "2001:db8::1"}},
+		{"by CIDR", "instance-x", []string{"10.0.0.0/16"}, []string{"2001:db8::1"}},
+		{"by IPv6 CIDR", "instance-x", []string{"2001:db8::/127"}, []string{"10.0.0.1", "10.0.0.2", "10.0.1.1"}},
+		{"invalid addresses are ignored", "instance-x", []string{"bogus"}, []string{"10.0.0.1", "10.0.0.2", "10.0.1.1", "2001:db8::1"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			cache := middleware.NewIPCache(10, time.Minute)
+
+			cache.Set("10.0.0.1", "instance-a", "10.0.0.0/31")
+			cache.Set("10.0.0.2", "instance-a", "10.0.0.2")
+			cache.Set("10.0.1.1", "instance-b", "10.0.1.1")
+			cache.Set("2001:db8::1", "instance-c", "2001:db8::/127")
+
+			cache.Invalidate(tc.instanceID, tc.addresses...)
+
+			assert.Equal(t, len(tc.remainingIPs), cache.Len())
+
+			for _, ip := range tc.remainingIPs {
+				_, _, ok := cache.Get(ip)
+				assert.True(t, ok, ip)
+			}
+		})
+	}
+}
+
+func TestIPCacheDisabled(t *testing.T) {
+	cache := middleware.NewIPCache(0, time.Minute)
+	assert.Nil(t, cache)
+
+	// A nil cache never has anything, and is safe to use.
+	cache.Set("10.0.0.1", "instance-a", "10.0.0.1")
+	cache.Invalidate("instance-a")
+
+	_, _, ok := cache.Get("10.0.0.1")
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.Len())
+}
@@ -30,6 +30,38 @@ var (
 		Help: "Number of userdata requests not found in the db that needed to be sent to the lookup service.",
 	})
 
+	// MetricRequestInstanceResolved total number of public requests from an IP address associated to a known instance
+	MetricRequestInstanceResolved = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "metadata_request_instance_resolved_total",
+		Help: "Number of metadata and userdata requests whose IP address matched a known instance.",
+	})
+
+	// MetricRequestInstanceUnresolved total number of public requests from an IP address not associated to any known instance
+	MetricRequestInstanceUnresolved = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "metadata_request_instance_unresolved_total",
+		Help: "Number of metadata and userdata requests whose IP address didn't match any known instance.",
+	})
+
+	// MetricUnresolvedClientIP total number of public requests without a resolvable client IP address
+	MetricUnresolvedClientIP = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "metadata_unresolved_client_ip_total",
+		Help: "Number of metadata and userdata requests whose client IP address couldn't be resolved.",
+	})
+
+	// MetricIPOwnershipUnverified total number of public requests whose IP
+	// address matched an instance, but isn't listed in the instance's metadata
+	MetricIPOwnershipUnverified = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "metadata_ip_ownership_unverified_total",
+		Help: "Number of metadata and userdata requests refused because the request IP address isn't listed in the identified instance's metadata.",
+	})
+
+	// MetricFingerprintMismatch total number of public metadata requests
+	// which didn't present the identified instance's fingerprint
+	MetricFingerprintMismatch = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "metadata_fingerprint_mismatch_total",
+		Help: "Number of metadata requests refused because they didn't present the fingerprint stored in the identified instance's metadata.",
+	})
+
 	// MetricMetadataLookupRequestCount total number of metadata requests sent to the external lookup service
 	MetricMetadataLookupRequestCount = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "metadata_lookup_request_total",
@@ -60,6 +92,30 @@ var (
 		Help: "Number of metadata deletions (which originate from the API).",
 	})
 
+	// MetricMetadataRecordDeletionsCount total number of instance_metadata records deleted (which originate from the API)
+	MetricMetadataRecordDeletionsCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "metadata_record_deletions_total",
+		Help: "Number of instance_metadata records deleted (which originate from the API).",
+	})
+
+	// MetricUserdataDeletionsCount total number of instance_userdata records deleted (which originate from the API)
+	MetricUserdataDeletionsCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "metadata_userdata_deletions_total",
+		Help: "Number of instance_userdata records deleted (which originate from the API).",
+	})
+
+	// MetricIPAddressDeletionsCount total number of instance_ip_addresses rows deleted as part of a metadata or userdata deletion
+	MetricIPAddressDeletionsCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "metadata_ip_address_deletions_total",
+		Help: "Number of instance_ip_addresses rows deleted as part of a metadata or userdata deletion.",
+	})
+
+	// MetricDeletionRetriesExhausted total number of deletions that failed even after exhausting all retries
+	MetricDeletionRetriesExhausted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "metadata_deletion_retries_exhausted_total",
+		Help: "Number of deletion operations that failed even after exhausting all retries.",
+	})
+
 	// MetricLookupErrors total number of errors produced during external lookup requests
 	MetricLookupErrors = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "metadata_lookup_error_total",
@@ -83,4 +139,59 @@ var (
 		Name: "metadata_userdata_store_error_total",
 		Help: "Number of errors produced while saving or updating userdata to the database.",
 	})
+
+	// MetricLookupTimeouts total number of lookup service requests which exceeded the lookup request timeout
+	MetricLookupTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "metadata_lookup_timeout_total",
+		Help: "Number of lookup service requests which timed out, counting each attempt.",
+	})
+
+	// MetricLookupsThrottled total number of upstream lookups rejected by the lookup rate limiter
+	MetricLookupsThrottled = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "metadata_lookup_throttled_total",
+		Help: "Number of upstream lookups that failed because the lookup rate limit was exceeded.",
+	})
+
+	// MetricRateLimitedRequestCount total number of requests rejected by a rate limiter
+	MetricRateLimitedRequestCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "metadata_rate_limited_request_total",
+		Help: "Number of requests rejected with a 429 by a rate limiter.",
+	})
+
+	// MetricOversizedAuthorizationCount total number of requests rejected because of an oversized Authorization header
+	MetricOversizedAuthorizationCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "metadata_oversized_authorization_total",
+		Help: "Number of requests rejected with a 431 because their Authorization header exceeded the maximum size.",
+	})
+
+	// MetricTimedOutRequestCount total number of requests which exceeded their route timeout
+	MetricTimedOutRequestCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "metadata_timed_out_request_total",
+		Help: "Number of requests answered with a 504 because they exceeded their route timeout.",
+	})
+
+	// MetricUpsertDuration time taken by metadata and userdata upserts, including any retries
+	MetricUpsertDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "metadata_upsert_duration_seconds",
+		Help:    "Time taken to upsert metadata or userdata records along with their IP addresses, including any retries.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"record_type"})
+
+	// MetricUpsertRetries total number of metadata and userdata upsert attempts which were retries
+	MetricUpsertRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "metadata_upsert_retries_total",
+		Help: "Number of metadata or userdata upsert transactions retried after a failed attempt.",
+	}, []string{"record_type"})
+
+	// MetricUpsertRetryExhausted total number of upserts that failed even after exhausting all retries
+	MetricUpsertRetryExhausted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "metadata_upsert_retries_exhausted_total",
+		Help: "Number of metadata or userdata upserts that failed even after exhausting all retries.",
+	}, []string{"record_type"})
+
+	// MetricUpsertRetryBudgetExhausted total number of upserts that failed because the request's retry budget ran out
+	MetricUpsertRetryBudgetExhausted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "metadata_upsert_retry_budget_exhausted_total",
+		Help: "Number of metadata or userdata upserts that failed after the request's retry budget ran out, before exhausting all retries.",
+	}, []string{"record_type"})
 )
@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.hollow.sh/toolbox/ginjwt"
+	"golang.org/x/time/rate"
+)
+
+// RateLimitKeyFunc returns the key a request should be rate limited by.
+type RateLimitKeyFunc func(c *gin.Context) string
+
+// rateLimitSweepInterval is how often rateLimiters looks for limiters to
+// evict, at most.
+const rateLimitSweepInterval = time.Minute
+
+// rateLimiters holds a token-bucket rate limiter for each key. Once their
+// bucket has refilled, keys are forgotten, as a new limiter would be just the
+// same, so keys which stop sending requests don't pile up.
+type rateLimiters struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	limiters  map[string]*rate.Limiter
+	lastSweep time.Time
+}
+
+func newRateLimiters(limit rate.Limit, burst int) *rateLimiters {
+	return &rateLimiters{
+		limit:     limit,
+		burst:     burst,
+		limiters:  make(map[string]*rate.Limiter),
+		lastSweep: time.Now(),
+	}
+}
+
+// get returns the limiter for the key, evicting the limiters whose bucket
+// has refilled if they haven't been swept for rateLimitSweepInterval.
+func (l *rateLimiters) get(key string, now time.Time) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		for k, limiter := range l.limiters {
+			if l.limit == rate.Inf || limiter.TokensAt(now) >= float64(l.burst) {
+				delete(l.limiters, k)
+			}
+		}
+
+		l.lastSweep = now
+	}
+
+	limiter, ok := l.limiters[key]
+	if !ok {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[key] = limiter
+	}
+
+	return limiter
+}
+
+// RateLimitByKey returns a middleware which applies a token-bucket rate limit
+// of limit requests per second (with the given burst) to each distinct key
+// returned by keyFunc. Requests over the limit are aborted with a 429, with a
+// Retry-After header set to the number of seconds until the next token is
+// available, rounded up.
+func RateLimitByKey(keyFunc RateLimitKeyFunc, limit rate.Limit, burst int) gin.HandlerFunc {
+	limiters := newRateLimiters(limit, burst)
+
+	return func(c *gin.Context) {
+		now := time.Now()
+
+		reservation := limiters.get(keyFunc(c), now).ReserveN(now, 1)
+
+		if delay := reservation.DelayFrom(now); !reservation.OK() || delay > 0 {
+			// The request isn't going to wait for its token, so give it back.
+			reservation.CancelAt(now)
+
+			MetricRateLimitedRequestCount.Inc()
+
+			if reservation.OK() {
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			}
+
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, &errorResponse{Message: "rate limit exceeded"})
+
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// RateLimitBySubject returns a middleware which rate limits requests by the
+// subject of the JWT used to authenticate them. It must be used after the
+// auth middleware has validated the request.
+func RateLimitBySubject(limit rate.Limit, burst int) gin.HandlerFunc {
+	return RateLimitByKey(ginjwt.GetSubject, limit, burst)
+}
+
+// RateLimitByIP returns a middleware which rate limits requests by the IP
+// address of the caller. It's meant for the unauthenticated public endpoints,
+// ahead of IdentifyInstance, so that a misbehaving instance can't hammer the
+// DB with lookups.
+func RateLimitByIP(limit rate.Limit, burst int) gin.HandlerFunc {
+	return RateLimitByKey(requestorIP, limit, burst)
+}
+
+// requestorIP returns the caller's IP address from ContextKeyRequestorIP,
+// or, before IdentifyInstance has set it, the same client IP address
+// IdentifyInstance resolves.
+func requestorIP(c *gin.Context) string {
+	if address := c.GetString(ContextKeyRequestorIP); address != "" {
+		return address
+	}
+
+	return c.ClientIP()
+}
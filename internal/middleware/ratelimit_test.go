@@ -0,0 +1,148 @@
+package middleware_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+)
+
+func TestRateLimitByKey(t *testing.T) {
+	// Key requests by a header standing in for the JWT subject, so we don't
+	// need to mint tokens to exercise the limiter.
+	subjectFromHeader := func(c *gin.Context) string {
+		return c.GetHeader("X-Test-Subject")
+	}
+
+	r := gin.New()
+	r.POST("/", middleware.RateLimitByKey(subjectFromHeader, 0, 2), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	type testCase struct {
+		testName       string
+		subject        string
+		expectedStatus int
+	}
+
+	// With a burst of 2 and no refill, each subject gets exactly two requests.
+	testCases := []testCase{
+		{"subject A first request", "subject-a", http.StatusOK},
+		{"subject A second request", "subject-a", http.StatusOK},
+		{"subject A over the limit", "subject-a", http.StatusTooManyRequests},
+		{"subject B unaffected by subject A", "subject-b", http.StatusOK},
+		{"subject A still limited", "subject-a", http.StatusTooManyRequests},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, "/", nil)
+			req.Header.Set("X-Test-Subject", testcase.subject)
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+		})
+	}
+}
+
+func TestRateLimitByIP(t *testing.T) {
+	const burst = 3
+
+	r := gin.New()
+	r.GET("/", middleware.RateLimitByIP(1, burst), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		r.ServeHTTP(w, req)
+
+		return w
+	}
+
+	for i := 0; i < burst; i++ {
+		assert.Equal(t, http.StatusOK, request("10.0.0.1:1234").Code)
+	}
+
+	// The next request from the same IP address is over the limit, even from
+	// another port.
+	w := request("10.0.0.1:5678")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"message":"rate limit exceeded"}`, w.Body.String())
+
+	// Other IP addresses have their own limit.
+	assert.Equal(t, http.StatusOK, request("10.0.0.2:1234").Code)
+}
+
+func TestRateLimitRetryAfter(t *testing.T) {
+	// One token every 4 seconds.
+	r := gin.New()
+	r.GET("/", middleware.RateLimitByIP(0.25, 1), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	request := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		r.ServeHTTP(w, req)
+
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, request().Code)
+
+	// Rejected requests don't use up tokens, so each is told to come back
+	// once the next token is available.
+	for i := 0; i < 2; i++ {
+		w := request()
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "4", w.Header().Get("Retry-After"))
+	}
+}
+
+func TestRateLimitersEviction(t *testing.T) {
+	limiters := middleware.NewRateLimiters(1, 2)
+	start := time.Now()
+
+	// Key A uses up its bucket, and key B never uses its own.
+	require.True(t, limiters.Get("a", start).AllowN(start, 2))
+	limiters.Get("b", start)
+
+	assert.Equal(t, 2, limiters.Len())
+
+	// Once swept, the refilled buckets are forgotten, leaving only key C's
+	// new one.
+	limiters.Get("c", start.Add(middleware.RateLimitSweepInterval))
+	assert.Equal(t, 1, limiters.Len())
+}
+
+func TestRateLimitersKeepRefillingBuckets(t *testing.T) {
+	// One token every two minutes, so key A's bucket is still refilling when
+	// swept.
+	limiters := middleware.NewRateLimiters(rate.Every(2*time.Minute), 1)
+	start := time.Now()
+	sweep := start.Add(middleware.RateLimitSweepInterval)
+
+	require.True(t, limiters.Get("a", start).AllowN(start, 1))
+
+	limiters.Get("b", sweep)
+	assert.Equal(t, 2, limiters.Len())
+
+	assert.False(t, limiters.Get("a", sweep).AllowN(sweep, 1))
+}
@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"runtime/debug"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// Recovery returns a middleware which recovers from panics in the handlers,
+// logging the panic along with its stack trace, and responding with a 500.
+// The stack trace is only ever logged. Like the API's other 500 responses,
+// the body only has a generic error, plus the panic value when exposeErrors
+// is set, for debugging.
+func Recovery(logger *zap.Logger, exposeErrors bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+
+			// http.ErrAbortHandler is used to deliberately abort a response,
+			// so leave it to the http server.
+			if p == http.ErrAbortHandler { //nolint:errorlint,goerr113 // the panic value is compared, not wrapped
+				panic(p)
+			}
+
+			httpRequest, _ := httputil.DumpRequest(c.Request, false)
+
+			// A broken connection doesn't warrant a stack trace, and there's
+			// no one left to respond to.
+			if isBrokenPipe(p) {
+				logger.Error(c.Request.URL.Path, zap.Any("error", p), zap.ByteString("request", httpRequest))
+
+				c.Abort()
+
+				return
+			}
+
+			logger.Error("[Recovery from panic]",
+				zap.Any("error", p),
+				zap.ByteString("request", httpRequest),
+				zap.ByteString("stack", debug.Stack()),
+			)
+
+			errMsgs := []string{"internal server error"}
+			if exposeErrors {
+				errMsgs = append(errMsgs, fmt.Sprint(p))
+			}
+
+			c.AbortWithStatusJSON(http.StatusInternalServerError, &errorResponse{Errors: errMsgs})
+		}()
+
+		c.Next()
+	}
+}
+
+func isBrokenPipe(p interface{}) bool {
+	err, ok := p.(error)
+	if !ok {
+		return false
+	}
+
+	var se *os.SyscallError
+	if !errors.As(err, new(*net.OpError)) || !errors.As(err, &se) {
+		return false
+	}
+
+	msg := strings.ToLower(se.Error())
+
+	return strings.Contains(msg, "broken pipe") || strings.Contains(msg, "connection reset by peer")
+}
@@ -0,0 +1,49 @@
+package middleware_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+)
+
+func TestRecovery(t *testing.T) {
+	type testCase struct {
+		testName     string
+		exposeErrors bool
+		expectedBody string
+	}
+
+	testCases := []testCase{
+		{"errors hidden", false, `{"errors":["internal server error"]}`},
+		{"errors exposed", true, `{"errors":["internal server error","something went wrong"]}`},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			r := gin.New()
+			r.Use(middleware.Recovery(zap.NewNop(), testcase.exposeErrors))
+
+			r.GET("/panic", func(c *gin.Context) {
+				panic("something went wrong")
+			})
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, "/panic", nil)
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusInternalServerError, w.Code)
+			assert.Equal(t, testcase.expectedBody, w.Body.String())
+
+			// The stack trace is never sent to the client.
+			assert.NotContains(t, w.Body.String(), "goroutine")
+			assert.NotContains(t, w.Body.String(), ".go:")
+		})
+	}
+}
@@ -0,0 +1,10 @@
+package middleware
+
+// errorResponse is the JSON body of the error responses sent by the
+// middlewares. It has the same shape as the v1 API's ErrorResponse, which
+// can't be used here without an import cycle: a message for client errors,
+// and a list of errors for server errors.
+type errorResponse struct {
+	Message string   `json:"message,omitempty"`
+	Errors  []string `json:"errors,omitempty"`
+}
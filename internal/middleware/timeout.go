@@ -0,0 +1,197 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RouteTimeouts returns a middleware which limits how long the handlers for
+// each route may take, keyed by the route as registered with gin (its
+// FullPath, like "/device-metadata/:instance-id"). Routes without a timeout
+// are left alone.
+//
+// The request context is given the route's deadline, so handlers making
+// database or lookup calls give up once it passes. If the handlers haven't
+// finished by then, the client gets a 504 right away, and anything the
+// handlers write afterwards is discarded.
+func RouteTimeouts(timeouts map[string]time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		timeout := timeouts[c.FullPath()]
+		if timeout <= 0 {
+			c.Next()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+
+		c.Request = c.Request.WithContext(ctx)
+
+		w := c.Writer
+		tw := &timeoutWriter{ResponseWriter: w, header: w.Header().Clone(), status: http.StatusOK}
+		c.Writer = tw
+
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+
+		go func() {
+			defer close(done)
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+
+			c.Next()
+		}()
+
+		select {
+		case <-done:
+			c.Writer = w
+
+			// Let the recovery middleware deal with panics, as if the
+			// handlers had run on this goroutine.
+			select {
+			case p := <-panicked:
+				panic(p)
+			default:
+			}
+
+			tw.writeTo(w)
+		case <-ctx.Done():
+			tw.timeOut()
+
+			MetricTimedOutRequestCount.Inc()
+
+			// The gin context is still in use by the handlers, so the
+			// response is written directly rather than with c.JSON.
+			body, _ := json.Marshal(&errorResponse{Message: "request timed out"})
+
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusGatewayTimeout)
+			_, _ = w.Write(body)
+			w.Flush()
+
+			// The handlers still hold the gin context, so wait for them to
+			// give up before it can be reused.
+			<-done
+
+			c.Writer = w
+			c.Abort()
+		}
+	}
+}
+
+// timeoutWriter buffers a response until the handlers have finished, so that
+// nothing reaches the client once the request has timed out.
+type timeoutWriter struct {
+	gin.ResponseWriter
+
+	mu       sync.Mutex
+	header   http.Header
+	body     bytes.Buffer
+	status   int
+	written  bool
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut || tw.written {
+		return
+	}
+
+	tw.status = code
+}
+
+func (tw *timeoutWriter) WriteHeaderNow() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	tw.written = true
+}
+
+func (tw *timeoutWriter) Write(data []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+
+	tw.written = true
+
+	return tw.body.Write(data)
+}
+
+func (tw *timeoutWriter) WriteString(s string) (int, error) {
+	return tw.Write([]byte(s))
+}
+
+func (tw *timeoutWriter) Status() int {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	return tw.status
+}
+
+func (tw *timeoutWriter) Size() int {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if !tw.written {
+		return -1
+	}
+
+	return tw.body.Len()
+}
+
+func (tw *timeoutWriter) Written() bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	return tw.written
+}
+
+// Flush is a no-op, as the response is only sent once the handlers are done.
+func (tw *timeoutWriter) Flush() {}
+
+func (tw *timeoutWriter) timeOut() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	tw.timedOut = true
+}
+
+// writeTo sends the buffered response to w.
+func (tw *timeoutWriter) writeTo(w gin.ResponseWriter) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	dst := w.Header()
+	for key, values := range tw.header {
+		dst[key] = values
+	}
+
+	if !tw.written && tw.status == http.StatusOK {
+		// Nothing was written, so leave it to gin to send the default
+		// response.
+		return
+	}
+
+	w.WriteHeader(tw.status)
+
+	_, _ = w.Write(tw.body.Bytes())
+}
@@ -0,0 +1,100 @@
+package middleware_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+)
+
+func TestRouteTimeouts(t *testing.T) {
+	r := gin.New()
+	r.Use(middleware.RouteTimeouts(map[string]time.Duration{
+		"/fast":            time.Second,
+		"/slow":            20 * time.Millisecond,
+		"/ignores-context": 20 * time.Millisecond,
+		"/status-only":     time.Second,
+	}))
+
+	r.GET("/fast", func(c *gin.Context) {
+		c.Header("X-Test", "fast")
+		c.String(http.StatusOK, "done")
+	})
+
+	// A slow handler which gives up once the request context is done, like
+	// one waiting on the database.
+	r.GET("/slow", func(c *gin.Context) {
+		select {
+		case <-time.After(time.Second):
+			c.String(http.StatusOK, "done")
+		case <-c.Request.Context().Done():
+			c.String(http.StatusInternalServerError, "canceled")
+		}
+	})
+
+	// A slow handler which doesn't check the request context at all.
+	r.GET("/ignores-context", func(c *gin.Context) {
+		time.Sleep(100 * time.Millisecond)
+		c.String(http.StatusOK, "done")
+	})
+
+	r.GET("/status-only", func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	// A route without a timeout.
+	r.GET("/untimed", func(c *gin.Context) {
+		time.Sleep(50 * time.Millisecond)
+		c.String(http.StatusOK, "done")
+	})
+
+	type testCase struct {
+		testName       string
+		path           string
+		expectedStatus int
+		expectedBody   string
+		expectTimeout  bool
+	}
+
+	testCases := []testCase{
+		{"fast handler within its timeout", "/fast", http.StatusOK, "done", false},
+		{"slow handler respecting the context", "/slow", http.StatusGatewayTimeout, `{"message":"request timed out"}`, true},
+		{"slow handler ignoring the context", "/ignores-context", http.StatusGatewayTimeout, `{"message":"request timed out"}`, true},
+		{"handler only setting a status", "/status-only", http.StatusNoContent, "", false},
+		{"route without a timeout", "/untimed", http.StatusOK, "done", false},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			timedOutBefore := testutil.ToFloat64(middleware.MetricTimedOutRequestCount)
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, testcase.path, nil)
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+			assert.Equal(t, testcase.expectedBody, w.Body.String())
+
+			if testcase.expectTimeout {
+				assert.Equal(t, timedOutBefore+1, testutil.ToFloat64(middleware.MetricTimedOutRequestCount))
+			} else {
+				assert.Equal(t, timedOutBefore, testutil.ToFloat64(middleware.MetricTimedOutRequestCount))
+			}
+		})
+	}
+
+	t.Run("headers set by the handler are sent", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, "/fast", nil)
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, "fast", w.Header().Get("X-Test"))
+	})
+}
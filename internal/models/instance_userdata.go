@@ -24,37 +24,42 @@ import (
 
 // InstanceUserdatum is an object representing the database table.
 type InstanceUserdatum struct {
-	ID        string     `boil:"id" json:"id" toml:"id" yaml:"id"`
-	Userdata  null.Bytes `boil:"userdata" json:"userdata,omitempty" toml:"userdata" yaml:"userdata,omitempty"`
-	CreatedAt time.Time  `boil:"created_at" json:"created_at" toml:"created_at" yaml:"created_at"`
-	UpdatedAt time.Time  `boil:"updated_at" json:"updated_at" toml:"updated_at" yaml:"updated_at"`
+	ID         string     `boil:"id" json:"id" toml:"id" yaml:"id"`
+	Userdata   null.Bytes `boil:"userdata" json:"userdata,omitempty" toml:"userdata" yaml:"userdata,omitempty"`
+	CreatedAt  time.Time  `boil:"created_at" json:"created_at" toml:"created_at" yaml:"created_at"`
+	UpdatedAt  time.Time  `boil:"updated_at" json:"updated_at" toml:"updated_at" yaml:"updated_at"`
+	Compressed bool       `boil:"compressed" json:"compressed" toml:"compressed" yaml:"compressed"`
 
 	R *instanceUserdatumR `boil:"-" json:"-" toml:"-" yaml:"-"`
 	L instanceUserdatumL  `boil:"-" json:"-" toml:"-" yaml:"-"`
 }
 
 var InstanceUserdatumColumns = struct {
-	ID        string
-	Userdata  string
-	CreatedAt string
-	UpdatedAt string
+	ID         string
+	Userdata   string
+	CreatedAt  string
+	UpdatedAt  string
+	Compressed string
 }{
-	ID:        "id",
-	Userdata:  "userdata",
-	CreatedAt: "created_at",
-	UpdatedAt: "updated_at",
+	ID:         "id",
+	Userdata:   "userdata",
+	CreatedAt:  "created_at",
+	UpdatedAt:  "updated_at",
+	Compressed: "compressed",
 }
 
 var InstanceUserdatumTableColumns = struct {
-	ID        string
-	Userdata  string
-	CreatedAt string
-	UpdatedAt string
+	ID         string
+	Userdata   string
+	CreatedAt  string
+	UpdatedAt  string
+	Compressed string
 }{
-	ID:        "instance_userdata.id",
-	Userdata:  "instance_userdata.userdata",
-	CreatedAt: "instance_userdata.created_at",
-	UpdatedAt: "instance_userdata.updated_at",
+	ID:         "instance_userdata.id",
+	Userdata:   "instance_userdata.userdata",
+	CreatedAt:  "instance_userdata.created_at",
+	UpdatedAt:  "instance_userdata.updated_at",
+	Compressed: "instance_userdata.compressed",
 }
 
 // Generated where
@@ -83,16 +88,27 @@ func (w whereHelpernull_Bytes) GTE(x null.Bytes) qm.QueryMod {
 func (w whereHelpernull_Bytes) IsNull() qm.QueryMod    { return qmhelper.WhereIsNull(w.field) }
 func (w whereHelpernull_Bytes) IsNotNull() qm.QueryMod { return qmhelper.WhereIsNotNull(w.field) }
 
+type whereHelperbool struct{ field string }
+
+func (w whereHelperbool) EQ(x bool) qm.QueryMod  { return qmhelper.Where(w.field, qmhelper.EQ, x) }
+func (w whereHelperbool) NEQ(x bool) qm.QueryMod { return qmhelper.Where(w.field, qmhelper.NEQ, x) }
+func (w whereHelperbool) LT(x bool) qm.QueryMod  { return qmhelper.Where(w.field, qmhelper.LT, x) }
+func (w whereHelperbool) LTE(x bool) qm.QueryMod { return qmhelper.Where(w.field, qmhelper.LTE, x) }
+func (w whereHelperbool) GT(x bool) qm.QueryMod  { return qmhelper.Where(w.field, qmhelper.GT, x) }
+func (w whereHelperbool) GTE(x bool) qm.QueryMod { return qmhelper.Where(w.field, qmhelper.GTE, x) }
+
 var InstanceUserdatumWhere = struct {
-	ID        whereHelperstring
-	Userdata  whereHelpernull_Bytes
-	CreatedAt whereHelpertime_Time
-	UpdatedAt whereHelpertime_Time
+	ID         whereHelperstring
+	Userdata   whereHelpernull_Bytes
+	CreatedAt  whereHelpertime_Time
+	UpdatedAt  whereHelpertime_Time
+	Compressed whereHelperbool
 }{
-	ID:        whereHelperstring{field: "\"instance_userdata\".\"id\""},
-	Userdata:  whereHelpernull_Bytes{field: "\"instance_userdata\".\"userdata\""},
-	CreatedAt: whereHelpertime_Time{field: "\"instance_userdata\".\"created_at\""},
-	UpdatedAt: whereHelpertime_Time{field: "\"instance_userdata\".\"updated_at\""},
+	ID:         whereHelperstring{field: "\"instance_userdata\".\"id\""},
+	Userdata:   whereHelpernull_Bytes{field: "\"instance_userdata\".\"userdata\""},
+	CreatedAt:  whereHelpertime_Time{field: "\"instance_userdata\".\"created_at\""},
+	UpdatedAt:  whereHelpertime_Time{field: "\"instance_userdata\".\"updated_at\""},
+	Compressed: whereHelperbool{field: "\"instance_userdata\".\"compressed\""},
 }
 
 // InstanceUserdatumRels is where relationship names are stored.
@@ -112,9 +128,9 @@ func (*instanceUserdatumR) NewStruct() *instanceUserdatumR {
 type instanceUserdatumL struct{}
 
 var (
-	instanceUserdatumAllColumns            = []string{"id", "userdata", "created_at", "updated_at"}
+	instanceUserdatumAllColumns            = []string{"id", "userdata", "created_at", "updated_at", "compressed"}
 	instanceUserdatumColumnsWithoutDefault = []string{"id", "created_at", "updated_at"}
-	instanceUserdatumColumnsWithDefault    = []string{"userdata"}
+	instanceUserdatumColumnsWithDefault    = []string{"userdata", "compressed"}
 	instanceUserdatumPrimaryKeyColumns     = []string{"id"}
 	instanceUserdatumGeneratedColumns      = []string{}
 )
@@ -0,0 +1,65 @@
+package upserter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"github.com/spf13/viper"
+	"github.com/volatiletech/null/v8"
+
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+// gzipMagic is the header every gzip stream starts with.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// compressUserdata returns the userdata to store, gzip'd if it's larger than
+// "userdata.compress_threshold" bytes, and whether it was compressed. A
+// threshold of zero disables compression. Userdata which is gzip'd already
+// is stored as-is, as compressing it again wouldn't save anything.
+func compressUserdata(userdata []byte) ([]byte, bool, error) {
+	threshold := viper.GetInt("userdata.compress_threshold")
+	if threshold <= 0 || len(userdata) <= threshold || bytes.HasPrefix(userdata, gzipMagic) {
+		return userdata, false, nil
+	}
+
+	buf := new(bytes.Buffer)
+	w := gzip.NewWriter(buf)
+
+	if _, err := w.Write(userdata); err != nil {
+		return nil, false, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, false, err
+	}
+
+	return buf.Bytes(), true, nil
+}
+
+// DecompressUserdata replaces userdata which UpsertUserdata compressed before
+// storing it with the userdata as it was upserted. Other userdata is left
+// alone.
+func DecompressUserdata(userdata *models.InstanceUserdatum) error {
+	if !userdata.Compressed {
+		return nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(userdata.Userdata.Bytes))
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	decompressed, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	userdata.Userdata = null.NewBytes(decompressed, true)
+	userdata.Compressed = false
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package upserter_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/volatiletech/null/v8"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+func TestCompressUserdata(t *testing.T) {
+	viper.Set("userdata.compress_threshold", 64)
+	defer viper.Set("userdata.compress_threshold", 0)
+
+	large := []byte(strings.Repeat("#cloud-config\nruncmd: [echo hello]\n", 100))
+
+	gzipped := new(bytes.Buffer)
+	w := gzip.NewWriter(gzipped)
+	_, err := w.Write(large)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	testCases := []struct {
+		testName           string
+		userdata           []byte
+		expectedCompressed bool
+	}{
+		{"small userdata", []byte("#cloud-config"), false},
+		{"large userdata", large, true},
+		{"userdata gzip'd already", gzipped.Bytes(), false},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			stored, compressed, err := upserter.CompressUserdata(testcase.userdata)
+			require.NoError(t, err)
+			assert.Equal(t, testcase.expectedCompressed, compressed)
+
+			if !compressed {
+				assert.Equal(t, testcase.userdata, stored)
+				return
+			}
+
+			userdata := &models.InstanceUserdatum{Userdata: null.NewBytes(stored, true), Compressed: true}
+			require.NoError(t, upserter.DecompressUserdata(userdata))
+			assert.Equal(t, testcase.userdata, userdata.Userdata.Bytes)
+			assert.False(t, userdata.Compressed)
+		})
+	}
+
+	viper.Set("userdata.compress_threshold", 0)
+
+	_, compressed, err := upserter.CompressUserdata(large)
+	require.NoError(t, err)
+	assert.False(t, compressed)
+}
+
+// TestUpsertUserdataCompressesLargeUserdata tests that userdata over the
+// compression threshold is stored gzip'd, and reads back as it was upserted.
+func TestUpsertUserdataCompressesLargeUserdata(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	viper.Set("userdata.compress_threshold", 1024)
+	defer viper.Set("userdata.compress_threshold", 0)
+
+	large := []byte(strings.Repeat("#!/bin/sh\necho 'provisioning step'\n", 1000))
+
+	userdata := models.InstanceUserdatum{
+		ID:       instanceID,
+		Userdata: null.NewBytes(large, true),
+	}
+
+	_, err := upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &userdata)
+	require.NoError(t, err)
+
+	// The caller's userdata isn't changed.
+	assert.Equal(t, large, userdata.Userdata.Bytes)
+	assert.False(t, userdata.Compressed)
+
+	stored, err := models.FindInstanceUserdatum(context.TODO(), testDB, instanceID)
+	require.NoError(t, err)
+
+	assert.True(t, stored.Compressed)
+	assert.Less(t, len(stored.Userdata.Bytes), len(large))
+
+	require.NoError(t, upserter.DecompressUserdata(stored))
+	assert.Equal(t, large, stored.Userdata.Bytes)
+
+	// Upserting small userdata again stores it uncompressed.
+	userdata.Userdata = null.NewBytes([]byte(instanceUserdata1), true)
+
+	_, err = upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &userdata)
+	require.NoError(t, err)
+
+	stored, err = models.FindInstanceUserdatum(context.TODO(), testDB, instanceID)
+	require.NoError(t, err)
+
+	assert.False(t, stored.Compressed)
+	assert.Equal(t, instanceUserdata1, string(stored.Userdata.Bytes))
+}
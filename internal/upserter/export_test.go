@@ -0,0 +1,28 @@
+package upserter
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// SetNow replaces the clock used by the upserter, returning a func that
+// restores the previous one.
+func SetNow(f func() time.Time) func() {
+	previous := now
+	now = f
+
+	return func() { now = previous }
+}
+
+// CompressUserdata exposes compressUserdata to the external test package.
+var CompressUserdata = compressUserdata
+
+// UpsertMetadataWithRecordUpserter runs the metadata upsert retry loop with
+// the given RecordUpserter, so tests can inject failures into the upsert
+// transaction.
+func UpsertMetadataWithRecordUpserter(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string, upsertRecordFunc RecordUpserter) (bool, error) {
+	return doUpsertWithRetries(ctx, db, logger, id, ipAddresses, time.Time{}, recordTypeMetadata, upsertRecordFunc)
+}
@@ -0,0 +1,123 @@
+package upserter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/spf13/viper"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/variants"
+)
+
+const (
+	// IPAssociationModeReplace makes each metadata or userdata upsert replace
+	// all of the instance's IP address associations with the upsert's IP
+	// addresses, so the last write wins. This is the default.
+	IPAssociationModeReplace = "replace"
+	// IPAssociationModeUnion makes upserts only remove an instance's stale IP
+	// address associations when the instance has no stored record of the
+	// other type, so the IP addresses pushed with its metadata and its
+	// userdata don't clobber each other.
+	IPAssociationModeUnion = "union"
+
+	// IPConflictPolicyKeep makes upserts which may not take a conflicting IP
+	// address from another instance (see crdb.ip_conflict_require_newer)
+	// proceed without it, leaving it associated to the other instance. This
+	// is the default.
+	IPConflictPolicyKeep = "keep"
+	// IPConflictPolicyReject makes upserts which may not take a conflicting
+	// IP address from another instance fail with ErrIPConflictNotNewer,
+	// without changing anything.
+	IPConflictPolicyReject = "reject"
+)
+
+var (
+	// ErrInvalidIPAssociationMode is returned when crdb.ip_association_mode
+	// isn't one of the supported values.
+	ErrInvalidIPAssociationMode = errors.New("invalid IP association mode")
+
+	// ErrInvalidIPConflictPolicy is returned when crdb.ip_conflict_policy
+	// isn't one of the supported values.
+	ErrInvalidIPConflictPolicy = errors.New("invalid IP conflict policy")
+
+	// ErrIPConflictNotNewer is returned by upserts rejected under
+	// IPConflictPolicyReject, because one of their IP addresses is associated
+	// to another instance whose metadata isn't older than the incoming data.
+	ErrIPConflictNotNewer = errors.New("IP address is associated to another instance with newer metadata")
+)
+
+// recordType is the type of record being upserted along with its IP
+// addresses.
+type recordType int
+
+const (
+	recordTypeMetadata recordType = iota
+	recordTypeUserdata
+)
+
+// String returns the record type's name, as used in metric labels.
+func (t recordType) String() string {
+	if t == recordTypeUserdata {
+		return "userdata"
+	}
+
+	return "metadata"
+}
+
+// IPAssociationMode returns the crdb.ip_association_mode setting, which is
+// IPAssociationModeReplace when unset.
+func IPAssociationMode() (string, error) {
+	switch mode := viper.GetString("crdb.ip_association_mode"); mode {
+	case "", IPAssociationModeReplace:
+		return IPAssociationModeReplace, nil
+	case IPAssociationModeUnion:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrInvalidIPAssociationMode, mode)
+	}
+}
+
+// IPConflictPolicy returns the crdb.ip_conflict_policy setting, which is
+// IPConflictPolicyKeep when unset.
+func IPConflictPolicy() (string, error) {
+	switch policy := viper.GetString("crdb.ip_conflict_policy"); policy {
+	case "", IPConflictPolicyKeep:
+		return IPConflictPolicyKeep, nil
+	case IPConflictPolicyReject:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrInvalidIPConflictPolicy, policy)
+	}
+}
+
+// keepStaleIPs reports whether the stale IP address associations of an
+// instance should be kept by an upsert of the given record type. In union
+// mode, they're kept when the instance has a record of the other type, as
+// they may have been pushed with that record instead. Userdata variants count
+// as userdata records. The IP addresses pushed with each record aren't stored
+// separately, so the instance keeps the union of every IP address pushed with
+// either record until one of them is deleted.
+func keepStaleIPs(ctx context.Context, exec boil.ContextExecutor, id string, upserting recordType) (bool, error) {
+	mode, err := IPAssociationMode()
+	if err != nil {
+		return false, err
+	}
+
+	if mode != IPAssociationModeUnion {
+		return false, nil
+	}
+
+	if upserting == recordTypeUserdata {
+		return models.InstanceMetadatumExists(ctx, exec, id)
+	}
+
+	exists, err := models.InstanceUserdatumExists(ctx, exec, id)
+	if err != nil || exists {
+		return exists, err
+	}
+
+	return variants.Exists(ctx, exec, id)
+}
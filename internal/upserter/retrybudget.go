@@ -0,0 +1,73 @@
+package upserter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type retryBudgetContextKey struct{}
+
+// RetryBudget limits the DB transaction retries made while handling a single
+// request, across all of its retry loops, so that retries can't compound
+// past the request's latency SLA. A budget may limit the total time the
+// retries may take, the total number of retries, or both.
+type RetryBudget struct {
+	mu       sync.Mutex
+	deadline time.Time
+	retries  int
+}
+
+// NewRetryBudget returns a budget allowing retries to start until maxDuration
+// from now, and at most maxRetries retries. Zero (or less) for either means
+// no limit.
+func NewRetryBudget(maxDuration time.Duration, maxRetries int) *RetryBudget {
+	budget := &RetryBudget{retries: -1}
+
+	if maxDuration > 0 {
+		budget.deadline = time.Now().Add(maxDuration)
+	}
+
+	if maxRetries > 0 {
+		budget.retries = maxRetries
+	}
+
+	return budget
+}
+
+// WithRetryBudget returns a copy of ctx carrying the budget, which is then
+// honored by every retry loop the context is passed to.
+func WithRetryBudget(ctx context.Context, budget *RetryBudget) context.Context {
+	return context.WithValue(ctx, retryBudgetContextKey{}, budget)
+}
+
+// RetryAllowed reports whether another retry, starting after waiting for
+// wait, fits in the retry budget carried by ctx, and takes it out of the
+// budget if so. Retries are always allowed without a budget.
+func RetryAllowed(ctx context.Context, wait time.Duration) bool {
+	budget, ok := ctx.Value(retryBudgetContextKey{}).(*RetryBudget)
+	if !ok || budget == nil {
+		return true
+	}
+
+	return budget.take(wait)
+}
+
+func (b *RetryBudget) take(wait time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.deadline.IsZero() && time.Now().Add(wait).After(b.deadline) {
+		return false
+	}
+
+	if b.retries == 0 {
+		return false
+	}
+
+	if b.retries > 0 {
+		b.retries--
+	}
+
+	return true
+}
@@ -0,0 +1,118 @@
+package upserter_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/volatiletech/null/v8"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+func TestRetryAllowed(t *testing.T) {
+	type testCase struct {
+		testName string
+		budget   *upserter.RetryBudget
+		wait     time.Duration
+		expected []bool
+	}
+
+	testCases := []testCase{
+		{"no budget", nil, time.Second, []bool{true, true, true}},
+		{"unlimited budget", upserter.NewRetryBudget(0, 0), time.Second, []bool{true, true, true}},
+		{"attempts budget", upserter.NewRetryBudget(0, 2), 0, []bool{true, true, false}},
+		{"time budget", upserter.NewRetryBudget(time.Minute, 0), time.Second, []bool{true, true, true}},
+		{"retry past the time budget", upserter.NewRetryBudget(time.Second, 0), time.Minute, []bool{false, false, false}},
+		{"both budgets", upserter.NewRetryBudget(time.Minute, 1), time.Second, []bool{true, false, false}},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			ctx := context.TODO()
+			if testcase.budget != nil {
+				ctx = upserter.WithRetryBudget(ctx, testcase.budget)
+			}
+
+			allowed := make([]bool, 0, len(testcase.expected))
+
+			for range testcase.expected {
+				allowed = append(allowed, upserter.RetryAllowed(ctx, testcase.wait))
+			}
+
+			assert.Equal(t, testcase.expected, allowed)
+		})
+	}
+}
+
+// TestUpsertRetryBudget tests that the upsert retry loop stops retrying once
+// the request's retry budget runs out, well before crdb.max_retries, and that
+// it's counted as running out of budget rather than exhausting its retries.
+func TestUpsertRetryBudget(t *testing.T) {
+	setViper(t, "crdb.max_retries", 1000)
+	setViper(t, "crdb.retry_interval", 10*time.Millisecond)
+	setViper(t, "crdb.tx_timeout", time.Second)
+
+	db, err := sqlx.Open("postgres", unreachableDBURL)
+	require.NoError(t, err)
+
+	type testCase struct {
+		testName string
+		budget   *upserter.RetryBudget
+		// expectedAttempts is only checked when set, as the number of
+		// attempts fitting in a time budget depends on the jitter.
+		expectedAttempts int
+	}
+
+	testCases := []testCase{
+		// The first attempt isn't a retry.
+		{"attempts budget", upserter.NewRetryBudget(0, 3), 4},
+		{"time budget", upserter.NewRetryBudget(50*time.Millisecond, 0), 0},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			core, logs := observer.New(zap.InfoLevel)
+
+			budgetExhausted := middleware.MetricUpsertRetryBudgetExhausted.WithLabelValues("userdata")
+			exhausted := middleware.MetricUpsertRetryExhausted.WithLabelValues("userdata")
+
+			budgetExhaustedBefore := testutil.ToFloat64(budgetExhausted)
+			exhaustedBefore := testutil.ToFloat64(exhausted)
+
+			userdata := &models.InstanceUserdatum{ID: instanceID, Userdata: null.BytesFrom([]byte(instanceUserdata0))}
+
+			start := time.Now()
+
+			_, err := upserter.UpsertUserdata(upserter.WithRetryBudget(context.TODO(), testcase.budget), db, zap.New(core), instanceID, instanceIPs, userdata)
+			assert.Error(t, err)
+
+			// Without the budget, the retries would take several seconds.
+			assert.Less(t, time.Since(start), time.Second)
+
+			attempts := logs.FilterMessageSnippet("doUpsert starting").Len()
+			if testcase.expectedAttempts > 0 {
+				assert.Equal(t, testcase.expectedAttempts, attempts)
+			}
+
+			assert.Equal(t, 1, logs.FilterMessageSnippet("Retry budget exhausted").Len())
+
+			// The failure is logged with the number of attempts actually made.
+			failures := logs.FilterMessageSnippet("Upsert operation failed").All()
+			require.Len(t, failures, 1)
+			assert.Contains(t, failures[0].Message, fmt.Sprintf(" after %d attempts, when the retry budget ran out", attempts))
+
+			assert.Equal(t, budgetExhaustedBefore+1, testutil.ToFloat64(budgetExhausted))
+			assert.Equal(t, exhaustedBefore, testutil.ToFloat64(exhausted))
+		})
+	}
+}
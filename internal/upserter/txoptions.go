@@ -0,0 +1,43 @@
+package upserter
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// ErrInvalidIsolationLevel is returned when crdb.isolation_level isn't one of
+// the supported values.
+var ErrInvalidIsolationLevel = errors.New("invalid transaction isolation level")
+
+// isolationLevels maps the accepted crdb.isolation_level values to their
+// sql.IsolationLevel. An empty value leaves the choice to the driver (which,
+// for CockroachDB, is SERIALIZABLE unless the cluster is configured otherwise).
+var isolationLevels = map[string]sql.IsolationLevel{
+	"":                sql.LevelDefault,
+	"serializable":    sql.LevelSerializable,
+	"repeatable_read": sql.LevelRepeatableRead,
+	"read_committed":  sql.LevelReadCommitted,
+}
+
+// TxOptions returns the options used when starting write transactions, based
+// on the crdb.isolation_level setting. Valid values are "serializable",
+// "repeatable_read", and "read_committed". When unset, nil is returned so the
+// driver default is used.
+func TxOptions() (*sql.TxOptions, error) {
+	level := viper.GetString("crdb.isolation_level")
+
+	isolation, ok := isolationLevels[strings.ToLower(level)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidIsolationLevel, level)
+	}
+
+	if isolation == sql.LevelDefault {
+		return nil, nil
+	}
+
+	return &sql.TxOptions{Isolation: isolation}, nil
+}
@@ -0,0 +1,41 @@
+package upserter_test
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+func TestTxOptions(t *testing.T) {
+	defer viper.Set("crdb.isolation_level", "")
+
+	type testCase struct {
+		testName       string
+		isolationLevel string
+		expectedOpts   *sql.TxOptions
+		expectedError  error
+	}
+
+	testCases := []testCase{
+		{"unset", "", nil, nil},
+		{"serializable", "serializable", &sql.TxOptions{Isolation: sql.LevelSerializable}, nil},
+		{"repeatable read", "repeatable_read", &sql.TxOptions{Isolation: sql.LevelRepeatableRead}, nil},
+		{"read committed, mixed case", "Read_Committed", &sql.TxOptions{Isolation: sql.LevelReadCommitted}, nil},
+		{"unsupported level", "read_uncommitted", nil, upserter.ErrInvalidIsolationLevel},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			viper.Set("crdb.isolation_level", testcase.isolationLevel)
+
+			opts, err := upserter.TxOptions()
+
+			assert.ErrorIs(t, err, testcase.expectedError)
+			assert.Equal(t, testcase.expectedOpts, opts)
+		})
+	}
+}
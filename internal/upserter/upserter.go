@@ -2,18 +2,44 @@ package upserter
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"math/rand"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/spf13/viper"
+	"github.com/volatiletech/null/v8"
 	"github.com/volatiletech/sqlboiler/v4/boil"
+	"github.com/volatiletech/sqlboiler/v4/queries/qm"
+	"github.com/volatiletech/sqlboiler/v4/types"
 	"go.uber.org/zap"
 
+	"go.hollow.sh/metadataservice/internal/fieldcrypt"
+	"go.hollow.sh/metadataservice/internal/history"
+	"go.hollow.sh/metadataservice/internal/middleware"
 	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/variants"
 )
 
+// ipLockChunkSize is the number of IP addresses locked per query when
+// crdb.lock_ips_in_chunks is set.
+const ipLockChunkSize = 25
+
+// ErrExistingUserdataIsNewer is returned by UpsertUserdata when the stored
+// userdata was written after the incoming userdata was produced. Nothing is
+// changed, and callers should treat it as a skipped write rather than a
+// failure.
+var ErrExistingUserdataIsNewer = errors.New("existing userdata is newer than the incoming userdata")
+
+// now returns the current time. It's a variable so tests can control the
+// clock used for the timestamps the upserter stores, which later upserts are
+// compared against.
+var now = time.Now
+
 // RecordUpserter is a function defined in by each metadata or userdata upsert
 // handler function and passed into the general handleUpsertRequest function.
 // This lets us share the common functionality shared between both, like
@@ -21,44 +47,231 @@ import (
 // removing stale instance_ip_address rows can be handled generically while
 // delegating the specific implementation for handling upserting metadata
 // or userdata records back to the calling method.
-type RecordUpserter func(c context.Context, exec boil.ContextExecutor) error
+// The returned bool reports whether a new record was inserted, rather than an
+// existing one being updated.
+type RecordUpserter func(c context.Context, exec boil.ContextExecutor) (bool, error)
 
 // UpsertMetadata is used to upsert (update or insert) an instance_metadata
 // record, along with managing inserting new instance_ip_addresses rows and
 // removing conflicting or stale instance_ip_addresses rows.
-func UpsertMetadata(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string, metadata *models.InstanceMetadatum) error {
-	metadataUpserter := func(c context.Context, exec boil.ContextExecutor) error {
-		return metadata.Upsert(c, exec, true, []string{"id"}, boil.Whitelist("metadata", "updated_at"), boil.Infer())
+// If the caller sets metadata.UpdatedAt, it's treated as the time the incoming
+// metadata was produced, and is used when deciding whether conflicting IP
+// addresses may be taken from another instance. Without it, the incoming
+// metadata is never considered newer than another instance's. The stored
+// updated_at value is always set to the time of the write.
+// If metadata history is enabled, the new version is also recorded.
+// Fields configured with fieldcrypt are encrypted before they're stored.
+// The returned bool reports whether a new instance_metadata record was created.
+func UpsertMetadata(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string, metadata *models.InstanceMetadatum) (bool, error) {
+	_, _, created, err := upsertMetadata(ctx, db, logger, id, ipAddresses, metadata, false)
+
+	return created, err
+}
+
+// UpsertMetadataWithVersions behaves like UpsertMetadata, but also returns the
+// metadata stored for the instance before and after the upsert, as read within
+// the upsert transaction, with any encrypted fields decrypted. The previous
+// version is nil when a new record was created.
+func UpsertMetadataWithVersions(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string, metadata *models.InstanceMetadatum) (previous, stored types.JSON, created bool, err error) {
+	return upsertMetadata(ctx, db, logger, id, ipAddresses, metadata, true)
+}
+
+// upsertMetadata implements UpsertMetadata and UpsertMetadataWithVersions.
+// The stored metadata is only read back when readBack is set.
+func upsertMetadata(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string, metadata *models.InstanceMetadatum, readBack bool) (types.JSON, types.JSON, bool, error) {
+	metadataUpdatedAt := metadata.UpdatedAt
+
+	// Configured fields are only encrypted in the database. The caller's
+	// metadata is left as plaintext.
+	encrypted, err := fieldcrypt.EncryptMetadata(metadata.Metadata)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	var previous, stored types.JSON
+
+	metadataUpserter := func(c context.Context, exec boil.ContextExecutor) (bool, error) {
+		previous, stored = nil, nil
+
+		plaintext := metadata.Metadata
+		metadata.Metadata = encrypted
+
+		defer func() { metadata.Metadata = plaintext }()
+
+		existing, err := models.FindInstanceMetadatum(c, exec, metadata.ID, models.InstanceMetadatumColumns.Metadata)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return false, err
+		}
+
+		if existing != nil {
+			previous = existing.Metadata
+		}
+
+		if err := metadata.Upsert(c, exec, true, []string{"id"}, boil.Whitelist("metadata", "updated_at"), boil.Infer()); err != nil {
+			return false, err
+		}
+
+		if readBack {
+			// Read back what the database actually stored, which may differ
+			// from what was written, like in the order of its keys.
+			current, err := models.FindInstanceMetadatum(c, exec, metadata.ID, models.InstanceMetadatumColumns.Metadata)
+			if err != nil {
+				return false, err
+			}
+
+			stored = current.Metadata
+		}
+
+		return existing == nil, history.RecordMetadata(c, exec, metadata.ID, metadata.Metadata, metadata.UpdatedAt)
 	}
 
 	logger.Sugar().Info("Starting metadata upsert for uuid: ", id)
 
-	return doUpsertWithRetries(ctx, db, logger, id, ipAddresses, metadataUpserter)
+	created, err := doUpsertWithRetries(ctx, db, logger, id, ipAddresses, metadataUpdatedAt, recordTypeMetadata, metadataUpserter)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	if previous != nil {
+		if previous, err = fieldcrypt.DecryptMetadata(previous); err != nil {
+			return nil, nil, false, err
+		}
+	}
+
+	if stored != nil {
+		if stored, err = fieldcrypt.DecryptMetadata(stored); err != nil {
+			return nil, nil, false, err
+		}
+	}
+
+	return previous, stored, created, nil
 }
 
 // UpsertUserdata is used to upsert (update or insert) an instance_userdata
 // record, along with managing inserting new instance_ip_addresses rows and
 // removing conflicting or stale instance_ip_addresses rows.
-func UpsertUserdata(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string, userdata *models.InstanceUserdatum) error {
-	userdataUpserter := func(c context.Context, exec boil.ContextExecutor) error {
-		return userdata.Upsert(c, exec, true, []string{"id"}, boil.Whitelist("userdata", "updated_at"), boil.Infer())
+// If the caller sets userdata.UpdatedAt, it's treated as the time the incoming
+// userdata was produced. When the stored userdata was written after that, like
+// when older writes are replayed, nothing is changed and
+// ErrExistingUserdataIsNewer is returned. The stored updated_at value is
+// always set to the time of the write.
+// Userdata larger than "userdata.compress_threshold" is gzip'd before it's
+// stored. Readers must pass it through DecompressUserdata.
+// The returned bool reports whether a new instance_userdata record was created.
+func UpsertUserdata(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string, userdata *models.InstanceUserdatum) (bool, error) {
+	userdataUpdatedAt := userdata.UpdatedAt
+
+	// Userdata is only compressed in the database. The caller's userdata is
+	// left as it was.
+	stored, compressed, err := compressUserdata(userdata.Userdata.Bytes)
+	if err != nil {
+		return false, err
+	}
+
+	userdataUpserter := func(c context.Context, exec boil.ContextExecutor) (bool, error) {
+		existing, err := models.FindInstanceUserdatum(c, exec, userdata.ID, models.InstanceUserdatumColumns.UpdatedAt)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return false, err
+		}
+
+		if existing != nil && !userdataUpdatedAt.IsZero() && !userdataUpdatedAt.After(existing.UpdatedAt) {
+			return false, ErrExistingUserdataIsNewer
+		}
+
+		original := userdata.Userdata
+		userdata.Userdata = null.NewBytes(stored, original.Valid)
+		userdata.Compressed = compressed
+
+		defer func() {
+			userdata.Userdata = original
+			userdata.Compressed = false
+		}()
+
+		return existing == nil, userdata.Upsert(c, exec, true, []string{"id"}, boil.Whitelist("userdata", "updated_at", "compressed"), boil.Infer())
 	}
 
 	logger.Sugar().Info("Starting userdata upsert for uuid: ", id)
 
-	return doUpsertWithRetries(ctx, db, logger, id, ipAddresses, userdataUpserter)
+	return doUpsertWithRetries(ctx, db, logger, id, ipAddresses, userdataUpdatedAt, recordTypeUserdata, userdataUpserter)
 }
 
-// doUpsertWithRetries is just a wrapper function that invokes doUpsert(), but handles the retry logic
-func doUpsertWithRetries(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string, upsertRecordFunc RecordUpserter) error {
+// UpsertUserdataVariant behaves like UpsertUserdata, but upserts the named
+// userdata variant of the instance, like "ignition", instead of its default
+// userdata. An empty variant upserts the default userdata.
+// The returned bool reports whether the variant was newly created.
+func UpsertUserdataVariant(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id, variant string, ipAddresses []string, userdata *models.InstanceUserdatum) (bool, error) {
+	if variant == "" {
+		return UpsertUserdata(ctx, db, logger, id, ipAddresses, userdata)
+	}
+
+	userdataUpdatedAt := userdata.UpdatedAt
+
+	stored, compressed, err := compressUserdata(userdata.Userdata.Bytes)
+	if err != nil {
+		return false, err
+	}
+
+	variantUpserter := func(c context.Context, exec boil.ContextExecutor) (bool, error) {
+		existing, err := variants.Find(c, exec, id, variant)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return false, err
+		}
+
+		if existing != nil && !userdataUpdatedAt.IsZero() && !userdataUpdatedAt.After(existing.UpdatedAt) {
+			return false, ErrExistingUserdataIsNewer
+		}
+
+		return variants.Upsert(c, exec, &variants.Userdata{InstanceID: id, Variant: variant, Userdata: stored, Compressed: compressed}, now())
+	}
+
+	logger.Sugar().Info("Starting userdata upsert for uuid: ", id, " variant: ", variant)
+
+	return doUpsertWithRetries(ctx, db, logger, id, ipAddresses, userdataUpdatedAt, recordTypeUserdata, variantUpserter)
+}
+
+// doUpsertWithRetries is just a wrapper function that invokes doUpsert(), but handles the retry logic.
+// The time taken by all the attempts is observed by the MetricUpsertDuration histogram, and the
+// retries are counted by MetricUpsertRetries, and MetricUpsertRetryExhausted or
+// MetricUpsertRetryBudgetExhausted when they don't succeed.
+func doUpsertWithRetries(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string, metadataUpdatedAt time.Time, upserting recordType, upsertRecordFunc RecordUpserter) (bool, error) {
+	start := time.Now()
+	defer func() {
+		middleware.MetricUpsertDuration.WithLabelValues(upserting.String()).Observe(time.Since(start).Seconds())
+	}()
+
 	upsertSuccess := false
 	maxUpsertRetries := viper.GetInt("crdb.max_retries")
 	dbRetryInterval := viper.GetDuration("crdb.retry_interval")
 
-	var err error
+	var (
+		created         bool
+		err             error
+		attempts        int
+		budgetExhausted bool
+	)
 
 	for i := 0; i <= maxUpsertRetries && !upsertSuccess; i++ {
-		err = doUpsert(ctx, db, logger, id, ipAddresses, upsertRecordFunc)
+		attempts++
+
+		if i > 0 {
+			middleware.MetricUpsertRetries.WithLabelValues(upserting.String()).Inc()
+		}
+
+		created, err = doUpsert(ctx, db, logger, id, ipAddresses, metadataUpdatedAt, upserting, upsertRecordFunc)
+		if errors.Is(err, ErrExistingUserdataIsNewer) {
+			// Retrying wouldn't make the incoming data any newer.
+			logger.Sugar().Info("Skipping upsert for instance: ", id, ": ", err)
+
+			return false, err
+		}
+
+		if errors.Is(err, ErrIPConflictNotNewer) {
+			// Neither would it here.
+			logger.Sugar().Warn("Rejecting upsert for instance: ", id, ": ", err)
+
+			return false, err
+		}
+
 		if err == nil {
 			upsertSuccess = true
 
@@ -67,26 +280,50 @@ func doUpsertWithRetries(ctx context.Context, db *sqlx.DB, logger *zap.Logger, i
 			} else {
 				logger.Sugar().Info("Upsert operation for instance: ", id, " successful on first attempt")
 			}
-		} else {
+		} else if i < maxUpsertRetries {
 			// Exponential backoff would be overkill here, but adding a bit of jitter
 			// to sleep a short time is reasonable
 			jitter := time.Duration(rand.Int63n(int64(dbRetryInterval)))
+
+			if !RetryAllowed(ctx, jitter) {
+				logger.Sugar().Warn("Retry budget exhausted for the upsert operation for instance: ", id, " after ", attempts, " attempts")
+
+				budgetExhausted = true
+
+				break
+			}
+
 			time.Sleep(jitter)
 		}
 	}
 
 	if !upsertSuccess {
-		logger.Sugar().Error("Upsert operation failed for instance: ", id, " even after ", maxUpsertRetries, " attempts")
-		return err
+		if budgetExhausted {
+			middleware.MetricUpsertRetryBudgetExhausted.WithLabelValues(upserting.String()).Inc()
+
+			logger.Sugar().Error("Upsert operation failed for instance: ", id, " after ", attempts, " attempts, when the retry budget ran out")
+		} else {
+			middleware.MetricUpsertRetryExhausted.WithLabelValues(upserting.String()).Inc()
+
+			logger.Sugar().Error("Upsert operation failed for instance: ", id, " even after ", attempts, " attempts")
+		}
+
+		return false, err
 	}
 
-	return nil
+	return created, nil
 }
 
 // doUpsert handles the functionality common to inserting or updating both
 // metadata and userdata records. Namely, handling conflicting or stale
 // (in the case of an update) IP address associations.
-func doUpsert(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string, upsertRecordFunc RecordUpserter) error {
+// metadataUpdatedAt is the time the incoming data was produced, if known. A
+// zero value is never newer than a conflicting instance's metadata.
+// upserting is the type of record upsertRecordFunc upserts, which decides
+// whether stale IP addresses are removed in IPAssociationModeUnion.
+// The returned bool reports whether the metadata or userdata record was newly
+// inserted, as reported by upsertRecordFunc.
+func doUpsert(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string, metadataUpdatedAt time.Time, upserting recordType, upsertRecordFunc RecordUpserter) (bool, error) {
 	logger.Sugar().Info("doUpsert starting for id: ", id, " - upserting IPs ", ipAddresses)
 
 	ctx = boil.WithDebug(ctx, true)
@@ -97,9 +334,14 @@ func doUpsert(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, i
 	ctxWithTimeout, cancel := context.WithTimeout(ctx, viper.GetDuration("crdb.tx_timeout"))
 	defer cancel()
 
-	tx, err := db.BeginTx(ctxWithTimeout, nil)
+	txOpts, err := TxOptions()
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	tx, err := db.BeginTx(ctxWithTimeout, txOpts)
+	if err != nil {
+		return false, err
 	}
 
 	// If there's an error, we'll want to roll back the transaction.
@@ -122,13 +364,16 @@ func doUpsert(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, i
 	instanceIPAddresses, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(id)).All(ctxWithTimeout, db)
 	if err != nil {
 		logger.Sugar().Error("doUpsert DB error when selecting instanceIPAddresses for update: ", err)
-		return err
+		return false, err
 	}
 
-	conflictIPs, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.Address.IN(ipAddresses), models.InstanceIPAddressWhere.InstanceID.NEQ(id)).All(ctxWithTimeout, db)
+	conflictIPs, err := selectConflictIPs(ctxWithTimeout, db, tx, id, ipAddresses)
 	if err != nil {
+		txErr = true
+
 		logger.Sugar().Error("doUpsert DB error when selecting conflictIPs for update: ", err)
-		return err
+
+		return false, err
 	}
 
 	// Step 2.a
@@ -179,23 +424,97 @@ func doUpsert(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, i
 	// Step 3
 	// Remove any instance_ip_address rows for the specified IP addresses that
 	// are currently associated to a *different* instance ID
+	// If crdb.ip_conflict_require_newer is set, an IP is only taken from the
+	// other instance when the incoming data is newer than the other instance's
+	// metadata. Otherwise, depending on crdb.ip_conflict_policy, either the IP
+	// is left where it is and won't be associated to this instance, or the
+	// whole upsert is rejected.
+	// If crdb.ip_conflict_delete_orphans is set, the other instance's metadata
+	// and userdata are deleted too once its last IP is taken, since it's been
+	// deprovisioned.
+	var (
+		retainedConflictIPs models.InstanceIPAddressSlice
+		takenFromInstances  []string
+	)
+
+	conflictPolicy, err := IPConflictPolicy()
+	if err != nil {
+		txErr = true
+
+		return false, err
+	}
+
 	for _, conflictingIP := range conflictIPs {
-		// TODO: Maybe remove instance_metadata and instance_userdata records for the "old" instance ID(s)?
-		// Potentially after checking to see if this IP was the *last* IP address associated to the
-		// "old" instance ID?
+		if viper.GetBool("crdb.ip_conflict_require_newer") {
+			newer, err := isNewerThanInstanceMetadata(ctxWithTimeout, tx, conflictingIP.InstanceID, metadataUpdatedAt)
+			if err != nil {
+				txErr = true
+
+				logger.Sugar().Error("doUpsert DB error when checking conflicting instance metadata: ", err)
+
+				return false, err
+			}
+
+			if !newer && conflictPolicy == IPConflictPolicyReject {
+				txErr = true
+
+				return false, fmt.Errorf("%w: %s is associated to instance %s", ErrIPConflictNotNewer, conflictingIP.Address, conflictingIP.InstanceID)
+			}
+
+			if !newer {
+				logger.Sugar().Warn("Not taking IP ", conflictingIP.Address, " from instance ", conflictingIP.InstanceID, " for instance ", id, ": existing metadata is newer")
+
+				retainedConflictIPs = append(retainedConflictIPs, conflictingIP)
+
+				continue
+			}
+		}
+
 		_, err := conflictingIP.Delete(ctxWithTimeout, tx)
 		if err != nil {
 			txErr = true
 
 			logger.Sugar().Error("doUpsert DB error when deleting conflictIPs: ", err)
 
-			return err
+			return false, err
+		}
+
+		if !slices.Contains(takenFromInstances, conflictingIP.InstanceID) {
+			takenFromInstances = append(takenFromInstances, conflictingIP.InstanceID)
+		}
+	}
+
+	if viper.GetBool("crdb.ip_conflict_delete_orphans") {
+		for _, oldID := range takenFromInstances {
+			if err := deleteOrphanedInstance(ctxWithTimeout, tx, logger, oldID); err != nil {
+				txErr = true
+
+				logger.Sugar().Error("doUpsert DB error when deleting the records of orphaned instance ", oldID, ": ", err)
+
+				return false, err
+			}
 		}
 	}
 
 	// Step 4
 	// Remove any "stale" instance_ip_addresses rows associated to the provided
-	// instnace_id but were not specified in the call.
+	// instnace_id but were not specified in the call. In union mode, they're
+	// kept if they may belong to the instance's other record type.
+	keepStale, err := keepStaleIPs(ctxWithTimeout, tx, id, upserting)
+	if err != nil {
+		txErr = true
+
+		logger.Sugar().Error("doUpsert DB error when checking for the instance's other record: ", err)
+
+		return false, err
+	}
+
+	if keepStale && len(staleInstanceIPAddresses) > 0 {
+		logger.Sugar().Info("Keeping ", len(staleInstanceIPAddresses), " stale IPs for instance ", id, " in union IP association mode")
+
+		staleInstanceIPAddresses = nil
+	}
+
 	for _, staleIP := range staleInstanceIPAddresses {
 		_, err := staleIP.Delete(ctxWithTimeout, tx)
 		if err != nil {
@@ -203,7 +522,7 @@ func doUpsert(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, i
 
 			logger.Sugar().Error("doUpsert DB error when deleting staleIPs: ", err)
 
-			return err
+			return false, err
 		}
 	}
 
@@ -211,13 +530,17 @@ func doUpsert(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, i
 	// Create instance_ip_addresses rows for any IP addresses specified in the
 	// call that aren't already associated to the provided instance_id
 	for _, newInstanceIP := range newInstanceIPAddresses {
+		if containsAddress(retainedConflictIPs, newInstanceIP.Address) {
+			continue
+		}
+
 		err := newInstanceIP.Insert(ctxWithTimeout, tx, boil.Infer())
 		if err != nil {
 			txErr = true
 
 			logger.Sugar().Error("doUpsert DB error when inserting newInstanceIPs: ", err)
 
-			return err
+			return false, err
 		}
 	}
 
@@ -227,12 +550,19 @@ func doUpsert(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, i
 	// is no current row for instance_id. If there is an existing row matching on
 	// instance_id, instead this will just update the metadata or userdata column
 	// value.
-	if err := upsertRecordFunc(ctxWithTimeout, tx); err != nil {
+	created, err := upsertRecordFunc(ctxWithTimeout, tx)
+	if errors.Is(err, ErrExistingUserdataIsNewer) {
+		txErr = true
+
+		return false, err
+	}
+
+	if err != nil {
 		txErr = true
 
 		logger.Sugar().Error("doUpsert DB error when upserting the instance_metadata or instance_userdata table: ", err)
 
-		return err
+		return false, err
 	}
 
 	// Step 7
@@ -243,8 +573,117 @@ func doUpsert(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, i
 
 		logger.Sugar().Warn("Unable to commit db upsert transaction for instance: ", id, "Error: ", err)
 
+		return false, err
+	}
+
+	// The instance's IP addresses, and those taken from other instances,
+	// may now identify a different instance than the cached one.
+	middleware.InstanceIPCache().Invalidate(id, ipAddresses...)
+
+	return created, nil
+}
+
+// selectConflictIPs returns the instance_ip_addresses rows for the given
+// addresses which are associated to a different instance.
+// If crdb.lock_ips_in_chunks is set, the rows are instead selected FOR UPDATE
+// within the transaction, ipLockChunkSize addresses at a time, so conflict
+// detection still holds for instances with a very large number of IPs. The
+// addresses are sorted first, so concurrent upserts lock rows in the same order
+// and can't deadlock each other.
+func selectConflictIPs(ctx context.Context, db *sqlx.DB, tx boil.ContextExecutor, id string, ipAddresses []string) (models.InstanceIPAddressSlice, error) {
+	if !viper.GetBool("crdb.lock_ips_in_chunks") {
+		return models.InstanceIPAddresses(models.InstanceIPAddressWhere.Address.IN(ipAddresses), models.InstanceIPAddressWhere.InstanceID.NEQ(id)).All(ctx, db)
+	}
+
+	sortedIPs := slices.Clone(ipAddresses)
+	slices.Sort(sortedIPs)
+
+	var conflictIPs models.InstanceIPAddressSlice
+
+	for start := 0; start < len(sortedIPs); start += ipLockChunkSize {
+		chunk := sortedIPs[start:min(start+ipLockChunkSize, len(sortedIPs))]
+
+		chunkConflictIPs, err := models.InstanceIPAddresses(
+			models.InstanceIPAddressWhere.Address.IN(chunk),
+			models.InstanceIPAddressWhere.InstanceID.NEQ(id),
+			qm.OrderBy(models.InstanceIPAddressColumns.Address),
+			qm.For("UPDATE"),
+		).All(ctx, tx)
+		if err != nil {
+			return nil, err
+		}
+
+		conflictIPs = append(conflictIPs, chunkConflictIPs...)
+	}
+
+	return conflictIPs, nil
+}
+
+// deleteOrphanedInstance deletes the metadata and userdata stored for an
+// instance whose IP addresses were all taken by other instances. Instances
+// with IP addresses left are kept.
+func deleteOrphanedInstance(ctx context.Context, exec boil.ContextExecutor, logger *zap.Logger, instanceID string) error {
+	remaining, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).Count(ctx, exec)
+	if err != nil || remaining > 0 {
+		return err
+	}
+
+	deletedMetadata, err := models.InstanceMetadata(models.InstanceMetadatumWhere.ID.EQ(instanceID)).DeleteAll(ctx, exec)
+	if err != nil {
 		return err
 	}
 
+	if deletedMetadata > 0 {
+		if err := history.RecordMetadata(ctx, exec, instanceID, nil, now()); err != nil {
+			return err
+		}
+	}
+
+	deletedUserdata, err := models.InstanceUserdata(models.InstanceUserdatumWhere.ID.EQ(instanceID)).DeleteAll(ctx, exec)
+	if err != nil {
+		return err
+	}
+
+	deletedVariants, err := variants.DeleteAll(ctx, exec, instanceID)
+	if err != nil {
+		return err
+	}
+
+	if deletedMetadata > 0 || deletedUserdata > 0 || deletedVariants > 0 {
+		logger.Sugar().Info("Deleted the records of instance ", instanceID, " after its last IP address was taken")
+	}
+
 	return nil
 }
+
+// isNewerThanInstanceMetadata reports whether updatedAt is newer than the
+// stored metadata for the given instance. A zero updatedAt is never newer, and
+// an instance without any stored metadata is always considered older.
+func isNewerThanInstanceMetadata(ctx context.Context, exec boil.ContextExecutor, instanceID string, updatedAt time.Time) (bool, error) {
+	existing, err := models.FindInstanceMetadatum(ctx, exec, instanceID, models.InstanceMetadatumColumns.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return true, nil
+		}
+
+		return false, err
+	}
+
+	if updatedAt.IsZero() {
+		return false, nil
+	}
+
+	return updatedAt.After(existing.UpdatedAt), nil
+}
+
+// containsAddress reports whether the given address is present in the slice
+// of instance_ip_addresses rows.
+func containsAddress(instanceIPs models.InstanceIPAddressSlice, address string) bool {
+	for _, instanceIP := range instanceIPs {
+		if strings.EqualFold(instanceIP.Address, address) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -2,16 +2,27 @@ package upserter_test
 
 import (
 	"context"
+	"fmt"
+	"net"
 	"testing"
 	"time"
 
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/volatiletech/null/v8"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"github.com/volatiletech/sqlboiler/v4/queries/qm"
 	"github.com/volatiletech/sqlboiler/v4/types"
 	"go.uber.org/zap"
 
 	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/middleware"
 	"go.hollow.sh/metadataservice/internal/models"
 	"go.hollow.sh/metadataservice/internal/upserter"
 )
@@ -45,7 +56,7 @@ func TestUpsertMetadataAddsInstanceMetadataRow(t *testing.T) {
 		Metadata: types.JSON(instanceMetadata0),
 	}
 
-	err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &metadata)
+	_, err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &metadata)
 	assert.Nil(t, err)
 
 	exists, err = models.InstanceMetadatumExists(context.TODO(), testDB, instanceID)
@@ -69,7 +80,7 @@ func TestUpsertMetadataAddsInstanceIPAddressesRows(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &metadata)
+	_, err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &metadata)
 	assert.Nil(t, err)
 
 	newInstanceIPAddressesCount, err := models.InstanceIPAddresses().Count(context.TODO(), testDB)
@@ -97,7 +108,7 @@ func TestUpsertMetadataRemovesStaleInstanceIPAddressesRows(t *testing.T) {
 	}
 
 	// Insert the metadata record
-	err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &metadataInsert)
+	_, err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &metadataInsert)
 	assert.Nil(t, err)
 
 	// Check that 2 instance_ip_addresses rows were created
@@ -110,7 +121,7 @@ func TestUpsertMetadataRemovesStaleInstanceIPAddressesRows(t *testing.T) {
 
 	// Update the metadata record
 	newIPs := instanceIPs[:1]
-	err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, newIPs, &metadataUpdate)
+	_, err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, newIPs, &metadataUpdate)
 	assert.Nil(t, err)
 
 	// Check that now there is just 1 instance_ip_address row associated to the instance
@@ -134,7 +145,7 @@ func TestUpsertMetadataRemovesConflictingIPAddressesRows(t *testing.T) {
 		Metadata: types.JSON(`{"old":"metadata"}`),
 	}
 
-	err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), oldID, instanceIPs, &oldMetadata)
+	_, err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), oldID, instanceIPs, &oldMetadata)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -153,7 +164,7 @@ func TestUpsertMetadataRemovesConflictingIPAddressesRows(t *testing.T) {
 		Metadata: types.JSON(instanceMetadata0),
 	}
 
-	err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &newMetadata)
+	_, err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &newMetadata)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -175,6 +186,63 @@ func TestUpsertMetadataRemovesConflictingIPAddressesRows(t *testing.T) {
 	assert.Equal(t, 0, len(oldInstanceIPAddresses))
 }
 
+// Test that conflicting IPs are still resolved when the IP rows are locked in
+// chunks, for an instance with more IPs than fit in a single chunk.
+func TestUpsertMetadataRemovesConflictingIPAddressesRowsInChunks(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	viper.Set("crdb.lock_ips_in_chunks", true)
+	defer viper.Set("crdb.lock_ips_in_chunks", false)
+
+	manyIPs := make([]string, 0, 60)
+	for i := 1; i <= 60; i++ {
+		manyIPs = append(manyIPs, fmt.Sprintf("10.80.0.%d", i))
+	}
+
+	oldID := "1f36c15b-b3ef-45da-b7e8-f434287e2f03"
+	oldMetadata := models.InstanceMetadatum{
+		ID:       oldID,
+		Metadata: types.JSON(`{"old":"metadata"}`),
+	}
+
+	_, err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), oldID, manyIPs, &oldMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldCount, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(oldID)).Count(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, int64(60), oldCount)
+
+	// Upsert a new instance with all of the same IPs
+	newMetadata := models.InstanceMetadatum{
+		ID:       instanceID,
+		Metadata: types.JSON(instanceMetadata0),
+	}
+
+	_, err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, manyIPs, &newMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newCount, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).Count(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, int64(60), newCount)
+
+	oldCount, err = models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(oldID)).Count(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, int64(0), oldCount)
+}
+
 // Test that upsert userdata adds a new instance_userdata row to the DB
 func TestUpsertUserdataAddsInstanceMetadataRow(t *testing.T) {
 	testDB := dbtools.DatabaseTest(t)
@@ -191,7 +259,7 @@ func TestUpsertUserdataAddsInstanceMetadataRow(t *testing.T) {
 		Userdata: null.NewBytes([]byte(instanceUserdata0), true),
 	}
 
-	err = upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &userdata)
+	_, err = upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &userdata)
 	assert.Nil(t, err)
 
 	exists, err = models.InstanceUserdatumExists(context.TODO(), testDB, instanceID)
@@ -215,7 +283,7 @@ func TestUpsertUserdataAddsInstanceIPAddressesRows(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &userdata)
+	_, err = upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &userdata)
 	assert.Nil(t, err)
 
 	newInstanceIPAddressesCount, err := models.InstanceIPAddresses().Count(context.TODO(), testDB)
@@ -243,7 +311,7 @@ func TestUpsertUserdataRemovesStaleInstanceIPAddressesRows(t *testing.T) {
 	}
 
 	// Insert the userdata record
-	err := upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &userdataInsert)
+	_, err := upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &userdataInsert)
 	assert.Nil(t, err)
 
 	// Check that 2 instance_ip_addresses rows were created
@@ -256,7 +324,7 @@ func TestUpsertUserdataRemovesStaleInstanceIPAddressesRows(t *testing.T) {
 
 	// Update the userdata record
 	newIPs := instanceIPs[:1]
-	err = upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, newIPs, &userdataUpdate)
+	_, err = upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, newIPs, &userdataUpdate)
 	assert.Nil(t, err)
 
 	// Check that now there is just 1 instance_ip_address row associated to the instance
@@ -283,8 +351,9 @@ func TestMetadataUpsertModifiesUpdateAtField(t *testing.T) {
 	}
 
 	// Insert the metadata record
-	err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &metadataInsert)
+	created, err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &metadataInsert)
 	assert.Nil(t, err)
+	assert.True(t, created)
 
 	m1, err := models.InstanceMetadata(models.InstanceMetadatumWhere.ID.EQ(instanceID)).One(context.TODO(), testDB)
 	if err != nil {
@@ -292,8 +361,9 @@ func TestMetadataUpsertModifiesUpdateAtField(t *testing.T) {
 	}
 
 	// Update the metadata record
-	err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &metadataUpdate)
+	created, err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &metadataUpdate)
 	assert.Nil(t, err)
+	assert.False(t, created)
 
 	m2, err := models.InstanceMetadata(models.InstanceMetadatumWhere.ID.EQ(instanceID)).One(context.TODO(), testDB)
 	if err != nil {
@@ -318,8 +388,9 @@ func TestUserdataUpsertModifiesUpdateAtField(t *testing.T) {
 	}
 
 	// Insert the userdata record
-	err := upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &userdataInsert)
+	created, err := upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &userdataInsert)
 	assert.Nil(t, err)
+	assert.True(t, created)
 
 	u1, err := models.InstanceUserdata(models.InstanceUserdatumWhere.ID.EQ(instanceID)).One(context.TODO(), testDB)
 	if err != nil {
@@ -327,8 +398,9 @@ func TestUserdataUpsertModifiesUpdateAtField(t *testing.T) {
 	}
 
 	// Update the userdata record
-	err = upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &userdataUpdate)
+	created, err = upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &userdataUpdate)
 	assert.Nil(t, err)
+	assert.False(t, created)
 
 	u2, err := models.InstanceUserdata(models.InstanceUserdatumWhere.ID.EQ(instanceID)).One(context.TODO(), testDB)
 	if err != nil {
@@ -350,7 +422,7 @@ func TestUpsertUserdataRemovesConflictingIPAddressesRows(t *testing.T) {
 		Metadata: types.JSON(`{"old":"metadata"}`),
 	}
 
-	err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), oldID, instanceIPs, &oldMetadata)
+	_, err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), oldID, instanceIPs, &oldMetadata)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -369,7 +441,7 @@ func TestUpsertUserdataRemovesConflictingIPAddressesRows(t *testing.T) {
 		Userdata: null.NewBytes([]byte(instanceUserdata0), true),
 	}
 
-	err = upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &newUserdata)
+	_, err = upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &newUserdata)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -390,3 +462,627 @@ func TestUpsertUserdataRemovesConflictingIPAddressesRows(t *testing.T) {
 
 	assert.Equal(t, 0, len(oldInstanceIPAddresses))
 }
+
+// Test that when crdb.ip_conflict_require_newer is set, an upsert with data
+// older than the conflicting instance's metadata doesn't take its IPs, while
+// an upsert with newer data does.
+func TestUpsertMetadataConflictRequiresNewer(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	viper.Set("crdb.ip_conflict_require_newer", true)
+	defer viper.Set("crdb.ip_conflict_require_newer", false)
+
+	// Create an "old" record, which will be stored with an updated_at of now.
+	oldID := "1f36c15b-b3ef-45da-b7e8-f434287e2f03"
+	oldMetadata := models.InstanceMetadatum{
+		ID:       oldID,
+		Metadata: types.JSON(`{"old":"metadata"}`),
+	}
+
+	_, err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), oldID, instanceIPs, &oldMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a racing system pushing data produced before the "old" record
+	// was written. The upsert should succeed, but shouldn't take the IPs.
+	staleMetadata := models.InstanceMetadatum{
+		ID:        instanceID,
+		Metadata:  types.JSON(instanceMetadata0),
+		UpdatedAt: time.Now().Add(-1 * time.Hour),
+	}
+
+	_, err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &staleMetadata)
+	assert.Nil(t, err)
+
+	exists, err := models.InstanceMetadatumExists(context.TODO(), testDB, instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, exists)
+
+	oldCount, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(oldID)).Count(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newCount, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).Count(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, int64(2), oldCount)
+	assert.Equal(t, int64(0), newCount)
+
+	// Now push data produced after the "old" record was written. This time the
+	// IPs should be taken.
+	freshMetadata := models.InstanceMetadatum{
+		ID:        instanceID,
+		Metadata:  types.JSON(instanceMetadata1),
+		UpdatedAt: time.Now().Add(1 * time.Minute),
+	}
+
+	_, err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &freshMetadata)
+	assert.Nil(t, err)
+
+	oldCount, err = models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(oldID)).Count(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newCount, err = models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).Count(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, int64(0), oldCount)
+	assert.Equal(t, int64(2), newCount)
+}
+
+// TestUpsertMetadataConflictZeroUpdatedAtIsNotNewer tests that an upsert
+// without a producer time never takes IPs from the conflicting instance.
+func TestUpsertMetadataConflictZeroUpdatedAtIsNotNewer(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	setViper(t, "crdb.ip_conflict_require_newer", true)
+
+	oldID := "1f36c15b-b3ef-45da-b7e8-f434287e2f03"
+	oldMetadata := models.InstanceMetadatum{
+		ID:       oldID,
+		Metadata: types.JSON(`{"old":"metadata"}`),
+	}
+
+	_, err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), oldID, instanceIPs, &oldMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A zero UpdatedAt isn't newer than the stored record, so the IPs should
+	// stay where they are.
+	newMetadata := models.InstanceMetadatum{
+		ID:       instanceID,
+		Metadata: types.JSON(instanceMetadata0),
+	}
+
+	_, err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &newMetadata)
+	assert.Nil(t, err)
+
+	oldCount, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(oldID)).Count(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, int64(2), oldCount)
+}
+
+// TestUpsertMetadataConflictPolicyReject tests that with crdb.ip_conflict_policy
+// set to reject, an upsert with data older than the conflicting instance's
+// metadata fails without changing anything, while one with newer data takes
+// the IPs.
+func TestUpsertMetadataConflictPolicyReject(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	setViper(t, "crdb.ip_conflict_require_newer", true)
+	setViper(t, "crdb.ip_conflict_policy", upserter.IPConflictPolicyReject)
+
+	oldID := "1f36c15b-b3ef-45da-b7e8-f434287e2f03"
+	oldMetadata := models.InstanceMetadatum{
+		ID:       oldID,
+		Metadata: types.JSON(`{"old":"metadata"}`),
+	}
+
+	_, err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), oldID, instanceIPs, &oldMetadata)
+	require.NoError(t, err)
+
+	// A racing system pushes data produced before the "old" record was
+	// written.
+	staleMetadata := models.InstanceMetadatum{
+		ID:        instanceID,
+		Metadata:  types.JSON(instanceMetadata0),
+		UpdatedAt: time.Now().Add(-1 * time.Hour),
+	}
+
+	_, err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &staleMetadata)
+	assert.ErrorIs(t, err, upserter.ErrIPConflictNotNewer)
+
+	exists, err := models.InstanceMetadatumExists(context.TODO(), testDB, instanceID)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	oldCount, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(oldID)).Count(context.TODO(), testDB)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), oldCount)
+
+	// Newer data takes the IPs as usual.
+	freshMetadata := models.InstanceMetadatum{
+		ID:        instanceID,
+		Metadata:  types.JSON(instanceMetadata1),
+		UpdatedAt: time.Now().Add(1 * time.Minute),
+	}
+
+	_, err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &freshMetadata)
+	require.NoError(t, err)
+
+	newCount, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).Count(context.TODO(), testDB)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), newCount)
+}
+
+// Test that, depending on crdb.ip_association_mode, pushing userdata with a
+// different set of IP addresses than the instance's metadata either replaces
+// the instance's IP addresses, or adds to them.
+func TestUpsertIPAssociationMode(t *testing.T) {
+	defer viper.Set("crdb.ip_association_mode", "")
+
+	metadataIPs := []string{"1.2.3.4", "1.2.3.5"}
+	userdataIPs := []string{"1.2.3.5", "1.2.3.6"}
+
+	type testCase struct {
+		testName             string
+		mode                 string
+		expectedIPs          []string
+		expectedIPsAfterData []string
+	}
+
+	testCases := []testCase{
+		{
+			"replace",
+			upserter.IPAssociationModeReplace,
+			[]string{"1.2.3.5", "1.2.3.6"},
+			[]string{"1.2.3.4"},
+		},
+		{
+			"default",
+			"",
+			[]string{"1.2.3.5", "1.2.3.6"},
+			[]string{"1.2.3.4"},
+		},
+		{
+			"union",
+			upserter.IPAssociationModeUnion,
+			[]string{"1.2.3.4", "1.2.3.5", "1.2.3.6"},
+			[]string{"1.2.3.4", "1.2.3.5", "1.2.3.6"},
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			testDB := dbtools.DatabaseTest(t)
+
+			viper.Set("crdb.ip_association_mode", testcase.mode)
+
+			instanceIPAddresses := func() []string {
+				rows, err := models.InstanceIPAddresses(
+					models.InstanceIPAddressWhere.InstanceID.EQ(instanceID),
+					qm.OrderBy(models.InstanceIPAddressColumns.Address),
+				).All(context.TODO(), testDB)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				addresses := []string{}
+
+				for _, row := range rows {
+					addresses = append(addresses, row.Address)
+				}
+
+				return addresses
+			}
+
+			metadata := models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(instanceMetadata0)}
+			_, err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, metadataIPs, &metadata)
+			assert.Nil(t, err)
+
+			userdata := models.InstanceUserdatum{ID: instanceID, Userdata: null.NewBytes([]byte(instanceUserdata0), true)}
+			_, err = upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, userdataIPs, &userdata)
+			assert.Nil(t, err)
+
+			assert.Equal(t, testcase.expectedIPs, instanceIPAddresses())
+
+			// Pushing the metadata again with fewer IPs doesn't remove the
+			// IPs pushed with the userdata in union mode.
+			metadata = models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(instanceMetadata1)}
+			_, err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, metadataIPs[:1], &metadata)
+			assert.Nil(t, err)
+
+			assert.Equal(t, testcase.expectedIPsAfterData, instanceIPAddresses())
+		})
+	}
+}
+
+// Test that stale IP addresses are still removed in union mode when the
+// instance has no record of the other type.
+func TestUpsertIPAssociationModeUnionWithoutOtherRecord(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	viper.Set("crdb.ip_association_mode", upserter.IPAssociationModeUnion)
+	defer viper.Set("crdb.ip_association_mode", "")
+
+	metadata := models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(instanceMetadata0)}
+	_, err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &metadata)
+	assert.Nil(t, err)
+
+	metadata = models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(instanceMetadata1)}
+	_, err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs[:1], &metadata)
+	assert.Nil(t, err)
+
+	count, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).Count(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, int64(1), count)
+}
+
+// Test that, in union mode, a metadata upsert keeps the IP addresses which
+// may have been pushed with the instance's userdata variants.
+func TestUpsertIPAssociationModeUnionWithUserdataVariant(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	viper.Set("crdb.ip_association_mode", upserter.IPAssociationModeUnion)
+	defer viper.Set("crdb.ip_association_mode", "")
+
+	userdata := models.InstanceUserdatum{ID: instanceID, Userdata: null.BytesFrom([]byte(instanceUserdata0))}
+	_, err := upserter.UpsertUserdataVariant(context.TODO(), testDB, zap.NewNop(), instanceID, "ignition", instanceIPs, &userdata)
+	require.NoError(t, err)
+
+	metadata := models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(instanceMetadata0)}
+	_, err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs[:1], &metadata)
+	require.NoError(t, err)
+
+	count, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).Count(context.TODO(), testDB)
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(len(instanceIPs)), count)
+}
+
+// TestUpsertUserdataVariantUsesClock tests that userdata variants are stored
+// with the upserter's clock, which later upserts are compared against.
+func TestUpsertUserdataVariantUsesClock(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	// Store the variant as if it were an hour from now
+	restore := upserter.SetNow(func() time.Time { return time.Now().Add(1 * time.Hour) })
+	defer restore()
+
+	userdata := models.InstanceUserdatum{ID: instanceID, Userdata: null.BytesFrom([]byte(instanceUserdata0))}
+	_, err := upserter.UpsertUserdataVariant(context.TODO(), testDB, zap.NewNop(), instanceID, "ignition", instanceIPs, &userdata)
+	require.NoError(t, err)
+
+	// Userdata produced now is older than the stored variant, so it's
+	// skipped
+	userdata = models.InstanceUserdatum{ID: instanceID, Userdata: null.BytesFrom([]byte(instanceUserdata1)), UpdatedAt: time.Now()}
+	_, err = upserter.UpsertUserdataVariant(context.TODO(), testDB, zap.NewNop(), instanceID, "ignition", instanceIPs, &userdata)
+	assert.ErrorIs(t, err, upserter.ErrExistingUserdataIsNewer)
+}
+
+func TestIPAssociationMode(t *testing.T) {
+	defer viper.Set("crdb.ip_association_mode", "")
+
+	type testCase struct {
+		testName     string
+		mode         string
+		expectedMode string
+		expectedErr  error
+	}
+
+	testCases := []testCase{
+		{"unset", "", upserter.IPAssociationModeReplace, nil},
+		{"replace", "replace", upserter.IPAssociationModeReplace, nil},
+		{"union", "union", upserter.IPAssociationModeUnion, nil},
+		{"unknown", "merge", "", upserter.ErrInvalidIPAssociationMode},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			viper.Set("crdb.ip_association_mode", testcase.mode)
+
+			mode, err := upserter.IPAssociationMode()
+			assert.ErrorIs(t, err, testcase.expectedErr)
+			assert.Equal(t, testcase.expectedMode, mode)
+		})
+	}
+}
+
+func TestIPConflictPolicy(t *testing.T) {
+	type testCase struct {
+		testName       string
+		policy         string
+		expectedPolicy string
+		expectedErr    error
+	}
+
+	testCases := []testCase{
+		{"unset", "", upserter.IPConflictPolicyKeep, nil},
+		{"keep", "keep", upserter.IPConflictPolicyKeep, nil},
+		{"reject", "reject", upserter.IPConflictPolicyReject, nil},
+		{"unknown", "steal", "", upserter.ErrInvalidIPConflictPolicy},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			setViper(t, "crdb.ip_conflict_policy", testcase.policy)
+
+			policy, err := upserter.IPConflictPolicy()
+			assert.ErrorIs(t, err, testcase.expectedErr)
+			assert.Equal(t, testcase.expectedPolicy, policy)
+		})
+	}
+}
+
+// TestStaleUserdataUpdatesAreIgnored tests that a userdata upsert produced
+// before the stored userdata was written is skipped, along with its IP
+// address changes, while one produced afterwards is applied.
+func TestStaleUserdataUpdatesAreIgnored(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	userdataInsert := models.InstanceUserdatum{
+		ID:       instanceID,
+		Userdata: null.NewBytes([]byte(instanceUserdata0), true),
+	}
+
+	_, err := upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &userdataInsert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a replayed write produced before the stored userdata was
+	// written.
+	staleUserdata := models.InstanceUserdatum{
+		ID:        instanceID,
+		Userdata:  null.NewBytes([]byte(instanceUserdata1), true),
+		UpdatedAt: time.Now().Add(-1 * time.Hour),
+	}
+
+	created, err := upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, []string{"5.6.7.8"}, &staleUserdata)
+	assert.ErrorIs(t, err, upserter.ErrExistingUserdataIsNewer)
+	assert.False(t, created)
+
+	userdata, err := models.FindInstanceUserdatum(context.TODO(), testDB, instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, instanceUserdata0, string(userdata.Userdata.Bytes))
+
+	count, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).Count(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, int64(len(instanceIPs)), count)
+
+	// Userdata produced after the stored userdata was written is applied.
+	freshUserdata := models.InstanceUserdatum{
+		ID:        instanceID,
+		Userdata:  null.NewBytes([]byte(instanceUserdata1), true),
+		UpdatedAt: time.Now().Add(1 * time.Minute),
+	}
+
+	created, err = upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &freshUserdata)
+	assert.Nil(t, err)
+	assert.False(t, created)
+
+	userdata, err = models.FindInstanceUserdatum(context.TODO(), testDB, instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, instanceUserdata1, string(userdata.Userdata.Bytes))
+}
+
+// TestUpsertConflictDeletesOrphans tests that with crdb.ip_conflict_delete_orphans
+// set, taking the last IP address of another instance also deletes that
+// instance's metadata and userdata, while instances which keep some IP
+// addresses, or any instance without the option set, keep their records.
+func TestUpsertConflictDeletesOrphans(t *testing.T) {
+	type testCase struct {
+		testName        string
+		deleteOrphans   bool
+		takenIPs        []string
+		expectedDeleted bool
+	}
+
+	testCases := []testCase{
+		{"last IP taken", true, instanceIPs, true},
+		{"some IPs left", true, instanceIPs[:1], false},
+		{"last IP taken without the option", false, instanceIPs, false},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			testDB := dbtools.DatabaseTest(t)
+
+			viper.Set("crdb.ip_conflict_delete_orphans", testcase.deleteOrphans)
+			defer viper.Set("crdb.ip_conflict_delete_orphans", false)
+
+			oldID := "1f36c15b-b3ef-45da-b7e8-f434287e2f03"
+			oldMetadata := models.InstanceMetadatum{
+				ID:       oldID,
+				Metadata: types.JSON(`{"old":"metadata"}`),
+			}
+			oldUserdata := models.InstanceUserdatum{
+				ID:       oldID,
+				Userdata: null.NewBytes([]byte(instanceUserdata0), true),
+			}
+
+			if _, err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), oldID, instanceIPs, &oldMetadata); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), oldID, instanceIPs, &oldUserdata); err != nil {
+				t.Fatal(err)
+			}
+
+			newMetadata := models.InstanceMetadatum{
+				ID:       instanceID,
+				Metadata: types.JSON(instanceMetadata0),
+			}
+
+			if _, err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, testcase.takenIPs, &newMetadata); err != nil {
+				t.Fatal(err)
+			}
+
+			metadataExists, err := models.InstanceMetadatumExists(context.TODO(), testDB, oldID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			userdataExists, err := models.InstanceUserdatumExists(context.TODO(), testDB, oldID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, !testcase.expectedDeleted, metadataExists)
+			assert.Equal(t, !testcase.expectedDeleted, userdataExists)
+		})
+	}
+}
+
+// upsertDurationCount returns the number of upserts of the record type
+// observed by the MetricUpsertDuration histogram.
+func upsertDurationCount(t *testing.T, recordType string) uint64 {
+	t.Helper()
+
+	histogram, ok := middleware.MetricUpsertDuration.WithLabelValues(recordType).(prometheus.Histogram)
+	require.True(t, ok)
+
+	metric := &dto.Metric{}
+	require.NoError(t, histogram.Write(metric))
+
+	return metric.GetHistogram().GetSampleCount()
+}
+
+// Test that upserts are observed by the upsert duration histogram
+func TestUpsertDurationMetric(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	metadataBefore := upsertDurationCount(t, "metadata")
+	userdataBefore := upsertDurationCount(t, "userdata")
+
+	metadata := models.InstanceMetadatum{
+		ID:       instanceID,
+		Metadata: types.JSON(instanceMetadata0),
+	}
+
+	_, err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &metadata)
+	require.NoError(t, err)
+
+	assert.Equal(t, metadataBefore+1, upsertDurationCount(t, "metadata"))
+	assert.Equal(t, userdataBefore, upsertDurationCount(t, "userdata"))
+
+	userdata := models.InstanceUserdatum{
+		ID:       instanceID,
+		Userdata: null.BytesFrom([]byte(instanceUserdata0)),
+	}
+
+	_, err = upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &userdata)
+	require.NoError(t, err)
+
+	assert.Equal(t, metadataBefore+1, upsertDurationCount(t, "metadata"))
+	assert.Equal(t, userdataBefore+1, upsertDurationCount(t, "userdata"))
+}
+
+// unreachableDBURL is the URL of a database nothing is listening on, so every
+// transaction fails to connect.
+const unreachableDBURL = "postgres://root@localhost:12341/defaultdb?sslmode=disable"
+
+// setViper sets the config key for the rest of the test, then restores its
+// previous value, leaving the defaults set by other tests in effect.
+func setViper(t *testing.T, key string, value interface{}) {
+	t.Helper()
+
+	previous := viper.Get(key)
+	viper.Set(key, value)
+
+	t.Cleanup(func() { viper.Set(key, previous) })
+}
+
+// Test that retried upserts are counted, and so are upserts which fail even
+// after retrying
+func TestUpsertRetryMetrics(t *testing.T) {
+	setViper(t, "crdb.max_retries", 2)
+	setViper(t, "crdb.retry_interval", time.Millisecond)
+	setViper(t, "crdb.tx_timeout", time.Second)
+
+	db, err := sqlx.Open("postgres", unreachableDBURL)
+	require.NoError(t, err)
+
+	retries := middleware.MetricUpsertRetries.WithLabelValues("userdata")
+	exhausted := middleware.MetricUpsertRetryExhausted.WithLabelValues("userdata")
+
+	retriesBefore := testutil.ToFloat64(retries)
+	exhaustedBefore := testutil.ToFloat64(exhausted)
+
+	userdata := &models.InstanceUserdatum{ID: instanceID, Userdata: null.BytesFrom([]byte(instanceUserdata0))}
+
+	_, err = upserter.UpsertUserdata(context.TODO(), db, zap.NewNop(), instanceID, instanceIPs, userdata)
+
+	var netErr *net.OpError
+	require.ErrorAs(t, err, &netErr)
+
+	assert.Equal(t, retriesBefore+2, testutil.ToFloat64(retries))
+	assert.Equal(t, exhaustedBefore+1, testutil.ToFloat64(exhausted))
+}
+
+// Test that an upsert succeeding after a transient error is counted as a
+// retry, but not as exhausting its retries
+func TestUpsertRetryMetricsTransientError(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	retries := middleware.MetricUpsertRetries.WithLabelValues("metadata")
+	exhausted := middleware.MetricUpsertRetryExhausted.WithLabelValues("metadata")
+
+	retriesBefore := testutil.ToFloat64(retries)
+	exhaustedBefore := testutil.ToFloat64(exhausted)
+
+	// Fail the first attempt with a serialization error, like CockroachDB
+	// returns under contention.
+	attempts := 0
+	flakyUpserter := func(c context.Context, exec boil.ContextExecutor) (bool, error) {
+		attempts++
+		if attempts == 1 {
+			return false, &pq.Error{Code: "40001", Message: "restart transaction"}
+		}
+
+		metadata := &models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(instanceMetadata0)}
+
+		return true, metadata.Insert(c, exec, boil.Infer())
+	}
+
+	_, err := upserter.UpsertMetadataWithRecordUpserter(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, flakyUpserter)
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, retriesBefore+1, testutil.ToFloat64(retries))
+	assert.Equal(t, exhaustedBefore, testutil.ToFloat64(exhausted))
+}
@@ -0,0 +1,9 @@
+// Package variants stores additional userdata variants for an instance, like
+// an ignition config alongside its cloud-init userdata, which are requested
+// by name. The instance's default userdata stays in instance_userdata.
+//
+// Unlike the tables in the models package, instance_userdata_variants is
+// queried by hand: it's keyed by (instance_id, variant), and only ever read
+// or written by the few queries here, within the upserter's and the delete
+// handlers' transactions.
+package variants // import go.hollow.sh/metadataservice/internal/variants
@@ -0,0 +1,84 @@
+package variants
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/volatiletech/sqlboiler/v4/boil"
+)
+
+// Userdata is a userdata variant stored for an instance. Compressed reports
+// whether the userdata was gzip'd before it was stored.
+type Userdata struct {
+	InstanceID string
+	Variant    string
+	Userdata   []byte
+	Compressed bool
+	UpdatedAt  time.Time
+}
+
+// Find returns the named userdata variant stored for an instance, or
+// sql.ErrNoRows if there isn't one.
+func Find(ctx context.Context, exec boil.ContextExecutor, instanceID, variant string) (*Userdata, error) {
+	userdata := &Userdata{InstanceID: instanceID, Variant: variant}
+
+	row := exec.QueryRowContext(ctx,
+		"SELECT userdata, compressed, updated_at FROM instance_userdata_variants WHERE instance_id = $1 AND variant = $2",
+		instanceID, variant,
+	)
+
+	if err := row.Scan(&userdata.Userdata, &userdata.Compressed, &userdata.UpdatedAt); err != nil {
+		return nil, err
+	}
+
+	return userdata, nil
+}
+
+// Exists reports whether any userdata variant is stored for an instance.
+func Exists(ctx context.Context, exec boil.ContextExecutor, instanceID string) (bool, error) {
+	var exists bool
+
+	err := exec.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM instance_userdata_variants WHERE instance_id = $1)",
+		instanceID,
+	).Scan(&exists)
+
+	return exists, err
+}
+
+// Upsert stores the userdata variant, replacing any previous version of it,
+// with an updated_at of now. The returned bool reports whether the variant
+// was newly created. It should be called within the transaction updating
+// the instance's IP addresses.
+func Upsert(ctx context.Context, exec boil.ContextExecutor, userdata *Userdata, now time.Time) (bool, error) {
+	var exists bool
+
+	err := exec.QueryRowContext(ctx,
+		"SELECT true FROM instance_userdata_variants WHERE instance_id = $1 AND variant = $2",
+		userdata.InstanceID, userdata.Variant,
+	).Scan(&exists)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+
+	_, err = exec.ExecContext(ctx,
+		`INSERT INTO instance_userdata_variants (instance_id, variant, userdata, compressed, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $5)
+		ON CONFLICT (instance_id, variant) DO UPDATE SET userdata = excluded.userdata, compressed = excluded.compressed, updated_at = excluded.updated_at`,
+		userdata.InstanceID, userdata.Variant, userdata.Userdata, userdata.Compressed, now,
+	)
+
+	return !exists, err
+}
+
+// DeleteAll deletes every userdata variant stored for an instance, returning
+// how many were deleted.
+func DeleteAll(ctx context.Context, exec boil.ContextExecutor, instanceID string) (int64, error) {
+	result, err := exec.ExecContext(ctx, "DELETE FROM instance_userdata_variants WHERE instance_id = $1", instanceID)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,56 @@
+package metadataservice
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"github.com/volatiletech/sqlboiler/v4/types"
+
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+// InstanceTTLField is the top-level metadata field which, when set to a
+// number of seconds, overrides the global "cache_ttl" for the instance's
+// stored metadata and userdata, like for spot instances which change more
+// often than the rest.
+const InstanceTTLField = "_ttl_seconds"
+
+// cacheTTL returns how long the data stored for an instance with the given
+// metadata stays fresh: the instance's own TTL if its metadata has one, or
+// the global "cache_ttl" otherwise. A TTL of zero never expires data, and a
+// negative TTL always does.
+func cacheTTL(metadata types.JSON) time.Duration {
+	if ttl, ok := instanceCacheTTL(metadata); ok {
+		return ttl
+	}
+
+	return viper.GetDuration("cache_ttl")
+}
+
+// instanceCacheTTL returns the TTL in the metadata's InstanceTTLField, if it
+// has a numeric one.
+func instanceCacheTTL(metadata types.JSON) (time.Duration, bool) {
+	var fields struct {
+		TTLSeconds *float64 `json:"_ttl_seconds"`
+	}
+
+	if err := json.Unmarshal(metadata, &fields); err != nil || fields.TTLSeconds == nil {
+		return 0, false
+	}
+
+	return time.Duration(*fields.TTLSeconds * float64(time.Second)), true
+}
+
+// userdataCacheTTL returns how long the instance's stored userdata stays
+// fresh. Userdata has no TTL of its own, so the instance's stored metadata is
+// checked for one.
+func (r *Router) userdataCacheTTL(c *gin.Context, instanceID string) time.Duration {
+	metadata, err := models.FindInstanceMetadatum(c.Request.Context(), r.DB, instanceID, models.InstanceMetadatumColumns.Metadata)
+	if err != nil {
+		return viper.GetDuration("cache_ttl")
+	}
+
+	return cacheTTL(metadata.Metadata)
+}
@@ -0,0 +1,144 @@
+package metadataservice_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/volatiletech/sqlboiler/v4/types"
+	"go.hollow.sh/toolbox/ginjwt"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/lookup"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestCacheTTL(t *testing.T) {
+	viper.Set("cache_ttl", time.Hour)
+	defer viper.Set("cache_ttl", 0)
+
+	testCases := []struct {
+		testName string
+		metadata string
+		expected time.Duration
+	}{
+		{"no per-instance TTL", `{"hostname": "instance-a"}`, time.Hour},
+		{"short per-instance TTL", `{"_ttl_seconds": 30}`, 30 * time.Second},
+		{"fractional per-instance TTL", `{"_ttl_seconds": 1.5}`, 1500 * time.Millisecond},
+		{"per-instance TTL disabling expiry", `{"_ttl_seconds": 0}`, 0},
+		{"negative per-instance TTL", `{"_ttl_seconds": -1}`, -1 * time.Second},
+		{"non-numeric per-instance TTL", `{"_ttl_seconds": "30"}`, time.Hour},
+		{"invalid metadata", `not json`, time.Hour},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			assert.Equal(t, testcase.expected, v1api.CacheTTL(types.JSON(testcase.metadata)))
+		})
+	}
+}
+
+// TestGetPerInstanceCacheTTL tests that an instance's own TTL is used instead
+// of the global cache TTL to decide whether its stored metadata and userdata
+// are refreshed, and that instances without one still use the global TTL.
+func TestGetPerInstanceCacheTTL(t *testing.T) {
+	authMW, err := ginjwt.NewAuthMiddleware(ginjwt.AuthConfig{})
+	require.NoError(t, err)
+
+	lookupClient := newMockLookupClient()
+
+	// The clock is wound forward once the data is stored, rather than
+	// waiting for it to expire
+	var clockOffset time.Duration
+
+	rtr := v1api.NewRouter(zap.NewNop(), dbtools.DatabaseTest(t), authMW, lookupClient)
+	rtr.Now = func() time.Time { return time.Now().Add(clockOffset) }
+	router := testRouter(rtr)
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	viper.Set("cache_ttl", time.Hour)
+	defer viper.Set("cache_ttl", 0)
+
+	spotID := "0b1c2d3e-4f5a-4b6c-8d7e-9f0a1b2c3d4e"
+	spotIP := "192.168.60.1"
+
+	metadataBody, err := json.Marshal(&v1api.UpsertMetadataRequest{
+		ID:          spotID,
+		Metadata:    json.RawMessage(`{"hostname": "spot", "_ttl_seconds": 60}`),
+		IPAddresses: []string{spotIP},
+	})
+	require.NoError(t, err)
+
+	userdataBody, err := json.Marshal(&v1api.UpsertUserdataRequest{
+		ID:          spotID,
+		Userdata:    []byte("#cloud-config"),
+		IPAddresses: []string{spotIP},
+	})
+	require.NoError(t, err)
+
+	for path, body := range map[string][]byte{v1api.GetInternalMetadataPath(): metadataBody, v1api.GetInternalUserdataPath(): userdataBody} {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, path, bytes.NewReader(body))
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusCreated, w.Code, path)
+	}
+
+	clockOffset = 2 * time.Minute
+
+	refreshed := lookupResponse{
+		metadataResponse: lookup.MetadataLookupResponse{
+			ID:          spotID,
+			IPAddresses: []string{spotIP},
+			Metadata:    `{"hostname": "refreshed-spot", "_ttl_seconds": 60}`,
+		},
+		userdataResponse: lookup.UserdataLookupResponse{
+			ID:          spotID,
+			IPAddresses: []string{spotIP},
+			Userdata:    []byte("#cloud-config\nrefreshed: true"),
+		},
+	}
+	lookupClient.setResponse(spotID, refreshed)
+	lookupClient.setResponse(dbtools.FixtureInstanceA.InstanceID, refreshed)
+
+	type testCase struct {
+		testName      string
+		instanceIP    string
+		path          string
+		expectedCalls int
+	}
+
+	testCases := []testCase{
+		{"metadata with a short per-instance TTL", spotIP, v1api.GetMetadataPath(), 1},
+		{"userdata with a short per-instance TTL", spotIP, v1api.GetUserdataPath(), 1},
+		{"metadata without a per-instance TTL", dbtools.FixtureInstanceA.HostIPs[0], v1api.GetMetadataPath(), 0},
+		{"userdata without a per-instance TTL", dbtools.FixtureInstanceA.HostIPs[0], v1api.GetUserdataPath(), 0},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			lookupClient.calls = 0
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, testcase.path, nil)
+			req.RemoteAddr = net.JoinHostPort(testcase.instanceIP, "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, testcase.expectedCalls, lookupClient.calls)
+		})
+	}
+}
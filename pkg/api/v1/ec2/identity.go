@@ -0,0 +1,69 @@
+package ec2
+
+import (
+	"strings"
+)
+
+// IdentityDocumentVersion is the version of the identity document format,
+// matching the one served by the AWS instance metadata service.
+const IdentityDocumentVersion = "2017-09-30"
+
+// IdentityDocument represents the EC2-style instance identity document served
+// from the dynamic/instance-identity/document endpoint. Only the fields which
+// can be derived from the metadata are included.
+type IdentityDocument struct {
+	InstanceID       string `json:"instanceId"`
+	InstanceType     string `json:"instanceType,omitempty"`
+	ImageID          string `json:"imageId,omitempty"`
+	Architecture     string `json:"architecture,omitempty"`
+	Region           string `json:"region,omitempty"`
+	AvailabilityZone string `json:"availabilityZone,omitempty"`
+	PrivateIP        string `json:"privateIp,omitempty"`
+	Version          string `json:"version"`
+}
+
+// NewIdentityDocument builds the identity document for the metadata. The
+// instance type is the plan, and the image ID is the operating system slug.
+// The region and availability zone come from the facility's configured
+// placement, and without one, both are the facility itself. The architecture
+// is derived from the operating system slug or image tag, and is left empty
+// when neither names one.
+func NewIdentityDocument(metadata MetadataContainer) IdentityDocument {
+	doc := IdentityDocument{
+		InstanceID:       FirstItemValue(metadata, "instance-id"),
+		InstanceType:     FirstItemValue(metadata, "plan"),
+		ImageID:          FirstItemValue(metadata, "operating-system/slug"),
+		Architecture:     architecture(FirstItemValue(metadata, "operating-system/slug"), FirstItemValue(metadata, "operating-system/image-tag")),
+		Region:           FirstItemValue(metadata, "placement/region"),
+		AvailabilityZone: FirstItemValue(metadata, "placement/availability-zone"),
+		PrivateIP:        FirstItemValue(metadata, "local-ipv4"),
+		Version:          IdentityDocumentVersion,
+	}
+
+	if doc.Region == "" {
+		facility := FirstItemValue(metadata, "facility")
+
+		doc.Region = facility
+		doc.AvailabilityZone = facility
+	}
+
+	return doc
+}
+
+// architecture returns the EC2 architecture name ("x86_64" or "arm64") named
+// by any of the given operating system identifiers, like
+// "ubuntu_22_04_arm64", or an empty string if none of them name one.
+func architecture(identifiers ...string) string {
+	for _, identifier := range identifiers {
+		identifier = strings.ToLower(identifier)
+
+		switch {
+		case strings.Contains(identifier, "arm64"), strings.Contains(identifier, "aarch64"):
+			return "arm64"
+		case strings.Contains(identifier, "x86_64"), strings.Contains(identifier, "amd64"):
+			return "x86_64"
+		}
+	}
+
+	return ""
+}
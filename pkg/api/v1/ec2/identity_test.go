@@ -0,0 +1,77 @@
+package ec2_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/pkg/api/v1/ec2"
+)
+
+func TestNewIdentityDocument(t *testing.T) {
+	ec2.SetFacilityPlacements(map[string]ec2.Placement{"da11": {Region: "us-central", AvailabilityZone: "us-central-da11"}})
+	defer ec2.SetFacilityPlacements(nil)
+
+	type testCase struct {
+		testName string
+		metadata *ec2.Metadata
+		expected ec2.IdentityDocument
+	}
+
+	testCases := []testCase{
+		{
+			"facility with a placement",
+			&ec2.Metadata{
+				ID:              "e5e4bd27-2a33-4b5e-9d3a-0c1e2c2f1b4a",
+				Plan:            "c3.large.arm64",
+				Facility:        "da11",
+				OperatingSystem: &ec2.OperatingSystem{Slug: "ubuntu_22_04", ImageTag: "ubuntu_22_04-c3.large.arm64-aarch64"},
+				Network: &ec2.Network{Addresses: []ec2.NetworkAddress{
+					{AddressFamily: 4, Public: false, Address: "10.70.17.9"},
+				}},
+			},
+			ec2.IdentityDocument{
+				InstanceID:       "e5e4bd27-2a33-4b5e-9d3a-0c1e2c2f1b4a",
+				InstanceType:     "c3.large.arm64",
+				ImageID:          "ubuntu_22_04",
+				Architecture:     "arm64",
+				Region:           "us-central",
+				AvailabilityZone: "us-central-da11",
+				PrivateIP:        "10.70.17.9",
+				Version:          ec2.IdentityDocumentVersion,
+			},
+		},
+		{
+			"facility without a placement",
+			&ec2.Metadata{
+				ID:              "e5e4bd27-2a33-4b5e-9d3a-0c1e2c2f1b4a",
+				Plan:            "c3.small.x86",
+				Facility:        "ny5",
+				OperatingSystem: &ec2.OperatingSystem{Slug: "debian_12_x86_64"},
+			},
+			ec2.IdentityDocument{
+				InstanceID:       "e5e4bd27-2a33-4b5e-9d3a-0c1e2c2f1b4a",
+				InstanceType:     "c3.small.x86",
+				ImageID:          "debian_12_x86_64",
+				Architecture:     "x86_64",
+				Region:           "ny5",
+				AvailabilityZone: "ny5",
+				Version:          ec2.IdentityDocumentVersion,
+			},
+		},
+		{
+			"minimal metadata",
+			&ec2.Metadata{ID: "e5e4bd27-2a33-4b5e-9d3a-0c1e2c2f1b4a"},
+			ec2.IdentityDocument{
+				InstanceID: "e5e4bd27-2a33-4b5e-9d3a-0c1e2c2f1b4a",
+				Version:    ec2.IdentityDocumentVersion,
+			},
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			assert.Equal(t, testcase.expected, ec2.NewIdentityDocument(testcase.metadata))
+		})
+	}
+}
@@ -1,17 +1,38 @@
 package ec2
 
 import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 )
 
 // MetadataContainer is an interface defining methods used to access the list
-// of available metadata items as well their individual values
+// of available metadata items as well their individual values.
+// Item paths are treated the same with or without leading and trailing
+// slashes, except for "public-keys/", which lists the SSH public keys' indexes
+// instead of returning the keys. An empty item path, or the path of a
+// directory-like item (like "operating-system/" or "network/bonding"), returns
+// the names of the items beneath it.
 type MetadataContainer interface {
 	ItemNames() []string
 	TopLevelItemNames() []string
 	GetItem(itemPath string) ([]string, bool)
 }
 
+// FirstItemValue returns the first value of the metadata item, or an empty
+// string if it doesn't have one.
+func FirstItemValue(metadata MetadataContainer, itemPath string) string {
+	values, ok := metadata.GetItem(itemPath)
+	if !ok || len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
 // Metadata represents the top-level fields of the metadata
 type Metadata struct {
 	ID              string           `json:"id"`
@@ -21,11 +42,55 @@ type Metadata struct {
 	Facility        string           `json:"facility"`
 	Tags            []string         `json:"tags"`
 	OperatingSystem *OperatingSystem `json:"operating_system"`
-	SSHKeys         []string         `json:"ssh_keys"`
+	SSHKeys         []SSHKey         `json:"ssh_keys"`
 	Spot            *Spot            `json:"spot"`
 	Network         *Network         `json:"network"`
 }
 
+// UnmarshalJSON unmarshals each top-level field of the metadata on its own,
+// so that a malformed section (like a "spot" field that isn't an object) is
+// left empty instead of failing the whole record. The items from the other
+// sections can then still be served. Only data which isn't a JSON object at
+// all is an error.
+func (metadata *Metadata) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	*metadata = Metadata{}
+
+	unmarshalSection(fields["id"], &metadata.ID)
+	unmarshalSection(fields["hostname"], &metadata.Hostname)
+	unmarshalSection(fields["iqn"], &metadata.IQN)
+	unmarshalSection(fields["plan"], &metadata.Plan)
+	unmarshalSection(fields["facility"], &metadata.Facility)
+	unmarshalSection(fields["tags"], &metadata.Tags)
+	unmarshalSection(fields["operating_system"], &metadata.OperatingSystem)
+	unmarshalSection(fields["ssh_keys"], &metadata.SSHKeys)
+	unmarshalSection(fields["spot"], &metadata.Spot)
+	unmarshalSection(fields["network"], &metadata.Network)
+
+	return nil
+}
+
+// unmarshalSection unmarshals a single metadata section into target, leaving
+// target untouched if the section is missing or malformed.
+func unmarshalSection[T any](raw json.RawMessage, target *T) {
+	if raw == nil {
+		return
+	}
+
+	var value T
+
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return
+	}
+
+	*target = value
+}
+
 // ItemNames returns the list of top-level metadata keys that can be
 // subsequently queried by a client. For a Metadata record, this is thee same
 // as the list of "Top Level" item names.
@@ -48,6 +113,7 @@ func (metadata *Metadata) TopLevelItemNames() []string {
 	}
 
 	items = append(items, metadata.Spot.TopLevelItemNames()...)
+	items = append(items, placementForFacility(metadata.Facility).TopLevelItemNames()...)
 	items = append(items, metadata.Network.TopLevelItemNames()...)
 
 	return items
@@ -55,9 +121,13 @@ func (metadata *Metadata) TopLevelItemNames() []string {
 
 // GetItem takes a string "item path" like "/instance-id" or
 // "/operating-system/slug" and returns a slice of metadata values for the
-// requested item. If metadata doesn't contain a value for the requested
-// item path, it will return an empty slice and false.
-// While most calls will result in just a 1-element slice, Some metadata items
+// requested item. An empty item path returns the top-level item names. As with
+// EC2, "public-keys/" is the exception to trailing slashes being ignored: it
+// lists the indexes of the SSH public keys, like "0=user@host", and each key
+// can then be fetched from "public-keys/N/openssh-key". If metadata doesn't
+// contain a value for the requested item path, it will return an empty slice
+// and false.
+// While most calls will result in just a 1-element slice, some metadata items
 // might contain more than one value for the requested item
 // (for example, an instance might have more than 1 public IPv4 address).
 func (metadata *Metadata) GetItem(itemPath string) ([]string, bool) {
@@ -68,11 +138,9 @@ func (metadata *Metadata) GetItem(itemPath string) ([]string, bool) {
 	// trim any leading or trailing slashes
 	trimmed := strings.Trim(itemPath, "/")
 
-	if trimmed == "" {
-		return []string{}, false
-	}
-
 	switch {
+	case trimmed == "":
+		return metadata.ItemNames(), true
 	// Handle all the top-level items first
 	case trimmed == "instance-id":
 		return []string{metadata.ID}, true
@@ -87,19 +155,115 @@ func (metadata *Metadata) GetItem(itemPath string) ([]string, bool) {
 	case trimmed == "tags":
 		return metadata.Tags, true
 	case trimmed == "public-keys":
-		return metadata.SSHKeys, true
+		// Like EC2, "public-keys/" lists the keys' indexes, while
+		// "public-keys" returns the keys themselves.
+		if strings.HasSuffix(itemPath, "/") {
+			return metadata.publicKeyIndexes(), true
+		}
+
+		return metadata.publicKeys(), true
+	case strings.HasPrefix(trimmed, "public-keys/"):
+		return metadata.publicKeyItem(strings.TrimPrefix(trimmed, "public-keys/"))
 	case trimmed == "public-ipv4" || trimmed == "public-ipv6" || trimmed == "local-ipv4":
 		return metadata.Network.GetItem(trimmed)
+	case trimmed == "network" || strings.HasPrefix(trimmed, "network/"):
+		return metadata.Network.GetItem(trimmed)
 	// Now handle the potentially-nested items
 	case strings.HasPrefix(trimmed, "operating-system"):
 		return metadata.OperatingSystem.GetItem(strings.TrimPrefix(trimmed, "operating-system"))
 	case strings.HasPrefix(trimmed, "spot"):
 		return metadata.Spot.GetItem(strings.TrimPrefix(trimmed, "spot"))
+	case strings.HasPrefix(trimmed, "placement"):
+		return placementForFacility(metadata.Facility).GetItem(strings.TrimPrefix(trimmed, "placement"))
+	default:
+		return []string{}, false
+	}
+}
+
+// publicKeys returns the instance's SSH public keys, highest priority first.
+// Keys with the same priority keep the order they were given in.
+func (metadata *Metadata) publicKeys() []string {
+	sorted := slices.Clone(metadata.SSHKeys)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority > sorted[j].Priority
+	})
+
+	keys := make([]string, 0, len(sorted))
+	for _, key := range sorted {
+		keys = append(keys, key.Key)
+	}
+
+	return keys
+}
+
+// publicKeyIndexes returns the EC2-style "index=name" listing of the
+// instance's SSH public keys, in the order publicKeys returns them. A key is
+// named by its comment, like "user@host", or "key-N" if it doesn't have one.
+func (metadata *Metadata) publicKeyIndexes() []string {
+	keys := metadata.publicKeys()
+	indexes := make([]string, 0, len(keys))
+
+	for i, key := range keys {
+		name := fmt.Sprintf("key-%d", i)
+
+		if fields := strings.Fields(key); len(fields) > 2 {
+			name = strings.Join(fields[2:], " ")
+		}
+
+		indexes = append(indexes, fmt.Sprintf("%d=%s", i, name))
+	}
+
+	return indexes
+}
+
+// publicKeyItem returns the items beneath "public-keys/N", which is just
+// "openssh-key", or the Nth SSH public key for "public-keys/N/openssh-key".
+func (metadata *Metadata) publicKeyItem(itemPath string) ([]string, bool) {
+	indexStr, subPath, _ := strings.Cut(itemPath, "/")
+
+	keys := metadata.publicKeys()
+
+	index, err := strconv.Atoi(indexStr)
+	if err != nil || index < 0 || index >= len(keys) {
+		return []string{}, false
+	}
+
+	switch subPath {
+	case "":
+		return []string{"openssh-key"}, true
+	case "openssh-key":
+		return []string{keys[index]}, true
 	default:
 		return []string{}, false
 	}
 }
 
+// SSHKey represents an SSH public key in the metadata. A key can be given as
+// a plain string, or as an object with the key and an optional priority, like
+// {"key": "ssh-ed25519 AAAA...", "priority": 10}. Keys are served highest
+// priority first, and keys without a priority have a priority of 0.
+type SSHKey struct {
+	Key      string `json:"key"`
+	Priority int    `json:"priority"`
+}
+
+// UnmarshalJSON unmarshals an SSH key given either as a plain string or as an
+// object.
+func (key *SSHKey) UnmarshalJSON(data []byte) error {
+	var plain string
+
+	if err := json.Unmarshal(data, &plain); err == nil {
+		*key = SSHKey{Key: plain}
+
+		return nil
+	}
+
+	type sshKey SSHKey
+
+	return json.Unmarshal(data, (*sshKey)(key))
+}
+
 // Network represents the network-related fields in the metadata
 type Network struct {
 	Addresses  []NetworkAddress   `json:"addresses"`
@@ -123,6 +287,26 @@ func (network *Network) ItemNames() []string {
 		items = append(items, "local-ipv4")
 	}
 
+	if len(network.nestedItemNames()) > 0 {
+		items = append(items, "network")
+	}
+
+	return items
+}
+
+// nestedItemNames returns the names of the nested network items the instance
+// has, which are listed under "network".
+func (network *Network) nestedItemNames() []string {
+	var items []string
+
+	if network.Bonding != nil {
+		items = append(items, "bonding")
+	}
+
+	if len(network.Interfaces) > 0 {
+		items = append(items, "interfaces")
+	}
+
 	return items
 }
 
@@ -146,6 +330,21 @@ func (network *Network) GetItem(itemPath string) ([]string, bool) {
 
 	trimmed := strings.Trim(itemPath, "/")
 
+	// The nested network items (like network/bonding/mode) are exposed under
+	// "network", rather than as top-level aliases.
+	switch {
+	case trimmed == "network":
+		if items := network.nestedItemNames(); len(items) > 0 {
+			return items, true
+		}
+
+		return []string{}, false
+	case strings.HasPrefix(trimmed, "network/bonding"):
+		return network.Bonding.GetItem(strings.TrimPrefix(trimmed, "network/bonding"))
+	case trimmed == "network/interfaces" || strings.HasPrefix(trimmed, "network/interfaces/"):
+		return network.interfaceItem(strings.TrimPrefix(trimmed, "network/interfaces"))
+	}
+
 	var (
 		result     []string
 		filterFunc addressFilter
@@ -195,17 +394,95 @@ func (network *Network) filterNetworkAddressess(filter addressFilter) []NetworkA
 	return filteredAddresses
 }
 
+// interfaceItem returns the items beneath "network/interfaces": the indexes
+// of the instance's network interfaces for "network/interfaces", the items
+// of the Nth interface for "network/interfaces/N", and the item's value for
+// paths like "network/interfaces/N/name".
+func (network *Network) interfaceItem(itemPath string) ([]string, bool) {
+	if len(network.Interfaces) == 0 {
+		return []string{}, false
+	}
+
+	indexStr, subPath, _ := strings.Cut(strings.Trim(itemPath, "/"), "/")
+
+	if indexStr == "" {
+		indexes := make([]string, 0, len(network.Interfaces))
+
+		for i := range network.Interfaces {
+			indexes = append(indexes, strconv.Itoa(i))
+		}
+
+		return indexes, true
+	}
+
+	index, err := strconv.Atoi(indexStr)
+	if err != nil || index < 0 || index >= len(network.Interfaces) {
+		return []string{}, false
+	}
+
+	return network.Interfaces[index].GetItem(subPath)
+}
+
 // NetworkBonding represents network bonding-related information in the
 // metadata
 type NetworkBonding struct {
 	Mode int `json:"mode"`
 }
 
+// ItemNames returns the list of network bonding-related metadata items
+func (bonding *NetworkBonding) ItemNames() []string {
+	return []string{"mode"}
+}
+
+// TopLevelItemNames returns the list of metadata items exposed by this record
+// at the "top level" (that is, the /meta-data endpoint).
+// The network bonding record does not expose any top-level items.
+func (bonding *NetworkBonding) TopLevelItemNames() []string {
+	return []string{}
+}
+
+// GetItem returns the value for a network bonding-related item
+func (bonding *NetworkBonding) GetItem(itemPath string) ([]string, bool) {
+	if bonding == nil {
+		return []string{}, false
+	}
+
+	trimmed := strings.Trim(itemPath, "/")
+
+	switch trimmed {
+	case "":
+		return bonding.ItemNames(), true
+	case "mode":
+		return []string{strconv.Itoa(bonding.Mode)}, true
+	default:
+		return []string{}, false
+	}
+}
+
 // NetworkInterface represents fields describing a network interface
 type NetworkInterface struct {
 	Name string `json:"name"`
 }
 
+// ItemNames returns the list of network interface-related metadata items
+func (iface *NetworkInterface) ItemNames() []string {
+	return []string{"name"}
+}
+
+// GetItem returns the value for a network interface-related item
+func (iface *NetworkInterface) GetItem(itemPath string) ([]string, bool) {
+	trimmed := strings.Trim(itemPath, "/")
+
+	switch trimmed {
+	case "":
+		return iface.ItemNames(), true
+	case "name":
+		return []string{iface.Name}, true
+	default:
+		return []string{}, false
+	}
+}
+
 // NetworkAddress represents the fields describing a network address
 type NetworkAddress struct {
 	ID            string `json:"id"`
@@ -0,0 +1,247 @@
+package ec2_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hollow.sh/metadataservice/pkg/api/v1/ec2"
+)
+
+func TestNetworkBondingItems(t *testing.T) {
+	bonded := &ec2.Metadata{Network: &ec2.Network{Bonding: &ec2.NetworkBonding{Mode: 4}}}
+	unbonded := &ec2.Metadata{Network: &ec2.Network{}}
+
+	assert.Contains(t, bonded.ItemNames(), "network")
+	assert.NotContains(t, unbonded.ItemNames(), "network")
+
+	type testCase struct {
+		testName       string
+		metadata       *ec2.Metadata
+		itemPath       string
+		expectedResult []string
+		expectedFound  bool
+	}
+
+	testCases := []testCase{
+		{"bonded network", bonded, "network", []string{"bonding"}, true},
+		{"bonded network/bonding", bonded, "network/bonding", []string{"mode"}, true},
+		{"bonded network/bonding/mode", bonded, "network/bonding/mode", []string{"4"}, true},
+		{"bonded unknown bonding item", bonded, "network/bonding/unknown", []string{}, false},
+		{"unbonded network", unbonded, "network", []string{}, false},
+		{"unbonded network/bonding/mode", unbonded, "network/bonding/mode", []string{}, false},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			result, found := testcase.metadata.GetItem(testcase.itemPath)
+
+			assert.Equal(t, testcase.expectedFound, found)
+			assert.Equal(t, testcase.expectedResult, result)
+		})
+	}
+}
+
+func TestNetworkInterfaceItems(t *testing.T) {
+	withInterfaces := &ec2.Metadata{Network: &ec2.Network{Interfaces: []ec2.NetworkInterface{{Name: "eth0"}, {Name: "eth1"}}}}
+	bondedWithInterfaces := &ec2.Metadata{Network: &ec2.Network{
+		Bonding:    &ec2.NetworkBonding{Mode: 4},
+		Interfaces: []ec2.NetworkInterface{{Name: "eth0"}},
+	}}
+	emptyInterfaces := &ec2.Metadata{Network: &ec2.Network{Interfaces: []ec2.NetworkInterface{}}}
+	noNetwork := &ec2.Metadata{}
+
+	assert.Contains(t, withInterfaces.ItemNames(), "network")
+	assert.NotContains(t, emptyInterfaces.ItemNames(), "network")
+	assert.NotContains(t, noNetwork.ItemNames(), "network")
+
+	type testCase struct {
+		testName       string
+		metadata       *ec2.Metadata
+		itemPath       string
+		expectedResult []string
+		expectedFound  bool
+	}
+
+	testCases := []testCase{
+		{"network", withInterfaces, "network", []string{"interfaces"}, true},
+		{"bonded network", bondedWithInterfaces, "network", []string{"bonding", "interfaces"}, true},
+		{"network/interfaces", withInterfaces, "network/interfaces", []string{"0", "1"}, true},
+		{"network/interfaces/", withInterfaces, "network/interfaces/", []string{"0", "1"}, true},
+		{"network/interfaces/N", withInterfaces, "network/interfaces/1", []string{"name"}, true},
+		{"network/interfaces/N/name", withInterfaces, "network/interfaces/1/name", []string{"eth1"}, true},
+		{"unknown interface item", withInterfaces, "network/interfaces/0/mac", []string{}, false},
+		{"index out of range", withInterfaces, "network/interfaces/2/name", []string{}, false},
+		{"negative index", withInterfaces, "network/interfaces/-1/name", []string{}, false},
+		{"invalid index", withInterfaces, "network/interfaces/eth0/name", []string{}, false},
+		{"prefix of another item", withInterfaces, "network/interfacesx", nil, false},
+		{"empty interfaces network", emptyInterfaces, "network", []string{}, false},
+		{"empty interfaces", emptyInterfaces, "network/interfaces", []string{}, false},
+		{"no network", noNetwork, "network/interfaces/0/name", []string{}, false},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			result, found := testcase.metadata.GetItem(testcase.itemPath)
+
+			assert.Equal(t, testcase.expectedFound, found)
+			assert.Equal(t, testcase.expectedResult, result)
+		})
+	}
+}
+
+func TestGetItemTrailingSlash(t *testing.T) {
+	metadata := &ec2.Metadata{
+		Hostname: "host",
+		Network:  &ec2.Network{Bonding: &ec2.NetworkBonding{Mode: 4}},
+		OperatingSystem: &ec2.OperatingSystem{
+			Slug:              "ubuntu",
+			LicenseActivation: &ec2.LicenseActivation{State: "unlicensed"},
+		},
+	}
+
+	root, found := metadata.GetItem("")
+	assert.True(t, found)
+	assert.Equal(t, metadata.ItemNames(), root)
+
+	itemPaths := []string{
+		"hostname",
+		"network",
+		"network/bonding",
+		"operating-system",
+		"operating-system/license-activation",
+	}
+
+	for _, itemPath := range itemPaths {
+		t.Run(itemPath, func(t *testing.T) {
+			expected, found := metadata.GetItem(itemPath)
+			assert.True(t, found)
+
+			for _, variant := range []string{itemPath + "/", "/" + itemPath + "/"} {
+				result, found := metadata.GetItem(variant)
+				assert.True(t, found, variant)
+				assert.Equal(t, expected, result, variant)
+			}
+		})
+	}
+}
+
+// TestParseMetadataMalformedSection tests that a malformed section of the
+// metadata doesn't stop the rest of it from being served.
+func TestParseMetadataMalformedSection(t *testing.T) {
+	type testCase struct {
+		testName string
+		raw      string
+	}
+
+	testCases := []testCase{
+		{"spot isn't an object", `{"id":"instance-a","hostname":"host-a","spot":"soon","tags":["a"]}`},
+		{"spot field has the wrong type", `{"id":"instance-a","hostname":"host-a","spot":{"termination_time":12},"tags":["a"]}`},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			metadata, err := ec2.ParseMetadata([]byte(testcase.raw), "")
+			require.NoError(t, err)
+
+			assert.NotContains(t, metadata.ItemNames(), "spot")
+
+			for itemPath, expected := range map[string][]string{"instance-id": {"instance-a"}, "hostname": {"host-a"}, "tags": {"a"}} {
+				result, found := metadata.GetItem(itemPath)
+
+				assert.True(t, found, itemPath)
+				assert.Equal(t, expected, result, itemPath)
+			}
+
+			_, found := metadata.GetItem("spot/termination-time")
+			assert.False(t, found)
+		})
+	}
+
+	// Metadata which isn't an object at all still fails to parse.
+	_, err := ec2.ParseMetadata([]byte(`["instance-a"]`), "")
+	assert.Error(t, err)
+}
+
+func TestPublicKeysPriority(t *testing.T) {
+	type testCase struct {
+		testName     string
+		raw          string
+		expectedKeys []string
+	}
+
+	testCases := []testCase{
+		{
+			"plain keys keep their order",
+			`{"ssh_keys":["key-a","key-b","key-c"]}`,
+			[]string{"key-a", "key-b", "key-c"},
+		},
+		{
+			"keys sorted by priority",
+			`{"ssh_keys":[{"key":"key-a","priority":1},{"key":"key-b","priority":10},{"key":"key-c","priority":5}]}`,
+			[]string{"key-b", "key-c", "key-a"},
+		},
+		{
+			"equal priorities keep their order",
+			`{"ssh_keys":[{"key":"key-a","priority":5},{"key":"key-b"},{"key":"key-c","priority":5},{"key":"key-d"}]}`,
+			[]string{"key-a", "key-c", "key-b", "key-d"},
+		},
+		{
+			"plain keys mixed with prioritized keys",
+			`{"ssh_keys":["key-a",{"key":"key-b","priority":1},{"key":"key-c","priority":-1},"key-d"]}`,
+			[]string{"key-b", "key-a", "key-d", "key-c"},
+		},
+		{
+			"no keys",
+			`{"ssh_keys":[]}`,
+			[]string{},
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			metadata, err := ec2.ParseMetadata([]byte(testcase.raw), "")
+			require.NoError(t, err)
+
+			result, found := metadata.GetItem("public-keys")
+
+			assert.True(t, found)
+			assert.Equal(t, testcase.expectedKeys, result)
+		})
+	}
+}
+
+func TestPublicKeyItems(t *testing.T) {
+	metadata, err := ec2.ParseMetadata([]byte(`{"ssh_keys":["ssh-ed25519 AAAA-a user@host-a",{"key":"ssh-ed25519 AAAA-b","priority":10}]}`), "")
+	require.NoError(t, err)
+
+	type testCase struct {
+		testName       string
+		itemPath       string
+		expectedResult []string
+		expectedFound  bool
+	}
+
+	testCases := []testCase{
+		{"all keys", "public-keys", []string{"ssh-ed25519 AAAA-b", "ssh-ed25519 AAAA-a user@host-a"}, true},
+		{"key indexes", "public-keys/", []string{"0=key-0", "1=user@host-a"}, true},
+		{"key index items", "public-keys/1", []string{"openssh-key"}, true},
+		{"key index items with trailing slash", "public-keys/1/", []string{"openssh-key"}, true},
+		{"first key", "public-keys/0/openssh-key", []string{"ssh-ed25519 AAAA-b"}, true},
+		{"second key", "/public-keys/1/openssh-key/", []string{"ssh-ed25519 AAAA-a user@host-a"}, true},
+		{"out of range index", "public-keys/2/openssh-key", []string{}, false},
+		{"negative index", "public-keys/-1/openssh-key", []string{}, false},
+		{"invalid index", "public-keys/first/openssh-key", []string{}, false},
+		{"unknown key item", "public-keys/0/ssh2-key", []string{}, false},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			result, found := metadata.GetItem(testcase.itemPath)
+
+			assert.Equal(t, testcase.expectedFound, found)
+			assert.Equal(t, testcase.expectedResult, result)
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package ec2
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrInvalidPlacement is returned when a configured facility placement isn't
+// in the "region/availability-zone" format.
+var ErrInvalidPlacement = errors.New("placement must be in the form 'region/availability-zone'")
+
+// facilityPlacements maps facility codes to the placement reported for
+// instances in them. It's empty unless SetFacilityPlacements is called.
+var facilityPlacements atomic.Pointer[map[string]Placement]
+
+// Placement represents the AWS-style region and availability zone an instance
+// is placed in. It's derived from the instance's facility, rather than stored
+// in the metadata.
+type Placement struct {
+	Region           string
+	AvailabilityZone string
+}
+
+// SetFacilityPlacements sets the placements reported for instances in each
+// facility. Instances in facilities without a placement don't expose any
+// placement items.
+func SetFacilityPlacements(placements map[string]Placement) {
+	facilityPlacements.Store(&placements)
+}
+
+// ParseFacilityPlacements parses a facility -> "region/availability-zone" map
+// into the placements for SetFacilityPlacements.
+func ParseFacilityPlacements(raw map[string]string) (map[string]Placement, error) {
+	placements := make(map[string]Placement, len(raw))
+
+	for facility, value := range raw {
+		region, zone, ok := strings.Cut(value, "/")
+		if !ok || region == "" || zone == "" {
+			return nil, fmt.Errorf("%w: %s=%s", ErrInvalidPlacement, facility, value)
+		}
+
+		placements[facility] = Placement{Region: region, AvailabilityZone: zone}
+	}
+
+	return placements, nil
+}
+
+// placementForFacility returns the placement configured for the facility, or
+// nil if there isn't one.
+func placementForFacility(facility string) *Placement {
+	placements := facilityPlacements.Load()
+	if placements == nil || facility == "" {
+		return nil
+	}
+
+	placement, ok := (*placements)[facility]
+	if !ok {
+		return nil
+	}
+
+	return &placement
+}
+
+// ItemNames returns the list of placement-related metadata items
+func (placement *Placement) ItemNames() []string {
+	return []string{"availability-zone", "region"}
+}
+
+// TopLevelItemNames returns the list of metadata items exposed by this record
+// at the "top level" (that is, the /meta-data endpoint).
+// For a placement record, this is just "placement"
+func (placement *Placement) TopLevelItemNames() []string {
+	if placement != nil {
+		return []string{"placement"}
+	}
+
+	return []string{}
+}
+
+// GetItem returns the value for a placement-related item.
+func (placement *Placement) GetItem(itemPath string) ([]string, bool) {
+	if placement == nil {
+		return []string{}, false
+	}
+
+	trimmed := strings.Trim(itemPath, "/")
+
+	switch trimmed {
+	case "":
+		return placement.ItemNames(), true
+	case "availability-zone":
+		return []string{placement.AvailabilityZone}, true
+	case "region":
+		return []string{placement.Region}, true
+	default:
+		return []string{}, false
+	}
+}
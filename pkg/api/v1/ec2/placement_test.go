@@ -0,0 +1,58 @@
+package ec2_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hollow.sh/metadataservice/pkg/api/v1/ec2"
+)
+
+func TestParseFacilityPlacements(t *testing.T) {
+	placements, err := ec2.ParseFacilityPlacements(map[string]string{"da11": "us-central/us-central-da11"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]ec2.Placement{"da11": {Region: "us-central", AvailabilityZone: "us-central-da11"}}, placements)
+
+	for _, invalid := range []string{"us-central", "us-central/", "/us-central-da11"} {
+		_, err := ec2.ParseFacilityPlacements(map[string]string{"da11": invalid})
+		assert.ErrorIs(t, err, ec2.ErrInvalidPlacement, invalid)
+	}
+}
+
+func TestPlacementItems(t *testing.T) {
+	ec2.SetFacilityPlacements(map[string]ec2.Placement{"da11": {Region: "us-central", AvailabilityZone: "us-central-da11"}})
+	defer ec2.SetFacilityPlacements(nil)
+
+	known := &ec2.Metadata{Facility: "da11"}
+	unknown := &ec2.Metadata{Facility: "ny5"}
+
+	assert.Contains(t, known.ItemNames(), "placement")
+	assert.NotContains(t, unknown.ItemNames(), "placement")
+
+	type testCase struct {
+		testName       string
+		metadata       *ec2.Metadata
+		itemPath       string
+		expectedResult []string
+		expectedFound  bool
+	}
+
+	testCases := []testCase{
+		{"known facility placement", known, "placement", []string{"availability-zone", "region"}, true},
+		{"known facility availability zone", known, "placement/availability-zone", []string{"us-central-da11"}, true},
+		{"known facility region", known, "placement/region/", []string{"us-central"}, true},
+		{"known facility unknown item", known, "placement/unknown", []string{}, false},
+		{"unknown facility placement", unknown, "placement", []string{}, false},
+		{"unknown facility region", unknown, "placement/region", []string{}, false},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			result, found := testcase.metadata.GetItem(testcase.itemPath)
+
+			assert.Equal(t, testcase.expectedFound, found)
+			assert.Equal(t, testcase.expectedResult, result)
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package ec2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	// SchemaVersionV1 identifies the original metadata record shape, as
+	// represented by the Metadata type.
+	SchemaVersionV1 = "v1"
+
+	// SchemaVersionKey is the top-level key a metadata record can set to
+	// declare which schema version it was written with. Records without it are
+	// parsed using the configured default schema version.
+	SchemaVersionKey = "schema_version"
+)
+
+var (
+	// ErrUnknownSchemaVersion is returned when a metadata record (or the
+	// configured default) refers to a schema version without a registered
+	// adapter.
+	ErrUnknownSchemaVersion = errors.New("unknown metadata schema version")
+
+	// schemaAdaptersMu guards schemaAdapters, since adapters may be
+	// registered while requests are being served.
+	schemaAdaptersMu sync.RWMutex
+	schemaAdapters   = map[string]SchemaAdapter{
+		SchemaVersionV1: v1SchemaAdapter{},
+	}
+)
+
+// SchemaAdapter converts a raw metadata record of a particular schema version
+// into a MetadataContainer that the EC2 endpoints can render.
+type SchemaAdapter interface {
+	Version() string
+	Parse(raw []byte) (MetadataContainer, error)
+}
+
+// RegisterSchemaAdapter makes a schema adapter available to ParseMetadata,
+// replacing any adapter previously registered for the same version. It's safe
+// to call concurrently with ParseMetadata.
+func RegisterSchemaAdapter(adapter SchemaAdapter) {
+	schemaAdaptersMu.Lock()
+	defer schemaAdaptersMu.Unlock()
+
+	schemaAdapters[adapter.Version()] = adapter
+}
+
+// ValidateSchemaVersion returns an error if version, used as the default
+// schema version for ParseMetadata, has no registered adapter. An empty
+// version means v1.
+func ValidateSchemaVersion(version string) error {
+	if version == "" {
+		return nil
+	}
+
+	schemaAdaptersMu.RLock()
+	_, ok := schemaAdapters[version]
+	schemaAdaptersMu.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownSchemaVersion, version)
+	}
+
+	return nil
+}
+
+// ParseMetadata parses a raw metadata record using the adapter for the schema
+// version declared in the record itself, falling back to defaultVersion (or
+// v1, if that is empty) when the record doesn't declare one.
+func ParseMetadata(raw []byte, defaultVersion string) (MetadataContainer, error) {
+	var marker struct {
+		SchemaVersion string `json:"schema_version"`
+	}
+
+	if err := json.Unmarshal(raw, &marker); err != nil {
+		return nil, err
+	}
+
+	version := marker.SchemaVersion
+
+	if version == "" {
+		version = defaultVersion
+	}
+
+	if version == "" {
+		version = SchemaVersionV1
+	}
+
+	schemaAdaptersMu.RLock()
+	adapter, ok := schemaAdapters[version]
+	schemaAdaptersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSchemaVersion, version)
+	}
+
+	return adapter.Parse(raw)
+}
+
+type v1SchemaAdapter struct{}
+
+func (v1SchemaAdapter) Version() string {
+	return SchemaVersionV1
+}
+
+func (v1SchemaAdapter) Parse(raw []byte) (MetadataContainer, error) {
+	metadata := &Metadata{}
+
+	if err := json.Unmarshal(raw, metadata); err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+// WithInstanceIDFallback wraps a MetadataContainer so that the "instance-id"
+// item falls back to the given instance ID (such as the ID the record is
+// stored under) when the metadata record doesn't include one.
+func WithInstanceIDFallback(metadata MetadataContainer, instanceID string) MetadataContainer {
+	return &instanceIDFallback{MetadataContainer: metadata, instanceID: instanceID}
+}
+
+type instanceIDFallback struct {
+	MetadataContainer
+	instanceID string
+}
+
+func (m *instanceIDFallback) GetItem(itemPath string) ([]string, bool) {
+	result, ok := m.MetadataContainer.GetItem(itemPath)
+
+	if strings.Trim(itemPath, "/") == "instance-id" && (!ok || len(result) == 0 || result[0] == "") {
+		return []string{m.instanceID}, true
+	}
+
+	return result, ok
+}
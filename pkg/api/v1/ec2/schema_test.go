@@ -0,0 +1,140 @@
+package ec2_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/pkg/api/v1/ec2"
+)
+
+type testSchemaAdapter struct{}
+
+func (testSchemaAdapter) Version() string {
+	return "test"
+}
+
+func (testSchemaAdapter) Parse(_ []byte) (ec2.MetadataContainer, error) {
+	return &ec2.Metadata{Hostname: "from-test-schema"}, nil
+}
+
+func TestParseMetadata(t *testing.T) {
+	ec2.RegisterSchemaAdapter(testSchemaAdapter{})
+
+	type testCase struct {
+		testName         string
+		raw              string
+		defaultVersion   string
+		expectedHostname string
+		expectedError    error
+	}
+
+	testCases := []testCase{
+		{
+			"no marker, no default uses v1",
+			`{"hostname":"v1-host"}`,
+			"",
+			"v1-host",
+			nil,
+		},
+		{
+			"no marker uses the configured default",
+			`{"hostname":"v1-host"}`,
+			"test",
+			"from-test-schema",
+			nil,
+		},
+		{
+			"record marker takes precedence over the default",
+			`{"schema_version":"v1","hostname":"v1-host"}`,
+			"test",
+			"v1-host",
+			nil,
+		},
+		{
+			"unknown record schema version",
+			`{"schema_version":"v99","hostname":"v1-host"}`,
+			"",
+			"",
+			ec2.ErrUnknownSchemaVersion,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			metadata, err := ec2.ParseMetadata([]byte(testcase.raw), testcase.defaultVersion)
+
+			if testcase.expectedError != nil {
+				assert.ErrorIs(t, err, testcase.expectedError)
+				return
+			}
+
+			assert.Nil(t, err)
+
+			hostname, ok := metadata.GetItem("hostname")
+			assert.True(t, ok)
+			assert.Equal(t, []string{testcase.expectedHostname}, hostname)
+		})
+	}
+}
+
+func TestValidateSchemaVersion(t *testing.T) {
+	ec2.RegisterSchemaAdapter(testSchemaAdapter{})
+
+	assert.NoError(t, ec2.ValidateSchemaVersion(""))
+	assert.NoError(t, ec2.ValidateSchemaVersion(ec2.SchemaVersionV1))
+	assert.NoError(t, ec2.ValidateSchemaVersion("test"))
+	assert.ErrorIs(t, ec2.ValidateSchemaVersion("v9"), ec2.ErrUnknownSchemaVersion)
+}
+
+func TestRegisterSchemaAdapterConcurrently(t *testing.T) {
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			ec2.RegisterSchemaAdapter(testSchemaAdapter{})
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			_, err := ec2.ParseMetadata([]byte(`{"hostname":"v1-host"}`), "")
+			assert.NoError(t, err)
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestWithInstanceIDFallback(t *testing.T) {
+	type testCase struct {
+		testName       string
+		raw            string
+		itemPath       string
+		expectedResult []string
+	}
+
+	testCases := []testCase{
+		{"record with an ID", `{"id": "record-id", "hostname": "host"}`, "instance-id", []string{"record-id"}},
+		{"record without an ID", `{"hostname": "host"}`, "instance-id", []string{"fallback-id"}},
+		{"record with an empty ID", `{"id": "", "hostname": "host"}`, "/instance-id/", []string{"fallback-id"}},
+		{"other items are unchanged", `{"hostname": "host"}`, "hostname", []string{"host"}},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			metadata, err := ec2.ParseMetadata([]byte(testcase.raw), "")
+			assert.NoError(t, err)
+
+			result, found := ec2.WithInstanceIDFallback(metadata, "fallback-id").GetItem(testcase.itemPath)
+
+			assert.True(t, found)
+			assert.Equal(t, testcase.expectedResult, result)
+		})
+	}
+}
@@ -6,8 +6,6 @@ import (
 	"strings"
 
 	"github.com/gin-gonic/gin"
-
-	"go.hollow.sh/metadataservice/internal/middleware"
 )
 
 const (
@@ -24,15 +22,21 @@ const (
 
 	// Ec2UserdataURI is the path to the ec2-style userdata endpoint
 	Ec2UserdataURI = "/user-data"
+
+	// Ec2DynamicURI is the path to the ec2-style instance identity document
+	// endpoint.
+	Ec2DynamicURI = "/dynamic/instance-identity/document"
 )
 
 // Ec2Routes will add the routes for the EC2-style API to a router group
 func (r *Router) Ec2Routes(rg *gin.RouterGroup) {
 	// GET /2009-04-04/meta-data/:item-name
 	// GET /2009-04-04/user-data
-	rg.GET(Ec2MetadataURI, middleware.IdentifyInstanceByIP(r.Logger, r.DB), r.instanceEc2MetadataGet)
-	rg.GET(Ec2MetadataItemURI, middleware.IdentifyInstanceByIP(r.Logger, r.DB), r.instanceEc2MetadataItemGet)
-	rg.GET(Ec2UserdataURI, middleware.IdentifyInstanceByIP(r.Logger, r.DB), r.instanceEc2UserdataGet)
+	// GET /2009-04-04/dynamic/instance-identity/document
+	rg.GET(Ec2MetadataURI, r.serverTimingMiddleware, r.publicRateLimiter(), r.identifyInstance(), r.requireClientIP, r.instanceEc2MetadataGet)
+	rg.GET(Ec2MetadataItemURI, r.serverTimingMiddleware, r.publicRateLimiter(), r.identifyInstance(), r.requireClientIP, r.instanceEc2MetadataItemGet)
+	rg.GET(Ec2UserdataURI, varyOnAccept, r.serverTimingMiddleware, r.publicRateLimiter(), r.identifyInstance(), r.requireClientIP, r.instanceEc2UserdataGet)
+	rg.GET(Ec2DynamicURI, r.serverTimingMiddleware, r.publicRateLimiter(), r.identifyInstance(), r.requireClientIP, r.instanceEc2DynamicGet)
 }
 
 // GetEc2MetadataPath returns the path used to fetch a list of the ec2-style
@@ -54,3 +58,9 @@ func GetEc2MetadataItemPath(itemPath string) string {
 func GetEc2UserdataPath() string {
 	return path.Join(V20090404URI, Ec2UserdataURI)
 }
+
+// GetEc2DynamicPath returns the path used to fetch the ec2-style instance
+// identity document
+func GetEc2DynamicPath() string {
+	return path.Join(V20090404URI, Ec2DynamicURI)
+}
@@ -0,0 +1,16 @@
+package metadataservice
+
+// DiffMetadata exposes diffMetadata to the external test package.
+var DiffMetadata = diffMetadata
+
+// NormalizeMetadata exposes normalizeMetadata to the external test package.
+var NormalizeMetadata = normalizeMetadata
+
+// MetadataStringField exposes metadataStringField to the external test package.
+var MetadataStringField = metadataStringField
+
+// CacheTTL exposes cacheTTL to the external test package.
+var CacheTTL = cacheTTL
+
+// TrimStringValues exposes trimStringValues to the external test package.
+var TrimStringValues = trimStringValues
@@ -0,0 +1,64 @@
+package metadataservice
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+// fingerprintVerified reports whether the metadata may be served to the
+// request. With FingerprintHeader and FingerprintField set, the request must
+// present the fingerprint stored in the instance's metadata, so that knowing
+// (or spoofing) an instance's IP address isn't enough to read its metadata.
+// Instances without a stored fingerprint can't be served at all.
+func (r *Router) fingerprintVerified(c *gin.Context, metadata *models.InstanceMetadatum) bool {
+	if r.FingerprintHeader == "" || r.FingerprintField == "" {
+		return true
+	}
+
+	presented := c.GetHeader(r.FingerprintHeader)
+	stored := metadataStringField(metadata.Metadata, r.FingerprintField)
+
+	if presented != "" && stored != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(stored)) == 1 {
+		return true
+	}
+
+	r.Logger.Warn("request didn't present the instance's fingerprint",
+		zap.String("instance_id", metadata.ID),
+		zap.Bool("fingerprint_presented", presented != ""),
+		zap.Bool("fingerprint_stored", stored != ""),
+	)
+	middleware.MetricFingerprintMismatch.Inc()
+
+	return false
+}
+
+// metadataStringField returns the string value at the dot-separated path in
+// the metadata, like "customdata.fingerprint", or an empty string if there
+// isn't one.
+func metadataStringField(metadata []byte, path string) string {
+	var value interface{}
+
+	if err := json.Unmarshal(metadata, &value); err != nil {
+		return ""
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+
+		value = obj[key]
+	}
+
+	str, _ := value.(string)
+
+	return str
+}
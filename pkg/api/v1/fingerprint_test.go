@@ -0,0 +1,97 @@
+package metadataservice_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestMetadataStringField(t *testing.T) {
+	metadata := []byte(`{"customdata": {"fingerprint": "abc123", "nested": {"count": 3}}, "hostname": "instance-a"}`)
+
+	testCases := []struct {
+		testName string
+		path     string
+		expected string
+	}{
+		{"top-level field", "hostname", "instance-a"},
+		{"nested field", "customdata.fingerprint", "abc123"},
+		{"missing field", "customdata.missing", ""},
+		{"non-string field", "customdata.nested.count", ""},
+		{"path through a non-object", "hostname.fingerprint", ""},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			assert.Equal(t, testcase.expected, v1api.MetadataStringField(metadata, testcase.path))
+		})
+	}
+
+	assert.Equal(t, "", v1api.MetadataStringField([]byte("not json"), "hostname"))
+}
+
+// TestGetMetadataFingerprint tests that with a fingerprint header and field
+// configured, metadata is only served to requests presenting the
+// fingerprint stored in the instance's metadata.
+func TestGetMetadataFingerprint(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{
+		FingerprintHeader: "X-Instance-Fingerprint",
+		FingerprintField:  "customdata.fingerprint",
+	})
+
+	instanceIP := "192.168.50.1"
+
+	reqBody, err := json.Marshal(&v1api.UpsertMetadataRequest{
+		ID:          "6a8c3f52-3b1e-4d5f-8e2a-7c9b0d1e2f3a",
+		Metadata:    json.RawMessage(`{"hostname": "fingerprinted", "customdata": {"fingerprint": "sha256:5d41402abc4b2a76"}}`),
+		IPAddresses: []string{instanceIP},
+	})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	testCases := []struct {
+		testName       string
+		requestIP      string
+		fingerprint    string
+		expectedStatus int
+	}{
+		{"matching fingerprint", instanceIP, "sha256:5d41402abc4b2a76", http.StatusOK},
+		{"mismatching fingerprint", instanceIP, "sha256:0000000000000000", http.StatusForbidden},
+		{"missing fingerprint", instanceIP, "", http.StatusForbidden},
+		// Instance A doesn't have a fingerprint stored at all.
+		{"instance without a fingerprint", "139.178.82.3", "sha256:5d41402abc4b2a76", http.StatusForbidden},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			for _, path := range []string{v1api.GetMetadataPath(), v1api.GetEc2MetadataPath()} {
+				w := httptest.NewRecorder()
+
+				req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+				req.RemoteAddr = net.JoinHostPort(testcase.requestIP, "0")
+
+				if testcase.fingerprint != "" {
+					req.Header.Set("X-Instance-Fingerprint", testcase.fingerprint)
+				}
+
+				router.ServeHTTP(w, req)
+
+				assert.Equal(t, testcase.expectedStatus, w.Code, path)
+			}
+		})
+	}
+}
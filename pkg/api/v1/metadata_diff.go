@@ -0,0 +1,99 @@
+package metadataservice
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Metadata change operations
+const (
+	MetadataChangeAdd     = "add"
+	MetadataChangeRemove  = "remove"
+	MetadataChangeReplace = "replace"
+)
+
+// MetadataChange describes a single difference between two metadata
+// documents. Path is a JSON pointer (RFC 6901) to the changed value.
+type MetadataChange struct {
+	Op   string      `json:"op"`
+	Path string      `json:"path"`
+	Old  interface{} `json:"old"`
+	New  interface{} `json:"new"`
+}
+
+// MetadataDiffResponse is returned from a metadata upsert when the diff
+// between the previous and new metadata was requested.
+type MetadataDiffResponse struct {
+	Changes []MetadataChange `json:"changes"`
+}
+
+// diffMetadata returns the changes between two JSON metadata documents, sorted
+// by path. Objects are compared key by key, while any other values (including
+// arrays) are compared as a whole. An empty previous document is treated as
+// an empty object.
+func diffMetadata(previous, current []byte) ([]MetadataChange, error) {
+	var oldValue, newValue interface{} = map[string]interface{}{}, nil
+
+	if len(previous) > 0 {
+		if err := json.Unmarshal(previous, &oldValue); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := json.Unmarshal(current, &newValue); err != nil {
+		return nil, err
+	}
+
+	changes := []MetadataChange{}
+	changes = appendMetadataChanges(changes, "", oldValue, newValue)
+
+	return changes, nil
+}
+
+func appendMetadataChanges(changes []MetadataChange, path string, oldValue, newValue interface{}) []MetadataChange {
+	oldObj, oldIsObj := oldValue.(map[string]interface{})
+	newObj, newIsObj := newValue.(map[string]interface{})
+
+	if !oldIsObj || !newIsObj {
+		if !reflect.DeepEqual(oldValue, newValue) {
+			changes = append(changes, MetadataChange{Op: MetadataChangeReplace, Path: path, Old: oldValue, New: newValue})
+		}
+
+		return changes
+	}
+
+	keys := make([]string, 0, len(oldObj)+len(newObj))
+
+	for key := range oldObj {
+		keys = append(keys, key)
+	}
+
+	for key := range newObj {
+		if _, ok := oldObj[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		keyPath := path + "/" + jsonPointerEscaper.Replace(key)
+		oldKeyValue, inOld := oldObj[key]
+		newKeyValue, inNew := newObj[key]
+
+		switch {
+		case !inOld:
+			changes = append(changes, MetadataChange{Op: MetadataChangeAdd, Path: keyPath, New: newKeyValue})
+		case !inNew:
+			changes = append(changes, MetadataChange{Op: MetadataChangeRemove, Path: keyPath, Old: oldKeyValue})
+		default:
+			changes = appendMetadataChanges(changes, keyPath, oldKeyValue, newKeyValue)
+		}
+	}
+
+	return changes
+}
+
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
@@ -0,0 +1,65 @@
+package metadataservice_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestDiffMetadata(t *testing.T) {
+	type testCase struct {
+		testName        string
+		previous        string
+		current         string
+		expectedChanges []v1api.MetadataChange
+	}
+
+	testCases := []testCase{
+		{
+			"no previous metadata",
+			"",
+			`{"hostname": "instance-a", "plan": "c3.small.x86"}`,
+			[]v1api.MetadataChange{
+				{Op: v1api.MetadataChangeAdd, Path: "/hostname", New: "instance-a"},
+				{Op: v1api.MetadataChangeAdd, Path: "/plan", New: "c3.small.x86"},
+			},
+		},
+		{
+			"no-op update",
+			`{"hostname": "instance-a", "tags": ["a", "b"]}`,
+			`{"tags": ["a", "b"], "hostname": "instance-a"}`,
+			[]v1api.MetadataChange{},
+		},
+		{
+			"changed, added, and removed fields",
+			`{"hostname": "instance-a", "plan": "c3.small.x86", "operating_system": {"slug": "ubuntu_20_04", "distro": "ubuntu"}}`,
+			`{"hostname": "instance-b", "facility": "da11", "operating_system": {"slug": "ubuntu_22_04", "distro": "ubuntu"}}`,
+			[]v1api.MetadataChange{
+				{Op: v1api.MetadataChangeAdd, Path: "/facility", New: "da11"},
+				{Op: v1api.MetadataChangeReplace, Path: "/hostname", Old: "instance-a", New: "instance-b"},
+				{Op: v1api.MetadataChangeReplace, Path: "/operating_system/slug", Old: "ubuntu_20_04", New: "ubuntu_22_04"},
+				{Op: v1api.MetadataChangeRemove, Path: "/plan", Old: "c3.small.x86"},
+			},
+		},
+		{
+			"changed array and escaped key",
+			`{"tags": ["a"], "a/b~c": 1}`,
+			`{"tags": ["a", "b"], "a/b~c": 2}`,
+			[]v1api.MetadataChange{
+				{Op: v1api.MetadataChangeReplace, Path: "/a~1b~0c", Old: float64(1), New: float64(2)},
+				{Op: v1api.MetadataChangeReplace, Path: "/tags", Old: []interface{}{"a"}, New: []interface{}{"a", "b"}},
+			},
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			changes, err := v1api.DiffMetadata([]byte(testcase.previous), []byte(testcase.current))
+
+			assert.NoError(t, err)
+			assert.Equal(t, testcase.expectedChanges, changes)
+		})
+	}
+}
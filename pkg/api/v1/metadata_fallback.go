@@ -0,0 +1,105 @@
+package metadataservice
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+// ErrInvalidMetadataFallback is returned when a metadata fallback rule isn't
+// a CIDR mapped to an instance ID.
+var ErrInvalidMetadataFallback = errors.New("invalid metadata fallback")
+
+// MetadataFallback maps a prefix to the "template" instance whose metadata is
+// served to requests from IP addresses in the prefix which don't match any
+// instance, so that a whole subnet can share default metadata.
+type MetadataFallback struct {
+	Prefix     netip.Prefix
+	InstanceID string
+}
+
+// ParseMetadataFallbacks parses CIDR to instance ID rules, like
+// {"10.70.16.0/20": "316ed337-feee-48c6-a11b-3d4738e3cd6d"}, into metadata
+// fallbacks. They're ordered from the most to the least specific prefix, so
+// that a request IP within several of the prefixes falls back to the instance
+// for the narrowest one.
+func ParseMetadataFallbacks(raw map[string]string) ([]MetadataFallback, error) {
+	fallbacks := make([]MetadataFallback, 0, len(raw))
+
+	for cidr, instanceID := range raw {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s=%s: %w", ErrInvalidMetadataFallback, cidr, instanceID, err)
+		}
+
+		if _, err := uuid.Parse(instanceID); err != nil {
+			return nil, fmt.Errorf("%w: %s=%s: %w", ErrInvalidMetadataFallback, cidr, instanceID, ErrInvalidUUID)
+		}
+
+		fallbacks = append(fallbacks, MetadataFallback{Prefix: prefix.Masked(), InstanceID: instanceID})
+	}
+
+	sort.Slice(fallbacks, func(i, j int) bool {
+		if fallbacks[i].Prefix.Bits() != fallbacks[j].Prefix.Bits() {
+			return fallbacks[i].Prefix.Bits() > fallbacks[j].Prefix.Bits()
+		}
+
+		return fallbacks[i].Prefix.String() < fallbacks[j].Prefix.String()
+	})
+
+	return fallbacks, nil
+}
+
+// metadataFallbackFor returns the ID of the fallback instance for the request
+// IP's most specific prefix, or an empty string if it isn't within any of
+// them.
+func (r *Router) metadataFallbackFor(requestIP string) string {
+	ip, err := netip.ParseAddr(requestIP)
+	if err != nil {
+		return ""
+	}
+
+	for _, fallback := range r.MetadataFallbacks {
+		if fallback.Prefix.Contains(ip.Unmap()) {
+			return fallback.InstanceID
+		}
+	}
+
+	return ""
+}
+
+// getFallbackMetadata returns the metadata of the fallback instance for the
+// request IP, for requests which didn't match any instance. Without a
+// fallback for the request IP, or if the fallback instance has no metadata,
+// it returns errNotFound.
+func (r *Router) getFallbackMetadata(c *gin.Context, requestIP string) (*models.InstanceMetadatum, error) {
+	instanceID := r.metadataFallbackFor(requestIP)
+	if instanceID == "" {
+		return nil, errNotFound
+	}
+
+	dbStart := time.Now()
+	metadata, err := findInstanceMetadata(c.Request.Context(), r.DB, instanceID)
+	recordServerTiming(c, serverTimingDB, dbStart)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			r.Logger.Sugar().Warnw("metadata fallback instance has no metadata", "instance_id", instanceID, "request_ip", requestIP)
+			return nil, errNotFound
+		}
+
+		return nil, err
+	}
+
+	c.Set(contextKeyMetadataSource, metadataSourceFallback)
+
+	return metadata, nil
+}
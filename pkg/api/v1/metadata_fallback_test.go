@@ -0,0 +1,116 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestParseMetadataFallbacks(t *testing.T) {
+	instanceA := "316ed337-feee-48c6-a11b-3d4738e3cd6d"
+	instanceB := "8b1ad2a4-5d8e-4b4e-9f2c-6f2b2f0d1e3a"
+
+	fallbacks, err := v1api.ParseMetadataFallbacks(map[string]string{
+		"10.0.0.0/8":      instanceA,
+		"10.70.17.99/24":  instanceB,
+		"2604:1380::/32":  instanceA,
+		"192.168.10.0/24": instanceB,
+	})
+	require.NoError(t, err)
+
+	// The longest prefixes come first, and prefixes are masked.
+	expected := []v1api.MetadataFallback{
+		{Prefix: netip.MustParsePrefix("2604:1380::/32"), InstanceID: instanceA},
+		{Prefix: netip.MustParsePrefix("10.70.17.0/24"), InstanceID: instanceB},
+		{Prefix: netip.MustParsePrefix("192.168.10.0/24"), InstanceID: instanceB},
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), InstanceID: instanceA},
+	}
+	assert.Equal(t, expected, fallbacks)
+
+	for _, raw := range []map[string]string{
+		{"10.0.0.0": instanceA},
+		{"not-a-cidr/24": instanceA},
+		{"10.0.0.0/8": "not-a-uuid"},
+	} {
+		_, err := v1api.ParseMetadataFallbacks(raw)
+		assert.ErrorIs(t, err, v1api.ErrInvalidMetadataFallback, raw)
+	}
+}
+
+func TestGetMetadataFallback(t *testing.T) {
+	// The fixtures are only set up along with the test server, so instance
+	// A's ID is spelled out here.
+	instanceA := "316ed337-feee-48c6-a11b-3d4738e3cd6d"
+
+	fallbacks, err := v1api.ParseMetadataFallbacks(map[string]string{
+		"192.168.200.0/24": instanceA,
+		"192.168.201.0/24": "b5c1e1a4-9a53-4d36-9c1f-7f7b1e2e4c11",
+		"145.40.77.0/24":   instanceA,
+	})
+	require.NoError(t, err)
+
+	router := *testHTTPServerWithConfig(t, TestServerConfig{MetadataFallbacks: fallbacks})
+
+	type testCase struct {
+		testName           string
+		instanceIP         string
+		expectedStatus     int
+		expectedInstanceID string
+	}
+
+	testCases := []testCase{
+		{
+			"unknown IP within a fallback prefix",
+			"192.168.200.17",
+			http.StatusOK,
+			instanceA,
+		},
+		{
+			"unknown IP outside the fallback prefixes",
+			"192.168.202.17",
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"fallback instance without metadata",
+			"192.168.201.17",
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"known IP within a fallback prefix",
+			dbtools.FixtureInstanceB.HostIPs[0],
+			http.StatusOK,
+			dbtools.FixtureInstanceB.InstanceID,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataPath(), nil)
+			req.RemoteAddr = net.JoinHostPort(testcase.instanceIP, "0")
+			router.ServeHTTP(w, req)
+
+			require.Equal(t, testcase.expectedStatus, w.Code)
+
+			if testcase.expectedStatus == http.StatusOK {
+				metadata := map[string]interface{}{}
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &metadata))
+
+				assert.Equal(t, testcase.expectedInstanceID, metadata["id"])
+			}
+		})
+	}
+}
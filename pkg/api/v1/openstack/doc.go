@@ -0,0 +1,3 @@
+// Package openstack provides for converting metadata json to the OpenStack
+// config-drive format
+package openstack
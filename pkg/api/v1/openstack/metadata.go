@@ -0,0 +1,49 @@
+package openstack
+
+import (
+	"fmt"
+
+	"go.hollow.sh/metadataservice/pkg/api/v1/ec2"
+)
+
+// OpenstackMetadata represents the OpenStack meta_data.json document, as
+// parsed by cloud-init's OpenStack datasource. Only the fields which can be
+// derived from the metadata are included.
+type OpenstackMetadata struct { //nolint:revive // stutters, but reads better next to the ec2 types in the router
+	UUID             string            `json:"uuid"`
+	Name             string            `json:"name"`
+	Hostname         string            `json:"hostname"`
+	PublicKeys       map[string]string `json:"public_keys"`
+	AvailabilityZone string            `json:"availability_zone,omitempty"`
+	LaunchIndex      int               `json:"launch_index"`
+}
+
+// NewOpenstackMetadata builds the meta_data.json document for the metadata.
+// The instance's hostname is used as both its name and hostname. The SSH
+// public keys are named "key-N", in the order the EC2-style endpoints serve
+// them, since their comments aren't necessarily unique. The availability
+// zone comes from the facility's configured placement, and without one, is
+// the facility itself.
+func NewOpenstackMetadata(metadata ec2.MetadataContainer) OpenstackMetadata {
+	doc := OpenstackMetadata{
+		UUID:             ec2.FirstItemValue(metadata, "instance-id"),
+		Name:             ec2.FirstItemValue(metadata, "hostname"),
+		Hostname:         ec2.FirstItemValue(metadata, "hostname"),
+		PublicKeys:       map[string]string{},
+		AvailabilityZone: ec2.FirstItemValue(metadata, "placement/availability-zone"),
+	}
+
+	if keys, ok := metadata.GetItem("public-keys"); ok {
+		for i, key := range keys {
+			if key != "" {
+				doc.PublicKeys[fmt.Sprintf("key-%d", i)] = key
+			}
+		}
+	}
+
+	if doc.AvailabilityZone == "" {
+		doc.AvailabilityZone = ec2.FirstItemValue(metadata, "facility")
+	}
+
+	return doc
+}
@@ -0,0 +1,113 @@
+package openstack_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hollow.sh/metadataservice/pkg/api/v1/ec2"
+	"go.hollow.sh/metadataservice/pkg/api/v1/openstack"
+)
+
+func TestNewOpenstackMetadata(t *testing.T) {
+	ec2.SetFacilityPlacements(map[string]ec2.Placement{"da11": {Region: "us-central", AvailabilityZone: "us-central-da11"}})
+	defer ec2.SetFacilityPlacements(nil)
+
+	type testCase struct {
+		testName string
+		metadata *ec2.Metadata
+		expected openstack.OpenstackMetadata
+	}
+
+	testCases := []testCase{
+		{
+			"facility with a placement",
+			&ec2.Metadata{
+				ID:       "e5e4bd27-2a33-4b5e-9d3a-0c1e2c2f1b4a",
+				Hostname: "instance-a",
+				Facility: "da11",
+				SSHKeys: []ec2.SSHKey{
+					{Key: "ssh-ed25519 AAAAfirst test@user.local"},
+					{Key: "ssh-ed25519 AAAAsecond test@user.local", Priority: 10},
+				},
+			},
+			openstack.OpenstackMetadata{
+				UUID:     "e5e4bd27-2a33-4b5e-9d3a-0c1e2c2f1b4a",
+				Name:     "instance-a",
+				Hostname: "instance-a",
+				PublicKeys: map[string]string{
+					"key-0": "ssh-ed25519 AAAAsecond test@user.local",
+					"key-1": "ssh-ed25519 AAAAfirst test@user.local",
+				},
+				AvailabilityZone: "us-central-da11",
+			},
+		},
+		{
+			"facility without a placement",
+			&ec2.Metadata{
+				ID:       "e5e4bd27-2a33-4b5e-9d3a-0c1e2c2f1b4a",
+				Hostname: "instance-b",
+				Facility: "ny5",
+			},
+			openstack.OpenstackMetadata{
+				UUID:             "e5e4bd27-2a33-4b5e-9d3a-0c1e2c2f1b4a",
+				Name:             "instance-b",
+				Hostname:         "instance-b",
+				PublicKeys:       map[string]string{},
+				AvailabilityZone: "ny5",
+			},
+		},
+		{
+			"minimal metadata",
+			&ec2.Metadata{ID: "e5e4bd27-2a33-4b5e-9d3a-0c1e2c2f1b4a"},
+			openstack.OpenstackMetadata{
+				UUID:       "e5e4bd27-2a33-4b5e-9d3a-0c1e2c2f1b4a",
+				PublicKeys: map[string]string{},
+			},
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			assert.Equal(t, testcase.expected, openstack.NewOpenstackMetadata(testcase.metadata))
+		})
+	}
+}
+
+// TestOpenstackMetadataJSON tests that the document has the shape cloud-init's
+// OpenStack datasource expects: a string "uuid" (which it requires), a
+// "public_keys" object mapping names to keys (even when there are none), and
+// the optional "hostname", "name", "availability_zone", and "launch_index".
+func TestOpenstackMetadataJSON(t *testing.T) {
+	doc := openstack.NewOpenstackMetadata(&ec2.Metadata{
+		ID:       "e5e4bd27-2a33-4b5e-9d3a-0c1e2c2f1b4a",
+		Hostname: "instance-a",
+		Facility: "ny5",
+		SSHKeys:  []ec2.SSHKey{{Key: "ssh-ed25519 AAAAfirst test@user.local"}},
+	})
+
+	data, err := json.Marshal(doc)
+	require.NoError(t, err)
+
+	expected := `{
+		"uuid": "e5e4bd27-2a33-4b5e-9d3a-0c1e2c2f1b4a",
+		"name": "instance-a",
+		"hostname": "instance-a",
+		"public_keys": {"key-0": "ssh-ed25519 AAAAfirst test@user.local"},
+		"availability_zone": "ny5",
+		"launch_index": 0
+	}`
+	assert.JSONEq(t, expected, string(data))
+
+	data, err = json.Marshal(openstack.NewOpenstackMetadata(&ec2.Metadata{}))
+	require.NoError(t, err)
+
+	var minimal map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &minimal))
+
+	assert.Contains(t, minimal, "uuid")
+	assert.Equal(t, map[string]interface{}{}, minimal["public_keys"])
+	assert.NotContains(t, minimal, "availability_zone")
+}
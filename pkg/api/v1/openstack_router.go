@@ -0,0 +1,41 @@
+package metadataservice
+
+import (
+	"path"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// OpenstackURI is the path prefix for the OpenStack config-drive format
+	OpenstackURI = "/openstack"
+
+	// OpenstackMetadataURI is the path to the OpenStack-style metadata
+	// endpoint, serving the meta_data.json document.
+	OpenstackMetadataURI = "/latest/meta_data.json"
+
+	// OpenstackUserdataURI is the path to the OpenStack-style userdata
+	// endpoint
+	OpenstackUserdataURI = "/latest/user_data"
+)
+
+// OpenstackRoutes will add the routes for the OpenStack-style API, as read by
+// cloud-init's OpenStack datasource, to a router group
+func (r *Router) OpenstackRoutes(rg *gin.RouterGroup) {
+	// GET /openstack/latest/meta_data.json
+	// GET /openstack/latest/user_data
+	rg.GET(OpenstackMetadataURI, r.serverTimingMiddleware, r.publicRateLimiter(), r.identifyInstance(), r.requireClientIP, r.instanceOpenstackMetadataGet)
+	rg.GET(OpenstackUserdataURI, varyOnAccept, r.serverTimingMiddleware, r.publicRateLimiter(), r.identifyInstance(), r.requireClientIP, r.instanceOpenstackUserdataGet)
+}
+
+// GetOpenstackMetadataPath returns the path used to fetch the OpenStack-style
+// meta_data.json document
+func GetOpenstackMetadataPath() string {
+	return path.Join(OpenstackURI, OpenstackMetadataURI)
+}
+
+// GetOpenstackUserdataPath returns the path used to fetch OpenStack-style
+// userdata
+func GetOpenstackUserdataPath() string {
+	return path.Join(OpenstackURI, OpenstackUserdataURI)
+}
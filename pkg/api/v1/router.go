@@ -1,25 +1,36 @@
 package metadataservice
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/netip"
 	"path"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"text/template"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
+	"github.com/spf13/viper"
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 
 	"go.hollow.sh/toolbox/ginjwt"
 
+	"go.hollow.sh/metadataservice/internal/audit"
+	"go.hollow.sh/metadataservice/internal/fieldcrypt"
 	"go.hollow.sh/metadataservice/internal/lookup"
 	"go.hollow.sh/metadataservice/internal/middleware"
 	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/upserter"
 )
 
 const (
@@ -34,6 +45,11 @@ const (
 	// instances themselves to retrieve their userdata.
 	UserdataURI = "/userdata"
 
+	// MetadataSignedURI is the path to the metadata endpoint serving an
+	// instance's metadata by its ID to requests with a valid signature, for
+	// when instances can't be identified by their IP address.
+	MetadataSignedURI = "/metadata/signed/:instance-id"
+
 	// InternalMetadataURI is the path to the internal (authenticated) endpoint
 	// used for updating & retrieving metadata for any instance
 	InternalMetadataURI = "/device-metadata"
@@ -50,7 +66,109 @@ const (
 	// endpoint used for retrieving the stored metadata for an instance
 	InternalUserdataWithIDURI = "/device-userdata/:instance-id"
 
+	// InternalMetadataFreshnessURI is the path to the internal
+	// (authenticated) endpoint used for checking whether the stored metadata
+	// for an instance is older than the cache TTL.
+	InternalMetadataFreshnessURI = "/device-metadata/:instance-id/freshness"
+
+	// InternalMetadataFullURI is the path to the internal (authenticated)
+	// endpoint used for retrieving the stored metadata for an instance along
+	// with its IP address associations.
+	InternalMetadataFullURI = "/device-metadata/:instance-id/full"
+
+	// InternalMetadataEc2URI is the path to the internal (authenticated)
+	// endpoint used for retrieving the stored metadata for an instance as
+	// parsed for the EC2-style endpoints, for debugging.
+	InternalMetadataEc2URI = "/device-metadata/:instance-id/ec2"
+
+	// InternalInstancesWithinCIDRURI is the path to the internal
+	// (authenticated) endpoint used for listing the IDs of instances with IP
+	// addresses within a CIDR.
+	InternalInstancesWithinCIDRURI = "/device-ip/within/*cidr"
+
+	// InternalInstancesMissingEC2ItemURI is the path to the internal
+	// (authenticated) endpoint used to list the instances whose metadata
+	// doesn't have a value for an EC2 item.
+	InternalInstancesMissingEC2ItemURI = "/device-metadata/missing-item/*item"
+
+	// InternalMetadataDeleteBatchURI is the path to the internal
+	// (authenticated) endpoint used to delete the data stored for a list of
+	// instances at once.
+	InternalMetadataDeleteBatchURI = "/device-metadata/delete-batch"
+
+	// InternalUserdataMaintenanceURI is the path to the internal
+	// (authenticated) endpoint used to start or stop serving the maintenance
+	// userdata, and to check whether it's being served.
+	InternalUserdataMaintenanceURI = "/device-userdata-maintenance"
+
+	// InstanceIDHeader is the response header set on successful responses from
+	// the public metadata and userdata endpoints, containing the ID of the
+	// instance the request was resolved to.
+	InstanceIDHeader = "X-Instance-ID"
+
+	// CreatedAtHeader and UpdatedAtHeader are the response headers set on
+	// successful responses from the internal metadata endpoint, containing
+	// when the instance's metadata was first stored and last updated.
+	CreatedAtHeader = "X-Created-At"
+	UpdatedAtHeader = "X-Updated-At"
+
+	// DefaultInstanceNotFoundMessage is the message returned in 404 responses
+	// from the public metadata and userdata endpoints when there's no data for
+	// the requesting instance.
+	DefaultInstanceNotFoundMessage = "no data for requesting address"
+
+	// TemplateMissingKeyDrop omits a template field from the metadata response
+	// when its template references a missing metadata key.
+	TemplateMissingKeyDrop = "drop"
+	// TemplateMissingKeyEmpty renders a template field as an empty string when
+	// its template references a missing metadata key.
+	TemplateMissingKeyEmpty = "empty"
+	// TemplateMissingKeyDefault renders a template field as its configured
+	// default value when its template references a missing metadata key.
+	TemplateMissingKeyDefault = "default"
+
+	// MetadataIPMismatchWarn logs a warning when metadata being stored lists
+	// IP addresses in network.addresses which aren't in the request's
+	// ipAddresses, so /metadata won't resolve them to the instance.
+	MetadataIPMismatchWarn = "warn"
+	// MetadataIPMismatchError rejects such requests with a 400 instead.
+	MetadataIPMismatchError = "error"
+
+	// UserdataLineEndingsStore converts CRLF line endings in userdata to LF
+	// before it's stored.
+	UserdataLineEndingsStore = "store"
+	// UserdataLineEndingsServe stores userdata as it was pushed, and converts
+	// CRLF line endings to LF when it's served to instances instead.
+	UserdataLineEndingsServe = "serve"
+
+	// DefaultMaxAuthorizationHeaderSize is the maximum size, in bytes, of the
+	// Authorization header accepted by the internal endpoints when the
+	// Router's MaxAuthorizationHeaderSize isn't set.
+	DefaultMaxAuthorizationHeaderSize = 16 * 1024
+
+	// DefaultSignedURLMaxLifetime is how far in the future a signed metadata
+	// URL may expire when the Router's SignedURLMaxLifetime isn't set.
+	DefaultSignedURLMaxLifetime = 24 * time.Hour
+
+	// YAMLContentType is the Content-Type of metadata responses served as YAML.
+	YAMLContentType = mimeYAML + "; charset=utf-8"
+
+	mimeYAML = "application/yaml"
+
 	scopePrefix = "metadata"
+
+	// contextKeyMetadataSource is the gin.Context key recording where the
+	// metadata for a request came from (metadataSourceDB,
+	// metadataSourceLookup, or metadataSourceFallback), for the optional debug
+	// fields.
+	contextKeyMetadataSource = "metadata-source"
+	metadataSourceDB         = "db"
+	metadataSourceLookup     = "lookup"
+	metadataSourceFallback   = "fallback"
+
+	// debugFieldsKey is the metadata response key holding the optional debug
+	// fields.
+	debugFieldsKey = "_debug"
 )
 
 var (
@@ -66,6 +184,47 @@ var (
 
 	// ErrInvalidUUID is returned when an invalid uuid is provided.
 	ErrInvalidUUID = errors.New("invalid uuid")
+
+	// ErrInvalidPagination is returned when invalid limit or offset query
+	// parameters are provided.
+	ErrInvalidPagination = errors.New("limit must be a positive integer and offset a non-negative integer")
+
+	// ErrInvalidCursor is returned when a list's cursor isn't an instance ID.
+	ErrInvalidCursor = errors.New("cursor must be an instance ID")
+
+	errInvalidUTF8Userdata = errors.New("userdata must be valid UTF-8 or gzip'd")
+
+	errInvalidMetadata = errors.New("metadata must be a JSON object or array, or a string containing JSON")
+
+	errDisallowedMetadataKeys = errors.New("metadata contains keys that aren't allowed")
+
+	errDisallowedIPAddresses = errors.New("IP addresses aren't within the allowed CIDRs")
+
+	errFutureUpdatedAt = errors.New("updatedAt is too far in the future")
+
+	errMismatchedInstanceID = errors.New("request body ID doesn't match the instance ID in the path")
+
+	errMetadataIPMismatch = errors.New("metadata lists IP addresses which aren't in ipAddresses")
+
+	errMissingEC2Item = errors.New("an EC2 item, like public-keys, is required")
+
+	errFingerprintMismatch = errors.New("instance fingerprint doesn't match")
+
+	// ErrInvalidUnresolvedClientIPStatus is returned when the configured
+	// status for requests without a resolvable client IP isn't 400 or 404.
+	ErrInvalidUnresolvedClientIPStatus = errors.New("unresolved client IP status must be 400 or 404")
+
+	// ErrInvalidTemplateMissingKeyMode is returned when an unknown template
+	// missing key mode is configured.
+	ErrInvalidTemplateMissingKeyMode = errors.New("invalid template missing key mode")
+
+	// ErrInvalidMetadataIPMismatchMode is returned when an unknown metadata IP
+	// mismatch mode is configured.
+	ErrInvalidMetadataIPMismatchMode = errors.New("invalid metadata IP mismatch mode")
+
+	// ErrInvalidUserdataLineEndingsMode is returned when an unknown userdata
+	// line ending normalization mode is configured.
+	ErrInvalidUserdataLineEndingsMode = errors.New("invalid userdata line endings normalization mode")
 )
 
 // Router provides a router for the v1 API
@@ -76,76 +235,577 @@ type Router struct {
 	LookupEnabled  bool
 	LookupClient   lookup.Client
 	TemplateFields map[string]template.Template
+	// TemplateFieldConditions holds optional conditions for template fields,
+	// keyed by field name. A field is only added when its condition, executed
+	// against the metadata, renders a truthy value.
+	TemplateFieldConditions map[string]template.Template
+	// LookupSkipCIDRs lists request IP ranges the upstream lookup service is
+	// never called for, since it's known not to have data for them.
+	LookupSkipCIDRs []netip.Prefix
+	// AllowedIPCIDRs, if set, are the CIDRs the IP addresses of metadata and
+	// userdata upserts must be within. See ParseAllowedIPCIDRs.
+	AllowedIPCIDRs []netip.Prefix
+	// AuditLogger, if set, records every successful write to the internal
+	// endpoints.
+	AuditLogger *audit.Logger
+	// TemplateMissingKeyMode controls how a template field is rendered when its
+	// template references a metadata key the instance doesn't have. It's one of
+	// TemplateMissingKeyDrop, TemplateMissingKeyEmpty, or
+	// TemplateMissingKeyDefault. Only templates parsed with the
+	// "missingkey=error" option report missing keys. When unset, missing keys
+	// aren't handled: templates parsed with "missingkey=error" fail, and the
+	// metadata is served without any template fields, while other templates
+	// render missing keys as "<no value>".
+	TemplateMissingKeyMode string
+	// TemplateMissingKeyDefaults holds per-field values rendered in
+	// TemplateMissingKeyDefault mode. Fields without an entry are rendered as
+	// TemplateMissingKeyDefaultValue.
+	TemplateMissingKeyDefaults     map[string]string
+	TemplateMissingKeyDefaultValue string
+	// UserdataTemplate, if set, is used to generate userdata for instances
+	// with metadata but no stored userdata. It's executed against the
+	// instance's metadata.
+	UserdataTemplate *template.Template
+	// DefaultUserdata, if set, is served to instances with metadata but no
+	// stored userdata. A UserdataTemplate takes precedence over it on the
+	// /userdata endpoint.
+	DefaultUserdata []byte
+	// MaintenanceUserdata, if set, can be served by the public userdata
+	// endpoints in place of the instances' own userdata while maintenance is
+	// toggled on with SetUserdataMaintenance or the internal endpoint, like
+	// to have instances hold during cluster work. The internal endpoints
+	// always serve the stored userdata.
+	MaintenanceUserdata []byte
+	// UserdataGzipPassthrough, if set, serves userdata that was stored gzip'd
+	// as-is with a "Content-Encoding: gzip" header to clients that accept
+	// gzip, and decompressed to clients that don't. Otherwise, stored userdata
+	// is always served exactly as it was pushed.
+	UserdataGzipPassthrough bool
+	// NotFoundRetryAfter, if set, is returned as a Retry-After header on 404
+	// responses from the public metadata and userdata endpoints.
+	NotFoundRetryAfter time.Duration
+	// NotFoundMessage overrides DefaultInstanceNotFoundMessage.
+	NotFoundMessage string
+	// IncludeDebugFields, if set, adds a "_debug" object to /metadata responses
+	// with the request IP and whether the metadata came from the DB or the
+	// upstream lookup service.
+	IncludeDebugFields bool
+	// FieldRenames maps stored top-level metadata keys to the names they're
+	// presented with in the JSON metadata responses. The EC2 endpoints always
+	// use the stored names.
+	FieldRenames map[string]string
+	// EC2SchemaVersion is the metadata schema version used to render the EC2
+	// endpoints for records that don't declare their own. Defaults to v1.
+	EC2SchemaVersion string
+	// EC2AlwaysAdvertisedItems are top-level EC2 item names, like "public-keys",
+	// which are listed for every instance even when they're empty. Requests
+	// for an empty item still get a 404.
+	EC2AlwaysAdvertisedItems []string
+	// EmptyMetadataNotFound, if set, makes the metadata JSON endpoints respond
+	// with a 404 instead of a 200 when the stored metadata is an empty object.
+	EmptyMetadataNotFound bool
+	// UnresolvedClientIPStatus is the status returned by the public endpoints
+	// when the request's client IP address can't be resolved, either
+	// http.StatusNotFound (the default) or http.StatusBadRequest.
+	UnresolvedClientIPStatus int
+	// WriteRateLimit, if set, limits each JWT subject to this many requests per
+	// second (with a burst of WriteRateBurst) on the internal POST and DELETE
+	// endpoints.
+	WriteRateLimit float64
+	WriteRateBurst int
+	// PublicRateLimit, if set, limits each client IP address to this many
+	// requests per second (with a burst of PublicRateBurst) on the public
+	// metadata and userdata endpoints, shared across all of them.
+	PublicRateLimit float64
+	PublicRateBurst int
+	// ExposeErrors, if set, includes the underlying error in 500 responses,
+	// for debugging. Otherwise they only ever have a generic message.
+	ExposeErrors bool
+	// InstanceIDHeader, if set, is the request header the public endpoints
+	// first try to take the requesting instance's ID from. It's only honoured
+	// on requests from the TrustedProxies.
+	InstanceIDHeader string
+	// MACHeader, if set, is the request header the public endpoints try to
+	// identify the requesting instance by MAC address from, after the
+	// InstanceIDHeader. It's only honoured on requests from the
+	// TrustedProxies.
+	MACHeader string
+	// TrustedProxies are the IP addresses and CIDRs of the proxies whose
+	// InstanceIDHeader and MACHeader are honoured. With none, the headers are
+	// always ignored.
+	TrustedProxies []string
+	// DisableIPIdentification, if set, stops the public endpoints from
+	// identifying the requesting instance by its IP address, which is
+	// otherwise tried last.
+	DisableIPIdentification bool
+	// VerifyIPOwnership, if set, only serves instances identified by their IP
+	// address when the request IP is also listed in the network.addresses of
+	// their stored metadata, guarding against spoofed or stale IP address
+	// associations. Other requests get a 404.
+	VerifyIPOwnership bool
+	// FingerprintHeader and FingerprintField, if set, only serve metadata to
+	// requests whose FingerprintHeader matches the value of FingerprintField
+	// (a dot-separated path, like "customdata.fingerprint") in the instance's
+	// metadata. Other requests get a 403.
+	FingerprintHeader string
+	FingerprintField  string
+	// ServerTiming, if set, adds a Server-Timing header to the responses from
+	// the public read endpoints, breaking down the time spent identifying the
+	// instance, querying the DB, calling the upstream lookup service, and
+	// rendering templates.
+	ServerTiming bool
+	// DeleteBatchMaxSize caps the number of instance IDs accepted by the
+	// batch delete endpoint. Defaults to DefaultDeleteBatchMaxSize.
+	DeleteBatchMaxSize int
+	// MaxAuthorizationHeaderSize caps the size, in bytes, of the
+	// Authorization header accepted by the internal endpoints. Larger headers
+	// get a 431 before the token is parsed. Defaults to
+	// DefaultMaxAuthorizationHeaderSize.
+	MaxAuthorizationHeaderSize int
+	// MetadataFallbacks map prefixes to the instances whose metadata is served
+	// to requests from IP addresses in the prefix which don't match any
+	// instance. See ParseMetadataFallbacks.
+	MetadataFallbacks []MetadataFallback
+	// SignedURLSecret, if set, enables the signed metadata URLs, which serve
+	// an instance's metadata by its ID when signed with this secret. See
+	// SignMetadataURL.
+	SignedURLSecret string
+	// SignedURLMaxLifetime caps how far in the future a signed metadata URL
+	// may expire, so a leaked URL can't be used indefinitely. URLs expiring
+	// later get a 403. Defaults to DefaultSignedURLMaxLifetime.
+	SignedURLMaxLifetime time.Duration
+	// UserdataRequireUTF8, if set, rejects userdata upserts with a 400 when
+	// the userdata isn't valid UTF-8. gzip'd userdata is still accepted.
+	UserdataRequireUTF8 bool
+	// MetadataAllowedKeys, if set, rejects metadata upserts with a 400 when
+	// the metadata has top-level keys outside this list.
+	MetadataAllowedKeys []string
+	// MetadataIPMismatchMode, if set to MetadataIPMismatchWarn or
+	// MetadataIPMismatchError, compares the IP addresses listed in upserted
+	// metadata with the request's ipAddresses, logging or rejecting any
+	// mismatches. See ValidateMetadataIPMismatchMode.
+	MetadataIPMismatchMode string
+	// UserdataLineEndingsMode, if set to UserdataLineEndingsStore or
+	// UserdataLineEndingsServe, converts CRLF line endings in userdata to LF
+	// when it's pushed or when it's served. See
+	// ValidateUserdataLineEndingsMode.
+	UserdataLineEndingsMode string
+	// MetadataTrimStringValues, if set, trims the surrounding whitespace from
+	// top-level string values of metadata before it's stored.
+	MetadataTrimStringValues bool
+	// Now, if set, replaces time.Now as the clock used to decide whether
+	// stored data is stale, and to check updatedAt values and signed URL
+	// expiry times, so tests can control time.
+	Now func() time.Time
+
+	// maintenance is set while the MaintenanceUserdata is being served.
+	maintenance atomic.Bool
+
+	// publicLimiter is the middleware rate limiting the public endpoints,
+	// created once so that all the route groups share the same limits.
+	publicLimiter     gin.HandlerFunc
+	publicLimiterOnce sync.Once
+}
+
+// NewRouter returns a Router using the given dependencies. The upstream lookup
+// service is enabled when lookupClient isn't nil. Everything else is left at
+// its default, and can be configured by setting the Router's fields before
+// its routes are added.
+func NewRouter(logger *zap.Logger, db *sqlx.DB, authMW *ginjwt.Middleware, lookupClient lookup.Client) *Router {
+	return &Router{
+		AuthMW:        authMW,
+		DB:            db,
+		Logger:        logger,
+		LookupEnabled: lookupClient != nil,
+		LookupClient:  lookupClient,
+	}
+}
+
+// now returns the current time, from the Router's Now if it's set.
+func (r *Router) now() time.Time {
+	if r.Now != nil {
+		return r.Now()
+	}
+
+	return time.Now()
 }
 
 // Routes will add the routes for this API version to a router group
 func (r *Router) Routes(rg *gin.RouterGroup) {
 	setupValidator()
 
-	rg.GET(MetadataURI, middleware.IdentifyInstanceByIP(r.Logger, r.DB), r.instanceMetadataGet)
-	rg.GET(UserdataURI, middleware.IdentifyInstanceByIP(r.Logger, r.DB), r.instanceUserdataGet)
+	rg.GET(MetadataURI, r.serverTimingMiddleware, r.publicRateLimiter(), r.identifyInstance(), r.requireClientIP, r.instanceMetadataGet)
+	rg.GET(UserdataURI, varyOnAccept, r.serverTimingMiddleware, r.publicRateLimiter(), r.identifyInstance(), r.requireClientIP, r.instanceUserdataGet)
+
+	if r.SignedURLSecret != "" {
+		rg.GET(MetadataSignedURI, r.serverTimingMiddleware, r.publicRateLimiter(), r.verifySignedURL, r.instanceMetadataGet)
+	}
 
 	authMw := r.AuthMW
-	rg.POST(InternalMetadataURI, authMw.AuthRequired(), authMw.RequiredScopes(upsertScopes("metadata")), r.instanceMetadataSet)
-	rg.POST(InternalUserdataURI, authMw.AuthRequired(), authMw.RequiredScopes(upsertScopes("userdata")), r.instanceUserdataSet)
+	writeLimiter := r.writeRateLimiter()
+	authSizeLimiter := r.authorizationHeaderSizeLimiter()
+
+	rg.POST(InternalMetadataURI, authSizeLimiter, authMw.AuthRequired(), writeLimiter, authMw.RequiredScopes(upsertScopes("metadata")), r.retryBudget, r.instanceMetadataSet)
+	rg.POST(InternalUserdataURI, authSizeLimiter, authMw.AuthRequired(), writeLimiter, authMw.RequiredScopes(upsertScopes("userdata")), r.retryBudget, r.instanceUserdataSet)
+	rg.PUT(InternalMetadataWithIDURI, authSizeLimiter, authMw.AuthRequired(), writeLimiter, authMw.RequiredScopes(upsertScopes("metadata")), r.retryBudget, r.instanceMetadataReplace)
+	rg.POST(InternalMetadataDeleteBatchURI, authSizeLimiter, authMw.AuthRequired(), writeLimiter, authMw.RequiredScopes(deleteScopes("metadata")), r.retryBudget, r.instanceMetadataDeleteBatch)
+
+	rg.HEAD(InternalMetadataWithIDURI, authSizeLimiter, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("metadata")), r.instanceMetadataExistsInternal)
+	rg.HEAD(InternalUserdataWithIDURI, authSizeLimiter, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("userdata")), r.instanceUserdataExistsInternal)
+
+	rg.GET(InternalMetadataURI, authSizeLimiter, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("metadata")), r.instanceMetadataListInternal)
+	rg.GET(InternalMetadataWithIDURI, authSizeLimiter, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("metadata")), r.instanceMetadataGetInternal)
+	rg.GET(InternalUserdataWithIDURI, authSizeLimiter, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("userdata")), r.instanceUserdataGetInternal)
+	rg.GET(InternalMetadataFreshnessURI, authSizeLimiter, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("metadata")), r.instanceMetadataFreshnessGet)
+	rg.GET(InternalMetadataFullURI, authSizeLimiter, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("metadata")), r.instanceMetadataFullGetInternal)
+	rg.GET(InternalMetadataEc2URI, authSizeLimiter, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("metadata")), r.instanceEc2MetadataGetInternal)
+	rg.GET(InternalInstancesWithinCIDRURI, authSizeLimiter, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("metadata")), r.instancesWithinCIDRGet)
+	rg.GET(InternalUserdataMaintenanceURI, authSizeLimiter, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("userdata")), r.userdataMaintenanceGet)
+	rg.PUT(InternalUserdataMaintenanceURI, authSizeLimiter, authMw.AuthRequired(), writeLimiter, authMw.RequiredScopes(upsertScopes("userdata")), r.userdataMaintenanceSet)
+	rg.GET(InternalInstancesMissingEC2ItemURI, authSizeLimiter, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("metadata")), r.instancesMissingEc2ItemGet)
+	rg.DELETE(InternalMetadataWithIDURI, authSizeLimiter, authMw.AuthRequired(), writeLimiter, authMw.RequiredScopes(deleteScopes("metadata")), r.retryBudget, r.instanceMetadataDelete)
+	rg.DELETE(InternalUserdataWithIDURI, authSizeLimiter, authMw.AuthRequired(), writeLimiter, authMw.RequiredScopes(deleteScopes("userdata")), r.retryBudget, r.instanceUserdataDelete)
+}
+
+// identifyInstance returns the middleware identifying the instance making a
+// request to the public endpoints, trying each of the enabled identifiers in
+// turn: the instance ID header, the MAC address header, then the request IP.
+func (r *Router) identifyInstance() gin.HandlerFunc {
+	var identifiers []middleware.InstanceIdentifier
+
+	// Invalid trusted proxies leave the headers ignored, rather than trusted.
+	trustedProxies, err := middleware.ParseTrustedProxies(r.TrustedProxies)
+	if err != nil {
+		r.Logger.Error("ignoring the instance identification headers", zap.Error(err))
+	}
+
+	if r.InstanceIDHeader != "" {
+		identifiers = append(identifiers, middleware.IdentifyByInstanceIDHeader(r.InstanceIDHeader, trustedProxies))
+	}
+
+	if r.MACHeader != "" {
+		identifiers = append(identifiers, middleware.IdentifyByMACHeader(r.DB, r.MACHeader, trustedProxies))
+	}
+
+	if !r.DisableIPIdentification {
+		identifiers = append(identifiers, middleware.IdentifyByIP(r.DB))
+	}
+
+	identify := middleware.IdentifyInstance(r.Logger, identifiers...)
+
+	return func(c *gin.Context) {
+		start := time.Now()
+		identify(c)
+		recordServerTiming(c, serverTimingIdentify, start)
+	}
+}
+
+// requireClientIP stops requests to the public endpoints whose client IP
+// address couldn't be resolved by middleware.IdentifyInstance, responding
+// with the configured UnresolvedClientIPStatus.
+func (r *Router) requireClientIP(c *gin.Context) {
+	if c.GetString(middleware.ContextKeyRequestorIP) != "" {
+		return
+	}
+
+	if r.UnresolvedClientIPStatus == http.StatusBadRequest {
+		c.AbortWithStatusJSON(http.StatusBadRequest, &ErrorResponse{Message: "unable to determine client IP address"})
+		return
+	}
+
+	r.instanceNotFoundResponse(c)
+}
+
+// writeRateLimiter returns the middleware used to rate limit the internal
+// write endpoints by JWT subject, or a no-op if no limit is configured.
+func (r *Router) writeRateLimiter() gin.HandlerFunc {
+	if r.WriteRateLimit <= 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	return middleware.RateLimitBySubject(rate.Limit(r.WriteRateLimit), max(r.WriteRateBurst, 1))
+}
+
+// publicRateLimiter returns the middleware used to rate limit the public
+// endpoints by client IP address, or a no-op if no limit is configured.
+func (r *Router) publicRateLimiter() gin.HandlerFunc {
+	r.publicLimiterOnce.Do(func() {
+		if r.PublicRateLimit <= 0 {
+			r.publicLimiter = func(c *gin.Context) { c.Next() }
+			return
+		}
+
+		r.publicLimiter = middleware.RateLimitByIP(rate.Limit(r.PublicRateLimit), max(r.PublicRateBurst, 1))
+	})
+
+	return r.publicLimiter
+}
+
+// authorizationHeaderSizeLimiter returns the middleware rejecting requests to
+// the internal endpoints with oversized Authorization headers.
+func (r *Router) authorizationHeaderSizeLimiter() gin.HandlerFunc {
+	maxSize := r.MaxAuthorizationHeaderSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxAuthorizationHeaderSize
+	}
+
+	return middleware.LimitAuthorizationHeaderSize(maxSize)
+}
+
+// retryBudget gives the request a retry budget, shared by all of its DB
+// transaction retry loops, from crdb.retry_budget and
+// crdb.retry_budget_attempts. Without either, retries are only limited by
+// crdb.max_retries in each loop.
+func (r *Router) retryBudget(c *gin.Context) {
+	maxDuration := viper.GetDuration("crdb.retry_budget")
+	maxRetries := viper.GetInt("crdb.retry_budget_attempts")
+
+	if maxDuration <= 0 && maxRetries <= 0 {
+		return
+	}
+
+	budget := upserter.NewRetryBudget(maxDuration, maxRetries)
+	c.Request = c.Request.WithContext(upserter.WithRetryBudget(c.Request.Context(), budget))
+}
 
-	rg.HEAD(InternalMetadataWithIDURI, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("metadata")), r.instanceMetadataExistsInternal)
-	rg.HEAD(InternalUserdataWithIDURI, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("userdata")), r.instanceUserdataExistsInternal)
+// auditLog records a successful write operation by the request's JWT subject
+// in the audit log.
+func (r *Router) auditLog(c *gin.Context, action, instanceID string) {
+	r.AuditLogger.Log(action, ginjwt.GetSubject(c), instanceID)
+}
+
+// ValidateUnresolvedClientIPStatus returns an error if status isn't a
+// supported status for requests without a resolvable client IP address. Zero
+// is treated as http.StatusNotFound.
+func ValidateUnresolvedClientIPStatus(status int) error {
+	switch status {
+	case 0, http.StatusNotFound, http.StatusBadRequest:
+		return nil
+	default:
+		return fmt.Errorf("%w: %d", ErrInvalidUnresolvedClientIPStatus, status)
+	}
+}
+
+// ValidateTemplateMissingKeyMode returns an error if mode isn't a known
+// template missing key mode. An empty mode, which leaves missing keys
+// unhandled, is valid.
+func ValidateTemplateMissingKeyMode(mode string) error {
+	switch mode {
+	case "", TemplateMissingKeyDrop, TemplateMissingKeyEmpty, TemplateMissingKeyDefault:
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidTemplateMissingKeyMode, mode)
+	}
+}
+
+// ValidateMetadataIPMismatchMode returns an error if mode isn't a known
+// metadata IP mismatch mode. An empty mode disables the check.
+func ValidateMetadataIPMismatchMode(mode string) error {
+	switch mode {
+	case "", MetadataIPMismatchWarn, MetadataIPMismatchError:
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidMetadataIPMismatchMode, mode)
+	}
+}
+
+// ValidateUserdataLineEndingsMode returns an error if mode isn't a known
+// userdata line ending normalization mode. An empty mode disables it.
+func ValidateUserdataLineEndingsMode(mode string) error {
+	switch mode {
+	case "", UserdataLineEndingsStore, UserdataLineEndingsServe:
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidUserdataLineEndingsMode, mode)
+	}
+}
+
+// lookupAllowed reports whether the upstream lookup service is enabled and
+// should be called for the request. Requests from IPs within LookupSkipCIDRs
+// are never looked up.
+func (r *Router) lookupAllowed(c *gin.Context) bool {
+	if !r.LookupEnabled || r.LookupClient == nil {
+		return false
+	}
+
+	requestIP, err := netip.ParseAddr(c.GetString(middleware.ContextKeyRequestorIP))
+	if err != nil {
+		return true
+	}
 
-	rg.GET(InternalMetadataWithIDURI, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("metadata")), r.instanceMetadataGetInternal)
-	rg.GET(InternalUserdataWithIDURI, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("userdata")), r.instanceUserdataGetInternal)
-	rg.DELETE(InternalMetadataWithIDURI, authMw.AuthRequired(), authMw.RequiredScopes(deleteScopes("metadata")), r.instanceMetadataDelete)
-	rg.DELETE(InternalUserdataWithIDURI, authMw.AuthRequired(), authMw.RequiredScopes(deleteScopes("userdata")), r.instanceUserdataDelete)
+	for _, prefix := range r.LookupSkipCIDRs {
+		if prefix.Contains(requestIP.Unmap()) {
+			return false
+		}
+	}
+
+	return true
 }
 
+// getMetadata returns the metadata for the requesting instance, as long as the
+// request presents the instance's fingerprint when that's required.
 func (r *Router) getMetadata(c *gin.Context) (*models.InstanceMetadatum, error) {
+	metadata, err := r.resolveMetadata(c)
+	if err == nil && !r.fingerprintVerified(c, metadata) {
+		return nil, errFingerprintMismatch
+	}
+
+	return metadata, err
+}
+
+func (r *Router) resolveMetadata(c *gin.Context) (*models.InstanceMetadatum, error) {
 	instanceID := c.GetString(middleware.ContextKeyInstanceID)
 
 	if instanceID == "" {
 		// We couldn't match the request IP to an instance ID that the metadata
 		// service already knows about. So we'll try to get it from the upstream
-		// lookup service (if it's enabled and configured).
+		// lookup service (if it's enabled and configured), and then from the
+		// fallback instance for the request IP's prefix (if one is configured).
 		middleware.MetricMetadataCacheMiss.Inc()
 		requestIP := c.GetString(middleware.ContextKeyRequestorIP)
 
-		if r.LookupEnabled && r.LookupClient != nil {
+		if r.lookupAllowed(c) {
+			c.Set(contextKeyMetadataSource, metadataSourceLookup)
+
+			lookupStart := time.Now()
 			metadata, err := lookup.MetadataSyncByIP(c.Request.Context(), r.DB, r.Logger, r.LookupClient, requestIP)
+			recordServerTiming(c, serverTimingLookup, lookupStart)
+
 			if err != nil && errors.Is(err, lookup.ErrNotFound) {
-				return nil, errNotFound
+				return r.getFallbackMetadata(c, requestIP)
 			}
 
 			return metadata, err
 		}
 
-		return nil, errNotFound
+		return r.getFallbackMetadata(c, requestIP)
 	}
 
 	// We got an instance ID from the middleware, either because we could match
 	// the request IP to an ID, or the request itself provided the instance ID.
-	metadata, err := models.FindInstanceMetadatum(c.Request.Context(), r.DB, instanceID)
+	dbStart := time.Now()
+	metadata, err := findInstanceMetadata(c.Request.Context(), r.DB, instanceID)
+	recordServerTiming(c, serverTimingDB, dbStart)
 
 	if err != nil && errors.Is(err, sql.ErrNoRows) {
 		// We couldn't find an instance_metadata row for this instance ID. Try
 		// to fetch it from the upstream lookup service (if enabled and configured)
 		middleware.MetricMetadataCacheMiss.Inc()
 
-		if r.LookupEnabled && r.LookupClient != nil {
-			metadata, err = lookup.MetadataSyncByID(c.Request.Context(), r.DB, r.Logger, r.LookupClient, instanceID)
+		if r.lookupAllowed(c) {
+			c.Set(contextKeyMetadataSource, metadataSourceLookup)
+
+			lookupStart := time.Now()
+			metadata, err = lookup.MetadataSyncByID(r.lookupContext(c), r.DB, r.Logger, r.LookupClient, instanceID)
+			recordServerTiming(c, serverTimingLookup, lookupStart)
+
 			if err != nil && errors.Is(err, lookup.ErrNotFound) {
 				return nil, errNotFound
 			}
 
+			if err == nil && !r.ipOwnershipVerified(c, metadata) {
+				return nil, errNotFound
+			}
+
 			return metadata, err
 		}
 
 		return nil, errNotFound
 	}
 
-	middleware.MetricMetadataCacheHit.Inc()
+	if err == nil && r.lookupAllowed(c) && isStale(r.now().Sub(metadata.UpdatedAt), cacheTTL(metadata.Metadata)) {
+		metadata = r.refreshExpiredMetadata(c, metadata)
+	} else {
+		middleware.MetricMetadataCacheHit.Inc()
+		c.Set(contextKeyMetadataSource, metadataSourceDB)
+	}
+
+	if err == nil && !r.ipOwnershipVerified(c, metadata) {
+		return nil, errNotFound
+	}
 
 	return metadata, err
 }
 
+// refreshExpiredMetadata fetches the instance's metadata from the upstream
+// lookup service to replace its expired local copy. If the refresh fails, the
+// stale local copy is returned instead, as it's still better than nothing.
+func (r *Router) refreshExpiredMetadata(c *gin.Context, stale *models.InstanceMetadatum) *models.InstanceMetadatum {
+	middleware.MetricMetadataCacheMiss.Inc()
+
+	lookupStart := time.Now()
+	metadata, err := lookup.MetadataSyncByID(r.lookupContext(c), r.DB, r.Logger, r.LookupClient, stale.ID)
+	recordServerTiming(c, serverTimingLookup, lookupStart)
+
+	if err != nil {
+		r.Logger.Sugar().Warn("Failed to refresh expired metadata for instance ", stale.ID, ", serving the stored copy. Error: ", err)
+		c.Set(contextKeyMetadataSource, metadataSourceDB)
+
+		return stale
+	}
+
+	c.Set(contextKeyMetadataSource, metadataSourceLookup)
+
+	return metadata
+}
+
+// ipOwnershipVerified reports whether the metadata may be served to the
+// request. With VerifyIPOwnership set, an instance identified by the request
+// IP must also list that IP in its metadata's network.addresses.
+func (r *Router) ipOwnershipVerified(c *gin.Context, metadata *models.InstanceMetadatum) bool {
+	if !r.VerifyIPOwnership || !c.GetBool(middleware.ContextKeyIdentifiedByIP) {
+		return true
+	}
+
+	requestIP := c.GetString(middleware.ContextKeyRequestorIP)
+
+	metadataIPs, err := ExtractIPAddressesFromMetadata(metadata.Metadata.String())
+	if err == nil && ipWithinPrefixes(requestIP, ipAddressPrefixes(metadataIPs)) {
+		return true
+	}
+
+	r.Logger.Warn("request IP address isn't listed in the identified instance's metadata", zap.String("instance_id", metadata.ID), zap.String("request_ip", requestIP))
+	middleware.MetricIPOwnershipUnverified.Inc()
+
+	return false
+}
+
+// lookupContext returns the context for a lookup by instance ID, carrying the
+// requesting instance's IP address so the lookup client can forward it.
+func (r *Router) lookupContext(c *gin.Context) context.Context {
+	return lookup.WithClientIP(c.Request.Context(), c.GetString(middleware.ContextKeyRequestorIP))
+}
+
+// findInstanceMetadata finds the metadata stored for an instance, with any
+// encrypted fields decrypted.
+func findInstanceMetadata(ctx context.Context, db *sqlx.DB, instanceID string) (*models.InstanceMetadatum, error) {
+	metadata, err := models.FindInstanceMetadatum(ctx, db, instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if metadata.Metadata, err = fieldcrypt.DecryptMetadata(metadata.Metadata); err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+// findInstanceUserdata finds the userdata stored for an instance, decompressed
+// if it was compressed at rest.
+func findInstanceUserdata(ctx context.Context, db *sqlx.DB, instanceID string) (*models.InstanceUserdatum, error) {
+	userdata, err := models.FindInstanceUserdatum(ctx, db, instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := upserter.DecompressUserdata(userdata); err != nil {
+		return nil, err
+	}
+
+	return userdata, nil
+}
+
 func (r *Router) getUserdata(c *gin.Context) (*models.InstanceUserdatum, error) {
 	instanceID := c.GetString(middleware.ContextKeyInstanceID)
 
@@ -156,8 +816,11 @@ func (r *Router) getUserdata(c *gin.Context) (*models.InstanceUserdatum, error)
 		middleware.MetricUserdataCacheMiss.Inc()
 		requestIP := c.GetString(middleware.ContextKeyRequestorIP)
 
-		if r.LookupEnabled && r.LookupClient != nil {
+		if r.lookupAllowed(c) {
+			lookupStart := time.Now()
 			userdata, err := lookup.UserdataSyncByIP(c.Request.Context(), r.DB, r.Logger, r.LookupClient, requestIP)
+			recordServerTiming(c, serverTimingLookup, lookupStart)
+
 			if err != nil && errors.Is(err, lookup.ErrNotFound) {
 				return nil, errNotFound
 			}
@@ -168,15 +831,26 @@ func (r *Router) getUserdata(c *gin.Context) (*models.InstanceUserdatum, error)
 		return nil, errNotFound
 	}
 
+	// Userdata has no IP addresses of its own, so its ownership is verified
+	// against the instance's stored metadata.
+	if err := r.verifyUserdataIPOwnership(c, instanceID); err != nil {
+		return nil, err
+	}
+
 	// We got an instance ID from the middleware, either because we could match
 	// the request IP to an ID, or the request itself provided the instance ID.
-	userdata, err := models.FindInstanceUserdatum(c.Request.Context(), r.DB, instanceID)
+	dbStart := time.Now()
+	userdata, err := findInstanceUserdata(c.Request.Context(), r.DB, instanceID)
+	recordServerTiming(c, serverTimingDB, dbStart)
 
 	if err != nil && errors.Is(err, sql.ErrNoRows) {
 		// We couldn't find an instance_metadata row for this instance ID. Try
 		// to fetch it from the upstream lookup service (if enabled and configured)
-		if r.LookupEnabled && r.LookupClient != nil {
-			userdata, err = lookup.UserdataSyncByID(c.Request.Context(), r.DB, r.Logger, r.LookupClient, instanceID)
+		if r.lookupAllowed(c) {
+			lookupStart := time.Now()
+			userdata, err = lookup.UserdataSyncByID(r.lookupContext(c), r.DB, r.Logger, r.LookupClient, instanceID)
+			recordServerTiming(c, serverTimingLookup, lookupStart)
+
 			if err != nil && errors.Is(err, lookup.ErrNotFound) {
 				return nil, errNotFound
 			}
@@ -187,16 +861,74 @@ func (r *Router) getUserdata(c *gin.Context) (*models.InstanceUserdatum, error)
 		return nil, errNotFound
 	}
 
+	if err == nil && r.lookupAllowed(c) && isStale(r.now().Sub(userdata.UpdatedAt), r.userdataCacheTTL(c, instanceID)) {
+		return r.refreshExpiredUserdata(c, userdata), nil
+	}
+
 	middleware.MetricUserdataCacheHit.Inc()
 
 	return userdata, err
 }
 
+// refreshExpiredUserdata fetches the instance's userdata from the upstream
+// lookup service to replace its expired local copy. If the refresh fails, the
+// stale local copy is returned instead.
+func (r *Router) refreshExpiredUserdata(c *gin.Context, stale *models.InstanceUserdatum) *models.InstanceUserdatum {
+	middleware.MetricUserdataCacheMiss.Inc()
+
+	lookupStart := time.Now()
+	userdata, err := lookup.UserdataSyncByID(r.lookupContext(c), r.DB, r.Logger, r.LookupClient, stale.ID)
+	recordServerTiming(c, serverTimingLookup, lookupStart)
+
+	if err != nil {
+		r.Logger.Sugar().Warn("Failed to refresh expired userdata for instance ", stale.ID, ", serving the stored copy. Error: ", err)
+
+		return stale
+	}
+
+	return userdata
+}
+
+// verifyUserdataIPOwnership returns errNotFound if the request may not be
+// served the instance's userdata, according to ipOwnershipVerified for the
+// instance's stored metadata. Without stored metadata, ownership can't be
+// verified.
+func (r *Router) verifyUserdataIPOwnership(c *gin.Context, instanceID string) error {
+	if !r.VerifyIPOwnership || !c.GetBool(middleware.ContextKeyIdentifiedByIP) {
+		return nil
+	}
+
+	dbStart := time.Now()
+	metadata, err := findInstanceMetadata(c.Request.Context(), r.DB, instanceID)
+	recordServerTiming(c, serverTimingDB, dbStart)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errNotFound
+		}
+
+		return err
+	}
+
+	if !r.ipOwnershipVerified(c, metadata) {
+		return errNotFound
+	}
+
+	return nil
+}
+
 // GetMetadataPath returns the path used by an instance to fetch Metadata
 func GetMetadataPath() string {
 	return path.Join(V1URI, MetadataURI)
 }
 
+// GetMetadataSignedPath returns the path used by an instance to fetch its
+// Metadata with a signed URL, without the signature's query parameters. Use
+// SignMetadataURL to get the full signed URL.
+func GetMetadataSignedPath(id string) string {
+	return path.Join(V1URI, MetadataURI, "signed", id)
+}
+
 // GetUserdataPath returns the path used by an instance to fetch Userdata
 func GetUserdataPath() string {
 	return path.Join(V1URI, UserdataURI)
@@ -215,6 +947,41 @@ func GetInternalMetadataByIDPath(id string) string {
 	return path.Join(V1URI, InternalMetadataURI, id)
 }
 
+// GetInternalMetadataFreshnessPath returns the path used by an internal,
+// authenticated system or user to check whether the stored metadata for a
+// specific instance is stale.
+func GetInternalMetadataFreshnessPath(id string) string {
+	return path.Join(V1URI, InternalMetadataURI, id, "freshness")
+}
+
+// GetInternalMetadataFullPath returns the path used by an internal,
+// authenticated system or user to retrieve the stored metadata for a specific
+// instance along with its IP address associations.
+func GetInternalMetadataFullPath(id string) string {
+	return path.Join(V1URI, InternalMetadataURI, id, "full")
+}
+
+// GetInternalMetadataEc2Path returns the path used by an internal,
+// authenticated system or user to retrieve the stored metadata for a specific
+// instance as parsed for the EC2-style endpoints.
+func GetInternalMetadataEc2Path(id string) string {
+	return path.Join(V1URI, InternalMetadataURI, id, "ec2")
+}
+
+// GetInternalMetadataDeleteBatchPath returns the path used by an internal,
+// authenticated system or user to delete the data stored for a list of
+// instances.
+func GetInternalMetadataDeleteBatchPath() string {
+	return path.Join(V1URI, InternalMetadataDeleteBatchURI)
+}
+
+// GetInternalUserdataMaintenancePath returns the path used by an internal,
+// authenticated system or user to start, stop, or check serving the
+// maintenance userdata.
+func GetInternalUserdataMaintenancePath() string {
+	return path.Join(V1URI, InternalUserdataMaintenanceURI)
+}
+
 // GetInternalUserdataPath returns the patch used by an internal, authenticated
 // system or used to update or retrieve userdata.
 func GetInternalUserdataPath() string {
@@ -228,6 +995,20 @@ func GetInternalUserdataByIDPath(id string) string {
 	return path.Join(V1URI, InternalUserdataURI, id)
 }
 
+// GetInternalInstancesWithinCIDRPath returns the path used by an internal,
+// authenticated system or user to list the instances with IP addresses
+// within the given CIDR.
+func GetInternalInstancesWithinCIDRPath(cidr string) string {
+	return path.Join(V1URI, "/device-ip/within", cidr)
+}
+
+// GetInternalInstancesMissingEC2ItemPath returns the path used by an internal,
+// authenticated system or user to list the instances whose metadata doesn't
+// have a value for the given EC2 item.
+func GetInternalInstancesMissingEC2ItemPath(item string) string {
+	return path.Join(V1URI, "/device-metadata/missing-item", item)
+}
+
 func upsertScopes(items ...string) []string {
 	s := []string{"write", "create", "update"}
 	for _, i := range items {
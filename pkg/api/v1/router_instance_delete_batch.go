@@ -0,0 +1,189 @@
+package metadataservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"go.hollow.sh/metadataservice/internal/audit"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/variants"
+)
+
+const (
+	// DefaultDeleteBatchMaxSize is the maximum number of instance IDs accepted
+	// by the batch delete endpoint when the Router's DeleteBatchMaxSize isn't
+	// set.
+	DefaultDeleteBatchMaxSize = 100
+
+	// deleteBatchConcurrency is the maximum number of instances deleted at
+	// the same time by a single batch delete request.
+	deleteBatchConcurrency = 8
+
+	// DeleteBatchResultDeleted, DeleteBatchResultNotFound,
+	// DeleteBatchResultInvalid, and DeleteBatchResultError are the possible
+	// per-ID statuses in a batch delete response.
+	DeleteBatchResultDeleted  = "deleted"
+	DeleteBatchResultNotFound = "not_found"
+	DeleteBatchResultInvalid  = "invalid"
+	DeleteBatchResultError    = "error"
+)
+
+var errDeleteBatchTooLarge = errors.New("too many IDs in the batch")
+
+// DeleteBatchRequest is the body of a batch delete request. Userdata is only
+// deleted along with the metadata when DeleteUserdata is set.
+type DeleteBatchRequest struct {
+	IDs            []string `json:"ids" binding:"required"`
+	DeleteUserdata bool     `json:"deleteUserdata"`
+}
+
+// DeleteBatchResult is the outcome of deleting a single instance in a batch.
+type DeleteBatchResult struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	// deletedMetadata and deletedUserdata record what was deleted, for the
+	// audit log.
+	deletedMetadata bool
+	deletedUserdata bool
+}
+
+// DeleteBatchResponse lists the outcome for each ID of a batch delete
+// request, in the order they were requested.
+type DeleteBatchResponse struct {
+	Results []DeleteBatchResult `json:"results"`
+}
+
+// instanceMetadataDeleteBatch deletes the metadata, and optionally the
+// userdata, for each of a list of instances, along with their IP addresses
+// once nothing else is stored for them. Each instance is deleted the same way
+// as by the single instance delete endpoints, a few at a time. The request
+// succeeds even when some of the deletions don't, so the per-ID results have
+// to be checked.
+func (r *Router) instanceMetadataDeleteBatch(c *gin.Context) {
+	var params DeleteBatchRequest
+	if err := c.ShouldBindJSON(&params); err != nil {
+		badRequestResponse(c, "invalid request body", err)
+		return
+	}
+
+	maxSize := r.DeleteBatchMaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultDeleteBatchMaxSize
+	}
+
+	if len(params.IDs) > maxSize {
+		err := fmt.Errorf("%w: %d IDs requested, the limit is %d", errDeleteBatchTooLarge, len(params.IDs), maxSize)
+		badRequestResponse(c, err.Error(), err)
+
+		return
+	}
+
+	results := make([]DeleteBatchResult, len(params.IDs))
+	sem := make(chan struct{}, deleteBatchConcurrency)
+
+	var wg sync.WaitGroup
+
+	for i, instanceID := range params.IDs {
+		wg.Add(1)
+
+		sem <- struct{}{}
+
+		go func(i int, instanceID string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			results[i] = r.deleteBatchInstance(c.Request.Context(), instanceID, params.DeleteUserdata)
+		}(i, instanceID)
+	}
+
+	wg.Wait()
+
+	// The audit log is written here rather than by the workers, since it reads
+	// the request's JWT subject from the gin.Context.
+	for _, result := range results {
+		if result.deletedMetadata {
+			r.auditLog(c, audit.ActionMetadataDelete, result.ID)
+		}
+
+		if result.deletedUserdata {
+			r.auditLog(c, audit.ActionUserdataDelete, result.ID)
+		}
+	}
+
+	c.JSON(http.StatusOK, DeleteBatchResponse{Results: results})
+}
+
+// deleteBatchInstance deletes the metadata, and the userdata if
+// deleteUserdata is set, for a single instance of a batch delete request.
+func (r *Router) deleteBatchInstance(ctx context.Context, instanceID string, deleteUserdata bool) DeleteBatchResult {
+	result := DeleteBatchResult{ID: instanceID}
+
+	if _, err := uuid.Parse(instanceID); err != nil {
+		result.Status = DeleteBatchResultInvalid
+		result.Error = ErrInvalidUUID.Error()
+
+		return result
+	}
+
+	metadata, err := models.FindInstanceMetadatum(ctx, r.DB, instanceID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return r.deleteBatchError(result, err)
+	}
+
+	var userdata *models.InstanceUserdatum
+
+	if deleteUserdata {
+		userdata, err = models.FindInstanceUserdatum(ctx, r.DB, instanceID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return r.deleteBatchError(result, err)
+		}
+
+		// Instances with only userdata variants still have userdata to delete.
+		if userdata == nil {
+			deleteUserdata, err = variants.Exists(ctx, r.DB, instanceID)
+			if err != nil {
+				return r.deleteBatchError(result, err)
+			}
+		}
+	}
+
+	if metadata == nil && !deleteUserdata {
+		result.Status = DeleteBatchResultNotFound
+
+		return result
+	}
+
+	if err := r.deleteInstanceData(ctx, instanceID, metadata, userdata, deleteUserdata); err != nil {
+		return r.deleteBatchError(result, err)
+	}
+
+	result.Status = DeleteBatchResultDeleted
+	result.deletedMetadata = metadata != nil
+	result.deletedUserdata = deleteUserdata
+
+	return result
+}
+
+// deleteBatchError marks a batch delete result as failed. Like the 500
+// responses, the error itself is only included when ExposeErrors is set.
+func (r *Router) deleteBatchError(result DeleteBatchResult, err error) DeleteBatchResult {
+	r.Logger.Sugar().Error("batch deletion failed for instance ", result.ID, " Error: ", err)
+
+	result.Status = DeleteBatchResultError
+	result.Error = "internal server error"
+
+	if r.ExposeErrors {
+		result.Error = err.Error()
+	}
+
+	return result
+}
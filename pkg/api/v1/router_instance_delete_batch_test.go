@@ -0,0 +1,133 @@
+package metadataservice_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.hollow.sh/toolbox/ginjwt"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/models"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func deleteBatchRequest(t *testing.T, router http.Handler, params v1api.DeleteBatchRequest) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataDeleteBatchPath(), bytes.NewReader(body))
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestDeleteMetadataBatch(t *testing.T) {
+	router := *testHTTPServer(t)
+	testDB := dbtools.TestDB()
+
+	unknownID := "99c53a90-61c8-472d-95dc-9abeaeb646c9"
+
+	// Instance A has metadata and userdata, so its instance_ip_addresses rows
+	// remain. Instance B has metadata but no userdata, so its rows are
+	// deleted. Instance E has userdata but no metadata, so there's nothing
+	// to delete.
+	w := deleteBatchRequest(t, router, v1api.DeleteBatchRequest{
+		IDs: []string{dbtools.FixtureInstanceA.InstanceID, unknownID, dbtools.FixtureInstanceB.InstanceID, "bad-id", dbtools.FixtureInstanceE.InstanceID},
+	})
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := v1api.DeleteBatchResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+	expected := []v1api.DeleteBatchResult{
+		{ID: dbtools.FixtureInstanceA.InstanceID, Status: v1api.DeleteBatchResultDeleted},
+		{ID: unknownID, Status: v1api.DeleteBatchResultNotFound},
+		{ID: dbtools.FixtureInstanceB.InstanceID, Status: v1api.DeleteBatchResultDeleted},
+		{ID: "bad-id", Status: v1api.DeleteBatchResultInvalid, Error: v1api.ErrInvalidUUID.Error()},
+		{ID: dbtools.FixtureInstanceE.InstanceID, Status: v1api.DeleteBatchResultNotFound},
+	}
+	assert.Equal(t, expected, resp.Results)
+
+	for _, instanceID := range []string{dbtools.FixtureInstanceA.InstanceID, dbtools.FixtureInstanceB.InstanceID} {
+		exists, err := models.InstanceMetadatumExists(context.TODO(), testDB, instanceID)
+		require.NoError(t, err)
+		assert.False(t, exists, instanceID)
+	}
+
+	userdataExists, err := models.InstanceUserdatumExists(context.TODO(), testDB, dbtools.FixtureInstanceA.InstanceID)
+	require.NoError(t, err)
+	assert.True(t, userdataExists)
+
+	count, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(dbtools.FixtureInstanceA.InstanceID)).Count(context.TODO(), testDB)
+	require.NoError(t, err)
+	assert.Greater(t, count, int64(0))
+
+	count, err = models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(dbtools.FixtureInstanceB.InstanceID)).Count(context.TODO(), testDB)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestDeleteMetadataBatchWithUserdata(t *testing.T) {
+	router := *testHTTPServer(t)
+	testDB := dbtools.TestDB()
+
+	// With deleteUserdata set, instance A's userdata goes too, and so do its
+	// instance_ip_addresses rows. Instance E's userdata is deleted even
+	// though it has no metadata.
+	w := deleteBatchRequest(t, router, v1api.DeleteBatchRequest{
+		IDs:            []string{dbtools.FixtureInstanceA.InstanceID, dbtools.FixtureInstanceE.InstanceID},
+		DeleteUserdata: true,
+	})
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := v1api.DeleteBatchResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+	require.Len(t, resp.Results, 2)
+
+	for _, result := range resp.Results {
+		assert.Equal(t, v1api.DeleteBatchResultDeleted, result.Status, result.ID)
+
+		userdataExists, err := models.InstanceUserdatumExists(context.TODO(), testDB, result.ID)
+		require.NoError(t, err)
+		assert.False(t, userdataExists, result.ID)
+
+		count, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(result.ID)).Count(context.TODO(), testDB)
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), count, result.ID)
+	}
+}
+
+func TestDeleteMetadataBatchTooLarge(t *testing.T) {
+	authMW, err := ginjwt.NewAuthMiddleware(ginjwt.AuthConfig{})
+	require.NoError(t, err)
+
+	rtr := v1api.NewRouter(zap.NewNop(), nil, authMW, nil)
+	rtr.DeleteBatchMaxSize = 2
+
+	router := testRouter(rtr)
+
+	w := deleteBatchRequest(t, router, v1api.DeleteBatchRequest{
+		IDs: []string{uuid.NewString(), uuid.NewString(), uuid.NewString()},
+	})
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "the limit is 2")
+
+	w = deleteBatchRequest(t, router, v1api.DeleteBatchRequest{})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -1,9 +1,9 @@
 package metadataservice
 
 import (
-	"encoding/json"
 	"errors"
 	"net/http"
+	"slices"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -21,9 +21,11 @@ import (
 // operating-system
 // public-keys
 // spot
+// placement
 // public-ipv4
 // public-ipv6
 // local-ipv4
+// network
 
 // operating-system items:
 // slug
@@ -36,6 +38,14 @@ import (
 // spot items:
 // termination-time
 
+// placement items (only for facilities with a configured placement):
+// availability-zone
+// region
+
+// network items:
+// bonding
+//   - mode
+
 // instanceEc2MetadataGet returns the list of top-level metadata item names
 // which can be subsequently queried by the caller.
 func (r *Router) instanceEc2MetadataGet(c *gin.Context) {
@@ -43,24 +53,26 @@ func (r *Router) instanceEc2MetadataGet(c *gin.Context) {
 
 	if err != nil {
 		if errors.Is(err, errNotFound) {
-			notFoundResponse(c)
+			r.ec2NotFoundResponse(c)
 		} else {
-			dbErrorResponse(r.Logger, c, err)
+			r.metadataErrorResponse(c, err)
 		}
 
 		return
 	}
 
-	var metadata = ec2.Metadata{}
-
-	err = json.Unmarshal([]byte(instanceMetadata.Metadata), &metadata)
+	metadata, err := ec2.ParseMetadata([]byte(instanceMetadata.Metadata), r.EC2SchemaVersion)
 
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, &ErrorResponse{Errors: []string{"Invalid metadata for instance"}})
 		return
 	}
 
-	c.String(http.StatusOK, strings.Join(metadata.ItemNames(), "\n"))
+	// The record may not include its own ID, but we always know it.
+	metadata = ec2.WithInstanceIDFallback(metadata, instanceMetadata.ID)
+
+	setInstanceIDHeader(c, instanceMetadata.ID)
+	c.String(http.StatusOK, strings.Join(r.ec2TopLevelItemNames(metadata), "\n"))
 }
 
 func (r *Router) instanceEc2MetadataItemGet(c *gin.Context) {
@@ -68,38 +80,42 @@ func (r *Router) instanceEc2MetadataItemGet(c *gin.Context) {
 
 	if err != nil {
 		if errors.Is(err, errNotFound) {
-			notFoundResponse(c)
+			r.ec2NotFoundResponse(c)
 		} else {
-			dbErrorResponse(r.Logger, c, err)
+			r.metadataErrorResponse(c, err)
 		}
 
 		return
 	}
 
 	if err != nil {
-		dbErrorResponse(r.Logger, c, err)
+		r.dbErrorResponse(c, err)
 		return
 	}
 
-	var metadata = ec2.Metadata{}
-
-	err = json.Unmarshal([]byte(instanceMetadata.Metadata), &metadata)
+	metadata, err := ec2.ParseMetadata([]byte(instanceMetadata.Metadata), r.EC2SchemaVersion)
 
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, &ErrorResponse{Errors: []string{"Invalid metadata for instance"}})
 		return
 	}
 
+	// The record may not include its own ID, but we always know it.
+	metadata = ec2.WithInstanceIDFallback(metadata, instanceMetadata.ID)
+
 	if subPath, ok := c.Params.Get("subpath"); ok {
-		// If subPath is only a fwd slash, we're just hitting the EC2 endpoint
-		// with a trailing slash, so return the ItemNames as we would in
-		// instanceEc2MetadataGet()
-		if subPath == "/" {
-			c.String(http.StatusOK, strings.Join(metadata.ItemNames(), "\n"))
+		// A trailing slash is ignored, so requesting a directory-like item (or
+		// just "/", for the top level) with or without one returns the names
+		// of the items beneath it.
+		if strings.Trim(subPath, "/") == "" {
+			setInstanceIDHeader(c, instanceMetadata.ID)
+			c.String(http.StatusOK, strings.Join(r.ec2TopLevelItemNames(metadata), "\n"))
+
 			return
 		}
 
 		if result, ok := metadata.GetItem(subPath); ok {
+			setInstanceIDHeader(c, instanceMetadata.ID)
 			c.String(http.StatusOK, strings.Join(result, "\n"))
 			return
 		}
@@ -108,20 +124,93 @@ func (r *Router) instanceEc2MetadataItemGet(c *gin.Context) {
 	// If we're here, that means that either there wasn't a subpath item, or we
 	// couldn't find the item in the metadata for the instance. In that case,
 	// just return a 404.
-	notFoundResponse(c)
+	r.ec2NotFoundResponse(c)
+}
+
+// instanceEc2DynamicGet returns the EC2-style instance identity document for
+// the instance, built from its metadata. Some cloud-init datasources and AWS
+// SDKs fetch it while bootstrapping.
+func (r *Router) instanceEc2DynamicGet(c *gin.Context) {
+	instanceMetadata, err := r.getMetadata(c)
+
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			r.ec2NotFoundResponse(c)
+		} else {
+			r.metadataErrorResponse(c, err)
+		}
+
+		return
+	}
+
+	metadata, err := ec2.ParseMetadata([]byte(instanceMetadata.Metadata), r.EC2SchemaVersion)
+
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, &ErrorResponse{Errors: []string{"Invalid metadata for instance"}})
+		return
+	}
+
+	// The record may not include its own ID, but we always know it.
+	metadata = ec2.WithInstanceIDFallback(metadata, instanceMetadata.ID)
+
+	setInstanceIDHeader(c, instanceMetadata.ID)
+	c.JSON(http.StatusOK, ec2.NewIdentityDocument(metadata))
 }
 
 func (r *Router) instanceEc2UserdataGet(c *gin.Context) {
+	if r.maintenanceUserdataResponse(c) {
+		return
+	}
+
 	userdata, err := r.getUserdata(c)
 	if err != nil {
 		if errors.Is(err, errNotFound) {
-			notFoundResponse(c)
+			r.ec2DefaultUserdataResponse(c)
+		} else {
+			r.dbErrorResponse(c, err)
+		}
+
+		return
+	}
+
+	setInstanceIDHeader(c, userdata.ID)
+	r.userdataResponse(c, userdata.ID, userdata.Userdata.Bytes)
+}
+
+// ec2DefaultUserdataResponse serves the default userdata, if one is
+// configured, to an instance without stored userdata. Only instances with
+// metadata get the default userdata, so unknown instances still get a 404.
+func (r *Router) ec2DefaultUserdataResponse(c *gin.Context) {
+	if r.DefaultUserdata == nil {
+		r.ec2NotFoundResponse(c)
+		return
+	}
+
+	metadata, err := r.getMetadata(c)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			r.ec2NotFoundResponse(c)
 		} else {
-			dbErrorResponse(r.Logger, c, err)
+			r.metadataErrorResponse(c, err)
 		}
 
 		return
 	}
 
-	c.String(http.StatusOK, string(userdata.Userdata.Bytes))
+	setInstanceIDHeader(c, metadata.ID)
+	plainUserdataResponse(c, r.DefaultUserdata)
+}
+
+// ec2TopLevelItemNames returns the names of the instance's top-level items,
+// followed by any always-advertised items the instance doesn't have.
+func (r *Router) ec2TopLevelItemNames(metadata ec2.MetadataContainer) []string {
+	names := metadata.ItemNames()
+
+	for _, item := range r.EC2AlwaysAdvertisedItems {
+		if !slices.Contains(names, item) {
+			names = append(names, item)
+		}
+	}
+
+	return names
 }
@@ -1,17 +1,26 @@
 package metadataservice_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.hollow.sh/toolbox/ginjwt"
+	"go.uber.org/zap"
 
 	"go.hollow.sh/metadataservice/internal/dbtools"
 	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+	"go.hollow.sh/metadataservice/pkg/api/v1/ec2"
 )
 
 // GetEc2MetadataItemPathWithoutTrim is used to test routing edge cases where
@@ -62,7 +71,7 @@ func TestGetEc2MetadataByIP(t *testing.T) {
 			fmt.Sprintf("Instance A IP %s", hostIP),
 			hostIP,
 			http.StatusOK,
-			fmt.Sprintf("%s\npublic-ipv4\npublic-ipv6\nlocal-ipv4", standardFields),
+			fmt.Sprintf("%s\npublic-ipv4\npublic-ipv6\nlocal-ipv4\nnetwork", standardFields),
 		}
 
 		testCases = append(testCases, caseItem)
@@ -75,7 +84,7 @@ func TestGetEc2MetadataByIP(t *testing.T) {
 			fmt.Sprintf("Instance A1 IP %s", hostIP),
 			hostIP,
 			http.StatusOK,
-			fmt.Sprintf("%s\npublic-ipv6\nlocal-ipv4", standardFields),
+			fmt.Sprintf("%s\npublic-ipv6\nlocal-ipv4\nnetwork", standardFields),
 		}
 
 		testCases = append(testCases, caseItem)
@@ -89,7 +98,7 @@ func TestGetEc2MetadataByIP(t *testing.T) {
 			fmt.Sprintf("Instance A2 IP %s", hostIP),
 			hostIP,
 			http.StatusOK,
-			fmt.Sprintf("%s\nspot\nlocal-ipv4", standardFields),
+			fmt.Sprintf("%s\nspot\nlocal-ipv4\nnetwork", standardFields),
 		}
 
 		testCases = append(testCases, caseItem)
@@ -102,7 +111,7 @@ func TestGetEc2MetadataByIP(t *testing.T) {
 			fmt.Sprintf("Instance B IP %s", hostIP),
 			hostIP,
 			http.StatusOK,
-			fmt.Sprintf("%s\npublic-ipv4\npublic-ipv6\nlocal-ipv4", standardFields),
+			fmt.Sprintf("%s\npublic-ipv4\npublic-ipv6\nlocal-ipv4\nnetwork", standardFields),
 		}
 
 		testCases = append(testCases, caseItem)
@@ -286,6 +295,41 @@ func TestGetEc2MetadataItemByIP(t *testing.T) {
 				http.StatusOK,
 				"ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAACAQCV2BCNvg7WQtMzcKHCNY6/qoFC8R6GJlKq3rQRcfJMkpmSGudHx8ojuyUaj04LjDFL5pkt2lnGT5aWo2N58Y1O/7diOUNUJrTy+ZWuliEfqE7hJwuszUjhYwhiuGk6UEw5/g+lfzTv1POEqMIg2cORI7OfmSs4tf7cXqY442rdDSv9H8LtqiBER47Et23sNrcDWbK57cc2/+nwqDWtmf7Nin4t8Kc5p2I4PFVsiXzRue7wKswJJp37ZOxlnbxAJ2BQ3PJwCf9Qe7Y/zAlqUnmDaERVZyDQSVIRE8XqRTh9UtcsGqi81WGLYnW63Nd3LkfJ2WdtfMkGjOGG4aRENvQtmWzyp1QM4A/n/25PbYB2VAogf8dIVjpUFek/tXcRPEUDT1skYFt8czimbmEMnRgjihIvS6oHybl2GnJ0zvpSA9MrZy+/9AkaW1M8QYuJdHQ9JcDpFKFkXMEVPW8uUGIc4rciBoeewbsunCV8StI1XnHpaqe1VhPhCA0JK74Tnv7MUTCN8YCY65Vp6Rq4nGlNA34bJ4A0b99atmo6vYr1rvHs6R6NC+mxLyvzBQYMzhXFBbzeyFNGDdw8eRQy5WGAfyvjTQMtOK6bDpKjc57np8qJrRhIM7+Y8ovF1GWEentBzQyWAcPilvq0fSzBNDQxr7GSSRRc5USqAk0NgZPXlQ== test@user.local\nssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDPgTv1yUmNCGUcnCuFr94SQ0YqpuMwKSC022Fp2Q3TF test@user.local",
 			},
+			{
+				fmt.Sprintf("Instance A IP %s-public-keys/", hostIP),
+				"public-keys/",
+				hostIP,
+				http.StatusOK,
+				"0=test@user.local\n1=test@user.local",
+			},
+			{
+				fmt.Sprintf("Instance A IP %s-public-keys/0", hostIP),
+				"public-keys/0",
+				hostIP,
+				http.StatusOK,
+				"openssh-key",
+			},
+			{
+				fmt.Sprintf("Instance A IP %s-public-keys/0/openssh-key", hostIP),
+				"public-keys/0/openssh-key",
+				hostIP,
+				http.StatusOK,
+				"ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAACAQCV2BCNvg7WQtMzcKHCNY6/qoFC8R6GJlKq3rQRcfJMkpmSGudHx8ojuyUaj04LjDFL5pkt2lnGT5aWo2N58Y1O/7diOUNUJrTy+ZWuliEfqE7hJwuszUjhYwhiuGk6UEw5/g+lfzTv1POEqMIg2cORI7OfmSs4tf7cXqY442rdDSv9H8LtqiBER47Et23sNrcDWbK57cc2/+nwqDWtmf7Nin4t8Kc5p2I4PFVsiXzRue7wKswJJp37ZOxlnbxAJ2BQ3PJwCf9Qe7Y/zAlqUnmDaERVZyDQSVIRE8XqRTh9UtcsGqi81WGLYnW63Nd3LkfJ2WdtfMkGjOGG4aRENvQtmWzyp1QM4A/n/25PbYB2VAogf8dIVjpUFek/tXcRPEUDT1skYFt8czimbmEMnRgjihIvS6oHybl2GnJ0zvpSA9MrZy+/9AkaW1M8QYuJdHQ9JcDpFKFkXMEVPW8uUGIc4rciBoeewbsunCV8StI1XnHpaqe1VhPhCA0JK74Tnv7MUTCN8YCY65Vp6Rq4nGlNA34bJ4A0b99atmo6vYr1rvHs6R6NC+mxLyvzBQYMzhXFBbzeyFNGDdw8eRQy5WGAfyvjTQMtOK6bDpKjc57np8qJrRhIM7+Y8ovF1GWEentBzQyWAcPilvq0fSzBNDQxr7GSSRRc5USqAk0NgZPXlQ== test@user.local",
+			},
+			{
+				fmt.Sprintf("Instance A IP %s-public-keys/1/openssh-key", hostIP),
+				"public-keys/1/openssh-key",
+				hostIP,
+				http.StatusOK,
+				"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDPgTv1yUmNCGUcnCuFr94SQ0YqpuMwKSC022Fp2Q3TF test@user.local",
+			},
+			{
+				fmt.Sprintf("Instance A IP %s-public-keys/2/openssh-key", hostIP),
+				"public-keys/2/openssh-key",
+				hostIP,
+				http.StatusNotFound,
+				"",
+			},
 			{
 				fmt.Sprintf("Instance A IP %s-spot", hostIP),
 				"spot",
@@ -321,6 +365,76 @@ func TestGetEc2MetadataItemByIP(t *testing.T) {
 				http.StatusOK,
 				"10.70.17.9",
 			},
+			{
+				fmt.Sprintf("Instance A IP %s-network", hostIP),
+				"network",
+				hostIP,
+				http.StatusOK,
+				"bonding\ninterfaces",
+			},
+			{
+				fmt.Sprintf("Instance A IP %s-network/bonding", hostIP),
+				"network/bonding",
+				hostIP,
+				http.StatusOK,
+				"mode",
+			},
+			{
+				fmt.Sprintf("Instance A IP %s-network/bonding/mode", hostIP),
+				"network/bonding/mode",
+				hostIP,
+				http.StatusOK,
+				"4",
+			},
+			{
+				fmt.Sprintf("Instance A IP %s-network/bonding/unknown", hostIP),
+				"network/bonding/unknown",
+				hostIP,
+				http.StatusNotFound,
+				"",
+			},
+			{
+				fmt.Sprintf("Instance A IP %s-network/interfaces", hostIP),
+				"network/interfaces",
+				hostIP,
+				http.StatusOK,
+				"0\n1",
+			},
+			{
+				fmt.Sprintf("Instance A IP %s-network/interfaces/0", hostIP),
+				"network/interfaces/0",
+				hostIP,
+				http.StatusOK,
+				"name",
+			},
+			{
+				fmt.Sprintf("Instance A IP %s-network/interfaces/0/name", hostIP),
+				"network/interfaces/0/name",
+				hostIP,
+				http.StatusOK,
+				"eth0",
+			},
+			{
+				fmt.Sprintf("Instance A IP %s-network/interfaces/1/name", hostIP),
+				"network/interfaces/1/name",
+				hostIP,
+				http.StatusOK,
+				"eth1",
+			},
+			{
+				fmt.Sprintf("Instance A IP %s-network/interfaces/2/name", hostIP),
+				"network/interfaces/2/name",
+				hostIP,
+				http.StatusNotFound,
+				"",
+			},
+			{
+				fmt.Sprintf("Instance A IP %s-network/interfaces/0/unknown", hostIP),
+				"network/interfaces/0/unknown",
+				hostIP,
+				http.StatusNotFound,
+				"",
+			},
 		}
 		testCases = append(testCases, aCases...)
 	}
@@ -408,7 +522,7 @@ func TestGetEc2MetadataItemByIP(t *testing.T) {
 		t.Run(testcase.testName, func(t *testing.T) {
 			w := httptest.NewRecorder()
 
-			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetEc2MetadataItemPath(testcase.itemName), nil)
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, getEc2MetadataItemPathWithoutTrim(testcase.itemName), nil)
 			req.RemoteAddr = net.JoinHostPort(testcase.instanceIP, "0")
 			router.ServeHTTP(w, req)
 
@@ -428,7 +542,7 @@ func TestGetEc2MetadataItemByIP(t *testing.T) {
 		itemName := "/"
 		instanceIP := "139.178.82.3"
 		expectedStatus := http.StatusOK
-		expectedBody := fmt.Sprintf("%s\npublic-ipv4\npublic-ipv6\nlocal-ipv4", standardFields)
+		expectedBody := fmt.Sprintf("%s\npublic-ipv4\npublic-ipv6\nlocal-ipv4\nnetwork", standardFields)
 
 		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, getEc2MetadataItemPathWithoutTrim(itemName), nil)
 		req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
@@ -441,3 +555,326 @@ func TestGetEc2MetadataItemByIP(t *testing.T) {
 		}
 	})
 }
+
+// TestGetEc2MetadataItemTrailingSlash tests that requesting a directory-like
+// item with a trailing slash, at any depth, returns the same item names as
+// requesting it without one.
+func TestGetEc2MetadataItemTrailingSlash(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	type testCase struct {
+		testName     string
+		itemName     string
+		instanceIP   string
+		expectedBody string
+	}
+
+	instanceAIP := dbtools.FixtureInstanceA.HostIPs[0]
+	instanceA2IP := dbtools.FixtureInstanceA2.HostIPs[0]
+
+	testCases := []testCase{
+		{
+			"operating-system",
+			"operating-system/",
+			instanceAIP,
+			"slug\ndistro\nversion\nlicense-activation\nimage-tag",
+		},
+		{
+			"operating-system/license-activation",
+			"operating-system/license-activation/",
+			instanceAIP,
+			"state",
+		},
+		{
+			"network",
+			"network/",
+			instanceAIP,
+			"bonding\ninterfaces",
+		},
+		{
+			"network/interfaces",
+			"network/interfaces/",
+			instanceAIP,
+			"0\n1",
+		},
+		{
+			"network/bonding",
+			"network/bonding/",
+			instanceAIP,
+			"mode",
+		},
+		{
+			"spot",
+			"spot/",
+			instanceA2IP,
+			"termination-time",
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			for _, itemName := range []string{testcase.itemName, strings.TrimSuffix(testcase.itemName, "/")} {
+				w := httptest.NewRecorder()
+
+				req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, getEc2MetadataItemPathWithoutTrim(itemName), nil)
+				req.RemoteAddr = net.JoinHostPort(testcase.instanceIP, "0")
+				router.ServeHTTP(w, req)
+
+				assert.Equal(t, http.StatusOK, w.Code, itemName)
+				assert.Equal(t, testcase.expectedBody, w.Body.String(), itemName)
+			}
+		})
+	}
+}
+
+// TestGetEc2MetadataPlacement tests that the placement items are derived from
+// the instance's facility, and are only available for facilities with a
+// configured placement.
+func TestGetEc2MetadataPlacement(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	ec2.SetFacilityPlacements(map[string]ec2.Placement{"da11": {Region: "us-central", AvailabilityZone: "us-central-da11"}})
+	defer ec2.SetFacilityPlacements(nil)
+
+	type testCase struct {
+		testName       string
+		itemName       string
+		expectedStatus int
+		expectedBody   string
+	}
+
+	testCases := []testCase{
+		{
+			"placement",
+			"placement",
+			http.StatusOK,
+			"availability-zone\nregion",
+		},
+		{
+			"placement/availability-zone",
+			"placement/availability-zone",
+			http.StatusOK,
+			"us-central-da11",
+		},
+		{
+			"placement/region",
+			"placement/region",
+			http.StatusOK,
+			"us-central",
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetEc2MetadataItemPath(testcase.itemName), nil)
+			req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+			assert.Equal(t, testcase.expectedBody, w.Body.String())
+		})
+	}
+
+	// Without a placement for the fixtures' facility, placement isn't found.
+	ec2.SetFacilityPlacements(map[string]ec2.Placement{"ny5": {Region: "us-east", AvailabilityZone: "us-east-ny5"}})
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetEc2MetadataItemPath("placement/region"), nil)
+	req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// TestGetEc2MetadataInstanceIDFallback tests that the EC2 instance-id item
+// falls back to the ID the metadata is stored under when the metadata record
+// doesn't include its own "id" field.
+func TestGetEc2MetadataInstanceIDFallback(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	instanceID := "3b5d7f9a-1c2e-4f6a-8b0d-3e5f7a9b1c2d"
+	instanceIP := "192.168.100.1"
+
+	reqBody, err := json.Marshal(&v1api.UpsertMetadataRequest{
+		ID:          instanceID,
+		Metadata:    json.RawMessage(`{"hostname": "instance-without-id"}`),
+		IPAddresses: []string{instanceIP},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetEc2MetadataItemPath("instance-id"), nil)
+	req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, instanceID, w.Body.String())
+}
+
+// TestGetEc2MetadataAlwaysAdvertisedItems tests that always-advertised items
+// are listed even when the instance has no value for them, while requests for
+// them still return a 404.
+func TestGetEc2MetadataAlwaysAdvertisedItems(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{EC2AlwaysAdvertisedItems: []string{"public-keys", "spot", "public-ipv4"}})
+
+	instanceIP := dbtools.FixtureInstanceA.HostIPs[0]
+
+	// Instance A has no spot market info, so "spot" is added at the end of the
+	// listing. The items it already has aren't listed twice.
+	expectedListing := "instance-id\nhostname\niqn\nplan\nfacility\ntags\noperating-system\npublic-keys\npublic-ipv4\npublic-ipv6\nlocal-ipv4\nnetwork\nspot"
+
+	for _, path := range []string{v1api.GetEc2MetadataPath(), getEc2MetadataItemPathWithoutTrim("/")} {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+		req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Equal(t, expectedListing, w.Body.String(), path)
+	}
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetEc2MetadataItemPath("spot"), nil)
+	req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// TestGetEc2DynamicIdentityDocument tests that the instance identity document
+// is built from the instance's metadata, and that unknown instances get a 404.
+func TestGetEc2DynamicIdentityDocument(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	ec2.SetFacilityPlacements(map[string]ec2.Placement{"da11": {Region: "us-central", AvailabilityZone: "us-central-da11"}})
+	defer ec2.SetFacilityPlacements(nil)
+
+	type testCase struct {
+		testName       string
+		instanceIP     string
+		expectedStatus int
+		expectedDoc    *ec2.IdentityDocument
+	}
+
+	testCases := []testCase{
+		{
+			"unknown IPv4 address",
+			"1.2.3.4",
+			http.StatusNotFound,
+			nil,
+		},
+		{
+			"instance A",
+			dbtools.FixtureInstanceA.HostIPs[0],
+			http.StatusOK,
+			&ec2.IdentityDocument{
+				InstanceID:       dbtools.FixtureInstanceA.InstanceID,
+				InstanceType:     "c3.medium.x86",
+				ImageID:          "ubuntu_20_04",
+				Region:           "us-central",
+				AvailabilityZone: "us-central-da11",
+				PrivateIP:        "10.70.17.9",
+				Version:          ec2.IdentityDocumentVersion,
+			},
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetEc2DynamicPath(), nil)
+			req.RemoteAddr = net.JoinHostPort(testcase.instanceIP, "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+
+			if testcase.expectedDoc != nil {
+				doc := ec2.IdentityDocument{}
+
+				if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+					t.Fatal(err)
+				}
+
+				assert.Equal(t, *testcase.expectedDoc, doc)
+			}
+		})
+	}
+}
+
+// TestEc2NotFoundContentNegotiation tests that the EC2-style endpoints return
+// IMDS-style plain-text 404s to clients asking for text/plain, and the JSON
+// ErrorResponse otherwise.
+func TestEc2NotFoundContentNegotiation(t *testing.T) {
+	authMW, err := ginjwt.NewAuthMiddleware(ginjwt.AuthConfig{})
+	require.NoError(t, err)
+
+	// Without any way to identify the instance, every request is for an
+	// unknown instance.
+	rtr := v1api.NewRouter(zap.NewNop(), nil, authMW, nil)
+	rtr.DisableIPIdentification = true
+
+	router := testRouter(rtr)
+
+	type testCase struct {
+		testName    string
+		accept      string
+		expectPlain bool
+	}
+
+	testCases := []testCase{
+		{"text/plain", "text/plain", true},
+		{"text/plain preferred", "text/plain, application/json;q=0.5", true},
+		{"application/json", "application/json", false},
+		{"any", "*/*", false},
+		{"no accept header", "", false},
+	}
+
+	paths := []string{v1api.GetEc2MetadataPath(), v1api.GetEc2MetadataItemPath("hostname"), v1api.GetEc2UserdataPath(), v1api.GetEc2DynamicPath()}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			for _, path := range paths {
+				w := httptest.NewRecorder()
+
+				req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+				req.RemoteAddr = net.JoinHostPort("10.0.0.1", "0")
+
+				if testcase.accept != "" {
+					req.Header.Set("Accept", testcase.accept)
+				}
+
+				router.ServeHTTP(w, req)
+
+				assert.Equal(t, http.StatusNotFound, w.Code, path)
+
+				if testcase.expectPlain {
+					assert.Equal(t, "Not Found", w.Body.String(), path)
+					assert.Contains(t, w.Header().Get("Content-Type"), "text/plain", path)
+
+					continue
+				}
+
+				resp := v1api.ErrorResponse{}
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp), path)
+				assert.Equal(t, v1api.DefaultInstanceNotFoundMessage, resp.Message, path)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package metadataservice
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/volatiletech/sqlboiler/v4/queries/qm"
+
+	"go.hollow.sh/metadataservice/internal/fieldcrypt"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/pkg/api/v1/ec2"
+)
+
+// missingItemScanBatchSize is the number of instance_metadata rows loaded at
+// a time while looking for instances missing an EC2 item.
+const missingItemScanBatchSize = 500
+
+// instancesMissingEc2ItemGet returns the IDs of the instances whose stored
+// metadata doesn't have a value for the EC2 item in the path, like
+// "public-keys" or "operating-system/slug", as served by the EC2-style
+// endpoints. Items which are present but empty count as missing, and so does
+// everything for metadata which can't be parsed.
+// The EC2 items are derived from the metadata in code, so the rows are
+// scanned in batches rather than filtered by the DB. Results are ordered by
+// instance ID and paginated with the "limit" and "offset" query parameters.
+func (r *Router) instancesMissingEc2ItemGet(c *gin.Context) {
+	// The item path may contain slashes, so it's captured with a wildcard
+	// param, which includes the leading slash.
+	item := strings.Trim(c.Param("item"), "/")
+
+	if item == "" {
+		badRequestResponse(c, "invalid EC2 item", errMissingEC2Item)
+		return
+	}
+
+	limit, offset, err := getPaginationParams(c)
+	if err != nil {
+		badRequestResponse(c, "invalid pagination parameters", err)
+		return
+	}
+
+	resp := InstanceIDListResponse{
+		InstanceIDs: []string{},
+		Limit:       limit,
+		Offset:      offset,
+	}
+
+	skipped := 0
+	lastID := ""
+
+	for len(resp.InstanceIDs) < limit {
+		mods := []qm.QueryMod{
+			qm.Select(models.InstanceMetadatumColumns.ID, models.InstanceMetadatumColumns.Metadata),
+			qm.OrderBy(models.InstanceMetadatumColumns.ID),
+			qm.Limit(missingItemScanBatchSize),
+		}
+
+		if lastID != "" {
+			mods = append(mods, models.InstanceMetadatumWhere.ID.GT(lastID))
+		}
+
+		rows, err := models.InstanceMetadata(mods...).All(c.Request.Context(), r.DB)
+		if err != nil {
+			r.dbErrorResponse(c, err)
+			return
+		}
+
+		for _, row := range rows {
+			if len(resp.InstanceIDs) == limit {
+				break
+			}
+
+			lastID = row.ID
+
+			if !r.ec2ItemMissing(row, item) {
+				continue
+			}
+
+			if skipped < offset {
+				skipped++
+				continue
+			}
+
+			resp.InstanceIDs = append(resp.InstanceIDs, row.ID)
+		}
+
+		if len(rows) < missingItemScanBatchSize {
+			break
+		}
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// ec2ItemMissing reports whether the EC2 item has no non-empty value in the
+// instance's metadata.
+func (r *Router) ec2ItemMissing(instanceMetadata *models.InstanceMetadatum, item string) bool {
+	decrypted, err := fieldcrypt.DecryptMetadata(instanceMetadata.Metadata)
+	if err != nil {
+		return true
+	}
+
+	metadata, err := ec2.ParseMetadata(decrypted, r.EC2SchemaVersion)
+	if err != nil {
+		return true
+	}
+
+	values, ok := ec2.WithInstanceIDFallback(metadata, instanceMetadata.ID).GetItem(item)
+	if !ok {
+		return true
+	}
+
+	for _, value := range values {
+		if value != "" {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,127 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"github.com/volatiletech/sqlboiler/v4/types"
+	"go.hollow.sh/toolbox/ginjwt"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/models"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestGetInstancesMissingEC2Item(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	// An instance without any SSH keys, and one with only an empty key.
+	noKeysID := "00b6f1b8-5d8b-4c4d-9d0f-4f8f0e9a4c01"
+	emptyKeyID := "00b6f1b8-5d8b-4c4d-9d0f-4f8f0e9a4c02"
+
+	for id, metadata := range map[string]string{
+		noKeysID:   `{"hostname": "no-keys", "ssh_keys": []}`,
+		emptyKeyID: `{"hostname": "empty-key", "ssh_keys": [""]}`,
+	} {
+		record := models.InstanceMetadatum{ID: id, Metadata: types.JSON(metadata)}
+		require.NoError(t, record.Insert(context.TODO(), dbtools.TestDB(), boil.Infer()))
+	}
+
+	type testCase struct {
+		testName    string
+		item        string
+		query       string
+		expectedIDs []string
+	}
+
+	// Only instance A2 is a spot instance with a termination time.
+	testCases := []testCase{
+		{
+			"top-level item",
+			"public-keys",
+			"",
+			[]string{noKeysID, emptyKeyID},
+		},
+		{
+			"nested item",
+			"spot/termination-time",
+			"",
+			[]string{
+				noKeysID,
+				emptyKeyID,
+				dbtools.FixtureInstanceA.InstanceID,
+				dbtools.FixtureInstanceB.InstanceID,
+				dbtools.FixtureInstanceC.InstanceID,
+				dbtools.FixtureInstanceD.InstanceID,
+				dbtools.FixtureInstanceA1.InstanceID,
+			},
+		},
+		{
+			"paginated",
+			"spot/termination-time",
+			"?limit=2&offset=3",
+			[]string{dbtools.FixtureInstanceB.InstanceID, dbtools.FixtureInstanceC.InstanceID},
+		},
+		{
+			"offset past the results",
+			"spot/termination-time",
+			"?offset=10",
+			[]string{},
+		},
+		{
+			"item every instance has",
+			"instance-id",
+			"",
+			[]string{},
+		},
+		{
+			"unknown item",
+			"not-an-item",
+			"?limit=1",
+			[]string{noKeysID},
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalInstancesMissingEC2ItemPath(testcase.item)+testcase.query, nil)
+			router.ServeHTTP(w, req)
+
+			require.Equal(t, http.StatusOK, w.Code)
+
+			resp := v1api.InstanceIDListResponse{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+			assert.Equal(t, testcase.expectedIDs, resp.InstanceIDs)
+		})
+	}
+}
+
+func TestGetInstancesMissingEC2ItemBadRequest(t *testing.T) {
+	authMW, err := ginjwt.NewAuthMiddleware(ginjwt.AuthConfig{})
+	require.NoError(t, err)
+
+	router := testRouter(v1api.NewRouter(zap.NewNop(), nil, authMW, nil))
+
+	for _, path := range []string{
+		v1api.GetInternalInstancesMissingEC2ItemPath("") + "/",
+		v1api.GetInternalInstancesMissingEC2ItemPath("public-keys") + "?limit=0",
+		v1api.GetInternalInstancesMissingEC2ItemPath("public-keys") + "?offset=-1",
+	} {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+	}
+}
@@ -0,0 +1,47 @@
+package metadataservice
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/pkg/api/v1/ec2"
+)
+
+// instanceEc2MetadataGetInternal returns the stored metadata for an instance
+// as parsed for the EC2-style endpoints, like ec2.Metadata for v1 records,
+// so operators can see how their metadata document was mapped and exactly
+// what those endpoints will serve. Metadata which can't be parsed gets a 422
+// with the parse error.
+func (r *Router) instanceEc2MetadataGetInternal(c *gin.Context) {
+	instanceID, err := getUUIDParam(c, "instance-id")
+	if err != nil {
+		invalidUUIDResponse(c, err)
+		return
+	}
+
+	instanceMetadata, err := findInstanceMetadata(c.Request.Context(), r.DB, instanceID)
+	if err != nil {
+		r.dbErrorResponse(c, err)
+		return
+	}
+
+	metadata, err := ec2.ParseMetadata([]byte(instanceMetadata.Metadata), r.EC2SchemaVersion)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, &ErrorResponse{
+			Message: "metadata can't be parsed as EC2 metadata",
+			Errors:  []string{err.Error()},
+		})
+
+		return
+	}
+
+	// The EC2 endpoints serve the ID the record is stored under when the
+	// record doesn't include its own, so show that here too.
+	if v1Metadata, ok := metadata.(*ec2.Metadata); ok && v1Metadata.ID == "" {
+		v1Metadata.ID = instanceMetadata.ID
+	}
+
+	setTimestampHeaders(c, instanceMetadata.CreatedAt, instanceMetadata.UpdatedAt)
+	c.JSON(http.StatusOK, metadata)
+}
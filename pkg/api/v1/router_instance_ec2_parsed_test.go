@@ -0,0 +1,109 @@
+package metadataservice_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+	"go.hollow.sh/metadataservice/pkg/api/v1/ec2"
+)
+
+func TestGetEc2MetadataInternal(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalMetadataEc2Path(dbtools.FixtureInstanceA.InstanceID), nil)
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	expected, err := ec2.ParseMetadata(dbtools.FixtureInstanceA.InstanceMetadata.Metadata, "")
+	require.NoError(t, err)
+
+	resp := &ec2.Metadata{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), resp))
+
+	assert.Equal(t, expected, resp)
+}
+
+func TestGetEc2MetadataInternalParsing(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	type testCase struct {
+		testName       string
+		instanceID     string
+		metadata       string
+		expectedStatus int
+		expectedBody   string
+	}
+
+	testCases := []testCase{
+		{
+			"record without an ID",
+			"0f2b4d6a-8c1e-4a3b-9d5f-7e9a1b3c5d7e",
+			`{"hostname": "instance-without-id", "spot": "not an object"}`,
+			http.StatusOK,
+			`"id":"0f2b4d6a-8c1e-4a3b-9d5f-7e9a1b3c5d7e"`,
+		},
+		{
+			"unknown schema version",
+			"1a3c5e7b-9d2f-4b4c-8e6a-8f0b2c4d6e8f",
+			`{"hostname": "instance-from-the-future", "schema_version": "v99"}`,
+			http.StatusUnprocessableEntity,
+			ec2.ErrUnknownSchemaVersion.Error(),
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			reqBody, err := json.Marshal(&v1api.UpsertMetadataRequest{
+				ID:       testcase.instanceID,
+				Metadata: json.RawMessage(testcase.metadata),
+			})
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
+			router.ServeHTTP(w, req)
+			require.Equal(t, http.StatusCreated, w.Code)
+
+			w = httptest.NewRecorder()
+
+			req, _ = http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalMetadataEc2Path(testcase.instanceID), nil)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+			assert.Contains(t, w.Body.String(), testcase.expectedBody)
+		})
+	}
+}
+
+func TestGetEc2MetadataInternalNotFound(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	// Instance E has IP addresses and userdata, but no metadata.
+	for _, instanceID := range []string{dbtools.FixtureInstanceE.InstanceID, "not-a-uuid"} {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalMetadataEc2Path(instanceID), nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code, instanceID)
+	}
+}
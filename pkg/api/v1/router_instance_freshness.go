@@ -0,0 +1,50 @@
+package metadataservice
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+// FreshnessResponse reports how old the metadata stored for an instance is,
+// and whether it's older than the configured cache TTL.
+type FreshnessResponse struct {
+	UpdatedAt  time.Time `json:"updatedAt"`
+	AgeSeconds int64     `json:"ageSeconds"`
+	Stale      bool      `json:"stale"`
+}
+
+// instanceMetadataFreshnessGet reports whether the metadata stored for an
+// instance is older than its cache TTL, either its own or the "cache_ttl". It
+// never calls the upstream lookup service, so operators can use it to decide
+// which instances to refresh.
+func (r *Router) instanceMetadataFreshnessGet(c *gin.Context) {
+	instanceID, err := getUUIDParam(c, "instance-id")
+	if err != nil {
+		invalidUUIDResponse(c, err)
+		return
+	}
+
+	metadata, err := models.FindInstanceMetadatum(c.Request.Context(), r.DB, instanceID, models.InstanceMetadatumColumns.Metadata, models.InstanceMetadatumColumns.UpdatedAt)
+	if err != nil {
+		r.dbErrorResponse(c, err)
+		return
+	}
+
+	age := r.now().Sub(metadata.UpdatedAt)
+
+	c.JSON(http.StatusOK, FreshnessResponse{
+		UpdatedAt:  metadata.UpdatedAt,
+		AgeSeconds: int64(age.Seconds()),
+		Stale:      isStale(age, cacheTTL(metadata.Metadata)),
+	})
+}
+
+// isStale reports whether data of the given age is older than the cache TTL.
+// A TTL of zero never expires data, and a negative TTL always does.
+func isStale(age, ttl time.Duration) bool {
+	return ttl != 0 && age > ttl
+}
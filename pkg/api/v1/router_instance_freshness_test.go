@@ -0,0 +1,77 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestGetMetadataFreshness(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	defer viper.Set("cache_ttl", 0)
+
+	// Instance B's metadata was last updated two hours ago.
+	updatedAt := time.Now().Add(-2 * time.Hour).UTC().Truncate(time.Second)
+
+	_, err := dbtools.TestDB().ExecContext(context.TODO(), "UPDATE instance_metadata SET updated_at = $1 WHERE id = $2", updatedAt, dbtools.FixtureInstanceB.InstanceID)
+	require.NoError(t, err)
+
+	type testCase struct {
+		testName       string
+		ttl            time.Duration
+		expectedStatus int
+		expectedStale  bool
+	}
+
+	testCases := []testCase{
+		{"no TTL", 0, http.StatusOK, false},
+		{"TTL longer than the age", 3 * time.Hour, http.StatusOK, false},
+		{"TTL shorter than the age", time.Hour, http.StatusOK, true},
+		{"negative TTL", -time.Second, http.StatusOK, true},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			viper.Set("cache_ttl", testcase.ttl)
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalMetadataFreshnessPath(dbtools.FixtureInstanceB.InstanceID), nil)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+
+			resp := v1api.FreshnessResponse{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+			assert.True(t, updatedAt.Equal(resp.UpdatedAt))
+			assert.InDelta(t, 2*time.Hour.Seconds(), resp.AgeSeconds, 60)
+			assert.Equal(t, testcase.expectedStale, resp.Stale)
+		})
+	}
+}
+
+func TestGetMetadataFreshnessNotFound(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	// Instance E has userdata, but no metadata.
+	for _, instanceID := range []string{dbtools.FixtureInstanceE.InstanceID, "not-a-uuid"} {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalMetadataFreshnessPath(instanceID), nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code, instanceID)
+	}
+}
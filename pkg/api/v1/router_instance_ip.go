@@ -0,0 +1,110 @@
+package metadataservice
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/volatiletech/sqlboiler/v4/queries/qm"
+
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+const (
+	defaultInstanceListLimit = 100
+	maxInstanceListLimit     = 1000
+)
+
+// InstanceIDListResponse contains a page of instance IDs, along with the
+// limit and offset used to produce it.
+type InstanceIDListResponse struct {
+	InstanceIDs []string `json:"instanceIDs"`
+	Limit       int      `json:"limit"`
+	Offset      int      `json:"offset"`
+}
+
+// instancesWithinCIDRGet returns the IDs of all instances with at least one
+// instance_ip_addresses row contained by (or equal to) the CIDR in the path.
+// Results are ordered by instance ID and paginated with the "limit" and
+// "offset" query parameters.
+func (r *Router) instancesWithinCIDRGet(c *gin.Context) {
+	// The CIDR contains a slash, so it's captured with a wildcard param, which
+	// includes the leading slash.
+	cidr := strings.TrimPrefix(c.Param("cidr"), "/")
+
+	if _, _, err := net.ParseCIDR(cidr); err != nil {
+		badRequestResponse(c, "invalid CIDR", err)
+		return
+	}
+
+	limit, offset, err := getPaginationParams(c)
+	if err != nil {
+		badRequestResponse(c, "invalid pagination parameters", err)
+		return
+	}
+
+	instanceIPs, err := models.InstanceIPAddresses(
+		qm.Distinct(models.InstanceIPAddressColumns.InstanceID),
+		qm.Where("address <<= ?::inet", cidr),
+		qm.OrderBy(models.InstanceIPAddressColumns.InstanceID),
+		qm.Limit(limit),
+		qm.Offset(offset),
+	).All(c.Request.Context(), r.DB)
+	if err != nil {
+		r.dbErrorResponse(c, err)
+		return
+	}
+
+	resp := InstanceIDListResponse{
+		InstanceIDs: make([]string, 0, len(instanceIPs)),
+		Limit:       limit,
+		Offset:      offset,
+	}
+
+	for _, instanceIP := range instanceIPs {
+		resp.InstanceIDs = append(resp.InstanceIDs, instanceIP.InstanceID)
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// getPaginationParams reads the "limit" and "offset" query parameters,
+// applying the default limit when unset and capping it at the maximum.
+func getPaginationParams(c *gin.Context) (int, int, error) {
+	limit, err := getLimitParam(c)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	offset := 0
+
+	if o := c.Query("offset"); o != "" {
+		parsed, err := strconv.Atoi(o)
+		if err != nil || parsed < 0 {
+			return 0, 0, ErrInvalidPagination
+		}
+
+		offset = parsed
+	}
+
+	return limit, offset, nil
+}
+
+// getLimitParam reads the "limit" query parameter, applying the default limit
+// when unset and capping it at the maximum.
+func getLimitParam(c *gin.Context) (int, error) {
+	limit := defaultInstanceListLimit
+
+	if l := c.Query("limit"); l != "" {
+		parsed, err := strconv.Atoi(l)
+		if err != nil || parsed < 1 {
+			return 0, ErrInvalidPagination
+		}
+
+		limit = min(parsed, maxInstanceListLimit)
+	}
+
+	return limit, nil
+}
@@ -0,0 +1,105 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestGetInstancesWithinCIDR(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	// Instances A, A1, and A2 all have a private IPv4 block within 10.70.17.0/24
+	withinCIDR := []string{
+		dbtools.FixtureInstanceA.InstanceID,
+		dbtools.FixtureInstanceA1.InstanceID,
+		dbtools.FixtureInstanceA2.InstanceID,
+	}
+	sort.Strings(withinCIDR)
+
+	type testCase struct {
+		testName            string
+		path                string
+		expectedStatus      int
+		expectedInstanceIDs []string
+	}
+
+	testCases := []testCase{
+		{
+			"invalid CIDR",
+			v1api.GetInternalInstancesWithinCIDRPath("not-a-cidr"),
+			http.StatusBadRequest,
+			nil,
+		},
+		{
+			"bare IP address",
+			v1api.GetInternalInstancesWithinCIDRPath("10.70.17.8"),
+			http.StatusBadRequest,
+			nil,
+		},
+		{
+			"invalid limit",
+			v1api.GetInternalInstancesWithinCIDRPath("10.70.17.0/24") + "?limit=0",
+			http.StatusBadRequest,
+			nil,
+		},
+		{
+			"no matching instances",
+			v1api.GetInternalInstancesWithinCIDRPath("192.0.2.0/24"),
+			http.StatusOK,
+			[]string{},
+		},
+		{
+			"all matching instances",
+			v1api.GetInternalInstancesWithinCIDRPath("10.70.17.0/24"),
+			http.StatusOK,
+			withinCIDR,
+		},
+		{
+			"first page",
+			v1api.GetInternalInstancesWithinCIDRPath("10.70.17.0/24") + "?limit=2",
+			http.StatusOK,
+			withinCIDR[:2],
+		},
+		{
+			"second page",
+			v1api.GetInternalInstancesWithinCIDRPath("10.70.17.0/24") + "?limit=2&offset=2",
+			http.StatusOK,
+			withinCIDR[2:],
+		},
+		{
+			"IPv6 CIDR",
+			v1api.GetInternalInstancesWithinCIDRPath("2604:1380:4641:1f00::8/125"),
+			http.StatusOK,
+			[]string{dbtools.FixtureInstanceA.InstanceID},
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, testcase.path, nil)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+
+			if testcase.expectedStatus == http.StatusOK {
+				var resp v1api.InstanceIDListResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+
+				assert.Equal(t, testcase.expectedInstanceIDs, resp.InstanceIDs)
+			}
+		})
+	}
+}
@@ -1,35 +1,156 @@
 package metadataservice
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
+	"net/netip"
 	"strconv"
+	"strings"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/viper"
 	"github.com/volatiletech/null/v8"
 	"github.com/volatiletech/sqlboiler/v4/types"
 
+	"go.hollow.sh/metadataservice/internal/audit"
+	"go.hollow.sh/metadataservice/internal/fieldcrypt"
+	"go.hollow.sh/metadataservice/internal/history"
 	"go.hollow.sh/metadataservice/internal/middleware"
 	"go.hollow.sh/metadataservice/internal/models"
 	"go.hollow.sh/metadataservice/internal/upserter"
+	"go.hollow.sh/metadataservice/internal/variants"
 )
 
+// gzipMagic is the two-byte header identifying gzip-compressed data.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Base64UserdataContentType is the media type a client can accept, like
+// with the "encoding=base64" query parameter, to get userdata from the public
+// endpoints base64-encoded.
+const Base64UserdataContentType = "text/base64"
+
 // UpsertMetadataRequest contains the fields for inserting or updating an
-// instances metadata.
+// instances metadata. The metadata can be given directly as a JSON object or
+// array, or, as older clients do, as a string containing the JSON.
 type UpsertMetadataRequest struct {
-	ID          string   `json:"id" validate:"required,uuid"`
-	Metadata    string   `json:"metadata" validate:"required,json"`
-	IPAddresses []string `json:"ipAddresses" validate:"dive,ip_addr|cidr"`
+	ID          string          `json:"id" validate:"required,uuid"`
+	Metadata    json.RawMessage `json:"metadata" validate:"required"`
+	IPAddresses []string        `json:"ipAddresses" validate:"dive,ip_addr|cidr"`
+	// UpdatedAt optionally records when the metadata was produced by the
+	// caller. It's used to decide whether IP addresses may be taken from
+	// another instance when they conflict.
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
 }
 
+// validate normalizes the request's metadata to the JSON it holds, so that
+// the string and object forms are stored the same way, and then validates
+// the request.
 func (upsertRequest *UpsertMetadataRequest) validate() error {
-	return validate.Struct(upsertRequest)
+	metadata, metadataErr := normalizeMetadata(upsertRequest.Metadata)
+	upsertRequest.Metadata = metadata
+
+	if err := validate.Struct(upsertRequest); err != nil {
+		return err
+	}
+
+	return metadataErr
+}
+
+// normalizeMetadata returns the JSON held by the metadata field of an upsert
+// request: the embedded JSON if the field is a string, or the field itself if
+// it's an object or array. Empty and null metadata (or an empty string) is
+// returned as nil, so that it fails the "required" validation.
+func normalizeMetadata(raw json.RawMessage) (json.RawMessage, error) {
+	trimmed := bytes.TrimSpace(raw)
+
+	switch {
+	case len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")):
+		return nil, nil
+	case trimmed[0] == '"':
+		var embedded string
+
+		if err := json.Unmarshal(trimmed, &embedded); err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidMetadata, err)
+		}
+
+		if embedded == "" {
+			return nil, nil
+		}
+
+		if !json.Valid([]byte(embedded)) {
+			return nil, errInvalidMetadata
+		}
+
+		return json.RawMessage(embedded), nil
+	case trimmed[0] == '{' || trimmed[0] == '[':
+		if !json.Valid(trimmed) {
+			return nil, errInvalidMetadata
+		}
+
+		return trimmed, nil
+	default:
+		return nil, errInvalidMetadata
+	}
+}
+
+// trimStringValues returns the metadata with the surrounding whitespace
+// trimmed from its top-level string values, like a hostname with a trailing
+// newline. Nested values are left alone, as is metadata which isn't a JSON
+// object, or which has nothing to trim.
+func trimStringValues(metadata json.RawMessage) (json.RawMessage, error) {
+	var obj map[string]json.RawMessage
+
+	if err := json.Unmarshal(metadata, &obj); err != nil || obj == nil {
+		return metadata, nil //nolint:nilerr // only objects are trimmed
+	}
+
+	trimmed := false
+
+	for key, raw := range obj {
+		var value string
+
+		if len(raw) == 0 || raw[0] != '"' || json.Unmarshal(raw, &value) != nil {
+			continue
+		}
+
+		if strings.TrimSpace(value) == value {
+			continue
+		}
+
+		encoded, err := json.Marshal(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+
+		obj[key] = encoded
+		trimmed = true
+	}
+
+	if !trimmed {
+		return metadata, nil
+	}
+
+	buf := new(bytes.Buffer)
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(obj); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSpace(buf.Bytes()), nil
 }
 
 func (upsertRequest UpsertMetadataRequest) getID() string {
@@ -40,16 +161,174 @@ func (upsertRequest UpsertMetadataRequest) getIPAddresses() []string {
 	return upsertRequest.IPAddresses
 }
 
+// validateAllowedIPs returns an error listing any of the given IP addresses
+// (or CIDRs) which aren't within one of the AllowedIPCIDRs. If no CIDRs are
+// configured, every address is allowed.
+func (r *Router) validateAllowedIPs(ipAddresses []string) error {
+	if len(r.AllowedIPCIDRs) == 0 {
+		return nil
+	}
+
+	var disallowed []string
+
+	for _, ipAddress := range ipAddresses {
+		if !ipWithinPrefixes(ipAddress, r.AllowedIPCIDRs) {
+			disallowed = append(disallowed, ipAddress)
+		}
+	}
+
+	if len(disallowed) > 0 {
+		return fmt.Errorf("%w: %s", errDisallowedIPAddresses, strings.Join(disallowed, ", "))
+	}
+
+	return nil
+}
+
+// validateUpdatedAt returns an error if the given updatedAt is more than
+// crdb.max_future_updated_at ahead of the Router's clock. Such a value would
+// otherwise be stored and make every later, legitimate update look stale. If
+// no maximum is configured, any value is allowed.
+func (r *Router) validateUpdatedAt(updatedAt *time.Time) error {
+	maxFuture := viper.GetDuration("crdb.max_future_updated_at")
+	if updatedAt == nil || maxFuture <= 0 {
+		return nil
+	}
+
+	if limit := r.now().Add(maxFuture); updatedAt.After(limit) {
+		return fmt.Errorf("%w: %s is more than %s ahead of server time", errFutureUpdatedAt, updatedAt.Format(time.RFC3339), maxFuture)
+	}
+
+	return nil
+}
+
+// ParseAllowedIPCIDRs parses the CIDRs upserted IP addresses must be within.
+func ParseAllowedIPCIDRs(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// ipWithinPrefixes reports whether the IP address, or every address in the
+// CIDR, is within one of the prefixes.
+func ipWithinPrefixes(ipAddress string, prefixes []netip.Prefix) bool {
+	candidate, err := netip.ParsePrefix(ipAddress)
+	if err != nil {
+		addr, err := netip.ParseAddr(ipAddress)
+		if err != nil {
+			return false
+		}
+
+		candidate = netip.PrefixFrom(addr, addr.BitLen())
+	}
+
+	for _, prefix := range prefixes {
+		if prefix.Bits() <= candidate.Bits() && prefix.Contains(candidate.Addr()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ExtractIPAddressesFromMetadata returns the IP addresses listed in the
+// metadata's network.addresses, in order.
+func ExtractIPAddressesFromMetadata(metadata string) ([]string, error) {
+	var parsed struct {
+		Network struct {
+			Addresses []struct {
+				Address string `json:"address"`
+			} `json:"addresses"`
+		} `json:"network"`
+	}
+
+	if err := json.Unmarshal([]byte(metadata), &parsed); err != nil {
+		return nil, err
+	}
+
+	var ipAddresses []string
+
+	for _, address := range parsed.Network.Addresses {
+		if address.Address != "" {
+			ipAddresses = append(ipAddresses, address.Address)
+		}
+	}
+
+	return ipAddresses, nil
+}
+
+// metadataIPsNotInIPAddresses returns the IP addresses listed in the metadata
+// which aren't one of, or within one of the CIDRs in, ipAddresses.
+func metadataIPsNotInIPAddresses(metadata string, ipAddresses []string) ([]string, error) {
+	metadataIPs, err := ExtractIPAddressesFromMetadata(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	prefixes := ipAddressPrefixes(ipAddresses)
+
+	var missing []string
+
+	for _, metadataIP := range metadataIPs {
+		if !ipWithinPrefixes(metadataIP, prefixes) {
+			missing = append(missing, metadataIP)
+		}
+	}
+
+	return missing, nil
+}
+
+// ipAddressPrefixes parses IP addresses and CIDRs into prefixes, with single
+// IP addresses as full-length prefixes. Anything else is skipped.
+func ipAddressPrefixes(ipAddresses []string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(ipAddresses))
+
+	for _, ipAddress := range ipAddresses {
+		prefix, err := netip.ParsePrefix(ipAddress)
+		if err != nil {
+			addr, err := netip.ParseAddr(ipAddress)
+			if err != nil {
+				continue
+			}
+
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes
+}
+
 // UpsertUserdataRequest contains the fields for inserting or updating an
 // instances userdata.
 type UpsertUserdataRequest struct {
 	ID          string   `json:"id" validate:"required,uuid"`
 	Userdata    []byte   `json:"userdata"`
 	IPAddresses []string `json:"ipAddresses" validate:"dive,ip_addr|cidr"`
+	// UpdatedAt optionally records when the userdata was produced by the
+	// caller. The upsert is skipped if the stored userdata was written after
+	// that, so replayed writes can't overwrite newer userdata.
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+	// Variant optionally names the userdata variant being upserted, like
+	// "ignition". The instance's default userdata is upserted without one.
+	Variant string `json:"variant,omitempty"`
 }
 
 func (upsertRequest *UpsertUserdataRequest) validate() error {
-	return validate.Struct(upsertRequest)
+	if err := validate.Struct(upsertRequest); err != nil {
+		return err
+	}
+
+	return validateUserdataVariant(upsertRequest.Variant)
 }
 
 func (upsertRequest UpsertUserdataRequest) getID() string {
@@ -67,22 +346,40 @@ func (r *Router) instanceMetadataGet(c *gin.Context) {
 	// error wasn't a "not found" error, we should just return a generic 500
 	// error result to the caller.
 	if err != nil && !errors.Is(err, errNotFound) {
-		dbErrorResponse(r.Logger, c, err)
+		r.metadataErrorResponse(c, err)
 		return
 	}
 
+	if metadata != nil && r.EmptyMetadataNotFound && isEmptyJSONObject(metadata.Metadata) {
+		metadata = nil
+	}
+
 	if metadata != nil {
-		augmentedMetadata, err := addTemplateFields(metadata.Metadata, r.TemplateFields)
+		setInstanceIDHeader(c, metadata.ID)
+
+		templateStart := time.Now()
+		augmentedMetadata, err := r.addTemplateFields(metadata.Metadata)
+		recordServerTiming(c, serverTimingTemplate, templateStart)
+
 		if err != nil {
 			r.Logger.Sugar().Warnf("Error adding additional templated fields to metadata for instance %s", metadata.ID, "error", err)
 
 			// Since we couldn't add the templated fields, just return the metadata as-is
-			c.JSON(http.StatusOK, metadata.Metadata)
+			r.metadataResponse(c, metadata.Metadata)
 		} else {
-			c.JSON(http.StatusOK, augmentedMetadata)
+			renameFields(augmentedMetadata, r.FieldRenames)
+
+			if r.IncludeDebugFields {
+				augmentedMetadata[debugFieldsKey] = map[string]string{
+					"request_ip": c.GetString(middleware.ContextKeyRequestorIP),
+					"source":     c.GetString(contextKeyMetadataSource),
+				}
+			}
+
+			r.metadataResponse(c, augmentedMetadata)
 		}
 	} else {
-		notFoundResponse(c)
+		r.instanceNotFoundResponse(c)
 	}
 }
 
@@ -100,27 +397,66 @@ func (r *Router) instanceMetadataGetInternal(c *gin.Context) {
 		return
 	}
 
-	metadata, err := models.FindInstanceMetadatum(c.Request.Context(), r.DB, instanceID)
+	if asOf := c.Query("as_of"); asOf != "" {
+		r.instanceMetadataAsOfGetInternal(c, instanceID, asOf)
+		return
+	}
+
+	metadata, err := findInstanceMetadata(c.Request.Context(), r.DB, instanceID)
 
 	if err != nil {
 		// Here, we don't want to try to look up the metadata from an external
 		// system, as this endpoint should only return data for instances it
 		// already knows about
-		dbErrorResponse(r.Logger, c, err)
+		r.dbErrorResponse(c, err)
+		return
+	}
+
+	if r.EmptyMetadataNotFound && isEmptyJSONObject(metadata.Metadata) {
+		notFoundResponse(c)
 		return
 	}
 
-	augmentedMetadata, err := addTemplateFields(metadata.Metadata, r.TemplateFields)
+	setTimestampHeaders(c, metadata.CreatedAt, metadata.UpdatedAt)
+
+	augmentedMetadata, err := r.addTemplateFields(metadata.Metadata)
 	if err != nil {
 		r.Logger.Sugar().Warnf("Error adding additional templated fields to metadata for instance %s", metadata.ID, "error", err)
 
 		// Since we couldn't add the templated fields, just return the metadata as-is
 		c.JSON(http.StatusOK, metadata.Metadata)
 	} else {
+		renameFields(augmentedMetadata, r.FieldRenames)
 		c.JSON(http.StatusOK, augmentedMetadata)
 	}
 }
 
+// instanceMetadataAsOfGetInternal returns the version of the instance's
+// metadata that was current at the given RFC 3339 timestamp, as recorded in
+// the metadata history. It's returned exactly as it was stored, without any
+// templated fields or renames. If the instance had no metadata at that time,
+// it returns a 404.
+func (r *Router) instanceMetadataAsOfGetInternal(c *gin.Context, instanceID, asOf string) {
+	asOfTime, err := time.Parse(time.RFC3339Nano, asOf)
+	if err != nil {
+		badRequestResponse(c, "as_of must be an RFC 3339 timestamp", err)
+		return
+	}
+
+	metadata, err := history.MetadataAsOf(c.Request.Context(), r.DB, instanceID, asOfTime)
+	if err != nil {
+		r.dbErrorResponse(c, err)
+		return
+	}
+
+	if metadata, err = fieldcrypt.DecryptMetadata(metadata); err != nil {
+		r.dbErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, metadata)
+}
+
 // instanceMetadataExistsInternal retrieves the requested instance ID from the
 // path and looks to see if the database has metadata recorded for that ID.
 // If so, it returns a 200. If not, it returns a 404. This can be used by an
@@ -134,7 +470,7 @@ func (r *Router) instanceMetadataExistsInternal(c *gin.Context) {
 		return
 	}
 
-	metadata, err := models.FindInstanceMetadatum(c.Request.Context(), r.DB, instanceID)
+	metadata, err := findInstanceMetadata(c.Request.Context(), r.DB, instanceID)
 
 	if err != nil {
 		c.Status(http.StatusNotFound)
@@ -156,21 +492,88 @@ func (r *Router) instanceMetadataExistsInternal(c *gin.Context) {
 }
 
 func (r *Router) instanceUserdataGet(c *gin.Context) {
+	if r.maintenanceUserdataResponse(c) {
+		return
+	}
+
+	if variant := c.Query(UserdataVariantParam); variant != "" {
+		r.userdataVariantGet(c, variant)
+		return
+	}
+
 	userdata, err := r.getUserdata(c)
 
 	// If we got an error trying to retrieve userdata for the caller, and the
 	// error wasn't a "not found" error, we should just return a generic 500
 	// error result to the caller.
 	if err != nil && !errors.Is(err, errNotFound) {
-		dbErrorResponse(r.Logger, c, err)
+		r.dbErrorResponse(c, err)
 		return
 	}
 
 	if userdata != nil {
-		c.String(http.StatusOK, string(userdata.Userdata.Bytes))
-	} else {
-		notFoundResponse(c)
+		setInstanceIDHeader(c, userdata.ID)
+		r.userdataResponse(c, userdata.ID, userdata.Userdata.Bytes)
+
+		return
+	}
+
+	// Without stored userdata, fall back to generating it from the instance's
+	// metadata if a userdata template is configured, or to the default
+	// userdata. Either only applies to instances with metadata, so unknown
+	// instances still get a 404.
+	if r.UserdataTemplate != nil || r.DefaultUserdata != nil {
+		metadata, err := r.getMetadata(c)
+		if err != nil && !errors.Is(err, errNotFound) {
+			r.metadataErrorResponse(c, err)
+			return
+		}
+
+		if metadata != nil && r.UserdataTemplate == nil {
+			setInstanceIDHeader(c, metadata.ID)
+			plainUserdataResponse(c, r.DefaultUserdata)
+
+			return
+		}
+
+		if metadata != nil {
+			templateStart := time.Now()
+			generated, err := renderUserdataTemplate(r.UserdataTemplate, metadata.Metadata)
+			recordServerTiming(c, serverTimingTemplate, templateStart)
+
+			if err != nil {
+				r.Logger.Sugar().Warn("Error generating userdata from template for instance ", metadata.ID, " error: ", err)
+				r.internalErrorResponse(c, err)
+
+				return
+			}
+
+			setInstanceIDHeader(c, metadata.ID)
+			plainUserdataResponse(c, []byte(generated))
+
+			return
+		}
 	}
+
+	r.instanceNotFoundResponse(c)
+}
+
+// renderUserdataTemplate executes the userdata template against the given
+// metadata.
+func renderUserdataTemplate(tmpl *template.Template, metadata types.JSON) (string, error) {
+	data := make(map[string]interface{})
+
+	if err := json.Unmarshal(metadata, &data); err != nil {
+		return "", err
+	}
+
+	buf := new(bytes.Buffer)
+
+	if err := tmpl.Execute(buf, data); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
 }
 
 // instanceUserdataGetInternal retrieves the requested instance ID from the
@@ -187,17 +590,190 @@ func (r *Router) instanceUserdataGetInternal(c *gin.Context) {
 		return
 	}
 
-	userdata, err := models.FindInstanceUserdatum(c.Request.Context(), r.DB, instanceID)
+	userdata, err := findInstanceUserdata(c.Request.Context(), r.DB, instanceID)
 
 	if err != nil {
 		// Here, we don't want to try to look up the userdata from an external
 		// system, as this endpoint should only return data for instances it
 		// already knows about
-		dbErrorResponse(r.Logger, c, err)
+		r.dbErrorResponse(c, err)
+		return
+	}
+
+	body, gzipEncoded, err := r.internalUserdataBody(c, userdata.Userdata.Bytes)
+	if err != nil {
+		r.Logger.Sugar().Warnw("failed to decompress userdata", "instance_id", instanceID, "error", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, &ErrorResponse{Errors: []string{"Unable to decompress userdata for instance"}})
+
+		return
+	}
+
+	if gzipEncoded {
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", body)
+		return
+	}
+
+	c.String(http.StatusOK, string(body))
+}
+
+// internalUserdataBody returns the body the internal userdata endpoint
+// responds with for the stored userdata, so that GET and HEAD requests agree
+// on it. gzip'd userdata is returned as it's stored, unless decompression is
+// requested with the "decompress" query parameter. When
+// UserdataGzipPassthrough is set, it's instead negotiated like on the public
+// endpoints: returned as-is, with the Content-Encoding header set, if the
+// request's Accept-Encoding allows gzip, and decompressed if it doesn't.
+// The returned bool reports whether the body is gzip-encoded.
+func (r *Router) internalUserdataBody(c *gin.Context, userdata []byte) ([]byte, bool, error) {
+	// Some producers push userdata that's already gzip'd, which cloud-init
+	// handles fine, but other readers of this endpoint may want it as-is.
+	if c.Query("decompress") == "true" {
+		body, err := decompressUserdata(userdata)
+
+		return body, false, err
+	}
+
+	if !r.UserdataGzipPassthrough || !bytes.HasPrefix(userdata, gzipMagic) {
+		return userdata, false, nil
+	}
+
+	c.Header("Vary", "Accept-Encoding")
+
+	if acceptsGzip(c) {
+		c.Header("Content-Encoding", "gzip")
+
+		return userdata, true, nil
+	}
+
+	body, err := decompressUserdata(userdata)
+
+	return body, false, err
+}
+
+// decompressUserdata returns the decompressed contents of gzip'd userdata. If
+// the userdata doesn't start with the gzip magic bytes, it's returned as-is.
+func decompressUserdata(userdata []byte) ([]byte, error) {
+	if !bytes.HasPrefix(userdata, gzipMagic) {
+		return userdata, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(userdata))
+	if err != nil {
+		return nil, err
+	}
+
+	defer zr.Close()
+
+	return io.ReadAll(zr)
+}
+
+// userdataResponse writes the stored userdata for the public userdata
+// endpoints. When UserdataGzipPassthrough is set and the userdata was stored
+// gzip'd, it's sent as-is with a "Content-Encoding: gzip" header if the client
+// accepts gzip, or decompressed if it doesn't. Clients asking for base64
+// always get the stored bytes base64-encoded.
+func (r *Router) userdataResponse(c *gin.Context, instanceID string, userdata []byte) {
+	if r.UserdataLineEndingsMode == UserdataLineEndingsServe {
+		userdata = normalizeLineEndings(userdata)
+	}
+
+	if wantsBase64Userdata(c) || !r.UserdataGzipPassthrough || !bytes.HasPrefix(userdata, gzipMagic) {
+		plainUserdataResponse(c, userdata)
+		return
+	}
+
+	c.Writer.Header().Add("Vary", "Accept-Encoding")
+
+	if acceptsGzip(c) {
+		c.Header("Content-Encoding", "gzip")
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", userdata)
+
+		return
+	}
+
+	body, err := decompressUserdata(userdata)
+	if err != nil {
+		r.Logger.Sugar().Warnw("failed to decompress userdata", "instance_id", instanceID, "error", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, &ErrorResponse{Errors: []string{"Unable to decompress userdata for instance"}})
+
 		return
 	}
 
-	c.String(http.StatusOK, string(userdata.Userdata.Bytes))
+	c.String(http.StatusOK, string(body))
+}
+
+// varyOnAccept is the middleware for the public userdata endpoints, whose
+// responses depend on whether the Accept header asks for base64 userdata. It
+// sets "Vary: Accept" on every response, so caches don't serve a response
+// in one encoding to clients asking for the other.
+func varyOnAccept(c *gin.Context) {
+	c.Writer.Header().Add("Vary", "Accept")
+}
+
+// plainUserdataResponse writes userdata for the public userdata endpoints
+// as-is, or base64-encoded if the request asks for it.
+func plainUserdataResponse(c *gin.Context, userdata []byte) {
+	if wantsBase64Userdata(c) {
+		c.Data(http.StatusOK, Base64UserdataContentType, []byte(base64.StdEncoding.EncodeToString(userdata)))
+
+		return
+	}
+
+	c.String(http.StatusOK, string(userdata))
+}
+
+// wantsBase64Userdata reports whether the request asks for userdata to be
+// base64-encoded, like AWS SDKs return it, with the "encoding=base64" query
+// parameter or by accepting Base64UserdataContentType.
+func wantsBase64Userdata(c *gin.Context) bool {
+	if c.Query("encoding") == "base64" {
+		return true
+	}
+
+	for _, accept := range strings.Split(c.GetHeader("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(accept, ";")
+
+		if strings.EqualFold(strings.TrimSpace(mediaType), Base64UserdataContentType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizeLineEndings converts the CRLF line endings in userdata to LF, as
+// Windows-authored scripts otherwise break when run on Linux. gzip'd or other
+// binary (non-UTF-8) userdata is returned untouched.
+func normalizeLineEndings(userdata []byte) []byte {
+	if bytes.HasPrefix(userdata, gzipMagic) || !utf8.Valid(userdata) {
+		return userdata
+	}
+
+	return bytes.ReplaceAll(userdata, []byte("\r\n"), []byte("\n"))
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding header allows a
+// gzip-encoded response.
+func acceptsGzip(c *gin.Context) bool {
+	for _, encoding := range strings.Split(c.GetHeader("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(encoding, ";")
+
+		name = strings.TrimSpace(name)
+		if name != "gzip" && name != "*" {
+			continue
+		}
+
+		// An explicit q=0 means the encoding isn't acceptable.
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				continue
+			}
+		}
+
+		return true
+	}
+
+	return false
 }
 
 // instanceUserdataExistsInternal retrieves the requested instance ID from the
@@ -213,16 +789,25 @@ func (r *Router) instanceUserdataExistsInternal(c *gin.Context) {
 		return
 	}
 
-	userdata, err := models.FindInstanceUserdatum(c.Request.Context(), r.DB, instanceID)
+	userdata, err := findInstanceUserdata(c.Request.Context(), r.DB, instanceID)
 
 	if err != nil {
 		c.Status(http.StatusNotFound)
 		return
 	}
 
+	body, _, err := r.internalUserdataBody(c, userdata.Userdata.Bytes)
+	if err != nil {
+		r.Logger.Sugar().Warnw("failed to decompress userdata", "instance_id", instanceID, "error", err)
+		c.Status(http.StatusInternalServerError)
+
+		return
+	}
+
 	// HEAD request responses still set the Content-Length header to what it
-	// would be if we were returning the userdata
-	c.Writer.Header().Set("Content-Length", strconv.Itoa(len(userdata.Userdata.Bytes)))
+	// would be if we were returning the userdata, in the same encoding a GET
+	// request would get it in
+	c.Writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
 	c.Status(http.StatusOK)
 }
 
@@ -257,22 +842,161 @@ func (r *Router) instanceMetadataSet(c *gin.Context) {
 		return
 	}
 
+	r.upsertMetadata(c, params)
+}
+
+// instanceMetadataReplace handles PUT requests, which replace the metadata for
+// the instance ID in the path. The request body is the same as for POST, but
+// the ID can be left out. If it's included, it must match the path.
+func (r *Router) instanceMetadataReplace(c *gin.Context) {
+	instanceID, err := getUUIDParam(c, "instance-id")
+	if err != nil {
+		invalidUUIDResponse(c, err)
+		return
+	}
+
+	params := UpsertMetadataRequest{}
+
+	if err := c.BindJSON(&params); err != nil {
+		badRequestResponse(c, "invalid request body", err)
+		return
+	}
+
+	if params.ID != "" && !strings.EqualFold(params.ID, instanceID) {
+		badRequestResponse(c, errMismatchedInstanceID.Error(), errMismatchedInstanceID)
+		return
+	}
+
+	params.ID = instanceID
+
+	r.upsertMetadata(c, params)
+}
+
+// checkMetadataIPAddresses compares the IP addresses listed in the metadata
+// with the ones in the request, according to the MetadataIPMismatchMode. In
+// warn mode, mismatches are only logged. In error mode, they're returned as an
+// error.
+func (r *Router) checkMetadataIPAddresses(params UpsertMetadataRequest) error {
+	mode := r.MetadataIPMismatchMode
+	if mode != MetadataIPMismatchWarn && mode != MetadataIPMismatchError {
+		return nil
+	}
+
+	missing, err := metadataIPsNotInIPAddresses(string(params.Metadata), params.getIPAddresses())
+	if err != nil || len(missing) == 0 {
+		// Metadata that isn't a JSON object has no addresses to check.
+		return nil
+	}
+
+	if mode == MetadataIPMismatchError {
+		return fmt.Errorf("%w: %s", errMetadataIPMismatch, strings.Join(missing, ", "))
+	}
+
+	r.Logger.Sugar().Warnw("metadata lists IP addresses which aren't in ipAddresses", "instance_id", params.ID, "ip_addresses", missing)
+
+	return nil
+}
+
+// upsertMetadata validates and upserts the metadata from a POST or PUT request.
+func (r *Router) upsertMetadata(c *gin.Context, params UpsertMetadataRequest) {
 	if err := params.validate(); err != nil {
 		badRequestResponse(c, "Invalid request", err)
 		return
 	}
 
+	// Some producers leave trailing newlines in values like the hostname,
+	// which would otherwise end up in the EC2 item responses.
+	if r.MetadataTrimStringValues {
+		trimmed, err := trimStringValues(params.Metadata)
+		if err != nil {
+			badRequestResponse(c, "Invalid request", err)
+			return
+		}
+
+		params.Metadata = trimmed
+	}
+
+	if err := r.validateAllowedIPs(params.getIPAddresses()); err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	if err := r.validateUpdatedAt(params.UpdatedAt); err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	if err := r.checkMetadataIPAddresses(params); err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	// Some deployments only allow a fixed set of top-level metadata keys.
+	if len(r.MetadataAllowedKeys) > 0 {
+		disallowed, err := disallowedMetadataKeys(string(params.Metadata), r.MetadataAllowedKeys)
+		if err != nil {
+			badRequestResponse(c, "metadata must be a JSON object", err)
+			return
+		}
+
+		if len(disallowed) > 0 {
+			err := fmt.Errorf("%w: %s", errDisallowedMetadataKeys, strings.Join(disallowed, ", "))
+			badRequestResponse(c, err.Error(), err)
+
+			return
+		}
+	}
+
 	newInstanceMetadata := &models.InstanceMetadatum{
 		ID:       params.getID(),
 		Metadata: types.JSON(params.Metadata),
 	}
 
-	err := upserter.UpsertMetadata(c, r.DB, r.Logger, params.ID, params.getIPAddresses(), newInstanceMetadata)
+	if params.UpdatedAt != nil {
+		newInstanceMetadata.UpdatedAt = *params.UpdatedAt
+	}
+
+	// Callers can ask what actually changed, so they can log meaningful events.
+	returnDiff := c.Query("return_diff") == "true"
+
+	var (
+		previous, stored types.JSON
+		created          bool
+		err              error
+	)
+
+	if returnDiff {
+		previous, stored, created, err = upserter.UpsertMetadataWithVersions(c.Request.Context(), r.DB, r.Logger, params.ID, params.getIPAddresses(), newInstanceMetadata)
+	} else {
+		created, err = upserter.UpsertMetadata(c.Request.Context(), r.DB, r.Logger, params.ID, params.getIPAddresses(), newInstanceMetadata)
+	}
+
 	if err != nil {
-		dbErrorResponse(r.Logger, c, err)
+		r.upsertErrorResponse(c, err)
+		return
 	}
 
-	c.Status(http.StatusOK)
+	if created {
+		r.auditLog(c, audit.ActionMetadataCreate, params.ID)
+	} else {
+		r.auditLog(c, audit.ActionMetadataUpdate, params.ID)
+	}
+
+	if returnDiff {
+		changes, err := diffMetadata(previous, stored)
+		if err != nil {
+			r.Logger.Sugar().Warn("Error computing metadata diff for instance ", params.ID, " error: ", err)
+			r.internalErrorResponse(c, err)
+
+			return
+		}
+
+		c.JSON(upsertStatus(created), &MetadataDiffResponse{Changes: changes})
+
+		return
+	}
+
+	upsertResponse(c, created)
 }
 
 func (r *Router) instanceUserdataSet(c *gin.Context) {
@@ -289,17 +1013,57 @@ func (r *Router) instanceUserdataSet(c *gin.Context) {
 		return
 	}
 
+	if err := r.validateAllowedIPs(params.getIPAddresses()); err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	if err := r.validateUpdatedAt(params.UpdatedAt); err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	// Some downstream consumers can't handle userdata that isn't valid UTF-8.
+	// gzip'd userdata is still allowed through, since cloud-init handles it.
+	if r.UserdataRequireUTF8 && !bytes.HasPrefix(params.Userdata, gzipMagic) && !utf8.Valid(params.Userdata) {
+		badRequestResponse(c, errInvalidUTF8Userdata.Error(), errInvalidUTF8Userdata)
+		return
+	}
+
+	if r.UserdataLineEndingsMode == UserdataLineEndingsStore {
+		params.Userdata = normalizeLineEndings(params.Userdata)
+	}
+
 	newInstanceUserdata := &models.InstanceUserdatum{
 		ID:       params.getID(),
 		Userdata: null.NewBytes(params.Userdata, true),
 	}
 
-	err := upserter.UpsertUserdata(c, r.DB, r.Logger, params.ID, params.getIPAddresses(), newInstanceUserdata)
+	if params.UpdatedAt != nil {
+		newInstanceUserdata.UpdatedAt = *params.UpdatedAt
+	}
+
+	created, err := upserter.UpsertUserdataVariant(c.Request.Context(), r.DB, r.Logger, params.ID, params.Variant, params.getIPAddresses(), newInstanceUserdata)
+	if errors.Is(err, upserter.ErrExistingUserdataIsNewer) {
+		// Nothing was changed, but the caller has nothing to fix either.
+		r.Logger.Sugar().Info("Skipped stale userdata upsert for instance ", params.ID)
+		c.Status(http.StatusOK)
+
+		return
+	}
+
 	if err != nil {
-		dbErrorResponse(r.Logger, c, err)
+		r.upsertErrorResponse(c, err)
+		return
 	}
 
-	c.Status(http.StatusOK)
+	if created {
+		r.auditLog(c, audit.ActionUserdataCreate, params.ID)
+	} else {
+		r.auditLog(c, audit.ActionUserdataUpdate, params.ID)
+	}
+
+	upsertResponse(c, created)
 }
 
 func (r *Router) instanceMetadataDelete(c *gin.Context) {
@@ -317,11 +1081,11 @@ func (r *Router) instanceMetadataDelete(c *gin.Context) {
 	metadata, err := models.FindInstanceMetadatum(c.Request.Context(), r.DB, instanceID)
 
 	if err != nil {
-		dbErrorResponse(r.Logger, c, err)
+		r.dbErrorResponse(c, err)
 		return
 	}
 
-	handleDeleteRequest(c, r, instanceID, metadata, nil)
+	handleDeleteRequest(c, r, instanceID, metadata, nil, false)
 }
 
 func (r *Router) instanceUserdataDelete(c *gin.Context) {
@@ -338,19 +1102,54 @@ func (r *Router) instanceUserdataDelete(c *gin.Context) {
 
 	userdata, err := models.FindInstanceUserdatum(c.Request.Context(), r.DB, instanceID)
 
-	if err != nil {
-		dbErrorResponse(r.Logger, c, err)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		r.dbErrorResponse(c, err)
+		return
+	}
+
+	// The userdata variants are deleted along with the default userdata, but
+	// an instance may only have variants.
+	if userdata == nil {
+		hasVariants, err := variants.Exists(c.Request.Context(), r.DB, instanceID)
+		if err != nil {
+			r.dbErrorResponse(c, err)
+			return
+		}
+
+		if !hasVariants {
+			notFoundResponse(c)
+			return
+		}
+	}
+
+	handleDeleteRequest(c, r, instanceID, nil, userdata, true)
+}
+
+func handleDeleteRequest(c *gin.Context, r *Router, instanceID string, metadata *models.InstanceMetadatum, userdata *models.InstanceUserdatum, deleteUserdata bool) {
+	if err := r.deleteInstanceData(c.Request.Context(), instanceID, metadata, userdata, deleteUserdata); err != nil {
+		r.dbErrorResponse(c, err)
 		return
 	}
 
-	handleDeleteRequest(c, r, instanceID, nil, userdata)
+	if metadata != nil {
+		r.auditLog(c, audit.ActionMetadataDelete, instanceID)
+	}
+
+	if deleteUserdata {
+		r.auditLog(c, audit.ActionUserdataDelete, instanceID)
+	}
+
+	c.Status(http.StatusOK)
 }
 
-func handleDeleteRequest(c *gin.Context, r *Router, instanceID string, metadata *models.InstanceMetadatum, userdata *models.InstanceUserdatum) {
+// deleteInstanceData deletes the given metadata and/or userdata records for
+// an instance, along with its userdata variants if deleteUserdata is set,
+// retrying the transactions as configured, and then the instance's IP
+// addresses if no metadata, userdata, or userdata variant remains.
+func (r *Router) deleteInstanceData(ctx context.Context, instanceID string, metadata *models.InstanceMetadatum, userdata *models.InstanceUserdatum, deleteUserdata bool) error {
 	var err error
 
 	deleteMetadata := metadata != nil
-	deleteUserdata := userdata != nil
 
 	maxDeleteRetries := viper.GetInt("crdb.max_retries")
 	dbRetryInterval := viper.GetDuration("crdb.retry_interval")
@@ -362,84 +1161,107 @@ func handleDeleteRequest(c *gin.Context, r *Router, instanceID string, metadata
 	// Phase 1
 	deleteSuccess := false
 	for i := 0; i <= maxDeleteRetries && !deleteSuccess; i++ {
-		err := performDeleteTX(c, r, instanceID, metadata, userdata, deleteMetadata, deleteUserdata)
+		err = performDeleteTX(ctx, r, instanceID, metadata, userdata, deleteMetadata, deleteUserdata)
 		if err == nil {
 			deleteSuccess = true
 
 			if i > 0 {
 				r.Logger.Sugar().Info("DB metadata/userdata delete transaction for instance ", instanceID, " successful on retry attempt #", i)
 			}
-		} else {
+		} else if i < maxDeleteRetries {
 			// Exponential backoff would be overkill here, but adding a bit of jitter
 			// to sleep a short time is reasonable
 			jitter := time.Duration(rand.Int63n(int64(dbRetryInterval)))
+
+			if !upserter.RetryAllowed(ctx, jitter) {
+				r.Logger.Sugar().Warn("Retry budget exhausted for the metadata/userdata delete transaction for instance ", instanceID, " after ", i+1, " attempts")
+
+				break
+			}
+
 			time.Sleep(jitter)
 		}
 	}
 
 	if !deleteSuccess {
-		r.Logger.Sugar().Warn("Deletion operation for metadata/userdata failed for instance ", instanceID, " even after ", maxDeleteRetries, " attempts")
+		middleware.MetricDeletionRetriesExhausted.Inc()
 
-		dbErrorResponse(r.Logger, c, err)
+		r.Logger.Sugar().Warn("Deletion operation for metadata/userdata failed for instance ", instanceID, " even after ", maxDeleteRetries, " attempts")
 
-		return
+		return err
 	}
 
-	metadata, err = models.FindInstanceMetadatum(c.Request.Context(), r.DB, instanceID)
+	metadata, err = models.FindInstanceMetadatum(ctx, r.DB, instanceID)
 	// An ErrNoRows error is expected, so disregard it.
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		dbErrorResponse(r.Logger, c, err)
-		return
+		return err
 	}
 
-	userdata, err = models.FindInstanceUserdatum(c.Request.Context(), r.DB, instanceID)
+	userdata, err = models.FindInstanceUserdatum(ctx, r.DB, instanceID)
 	// An ErrNoRows error is expected, so disregard it.
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		dbErrorResponse(r.Logger, c, err)
-		return
+		return err
+	}
+
+	// The userdata variants were pushed with IP addresses too.
+	hasVariants, err := variants.Exists(ctx, r.DB, instanceID)
+	if err != nil {
+		return err
 	}
 
 	// Phase 2
-	if metadata == nil && userdata == nil {
+	if metadata == nil && userdata == nil && !hasVariants {
 		deleteSuccess = false
 		for i := 0; i <= maxDeleteRetries && !deleteSuccess; i++ {
-			err := performIPDeleteTX(c, r, instanceID)
+			err = performIPDeleteTX(ctx, r, instanceID)
 			if err == nil {
 				deleteSuccess = true
 
 				if i > 0 {
 					r.Logger.Sugar().Info("DB IP address delete transaction for instance ", instanceID, " successful on retry attempt #", i)
 				}
-			} else {
+			} else if i < maxDeleteRetries {
 				// Exponential backoff would be overkill here, but adding a bit of jitter
 				// to sleep a short time is reasonable
 				jitter := time.Duration(rand.Int63n(int64(dbRetryInterval)))
+
+				if !upserter.RetryAllowed(ctx, jitter) {
+					r.Logger.Sugar().Warn("Retry budget exhausted for the IP address delete transaction for instance ", instanceID, " after ", i+1, " attempts")
+
+					break
+				}
+
 				time.Sleep(jitter)
 			}
 		}
 	}
 
 	if !deleteSuccess {
-		r.Logger.Sugar().Warn("Deletion operation for IP addresses failed for instance ", instanceID, " even after ", maxDeleteRetries, " attempts")
+		middleware.MetricDeletionRetriesExhausted.Inc()
 
-		dbErrorResponse(r.Logger, c, err)
+		r.Logger.Sugar().Warn("Deletion operation for IP addresses failed for instance ", instanceID, " even after ", maxDeleteRetries, " attempts")
 
-		return
+		return err
 	}
 
 	middleware.MetricDeletionsCount.Inc()
 
-	c.Status(http.StatusOK)
+	return nil
 }
 
 // performDeleteTX handles creating and running the db transaction to delete metadata and/or userdata
-func performDeleteTX(c *gin.Context, r *Router, instanceID string, metadata *models.InstanceMetadatum, userdata *models.InstanceUserdatum, deleteMetadata bool, deleteUserdata bool) error {
+func performDeleteTX(ctx context.Context, r *Router, instanceID string, metadata *models.InstanceMetadatum, userdata *models.InstanceUserdatum, deleteMetadata bool, deleteUserdata bool) error {
 	txErr := false
 
-	cWithTimeout, cancel := context.WithTimeout(c, viper.GetDuration("crdb.tx_timeout"))
+	cWithTimeout, cancel := context.WithTimeout(ctx, viper.GetDuration("crdb.tx_timeout"))
 	defer cancel()
 
-	tx, err := r.DB.BeginTx(cWithTimeout, nil)
+	txOpts, err := upserter.TxOptions()
+	if err != nil {
+		return err
+	}
+
+	tx, err := r.DB.BeginTx(cWithTimeout, txOpts)
 	if err != nil {
 		r.Logger.Sugar().Warn("Something went wrong when running metadata/userdata DB.BeginTX() for instance: ", instanceID, err)
 
@@ -468,6 +1290,14 @@ func performDeleteTX(c *gin.Context, r *Router, instanceID string, metadata *mod
 
 			return err
 		}
+
+		if err := history.RecordMetadata(cWithTimeout, tx, instanceID, nil, r.now()); err != nil {
+			txErr = true
+
+			r.Logger.Sugar().Warn("Something went wrong when recording the metadata deletion in the history for instance: ", instanceID, "Error: ", err)
+
+			return err
+		}
 	}
 
 	if deleteUserdata && userdata != nil {
@@ -481,6 +1311,17 @@ func performDeleteTX(c *gin.Context, r *Router, instanceID string, metadata *mod
 		}
 	}
 
+	if deleteUserdata {
+		// The instance's userdata variants go along with its default userdata.
+		if _, err := variants.DeleteAll(cWithTimeout, tx, instanceID); err != nil {
+			txErr = true
+
+			r.Logger.Sugar().Warn("Something went wrong when deleting the userdata variants for instance: ", instanceID, "Error: ", err)
+
+			return err
+		}
+	}
+
 	// Commit our transaction
 	err = tx.Commit()
 	if err != nil {
@@ -491,17 +1332,30 @@ func performDeleteTX(c *gin.Context, r *Router, instanceID string, metadata *mod
 		return err
 	}
 
+	if deleteMetadata && metadata != nil {
+		middleware.MetricMetadataRecordDeletionsCount.Inc()
+	}
+
+	if deleteUserdata && userdata != nil {
+		middleware.MetricUserdataDeletionsCount.Inc()
+	}
+
 	return nil
 }
 
 // performIPDeleteTX handles creating and running the db transaction to delete instance ip addresses
-func performIPDeleteTX(c *gin.Context, r *Router, instanceID string) error {
+func performIPDeleteTX(ctx context.Context, r *Router, instanceID string) error {
 	txErr := false
 
-	cWithTimeout, cancel := context.WithTimeout(c, viper.GetDuration("crdb.tx_timeout"))
+	cWithTimeout, cancel := context.WithTimeout(ctx, viper.GetDuration("crdb.tx_timeout"))
 	defer cancel()
 
-	tx, err := r.DB.BeginTx(cWithTimeout, nil)
+	txOpts, err := upserter.TxOptions()
+	if err != nil {
+		return err
+	}
+
+	tx, err := r.DB.BeginTx(cWithTimeout, txOpts)
 	if err != nil {
 		r.Logger.Sugar().Warn("Something went wrong when running IP address DB.BeginTX() for instance: ", instanceID, err)
 
@@ -521,7 +1375,7 @@ func performIPDeleteTX(c *gin.Context, r *Router, instanceID string) error {
 	}()
 
 	// Delete the instance_ip_addresses rows for this instance
-	_, err = models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).DeleteAll(cWithTimeout, tx)
+	deletedIPs, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).DeleteAll(cWithTimeout, tx)
 	if err != nil {
 		txErr = true
 
@@ -540,5 +1394,8 @@ func performIPDeleteTX(c *gin.Context, r *Router, instanceID string) error {
 		return err
 	}
 
+	middleware.MetricIPAddressDeletionsCount.Add(float64(deletedIPs))
+	middleware.InstanceIPCache().Invalidate(instanceID)
+
 	return nil
 }
@@ -0,0 +1,62 @@
+package metadataservice
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/volatiletech/sqlboiler/v4/queries/qm"
+	"github.com/volatiletech/sqlboiler/v4/types"
+
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+// FullMetadataResponse contains the metadata stored for an instance, along
+// with the IP addresses actually associated to it in the
+// instance_ip_addresses table. The two can diverge, for example when the
+// metadata's network.addresses weren't all included in the request's
+// ipAddresses.
+type FullMetadataResponse struct {
+	ID          string     `json:"id"`
+	Metadata    types.JSON `json:"metadata"`
+	IPAddresses []string   `json:"ipAddresses"`
+}
+
+// instanceMetadataFullGetInternal returns the stored metadata for an instance
+// as-is, without any template fields, along with the instance's IP address
+// associations, so operators can compare the advertised and the
+// authoritative addresses.
+func (r *Router) instanceMetadataFullGetInternal(c *gin.Context) {
+	instanceID, err := getUUIDParam(c, "instance-id")
+	if err != nil {
+		invalidUUIDResponse(c, err)
+		return
+	}
+
+	metadata, err := findInstanceMetadata(c.Request.Context(), r.DB, instanceID)
+	if err != nil {
+		r.dbErrorResponse(c, err)
+		return
+	}
+
+	instanceIPs, err := models.InstanceIPAddresses(
+		models.InstanceIPAddressWhere.InstanceID.EQ(instanceID),
+		qm.OrderBy(models.InstanceIPAddressColumns.Address),
+	).All(c.Request.Context(), r.DB)
+	if err != nil {
+		r.dbErrorResponse(c, err)
+		return
+	}
+
+	resp := FullMetadataResponse{
+		ID:          metadata.ID,
+		Metadata:    metadata.Metadata,
+		IPAddresses: make([]string, 0, len(instanceIPs)),
+	}
+
+	for _, instanceIP := range instanceIPs {
+		resp.IPAddresses = append(resp.IPAddresses, instanceIP.Address)
+	}
+
+	setTimestampHeaders(c, metadata.CreatedAt, metadata.UpdatedAt)
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,51 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestGetMetadataFull(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalMetadataFullPath(dbtools.FixtureInstanceA.InstanceID), nil)
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := v1api.FullMetadataResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+	assert.Equal(t, dbtools.FixtureInstanceA.InstanceID, resp.ID)
+	assert.JSONEq(t, dbtools.FixtureInstanceA.InstanceMetadata.Metadata.String(), resp.Metadata.String())
+
+	// Instance A is associated to 139.178.82.3, 2604:1380:4641:1f00::9/127,
+	// and 10.70.17.8/31.
+	assert.Len(t, resp.IPAddresses, 3)
+	assert.Contains(t, resp.IPAddresses, "139.178.82.3")
+}
+
+func TestGetMetadataFullNotFound(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	// Instance E has IP addresses and userdata, but no metadata.
+	for _, instanceID := range []string{dbtools.FixtureInstanceE.InstanceID, "not-a-uuid"} {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalMetadataFullPath(instanceID), nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code, instanceID)
+	}
+}
@@ -0,0 +1,68 @@
+package metadataservice
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/volatiletech/sqlboiler/v4/queries/qm"
+
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+// InstanceListResponse contains a page of the IDs of the instances with
+// stored metadata. NextCursor is passed as the "cursor" query parameter to
+// get the next page, and is empty on the last one.
+type InstanceListResponse struct {
+	Instances  []string `json:"instances"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+// instanceMetadataListInternal returns the IDs of all the instances with
+// stored metadata, ordered by ID, so that operators can see which instances
+// are cached locally. Results are paginated with the "limit" and "cursor"
+// query parameters, where the cursor is the last ID of the previous page, so
+// that pages stay consistent while instances are added or removed.
+func (r *Router) instanceMetadataListInternal(c *gin.Context) {
+	limit, err := getLimitParam(c)
+	if err != nil {
+		badRequestResponse(c, "invalid pagination parameters", err)
+		return
+	}
+
+	mods := []qm.QueryMod{
+		qm.Select(models.InstanceMetadatumColumns.ID),
+		qm.OrderBy(models.InstanceMetadatumColumns.ID),
+		// One more row than the limit is loaded to know whether there's a
+		// next page.
+		qm.Limit(limit + 1),
+	}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		if _, err := uuid.Parse(cursor); err != nil {
+			badRequestResponse(c, "invalid pagination parameters", ErrInvalidCursor)
+			return
+		}
+
+		mods = append(mods, qm.Where(models.InstanceMetadatumColumns.ID+" > ?", cursor))
+	}
+
+	rows, err := models.InstanceMetadata(mods...).All(c.Request.Context(), r.DB)
+	if err != nil {
+		r.dbErrorResponse(c, err)
+		return
+	}
+
+	resp := InstanceListResponse{Instances: make([]string, 0, min(len(rows), limit))}
+
+	for i, row := range rows {
+		if i == limit {
+			resp.NextCursor = resp.Instances[limit-1]
+			break
+		}
+
+		resp.Instances = append(resp.Instances, row.ID)
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,118 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/volatiletech/sqlboiler/v4/queries/qm"
+	"go.hollow.sh/toolbox/ginjwt"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/models"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func listInstancesRequest(t *testing.T, router http.Handler, query url.Values) v1api.InstanceListResponse {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalMetadataPath()+"?"+query.Encode(), nil)
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := v1api.InstanceListResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+	return resp
+}
+
+func TestListMetadataInternal(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	rows, err := models.InstanceMetadata(qm.OrderBy(models.InstanceMetadatumColumns.ID)).All(context.TODO(), dbtools.TestDB())
+	require.NoError(t, err)
+
+	var allIDs []string
+
+	for _, row := range rows {
+		allIDs = append(allIDs, row.ID)
+	}
+
+	// The fixtures have fewer instances than the default limit.
+	require.Greater(t, len(allIDs), 3)
+
+	t.Run("default limit", func(t *testing.T) {
+		resp := listInstancesRequest(t, router, url.Values{})
+
+		assert.Equal(t, allIDs, resp.Instances)
+		assert.Empty(t, resp.NextCursor)
+	})
+
+	t.Run("explicit limit", func(t *testing.T) {
+		resp := listInstancesRequest(t, router, url.Values{"limit": {"2"}})
+
+		assert.Equal(t, allIDs[:2], resp.Instances)
+		assert.Equal(t, allIDs[1], resp.NextCursor)
+	})
+
+	t.Run("cursor continuation", func(t *testing.T) {
+		var (
+			listed []string
+			pages  int
+			cursor string
+		)
+
+		for {
+			query := url.Values{"limit": {"3"}}
+			if cursor != "" {
+				query.Set("cursor", cursor)
+			}
+
+			resp := listInstancesRequest(t, router, query)
+
+			listed = append(listed, resp.Instances...)
+			pages++
+
+			if resp.NextCursor == "" {
+				break
+			}
+
+			cursor = resp.NextCursor
+		}
+
+		assert.Equal(t, allIDs, listed)
+		assert.Equal(t, (len(allIDs)+2)/3, pages)
+	})
+
+	t.Run("cursor past the last instance", func(t *testing.T) {
+		resp := listInstancesRequest(t, router, url.Values{"cursor": {allIDs[len(allIDs)-1]}})
+
+		assert.Empty(t, resp.Instances)
+		assert.Empty(t, resp.NextCursor)
+	})
+}
+
+func TestListMetadataInternalBadRequest(t *testing.T) {
+	authMW, err := ginjwt.NewAuthMiddleware(ginjwt.AuthConfig{})
+	require.NoError(t, err)
+
+	router := testRouter(v1api.NewRouter(zap.NewNop(), nil, authMW, nil))
+
+	for _, query := range []string{"?limit=0", "?limit=abc", "?cursor=not-a-uuid"} {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalMetadataPath()+query, nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
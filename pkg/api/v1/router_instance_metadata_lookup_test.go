@@ -5,12 +5,14 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"testing"
 	"time"
 
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 
+	"go.hollow.sh/metadataservice/internal/dbtools"
 	"go.hollow.sh/metadataservice/internal/lookup"
 	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
 )
@@ -77,3 +79,171 @@ func TestGetMetadataLookupByIP(t *testing.T) {
 		})
 	}
 }
+
+// TestGetLookupSkipCIDRs tests that requests from IPs within the lookup skip
+// CIDRs get a 404 without calling the lookup service.
+func TestGetLookupSkipCIDRs(t *testing.T) {
+	lookupClient := newMockLookupClient()
+	serverConfig := TestServerConfig{
+		LookupEnabled: true,
+		LookupClient:  lookupClient,
+		LookupSkipCIDRs: []netip.Prefix{
+			netip.MustParsePrefix("10.250.0.0/16"),
+			netip.MustParsePrefix("fd00::/8"),
+		},
+	}
+	router := *testHTTPServerWithConfig(t, serverConfig)
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	validResponse := lookupResponse{
+		metadataResponse: lookup.MetadataLookupResponse{
+			ID:          "4d3c2b1a-9e8f-4a7b-8c6d-5e4f3a2b1c0d",
+			IPAddresses: []string{"10.251.1.1"},
+			Metadata:    `{"some":"metadata"}`,
+		},
+		userdataResponse: lookup.UserdataLookupResponse{
+			ID:          "4d3c2b1a-9e8f-4a7b-8c6d-5e4f3a2b1c0d",
+			IPAddresses: []string{"10.251.1.1"},
+			Userdata:    []byte("#cloud-config"),
+		},
+	}
+
+	// Once the metadata is stored, the userdata is looked up by instance ID
+	lookupClient.setResponse(validResponse.metadataResponse.ID, validResponse)
+
+	type testCase struct {
+		testName       string
+		instanceIP     string
+		expectedStatus int
+		expectedCalls  int
+	}
+
+	testCases := []testCase{
+		{
+			"IPv4 address in a skipped range",
+			"10.250.1.1",
+			http.StatusNotFound,
+			0,
+		},
+		{
+			"IPv6 address in a skipped range",
+			"fd00::1",
+			http.StatusNotFound,
+			0,
+		},
+		{
+			"address outside the skipped ranges",
+			"10.251.1.1",
+			http.StatusOK,
+			1,
+		},
+	}
+
+	for _, testcase := range testCases {
+		for _, path := range []string{v1api.GetMetadataPath(), v1api.GetUserdataPath()} {
+			t.Run(testcase.testName+" "+path, func(t *testing.T) {
+				lookupClient.calls = 0
+				lookupClient.setResponse(testcase.instanceIP, validResponse)
+
+				w := httptest.NewRecorder()
+
+				req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+				req.RemoteAddr = net.JoinHostPort(testcase.instanceIP, "")
+				router.ServeHTTP(w, req)
+
+				assert.Equal(t, testcase.expectedStatus, w.Code)
+				assert.Equal(t, testcase.expectedCalls, lookupClient.calls)
+			})
+		}
+	}
+}
+
+// TestGetMetadataLookupByIDForwardsClientIP tests that a lookup by instance ID
+// triggered by a request from a known IP address carries the requesting IP
+// address to the lookup client.
+func TestGetMetadataLookupByIDForwardsClientIP(t *testing.T) {
+	lookupClient := newMockLookupClient()
+	serverConfig := TestServerConfig{LookupEnabled: true, LookupClient: lookupClient}
+	router := *testHTTPServerWithConfig(t, serverConfig)
+
+	// Instance E has userdata but no metadata, so its metadata is looked up
+	// by its instance ID.
+	instanceIP := dbtools.FixtureInstanceE.HostIPs[0]
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataPath(), nil)
+	req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, 1, lookupClient.calls)
+	assert.Equal(t, instanceIP, lookupClient.byIDClientIP)
+}
+
+// TestGetMetadataCacheTTL tests that stored metadata older than the cache TTL
+// is refreshed from the lookup service, and that the stored copy is still
+// served when the refresh fails.
+func TestGetMetadataCacheTTL(t *testing.T) {
+	lookupClient := newMockLookupClient()
+	serverConfig := TestServerConfig{LookupEnabled: true, LookupClient: lookupClient}
+	router := *testHTTPServerWithConfig(t, serverConfig)
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	defer viper.Set("cache_ttl", 0)
+
+	refreshed := lookupResponse{
+		metadataResponse: lookup.MetadataLookupResponse{
+			ID:          dbtools.FixtureInstanceA.InstanceID,
+			IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+			Metadata:    `{"hostname":"refreshed-hostname"}`,
+		},
+	}
+
+	type testCase struct {
+		testName          string
+		ttl               time.Duration
+		lookupResponse    lookupResponse
+		expectedCalls     int
+		expectedRefreshed bool
+	}
+
+	// The cases run in order against the same DB, so the fixture's metadata
+	// is only replaced once a refresh succeeds.
+	testCases := []testCase{
+		{"zero TTL never expires", 0, refreshed, 0, false},
+		{"unexpired metadata", time.Hour, refreshed, 0, false},
+		{"failed refresh serves the stored copy", -1, lookupResponse{Error: lookup.ErrUnexpectedStatus}, 1, false},
+		{"expired metadata is refreshed", time.Nanosecond, refreshed, 1, true},
+		{"negative TTL always refreshes", -1, refreshed, 1, true},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			viper.Set("cache_ttl", testcase.ttl)
+			lookupClient.setResponse(dbtools.FixtureInstanceA.InstanceID, testcase.lookupResponse)
+			lookupClient.calls = 0
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataPath(), nil)
+			req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, testcase.expectedCalls, lookupClient.calls)
+
+			if testcase.expectedRefreshed {
+				assert.Contains(t, w.Body.String(), "refreshed-hostname")
+			} else {
+				assert.NotContains(t, w.Body.String(), "refreshed-hostname")
+			}
+		})
+	}
+}
@@ -8,15 +8,29 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
 	"text/template"
 	"time"
 
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.hollow.sh/toolbox/ginjwt"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
 
+	"go.hollow.sh/metadataservice/internal/audit"
 	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/fieldcrypt"
+	"go.hollow.sh/metadataservice/internal/middleware"
 	"go.hollow.sh/metadataservice/internal/models"
 	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
 )
@@ -187,6 +201,149 @@ func TestGetMetadataByIPWithTemplateFields(t *testing.T) {
 	assert.Equal(t, "just some static text", resultMap["static_text"])
 }
 
+// TestGetMetadataWithFieldRenames tests that configured field renames are
+// applied to the JSON metadata responses, but not to the EC2 endpoints.
+func TestGetMetadataWithFieldRenames(t *testing.T) {
+	config := TestServerConfig{
+		FieldRenames: map[string]string{
+			"id":       "instance_id",
+			"ssh_keys": "ssh-keys",
+			"missing":  "still_missing",
+		},
+	}
+
+	router := *testHTTPServerWithConfig(t, config)
+
+	paths := []string{
+		v1api.GetMetadataPath(),
+		v1api.GetInternalMetadataByIDPath(dbtools.FixtureInstanceA.InstanceID),
+	}
+
+	for _, path := range paths {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+		req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var resultMap map[string]interface{}
+
+		if err := json.Unmarshal(w.Body.Bytes(), &resultMap); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, dbtools.FixtureInstanceA.InstanceID, resultMap["instance_id"])
+		assert.NotContains(t, resultMap, "id")
+		assert.Contains(t, resultMap, "ssh-keys")
+		assert.NotContains(t, resultMap, "ssh_keys")
+		assert.NotContains(t, resultMap, "still_missing")
+		assert.Equal(t, "instance-a", resultMap["hostname"])
+	}
+
+	// The EC2 endpoints still read the stored field names
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetEc2MetadataItemPath("instance-id"), nil)
+	req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, dbtools.FixtureInstanceA.InstanceID, w.Body.String())
+}
+
+// TestGetMetadataYAML tests that metadata requested as YAML, either with the
+// format query parameter or an Accept header, matches the JSON response.
+func TestGetMetadataYAML(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	instanceIP := dbtools.FixtureInstanceA.HostIPs[0]
+
+	getMetadata := func(path, accept string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+		req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		router.ServeHTTP(w, req)
+
+		return w
+	}
+
+	jsonResp := getMetadata(v1api.GetMetadataPath(), "")
+	assert.Equal(t, http.StatusOK, jsonResp.Code)
+
+	var expected map[string]interface{}
+	if err := json.Unmarshal(jsonResp.Body.Bytes(), &expected); err != nil {
+		t.Fatal(err)
+	}
+
+	type testCase struct {
+		testName string
+		path     string
+		accept   string
+	}
+
+	testCases := []testCase{
+		{
+			"format query parameter",
+			v1api.GetMetadataPath() + "?format=yaml",
+			"",
+		},
+		{
+			"accept header",
+			v1api.GetMetadataPath(),
+			"application/yaml",
+		},
+		{
+			"legacy accept header",
+			v1api.GetMetadataPath(),
+			"application/x-yaml",
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := getMetadata(testcase.path, testcase.accept)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, v1api.YAMLContentType, w.Header().Get("Content-Type"))
+
+			// Round-trip the YAML through JSON, so numbers are compared the same
+			// way on both sides.
+			var decoded map[string]interface{}
+			if err := yaml.Unmarshal(w.Body.Bytes(), &decoded); err != nil {
+				t.Fatal(err)
+			}
+
+			asJSON, err := json.Marshal(decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var result map[string]interface{}
+			if err := json.Unmarshal(asJSON, &result); err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, expected, result)
+
+			// The output is deterministic
+			assert.Equal(t, w.Body.String(), getMetadata(testcase.path, testcase.accept).Body.String())
+		})
+	}
+
+	// An explicit format takes precedence over the Accept header
+	w := getMetadata(v1api.GetMetadataPath()+"?format=json", "application/yaml")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, jsonResp.Body.String(), w.Body.String())
+}
+
 func TestGetMetadataByIPWithErrorTemplate(t *testing.T) {
 	// Test that if an error occurs attempting to produce output for a template
 	// field, we just return the original metadata.
@@ -224,88 +381,1396 @@ func TestGetMetadataByIPWithErrorTemplate(t *testing.T) {
 	assert.Nil(t, v)
 }
 
-// TestSetMetadataRequestValidations tests the different validations performed
-// on the request body
-func TestSetMetadataRequestValidations(t *testing.T) {
-	router := *testHTTPServer(t)
+func TestRenderTemplateField(t *testing.T) {
+	metadata := []byte(`{"id": "abc123", "hostname": "instance-a"}`)
 
 	type testCase struct {
-		testName       string
-		requestBody    *v1api.UpsertMetadataRequest
-		expectedStatus int
-		expectedBody   *regexp.Regexp
+		testName      string
+		template      string
+		expected      string
+		expectedError bool
+	}
+
+	testCases := []testCase{
+		{"renders metadata fields", "https://api.example.com/{{ .id }}/{{ .hostname }}", "https://api.example.com/abc123/instance-a", false},
+		{"missing key with the default option", "{{ .spot }}", "<no value>", false},
+		{"execution failure", "{{ index .id 10 }}", "", true},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			tmpl := template.Must(template.New("test").Parse(testcase.template))
+
+			rendered, err := v1api.RenderTemplateField(tmpl, metadata)
+			if testcase.expectedError {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, testcase.expected, rendered)
+		})
+	}
+
+	t.Run("missing key with missingkey=error", func(t *testing.T) {
+		tmpl := template.Must(template.New("test").Option("missingkey=error").Parse("{{ .spot }}"))
+
+		_, err := v1api.RenderTemplateField(tmpl, metadata)
+		assert.Error(t, err)
+	})
+
+	t.Run("metadata which isn't a JSON object", func(t *testing.T) {
+		tmpl := template.Must(template.New("test").Parse("{{ .id }}"))
+
+		_, err := v1api.RenderTemplateField(tmpl, []byte(`["abc123"]`))
+		assert.Error(t, err)
+	})
+}
+
+// TestGetMetadataTemplateFieldConditions tests that template fields with a
+// condition are only added for instances whose metadata meets it.
+func TestGetMetadataTemplateFieldConditions(t *testing.T) {
+	spotURLTmpl, err := template.New("spotURL").Parse("https://spot.example.com/{{.id}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostURLTmpl, err := template.New("hostURL").Parse("https://{{.hostname}}.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spotCondition, err := template.New("spotURLCondition").Parse("{{ if .spot }}true{{ end }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostCondition, err := template.New("hostURLCondition").Parse(`{{ eq .hostname "instance-a" }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := *testHTTPServerWithConfig(t, TestServerConfig{
+		TemplateFields: map[string]template.Template{
+			"spot_url": *spotURLTmpl,
+			"host_url": *hostURLTmpl,
+		},
+		TemplateFieldConditions: map[string]template.Template{
+			"spot_url": *spotCondition,
+			"host_url": *hostCondition,
+		},
+	})
+
+	type testCase struct {
+		testName        string
+		instanceIP      string
+		expectedSpotURL interface{}
+		expectedHostURL interface{}
+		expectSpotURL   bool
+		expectHostURL   bool
 	}
 
 	testCases := []testCase{
 		{
-			"empty instance ID",
-			&v1api.UpsertMetadataRequest{
-				ID:          "",
-				Metadata:    `{"some": "json"}`,
-				IPAddresses: []string{"1.2.3.4", "10.1.0.0/25", "fe80:aede:48ff:fe00::1122"},
-			},
-			http.StatusBadRequest,
-			regexp.MustCompile(`.*id.*required`),
+			"Instance A",
+			dbtools.FixtureInstanceA.HostIPs[0],
+			nil,
+			"https://instance-a.example.com",
+			false,
+			true,
 		},
 		{
-			"non-uuid instance ID",
-			&v1api.UpsertMetadataRequest{
-				ID:          "abc123",
-				Metadata:    `{"some": "json"}`,
-				IPAddresses: []string{"1.2.3.4", "10.1.0.0/25", "fe80:aede:48ff:fe00::1122"},
-			},
-			http.StatusBadRequest,
-			regexp.MustCompile(`.*id.*uuid`),
+			"Instance A2",
+			dbtools.FixtureInstanceA2.HostIPs[0],
+			"https://spot.example.com/" + dbtools.FixtureInstanceA2.InstanceID,
+			nil,
+			true,
+			false,
 		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataPath(), nil)
+			req.RemoteAddr = net.JoinHostPort(testcase.instanceIP, "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			var resultMap map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &resultMap); err != nil {
+				t.Fatal(err)
+			}
+
+			spotURL, ok := resultMap["spot_url"]
+			assert.Equal(t, testcase.expectSpotURL, ok)
+			assert.Equal(t, testcase.expectedSpotURL, spotURL)
+
+			hostURL, ok := resultMap["host_url"]
+			assert.Equal(t, testcase.expectHostURL, ok)
+			assert.Equal(t, testcase.expectedHostURL, hostURL)
+		})
+	}
+}
+
+// TestGetMetadataTemplateMissingKeyMode tests how template fields referencing a
+// missing metadata key are rendered in each missing key mode.
+func TestGetMetadataTemplateMissingKeyMode(t *testing.T) {
+	missingFieldTmpl, err := template.New("missingField").Option("missingkey=error").Parse("oh look it's {{.missingField}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherMissingFieldTmpl, err := template.New("otherMissingField").Option("missingkey=error").Parse("{{.otherMissingField}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostnameTmpl, err := template.New("hostname").Option("missingkey=error").Parse("https://{{.hostname}}.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type testCase struct {
+		testName              string
+		mode                  string
+		defaults              map[string]string
+		defaultValue          string
+		expectedHostURL       interface{}
+		expectedMissing       interface{}
+		expectedOtherMissing  interface{}
+		expectMissingIncluded bool
+	}
+
+	testCases := []testCase{
 		{
-			"empty instance ID and empty metadata",
-			&v1api.UpsertMetadataRequest{
-				ID:          "",
-				Metadata:    "",
-				IPAddresses: []string{"1.2.3.4", "10.1.0.0/25", "fe80:aede:48ff:fe00::1122"},
-			},
-			http.StatusBadRequest,
-			regexp.MustCompile(`.*id.*required.*metadata.*required`),
+			"unset mode serves the metadata without template fields",
+			"",
+			nil,
+			"",
+			nil,
+			nil,
+			nil,
+			false,
 		},
 		{
-			"invalid IPv4 address",
-			&v1api.UpsertMetadataRequest{
-				ID:          "b9b24320-304e-4bfb-b46a-db75901c2f46",
-				Metadata:    `{"some": "json"}`,
-				IPAddresses: []string{"a.b.c.d"},
-			},
-			http.StatusBadRequest,
-			regexp.MustCompile(`.*ipAddresses\[0\].*ip_addr|cidr`),
+			"drop",
+			v1api.TemplateMissingKeyDrop,
+			nil,
+			"",
+			"https://instance-a.example.com",
+			nil,
+			nil,
+			false,
 		},
 		{
-			"invalid IPv6 address",
-			&v1api.UpsertMetadataRequest{
-				ID:          "02d91622-b1e8-41b4-9add-ce77ac619b89",
-				Metadata:    `{"some": "json"}`,
-				IPAddresses: []string{"a:b:c:d:e:f:g:h"},
-			},
+			"empty",
+			v1api.TemplateMissingKeyEmpty,
+			nil,
+			"",
+			"https://instance-a.example.com",
+			"",
+			"",
+			true,
+		},
+		{
+			"default with global and per-field values",
+			v1api.TemplateMissingKeyDefault,
+			map[string]string{"missing_field": "per-field default"},
+			"global default",
+			"https://instance-a.example.com",
+			"per-field default",
+			"global default",
+			true,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			config := TestServerConfig{
+				TemplateFields: map[string]template.Template{
+					"missing_field":       *missingFieldTmpl,
+					"other_missing_field": *otherMissingFieldTmpl,
+					"host_url":            *hostnameTmpl,
+				},
+				TemplateMissingKeyMode:         testcase.mode,
+				TemplateMissingKeyDefaults:     testcase.defaults,
+				TemplateMissingKeyDefaultValue: testcase.defaultValue,
+			}
+
+			router := *testHTTPServerWithConfig(t, config)
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataPath(), nil)
+			req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			var resultMap map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &resultMap); err != nil {
+				t.Fatal(err)
+			}
+
+			// Templates without missing keys are still rendered, unless the
+			// missing keys aren't handled at all
+			assert.Equal(t, testcase.expectedHostURL, resultMap["host_url"])
+
+			missing, ok := resultMap["missing_field"]
+			assert.Equal(t, testcase.expectMissingIncluded, ok)
+			assert.Equal(t, testcase.expectedMissing, missing)
+
+			otherMissing, ok := resultMap["other_missing_field"]
+			assert.Equal(t, testcase.expectMissingIncluded, ok)
+			assert.Equal(t, testcase.expectedOtherMissing, otherMissing)
+		})
+	}
+}
+
+// TestGetNotFoundRetryAfter tests that the public endpoints include a
+// Retry-After header on 404 responses only when configured to do so.
+func TestGetNotFoundRetryAfter(t *testing.T) {
+	type testCase struct {
+		testName           string
+		path               string
+		notFoundRetryAfter time.Duration
+		expectedHeader     string
+	}
+
+	testCases := []testCase{
+		{
+			"metadata without retry-after",
+			v1api.GetMetadataPath(),
+			0,
+			"",
+		},
+		{
+			"metadata with retry-after",
+			v1api.GetMetadataPath(),
+			5 * time.Second,
+			"5",
+		},
+		{
+			"userdata with retry-after rounded up",
+			v1api.GetUserdataPath(),
+			1500 * time.Millisecond,
+			"2",
+		},
+		{
+			"ec2 metadata with retry-after",
+			v1api.GetEc2MetadataPath(),
+			10 * time.Second,
+			"10",
+		},
+		{
+			"ec2 userdata with retry-after",
+			v1api.GetEc2UserdataPath(),
+			10 * time.Second,
+			"10",
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			router := *testHTTPServerWithConfig(t, TestServerConfig{NotFoundRetryAfter: testcase.notFoundRetryAfter})
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, testcase.path, nil)
+			req.RemoteAddr = net.JoinHostPort("1.2.3.4", "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusNotFound, w.Code)
+			assert.Equal(t, testcase.expectedHeader, w.Header().Get("Retry-After"))
+		})
+	}
+}
+
+// TestGetInstanceIDHeader tests that successful responses from the public
+// endpoints include the resolved instance ID, and that 404s don't.
+func TestGetInstanceIDHeader(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	type testCase struct {
+		testName       string
+		path           string
+		instanceIP     string
+		expectedStatus int
+		expectedHeader string
+	}
+
+	testCases := []testCase{
+		{
+			"metadata for unknown IP",
+			v1api.GetMetadataPath(),
+			"1.2.3.4",
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"metadata for Instance A",
+			v1api.GetMetadataPath(),
+			dbtools.FixtureInstanceA.HostIPs[0],
+			http.StatusOK,
+			dbtools.FixtureInstanceA.InstanceID,
+		},
+		{
+			"userdata for unknown IP",
+			v1api.GetUserdataPath(),
+			"1.2.3.4",
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"userdata for Instance A",
+			v1api.GetUserdataPath(),
+			dbtools.FixtureInstanceA.HostIPs[0],
+			http.StatusOK,
+			dbtools.FixtureInstanceA.InstanceID,
+		},
+		{
+			"userdata for Instance B, which has no userdata",
+			v1api.GetUserdataPath(),
+			dbtools.FixtureInstanceB.HostIPs[0],
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"ec2 metadata for Instance A",
+			v1api.GetEc2MetadataPath(),
+			dbtools.FixtureInstanceA.HostIPs[0],
+			http.StatusOK,
+			dbtools.FixtureInstanceA.InstanceID,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, testcase.path, nil)
+			req.RemoteAddr = net.JoinHostPort(testcase.instanceIP, "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+			assert.Equal(t, testcase.expectedHeader, w.Header().Get(v1api.InstanceIDHeader))
+		})
+	}
+}
+
+// TestGetIPMatchTypeHeader tests that the public endpoints report whether the
+// request IP matched one of the instance's addresses exactly, or was within
+// one of its CIDRs.
+func TestGetIPMatchTypeHeader(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	type testCase struct {
+		testName          string
+		path              string
+		instanceIP        string
+		expectedMatchType string
+	}
+
+	// Instance A is associated to 139.178.82.3 itself, and to the
+	// 10.70.17.8/31 CIDR.
+	testCases := []testCase{
+		{
+			"metadata for an exact IP",
+			v1api.GetMetadataPath(),
+			"139.178.82.3",
+			middleware.IPMatchTypeExact,
+		},
+		{
+			"metadata for an IP within a CIDR",
+			v1api.GetMetadataPath(),
+			"10.70.17.9",
+			middleware.IPMatchTypeCIDR,
+		},
+		{
+			"userdata for an IP within a CIDR",
+			v1api.GetUserdataPath(),
+			"10.70.17.8",
+			middleware.IPMatchTypeCIDR,
+		},
+		{
+			"ec2 metadata for an exact IP",
+			v1api.GetEc2MetadataPath(),
+			"139.178.82.3",
+			middleware.IPMatchTypeExact,
+		},
+		{
+			"metadata for unknown IP",
+			v1api.GetMetadataPath(),
+			"1.2.3.4",
+			"",
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, testcase.path, nil)
+			req.RemoteAddr = net.JoinHostPort(testcase.instanceIP, "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedMatchType, w.Header().Get(middleware.IPMatchTypeHeader))
+		})
+	}
+}
+
+// TestGetEmptyMetadata tests that metadata stored as an empty JSON object is
+// served as a 200 with `{}` by default, or as a 404 from both the public and
+// internal endpoints when configured to.
+func TestGetEmptyMetadata(t *testing.T) {
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	instanceID := "5d2a8a0e-6a4f-4a8e-9c55-2f5b0a6e8c31"
+	instanceIP := "10.20.30.40"
+
+	type testCase struct {
+		testName              string
+		emptyMetadataNotFound bool
+		expectedStatus        int
+	}
+
+	testCases := []testCase{
+		{
+			"empty metadata served as-is",
+			false,
+			http.StatusOK,
+		},
+		{
+			"empty metadata served as not found",
+			true,
+			http.StatusNotFound,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			router := *testHTTPServerWithConfig(t, TestServerConfig{EmptyMetadataNotFound: testcase.emptyMetadataNotFound})
+
+			reqBody, err := json.Marshal(&v1api.UpsertMetadataRequest{
+				ID:          instanceID,
+				Metadata:    json.RawMessage(`{}`),
+				IPAddresses: []string{instanceIP},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
+			router.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusCreated, w.Code)
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataPath(), nil)
+			req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+			router.ServeHTTP(w, req)
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalMetadataByIDPath(instanceID), nil)
+			router.ServeHTTP(w, req)
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+
+			if testcase.expectedStatus == http.StatusOK {
+				assert.JSONEq(t, `{}`, w.Body.String())
+			}
+		})
+	}
+}
+
+// TestGetNotFoundMessage tests that 404s for instances without data carry a
+// different (and configurable) message than 404s for unknown routes.
+func TestGetNotFoundMessage(t *testing.T) {
+	type testCase struct {
+		testName        string
+		notFoundMessage string
+		path            string
+		expectedBody    string
+	}
+
+	testCases := []testCase{
+		{
+			"unknown route",
+			"",
+			"/no-such-route",
+			`{"message":"invalid request - route not found"}`,
+		},
+		{
+			"metadata with default message",
+			"",
+			v1api.GetMetadataPath(),
+			`{"message":"no data for requesting address"}`,
+		},
+		{
+			"userdata with default message",
+			"",
+			v1api.GetUserdataPath(),
+			`{"message":"no data for requesting address"}`,
+		},
+		{
+			"metadata with custom message",
+			"no metadata for requesting address",
+			v1api.GetMetadataPath(),
+			`{"message":"no metadata for requesting address"}`,
+		},
+		{
+			"ec2 metadata with custom message",
+			"no metadata for requesting address",
+			v1api.GetEc2MetadataPath(),
+			`{"message":"no metadata for requesting address"}`,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			router := *testHTTPServerWithConfig(t, TestServerConfig{NotFoundMessage: testcase.notFoundMessage})
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, testcase.path, nil)
+			req.RemoteAddr = net.JoinHostPort("1.2.3.4", "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusNotFound, w.Code)
+			assert.JSONEq(t, testcase.expectedBody, w.Body.String())
+		})
+	}
+}
+
+// TestGetMetadataDebugFields tests that the "_debug" object is only added to
+// /metadata responses when enabled, and never shows up on the EC2 endpoints.
+func TestGetMetadataDebugFields(t *testing.T) {
+	type testCase struct {
+		testName           string
+		includeDebugFields bool
+	}
+
+	testCases := []testCase{
+		{"debug fields disabled", false},
+		{"debug fields enabled", true},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			router := *testHTTPServerWithConfig(t, TestServerConfig{IncludeDebugFields: testcase.includeDebugFields})
+			instanceIP := dbtools.FixtureInstanceA.HostIPs[0]
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataPath(), nil)
+			req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			var resp map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			debugFields, ok := resp["_debug"]
+			assert.Equal(t, testcase.includeDebugFields, ok)
+
+			if testcase.includeDebugFields {
+				assert.Equal(t, map[string]interface{}{"request_ip": instanceIP, "source": "db"}, debugFields)
+			}
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetEc2MetadataPath(), nil)
+			req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.NotContains(t, w.Body.String(), "_debug")
+		})
+	}
+}
+
+// TestGetMetadataUnresolvedClientIP tests that requests without a resolvable
+// client IP get the configured status.
+func TestGetMetadataUnresolvedClientIP(t *testing.T) {
+	type testCase struct {
+		testName       string
+		status         int
+		path           string
+		expectedStatus int
+	}
+
+	testCases := []testCase{
+		{
+			"default status",
+			0,
+			v1api.GetMetadataPath(),
+			http.StatusNotFound,
+		},
+		{
+			"bad request status",
+			http.StatusBadRequest,
+			v1api.GetMetadataPath(),
+			http.StatusBadRequest,
+		},
+		{
+			"bad request status, userdata",
+			http.StatusBadRequest,
+			v1api.GetUserdataPath(),
+			http.StatusBadRequest,
+		},
+		{
+			"bad request status, ec2",
+			http.StatusBadRequest,
+			v1api.GetEc2MetadataPath(),
+			http.StatusBadRequest,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			router := *testHTTPServerWithConfig(t, TestServerConfig{UnresolvedClientIPStatus: testcase.status})
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, testcase.path, nil)
+			req.RemoteAddr = ""
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+		})
+	}
+}
+
+// TestSetMetadataRequestValidations tests the different validations performed
+// on the request body
+func TestSetMetadataRequestValidations(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	type testCase struct {
+		testName       string
+		requestBody    *v1api.UpsertMetadataRequest
+		expectedStatus int
+		expectedBody   *regexp.Regexp
+	}
+
+	testCases := []testCase{
+		{
+			"empty instance ID",
+			&v1api.UpsertMetadataRequest{
+				ID:          "",
+				Metadata:    json.RawMessage(`{"some": "json"}`),
+				IPAddresses: []string{"1.2.3.4", "10.1.0.0/25", "fe80:aede:48ff:fe00::1122"},
+			},
+			http.StatusBadRequest,
+			regexp.MustCompile(`.*id.*required`),
+		},
+		{
+			"non-uuid instance ID",
+			&v1api.UpsertMetadataRequest{
+				ID:          "abc123",
+				Metadata:    json.RawMessage(`{"some": "json"}`),
+				IPAddresses: []string{"1.2.3.4", "10.1.0.0/25", "fe80:aede:48ff:fe00::1122"},
+			},
+			http.StatusBadRequest,
+			regexp.MustCompile(`.*id.*uuid`),
+		},
+		{
+			"empty instance ID and empty metadata",
+			&v1api.UpsertMetadataRequest{
+				ID:          "",
+				IPAddresses: []string{"1.2.3.4", "10.1.0.0/25", "fe80:aede:48ff:fe00::1122"},
+			},
+			http.StatusBadRequest,
+			regexp.MustCompile(`.*id.*required.*metadata.*required`),
+		},
+		{
+			"invalid IPv4 address",
+			&v1api.UpsertMetadataRequest{
+				ID:          "b9b24320-304e-4bfb-b46a-db75901c2f46",
+				Metadata:    json.RawMessage(`{"some": "json"}`),
+				IPAddresses: []string{"a.b.c.d"},
+			},
+			http.StatusBadRequest,
+			regexp.MustCompile(`.*ipAddresses\[0\].*ip_addr|cidr`),
+		},
+		{
+			"invalid IPv6 address",
+			&v1api.UpsertMetadataRequest{
+				ID:          "02d91622-b1e8-41b4-9add-ce77ac619b89",
+				Metadata:    json.RawMessage(`{"some": "json"}`),
+				IPAddresses: []string{"a:b:c:d:e:f:g:h"},
+			},
+			http.StatusBadRequest,
+			regexp.MustCompile(`.*ipAddresses\[0\].*ip_addr|cidr`),
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			reqBody, err := json.Marshal(testcase.requestBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+			assert.Regexp(t, testcase.expectedBody, w.Body.String())
+		})
+	}
+}
+
+// TestSetMetadataRawJSON tests that metadata can be submitted either as a
+// string containing JSON or directly as a JSON object, and that both are
+// stored the same way.
+func TestSetMetadataRawJSON(t *testing.T) {
+	router := *testHTTPServer(t)
+	testDB := dbtools.TestDB()
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	metadata := `{"hostname":"instance-a","tags":["a","b"],"customdata":{"nested":true}}`
+
+	legacyID := "1f3b5d7e-9a1c-4e5f-8b7d-3c5e7a9b1d3f"
+	objectID := "2a4c6e8f-0b2d-4f6a-9c8e-4d6f8b0c2e4a"
+
+	type testCase struct {
+		testName       string
+		requestBody    string
+		expectedStatus int
+	}
+
+	testCases := []testCase{
+		{
+			"legacy string form",
+			fmt.Sprintf(`{"id": %q, "metadata": %q, "ipAddresses": ["192.168.110.1"]}`, legacyID, metadata),
+			http.StatusCreated,
+		},
+		{
+			"object form",
+			fmt.Sprintf(`{"id": %q, "metadata": %s, "ipAddresses": ["192.168.110.2"]}`, objectID, metadata),
+			http.StatusCreated,
+		},
+		{
+			"string with invalid JSON",
+			fmt.Sprintf(`{"id": %q, "metadata": "{not json", "ipAddresses": ["192.168.110.3"]}`, legacyID),
+			http.StatusBadRequest,
+		},
+		{
+			"number",
+			fmt.Sprintf(`{"id": %q, "metadata": 42, "ipAddresses": ["192.168.110.3"]}`, legacyID),
+			http.StatusBadRequest,
+		},
+		{
+			"null",
+			fmt.Sprintf(`{"id": %q, "metadata": null, "ipAddresses": ["192.168.110.3"]}`, legacyID),
+			http.StatusBadRequest,
+		},
+		{
+			"empty string",
+			fmt.Sprintf(`{"id": %q, "metadata": "", "ipAddresses": ["192.168.110.3"]}`, legacyID),
+			http.StatusBadRequest,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), strings.NewReader(testcase.requestBody))
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+		})
+	}
+
+	legacy, err := models.FindInstanceMetadatum(context.TODO(), testDB, legacyID)
+	require.NoError(t, err)
+
+	object, err := models.FindInstanceMetadatum(context.TODO(), testDB, objectID)
+	require.NoError(t, err)
+
+	assert.Equal(t, legacy.Metadata, object.Metadata)
+	assert.JSONEq(t, metadata, string(object.Metadata))
+}
+
+func TestNormalizeMetadata(t *testing.T) {
+	type testCase struct {
+		testName    string
+		raw         string
+		expected    string
+		expectError bool
+	}
+
+	testCases := []testCase{
+		{"object", `{"hostname": "instance-a"}`, `{"hostname": "instance-a"}`, false},
+		{"array", ` ["a", "b"] `, `["a", "b"]`, false},
+		{"string containing an object", `"{\"hostname\": \"instance-a\"}"`, `{"hostname": "instance-a"}`, false},
+		{"string containing a number", `"42"`, `42`, false},
+		{"string containing invalid JSON", `"{not json"`, "", true},
+		{"number", `42`, "", true},
+		{"boolean", `true`, "", true},
+		{"empty string", `""`, "", false},
+		{"null", `null`, "", false},
+		{"missing", ``, "", false},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			normalized, err := v1api.NormalizeMetadata(json.RawMessage(testcase.raw))
+
+			if testcase.expectError {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, testcase.expected, string(normalized))
+		})
+	}
+}
+
+// TestSetMetadataAllowedKeys tests that, when an allowlist of metadata keys is
+// configured, upserts with other top-level keys are rejected.
+func TestSetMetadataAllowedKeys(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{MetadataAllowedKeys: []string{"hostname", "plan"}})
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	type testCase struct {
+		testName       string
+		metadata       string
+		expectedStatus int
+		expectedBody   string
+	}
+
+	testCases := []testCase{
+		{
+			"only allowed keys",
+			`{"hostname": "instance-a", "plan": "c3.small.x86"}`,
+			http.StatusCreated,
+			"",
+		},
+		{
+			"disallowed keys",
+			`{"hostname": "instance-a", "tags": [], "customdata": {}}`,
+			http.StatusBadRequest,
+			"customdata, tags",
+		},
+		{
+			"not a JSON object",
+			`["hostname"]`,
+			http.StatusBadRequest,
+			"metadata must be a JSON object",
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			reqBody, err := json.Marshal(&v1api.UpsertMetadataRequest{
+				ID:          "3c1e2f4a-7b8d-4e6f-9a0b-1c2d3e4f5a6b",
+				Metadata:    json.RawMessage(testcase.metadata),
+				IPAddresses: []string{"192.168.30.1"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+			assert.Contains(t, w.Body.String(), testcase.expectedBody)
+		})
+	}
+}
+
+// TestSetMetadataReturnDiff tests that, when requested, metadata upserts
+// respond with the changes made to the stored metadata.
+func TestSetMetadataReturnDiff(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	type testCase struct {
+		testName        string
+		metadata        string
+		expectedStatus  int
+		expectedChanges []v1api.MetadataChange
+	}
+
+	// The test cases run in order against the same instance.
+	testCases := []testCase{
+		{
+			"new instance",
+			`{"hostname": "instance-a", "plan": "c3.small.x86"}`,
+			http.StatusCreated,
+			[]v1api.MetadataChange{
+				{Op: v1api.MetadataChangeAdd, Path: "/hostname", New: "instance-a"},
+				{Op: v1api.MetadataChangeAdd, Path: "/plan", New: "c3.small.x86"},
+			},
+		},
+		{
+			"changed field",
+			`{"hostname": "instance-b", "plan": "c3.small.x86"}`,
+			http.StatusOK,
+			[]v1api.MetadataChange{
+				{Op: v1api.MetadataChangeReplace, Path: "/hostname", Old: "instance-a", New: "instance-b"},
+			},
+		},
+		{
+			"no-op update",
+			`{"hostname": "instance-b", "plan": "c3.small.x86"}`,
+			http.StatusOK,
+			[]v1api.MetadataChange{},
+		},
+	}
+
+	for _, testcase := range testCases {
+		reqBody, err := json.Marshal(&v1api.UpsertMetadataRequest{
+			ID:          "8d2b6c1e-4f3a-4b5c-9d7e-0a1b2c3d4e5f",
+			Metadata:    json.RawMessage(testcase.metadata),
+			IPAddresses: []string{"192.168.40.1"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath()+"?return_diff=true", bytes.NewReader(reqBody))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, testcase.expectedStatus, w.Code, testcase.testName)
+
+		var resp v1api.MetadataDiffResponse
+
+		err = json.Unmarshal(w.Body.Bytes(), &resp)
+		assert.NoError(t, err, testcase.testName)
+		assert.Equal(t, testcase.expectedChanges, resp.Changes, testcase.testName)
+	}
+}
+
+// TestSetMetadataReturnDiffStored tests that the changes returned by metadata
+// upserts are taken against the stored metadata, after trimming, and with
+// encrypted fields decrypted.
+func TestSetMetadataReturnDiffStored(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{MetadataTrimStringValues: true})
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	require.NoError(t, fieldcrypt.Configure("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=", []string{"customdata.join_token"}))
+	defer fieldcrypt.Configure("", nil) //nolint:errcheck // resetting to the default can't fail
+
+	type testCase struct {
+		testName        string
+		metadata        string
+		expectedChanges []v1api.MetadataChange
+	}
+
+	// The test cases run in order against the same instance.
+	testCases := []testCase{
+		{
+			"new instance",
+			`{"hostname": "instance-a\n", "customdata": {"join_token": "s3cr3t"}}`,
+			[]v1api.MetadataChange{
+				{Op: v1api.MetadataChangeAdd, Path: "/customdata", New: map[string]interface{}{"join_token": "s3cr3t"}},
+				{Op: v1api.MetadataChangeAdd, Path: "/hostname", New: "instance-a"},
+			},
+		},
+		{
+			// The join token is encrypted with a new nonce, but its value
+			// hasn't changed.
+			"no-op update",
+			`{"hostname": "instance-a", "customdata": {"join_token": "s3cr3t"}}`,
+			[]v1api.MetadataChange{},
+		},
+		{
+			"changed encrypted field",
+			`{"hostname": "instance-a", "customdata": {"join_token": "n3w"}}`,
+			[]v1api.MetadataChange{
+				{Op: v1api.MetadataChangeReplace, Path: "/customdata/join_token", Old: "s3cr3t", New: "n3w"},
+			},
+		},
+	}
+
+	for _, testcase := range testCases {
+		reqBody, err := json.Marshal(&v1api.UpsertMetadataRequest{
+			ID:          "4e7a9c2b-1d3f-4a5b-8c6d-7e8f9a0b1c2d",
+			Metadata:    json.RawMessage(testcase.metadata),
+			IPAddresses: []string{"192.168.41.1"},
+		})
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath()+"?return_diff=true", bytes.NewReader(reqBody))
+		router.ServeHTTP(w, req)
+
+		require.Contains(t, []int{http.StatusOK, http.StatusCreated}, w.Code, testcase.testName)
+
+		var resp v1api.MetadataDiffResponse
+
+		err = json.Unmarshal(w.Body.Bytes(), &resp)
+		assert.NoError(t, err, testcase.testName)
+		assert.Equal(t, testcase.expectedChanges, resp.Changes, testcase.testName)
+	}
+}
+
+// TestSetAllowedIPCIDRs tests that, when allowed CIDRs are configured, metadata
+// and userdata upserts with IPs outside of them are rejected.
+func TestSetAllowedIPCIDRs(t *testing.T) {
+	serverConfig := TestServerConfig{
+		AllowedIPCIDRs: []netip.Prefix{netip.MustParsePrefix("10.70.0.0/16"), netip.MustParsePrefix("2604:1380::/32")},
+	}
+	router := *testHTTPServerWithConfig(t, serverConfig)
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	type testCase struct {
+		testName       string
+		ipAddresses    []string
+		expectedStatus int
+		expectedBody   string
+	}
+
+	testCases := []testCase{
+		{
+			"IPv4 and IPv6 addresses in range",
+			[]string{"10.70.1.2", "2604:1380:4641:1f00::9"},
+			http.StatusCreated,
+			"",
+		},
+		{
+			"CIDR in range",
+			[]string{"10.70.17.0/24"},
+			http.StatusCreated,
+			"",
+		},
+		{
+			"addresses out of range",
+			[]string{"10.70.1.2", "192.168.0.1", "2001:db8::1"},
+			http.StatusBadRequest,
+			"192.168.0.1, 2001:db8::1",
+		},
+		{
+			"CIDR larger than the allowed range",
+			[]string{"10.0.0.0/8"},
+			http.StatusBadRequest,
+			"10.0.0.0/8",
+		},
+	}
+
+	for i, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			instanceID := fmt.Sprintf("6f1c2d3e-4a5b-4c6d-8e7f-%012d", i)
+
+			metadataBody, err := json.Marshal(&v1api.UpsertMetadataRequest{
+				ID:          instanceID,
+				Metadata:    json.RawMessage(`{"some": "json"}`),
+				IPAddresses: testcase.ipAddresses,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			userdataBody, err := json.Marshal(&v1api.UpsertUserdataRequest{
+				ID:          instanceID,
+				Userdata:    []byte("#cloud-config"),
+				IPAddresses: testcase.ipAddresses,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for path, body := range map[string][]byte{
+				v1api.GetInternalMetadataPath(): metadataBody,
+				v1api.GetInternalUserdataPath(): userdataBody,
+			} {
+				w := httptest.NewRecorder()
+
+				req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, path, bytes.NewReader(body))
+				router.ServeHTTP(w, req)
+
+				assert.Equal(t, testcase.expectedStatus, w.Code, path)
+				assert.Contains(t, w.Body.String(), testcase.expectedBody, path)
+			}
+		})
+	}
+}
+
+// TestSetMetadataMaxFutureUpdatedAt tests that, when a maximum is configured,
+// metadata upserts with an updatedAt too far in the future are rejected.
+func TestSetMetadataMaxFutureUpdatedAt(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	viper.Set("crdb.max_future_updated_at", 1*time.Hour)
+	defer viper.Set("crdb.max_future_updated_at", 0)
+
+	type testCase struct {
+		testName       string
+		updatedAt      *time.Time
+		expectedStatus int
+		expectedBody   string
+	}
+
+	past := time.Now().Add(-24 * time.Hour)
+	nearFuture := time.Now().Add(10 * time.Minute)
+	farFuture := time.Now().Add(365 * 24 * time.Hour)
+
+	testCases := []testCase{
+		{
+			"no updatedAt",
+			nil,
+			http.StatusCreated,
+			"",
+		},
+		{
+			"updatedAt in the past",
+			&past,
+			http.StatusOK,
+			"",
+		},
+		{
+			"updatedAt within the allowed skew",
+			&nearFuture,
+			http.StatusOK,
+			"",
+		},
+		{
+			"updatedAt too far in the future",
+			&farFuture,
+			http.StatusBadRequest,
+			"updatedAt is too far in the future",
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			reqBody, err := json.Marshal(&v1api.UpsertMetadataRequest{
+				ID:          "5e7f9a1b-2c3d-4e5f-8a9b-0c1d2e3f4a5b",
+				Metadata:    json.RawMessage(`{"hostname": "instance-a"}`),
+				IPAddresses: []string{"192.168.50.1"},
+				UpdatedAt:   testcase.updatedAt,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+			assert.Contains(t, w.Body.String(), testcase.expectedBody)
+		})
+	}
+}
+
+// TestSetMetadataMaxFutureUpdatedAtUsesClock tests that updatedAt is checked
+// against the Router's clock.
+func TestSetMetadataMaxFutureUpdatedAtUsesClock(t *testing.T) {
+	setViper(t, "crdb.max_future_updated_at", 1*time.Hour)
+	setViper(t, "crdb.tx_timeout", time.Second)
+
+	authMW, err := ginjwt.NewAuthMiddleware(ginjwt.AuthConfig{})
+	require.NoError(t, err)
+
+	db, err := sqlx.Open("postgres", unreachableDBURL)
+	require.NoError(t, err)
+
+	updatedAt := time.Now().Add(24 * time.Hour)
+
+	reqBody, err := json.Marshal(&v1api.UpsertMetadataRequest{
+		ID:          "5e7f9a1b-2c3d-4e5f-8a9b-0c1d2e3f4a5b",
+		Metadata:    json.RawMessage(`{"hostname": "instance-a"}`),
+		IPAddresses: []string{"192.168.50.1"},
+		UpdatedAt:   &updatedAt,
+	})
+	require.NoError(t, err)
+
+	for _, clockOffset := range []time.Duration{0, 48 * time.Hour} {
+		t.Run(clockOffset.String(), func(t *testing.T) {
+			rtr := v1api.NewRouter(zap.NewNop(), db, authMW, nil)
+			rtr.Now = func() time.Time { return time.Now().Add(clockOffset) }
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
+			testRouter(rtr).ServeHTTP(w, req)
+
+			// Only rejected when it's more than an hour ahead of the clock.
+			// Otherwise it gets as far as the (unreachable) database.
+			if clockOffset == 0 {
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+				assert.Contains(t, w.Body.String(), "updatedAt is too far in the future")
+			} else {
+				assert.Equal(t, http.StatusInternalServerError, w.Code)
+			}
+		})
+	}
+}
+
+func TestExtractIPAddressesFromMetadata(t *testing.T) {
+	ipAddresses, err := v1api.ExtractIPAddressesFromMetadata(`{"network": {"addresses": [{"address": "10.1.2.3"}, {"address": "2604:1380::1"}, {"public": true}]}}`)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.1.2.3", "2604:1380::1"}, ipAddresses)
+
+	ipAddresses, err = v1api.ExtractIPAddressesFromMetadata(`{"hostname": "no-network"}`)
+	require.NoError(t, err)
+	assert.Empty(t, ipAddresses)
+
+	_, err = v1api.ExtractIPAddressesFromMetadata(`["not", "an", "object"]`)
+	assert.Error(t, err)
+}
+
+func TestSetMetadataIPMismatch(t *testing.T) {
+	// One server per mode, sharing the test database
+	routers := map[string]http.Handler{}
+	for _, mode := range []string{"", v1api.MetadataIPMismatchWarn, v1api.MetadataIPMismatchError} {
+		routers[mode] = *testHTTPServerWithConfig(t, TestServerConfig{MetadataIPMismatchMode: mode})
+	}
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	metadata := `{"hostname": "instance-a", "network": {"addresses": [{"address": "192.168.60.1"}, {"address": "192.168.61.5"}]}}`
+
+	type testCase struct {
+		testName       string
+		mode           string
+		ipAddresses    []string
+		expectedStatus int
+		expectedBody   string
+	}
+
+	testCases := []testCase{
+		{
+			"check disabled",
+			"",
+			[]string{"192.168.60.1"},
+			http.StatusCreated,
+			"",
+		},
+		{
+			"warn mode stores the metadata",
+			v1api.MetadataIPMismatchWarn,
+			[]string{"192.168.60.1"},
+			http.StatusOK,
+			"",
+		},
+		{
+			"error mode rejects the mismatch",
+			v1api.MetadataIPMismatchError,
+			[]string{"192.168.60.1"},
 			http.StatusBadRequest,
-			regexp.MustCompile(`.*ipAddresses\[0\].*ip_addr|cidr`),
+			"metadata lists IP addresses which aren't in ipAddresses: 192.168.61.5",
+		},
+		{
+			"error mode allows addresses within a CIDR",
+			v1api.MetadataIPMismatchError,
+			[]string{"192.168.60.1", "192.168.61.0/24"},
+			http.StatusOK,
+			"",
 		},
 	}
 
 	for _, testcase := range testCases {
 		t.Run(testcase.testName, func(t *testing.T) {
-			reqBody, err := json.Marshal(testcase.requestBody)
+			reqBody, err := json.Marshal(&v1api.UpsertMetadataRequest{
+				ID:          "6a8b0c2d-3e4f-4a5b-9c6d-1e2f3a4b5c6d",
+				Metadata:    json.RawMessage(metadata),
+				IPAddresses: testcase.ipAddresses,
+			})
 			if err != nil {
 				t.Fatal(err)
 			}
+
 			w := httptest.NewRecorder()
 
 			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
-			router.ServeHTTP(w, req)
+			routers[testcase.mode].ServeHTTP(w, req)
 
 			assert.Equal(t, testcase.expectedStatus, w.Code)
-			assert.Regexp(t, testcase.expectedBody, w.Body.String())
+			assert.Contains(t, w.Body.String(), testcase.expectedBody)
 		})
 	}
 }
 
+// TestSetMetadataEncryptedFields tests that configured fields are encrypted in
+// the database, and served decrypted from both the public and internal
+// endpoints.
+func TestSetMetadataEncryptedFields(t *testing.T) {
+	router := *testHTTPServer(t)
+	testDB := dbtools.TestDB()
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	require.NoError(t, fieldcrypt.Configure("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=", []string{"customdata.join_token"}))
+	defer fieldcrypt.Configure("", nil) //nolint:errcheck // resetting to the default can't fail
+
+	instanceID := "7b9c1d3e-4f5a-4b6c-8d7e-2f3a4b5c6d7e"
+	instanceIP := "192.168.70.1"
+	metadata := `{"hostname": "instance-a", "customdata": {"join_token": "s3cr3t"}}`
+
+	reqBody, err := json.Marshal(&v1api.UpsertMetadataRequest{
+		ID:          instanceID,
+		Metadata:    json.RawMessage(metadata),
+		IPAddresses: []string{instanceIP},
+	})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	stored, err := models.FindInstanceMetadatum(context.TODO(), testDB, instanceID)
+	require.NoError(t, err)
+	assert.NotContains(t, string(stored.Metadata), "s3cr3t")
+	assert.Contains(t, string(stored.Metadata), "instance-a")
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalMetadataByIDPath(instanceID), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"join_token":"s3cr3t"`)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataPath(), nil)
+	req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"join_token":"s3cr3t"`)
+}
+
 // TestSetMetadataIPAddressConflict tests the actions performed when the
 // incoming request specifies an IP address (or multiple IP addresses) that are
 // currently associated to another instance.
@@ -329,7 +1794,7 @@ func TestSetMetadataIPAddressConflict(t *testing.T) {
 			map[string][]string{dbtools.FixtureInstanceA.InstanceID: {dbtools.FixtureInstanceA.HostIPs[0]}},
 			&v1api.UpsertMetadataRequest{
 				ID:          "59e1fac8-adc5-4955-9cc3-2fa3e5f5370e",
-				Metadata:    `{"some": "json"}`,
+				Metadata:    json.RawMessage(`{"some": "json"}`),
 				IPAddresses: []string{dbtools.FixtureInstanceA.HostIPs[0]},
 			},
 		},
@@ -338,7 +1803,7 @@ func TestSetMetadataIPAddressConflict(t *testing.T) {
 			map[string][]string{dbtools.FixtureInstanceA.InstanceID: {dbtools.FixtureInstanceA.HostIPs[1]}},
 			&v1api.UpsertMetadataRequest{
 				ID:          "b5b851a7-ea59-498d-b5c2-9ba10201ac28",
-				Metadata:    `{"some": "json"}`,
+				Metadata:    json.RawMessage(`{"some": "json"}`),
 				IPAddresses: []string{dbtools.FixtureInstanceA.HostIPs[1]},
 			},
 		},
@@ -347,7 +1812,7 @@ func TestSetMetadataIPAddressConflict(t *testing.T) {
 			map[string][]string{dbtools.FixtureInstanceA.InstanceID: {dbtools.FixtureInstanceA.HostIPs[0], dbtools.FixtureInstanceA.HostIPs[1]}},
 			&v1api.UpsertMetadataRequest{
 				ID:          "12256023-e708-4620-b6f0-57d39541994a",
-				Metadata:    `{"some": "json"}`,
+				Metadata:    json.RawMessage(`{"some": "json"}`),
 				IPAddresses: []string{dbtools.FixtureInstanceA.HostIPs[0], dbtools.FixtureInstanceA.HostIPs[1]},
 			},
 		},
@@ -358,7 +1823,7 @@ func TestSetMetadataIPAddressConflict(t *testing.T) {
 				dbtools.FixtureInstanceB.InstanceID: {dbtools.FixtureInstanceB.HostIPs[0]}},
 			&v1api.UpsertMetadataRequest{
 				ID:          "6bd001dd-0523-4002-93e9-36a98607638a",
-				Metadata:    `{"some": "json"}`,
+				Metadata:    json.RawMessage(`{"some": "json"}`),
 				IPAddresses: []string{dbtools.FixtureInstanceA.HostIPs[0], dbtools.FixtureInstanceB.HostIPs[0]},
 			},
 		},
@@ -370,7 +1835,7 @@ func TestSetMetadataIPAddressConflict(t *testing.T) {
 			},
 			&v1api.UpsertMetadataRequest{
 				ID:          "8c18b684-efb4-476b-87c3-a1dfd70a2024",
-				Metadata:    `{"some": "json"}`,
+				Metadata:    json.RawMessage(`{"some": "json"}`),
 				IPAddresses: []string{dbtools.FixtureInstanceA.HostIPs[1], dbtools.FixtureInstanceB.HostIPs[1]},
 			},
 		},
@@ -382,7 +1847,7 @@ func TestSetMetadataIPAddressConflict(t *testing.T) {
 			},
 			&v1api.UpsertMetadataRequest{
 				ID:          "f92d1d4a-a408-42d7-b541-3bc3296c9c7d",
-				Metadata:    `{"some": "json"}`,
+				Metadata:    json.RawMessage(`{"some": "json"}`),
 				IPAddresses: []string{dbtools.FixtureInstanceA.HostIPs[0], dbtools.FixtureInstanceB.HostIPs[1]},
 			},
 		},
@@ -400,7 +1865,7 @@ func TestSetMetadataIPAddressConflict(t *testing.T) {
 			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
 			router.ServeHTTP(w, req)
 
-			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, http.StatusCreated, w.Code)
 
 			// Check that the conflicting InstanceIPAddress row has been deleted
 			for id, conflictIPs := range testcase.conflictInstanceIDToIPs {
@@ -430,7 +1895,7 @@ func TestSetMetadataCreateMetadata(t *testing.T) {
 
 	requestBody := &v1api.UpsertMetadataRequest{
 		ID:          "b94fa75b-1fee-45eb-9925-83011c4834b9",
-		Metadata:    `{"some": "json for instance 'b94fa75b-1fee-45eb-9925-83011c4834b9'"}`,
+		Metadata:    json.RawMessage(`{"some": "json for instance 'b94fa75b-1fee-45eb-9925-83011c4834b9'"}`),
 		IPAddresses: []string{"192.168.0.1/25"},
 	}
 
@@ -451,12 +1916,12 @@ func TestSetMetadataCreateMetadata(t *testing.T) {
 
 	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
 	router.ServeHTTP(w, req)
-	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusCreated, w.Code)
 
 	instanceMetadata, _ := models.InstanceMetadata(models.InstanceMetadatumWhere.ID.EQ(requestBody.ID)).One(context.TODO(), testDB)
 	assert.NotNil(t, instanceMetadata)
 	assert.Equal(t, requestBody.ID, instanceMetadata.ID)
-	assert.Equal(t, requestBody.Metadata, instanceMetadata.Metadata.String())
+	assert.JSONEq(t, string(requestBody.Metadata), instanceMetadata.Metadata.String())
 
 	instanceIPAddresses, _ := models.InstanceIPAddresses(models.InstanceIPAddressWhere.ID.EQ(requestBody.ID)).All(context.TODO(), testDB)
 	for _, instanceIPAddress := range instanceIPAddresses {
@@ -490,7 +1955,7 @@ func TestSetMetadataUpsertMetadata(t *testing.T) {
 
 	requestBody := &v1api.UpsertMetadataRequest{
 		ID:          dbtools.FixtureInstanceA.InstanceID,
-		Metadata:    `{"some": "json"}`,
+		Metadata:    json.RawMessage(`{"some": "json"}`),
 		IPAddresses: dbtools.FixtureInstanceA.HostIPs,
 	}
 
@@ -507,7 +1972,106 @@ func TestSetMetadataUpsertMetadata(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w.Code)
 
 	instanceMetadata, _ := models.InstanceMetadata(models.InstanceMetadatumWhere.ID.EQ(dbtools.FixtureInstanceA.InstanceID)).One(context.TODO(), testDB)
-	assert.Equal(t, requestBody.Metadata, instanceMetadata.Metadata.String())
+	assert.JSONEq(t, string(requestBody.Metadata), instanceMetadata.Metadata.String())
+}
+
+// TestReplaceMetadata tests replacing an instance's metadata with a PUT to
+// the instance's path, which doesn't need the ID in the request body.
+func TestReplaceMetadata(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	instanceID := "9e1a3c5d-7f2b-4d6e-8a0c-4e6f8a0b2c3d"
+
+	type testCase struct {
+		testName       string
+		pathID         string
+		bodyID         string
+		metadata       string
+		expectedStatus int
+		expectedBody   string
+	}
+
+	// The test cases run in order against the same instance.
+	testCases := []testCase{
+		{
+			"new instance without body ID",
+			instanceID,
+			"",
+			`{"hostname": "instance-a"}`,
+			http.StatusCreated,
+			"",
+		},
+		{
+			"replace without body ID",
+			instanceID,
+			"",
+			`{"hostname": "instance-b"}`,
+			http.StatusOK,
+			"",
+		},
+		{
+			"replace with matching body ID",
+			instanceID,
+			instanceID,
+			`{"hostname": "instance-c"}`,
+			http.StatusOK,
+			"",
+		},
+		{
+			"mismatched body ID",
+			instanceID,
+			dbtools.FixtureInstanceA.InstanceID,
+			`{"hostname": "instance-d"}`,
+			http.StatusBadRequest,
+			"doesn't match the instance ID in the path",
+		},
+		{
+			"invalid metadata",
+			instanceID,
+			"",
+			`{"hostname":`,
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"invalid path ID",
+			"bad-id",
+			"",
+			`{"hostname": "instance-e"}`,
+			http.StatusNotFound,
+			"",
+		},
+	}
+
+	for _, testcase := range testCases {
+		reqBody, err := json.Marshal(&v1api.UpsertMetadataRequest{
+			ID:          testcase.bodyID,
+			Metadata:    json.RawMessage(testcase.metadata),
+			IPAddresses: []string{"192.168.90.1"},
+		})
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPut, v1api.GetInternalMetadataByIDPath(testcase.pathID), bytes.NewReader(reqBody))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, testcase.expectedStatus, w.Code, testcase.testName)
+		assert.Contains(t, w.Body.String(), testcase.expectedBody, testcase.testName)
+	}
+
+	// Only the valid replacements were stored.
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalMetadataByIDPath(instanceID), nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"hostname": "instance-c"}`, w.Body.String())
 }
 
 func TestDeleteMetadata(t *testing.T) {
@@ -609,6 +2173,28 @@ func TestDeleteMetadata(t *testing.T) {
 	}
 }
 
+// TestDeleteMetadataMetrics tests that the per-phase deletion counters are
+// incremented when metadata (and subsequently the instance IPs) are deleted.
+func TestDeleteMetadataMetrics(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	metadataDeletions := testutil.ToFloat64(middleware.MetricMetadataRecordDeletionsCount)
+	userdataDeletions := testutil.ToFloat64(middleware.MetricUserdataDeletionsCount)
+	ipDeletions := testutil.ToFloat64(middleware.MetricIPAddressDeletionsCount)
+
+	// Instance B has metadata but no userdata, so deleting the metadata should
+	// also remove all of its instance_ip_addresses rows.
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodDelete, v1api.GetInternalMetadataByIDPath(dbtools.FixtureInstanceB.InstanceID), nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, metadataDeletions+1, testutil.ToFloat64(middleware.MetricMetadataRecordDeletionsCount))
+	assert.Equal(t, userdataDeletions, testutil.ToFloat64(middleware.MetricUserdataDeletionsCount))
+	assert.Equal(t, ipDeletions+float64(len(dbtools.FixtureInstanceB.InstanceIPAddresses)), testutil.ToFloat64(middleware.MetricIPAddressDeletionsCount))
+}
+
 // metadataString is a helper function that ensures the db fixture string is marshaled
 // in a way that we can properly calculate its length for Content-Length comparisons
 func metadataString(metadata interface{}) string {
@@ -738,3 +2324,323 @@ func TestGetMetadataInternal(t *testing.T) {
 		})
 	}
 }
+
+// TestGetMetadataInternalTimestamps tests that the internal metadata endpoint
+// returns when the metadata was created and last updated, and that the
+// creation time is preserved across upserts.
+func TestGetMetadataInternalTimestamps(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	instanceID := "0f4e2d6c-8b1a-4c3e-9f5d-7a6b8c9d0e1f"
+
+	upsert := func(metadata string) {
+		reqBody, err := json.Marshal(&v1api.UpsertMetadataRequest{
+			ID:          instanceID,
+			Metadata:    json.RawMessage(metadata),
+			IPAddresses: []string{"192.168.60.1"},
+		})
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
+		router.ServeHTTP(w, req)
+
+		require.Contains(t, []int{http.StatusOK, http.StatusCreated}, w.Code)
+	}
+
+	getTimestamps := func() (time.Time, time.Time) {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalMetadataByIDPath(instanceID), nil)
+		router.ServeHTTP(w, req)
+
+		require.Equal(t, http.StatusOK, w.Code)
+
+		createdAt, err := time.Parse(time.RFC3339Nano, w.Header().Get(v1api.CreatedAtHeader))
+		require.NoError(t, err)
+
+		updatedAt, err := time.Parse(time.RFC3339Nano, w.Header().Get(v1api.UpdatedAtHeader))
+		require.NoError(t, err)
+
+		return createdAt, updatedAt
+	}
+
+	upsert(`{"hostname": "instance-a"}`)
+
+	createdAt, updatedAt := getTimestamps()
+	assert.False(t, createdAt.IsZero())
+	assert.Equal(t, createdAt, updatedAt)
+
+	time.Sleep(10 * time.Millisecond)
+
+	upsert(`{"hostname": "instance-b"}`)
+
+	newCreatedAt, newUpdatedAt := getTimestamps()
+	assert.Equal(t, createdAt, newCreatedAt)
+	assert.True(t, newUpdatedAt.After(updatedAt))
+}
+
+// TestGetMetadataInternalAsOf tests that the internal metadata endpoint returns
+// the version of the metadata that was current at the requested time.
+func TestGetMetadataInternalAsOf(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	viper.Set("metadata.history_enabled", true)
+	defer viper.Set("metadata.history_enabled", false)
+
+	instanceID := "4a6c8e0b-2d4f-4a6b-8c0d-2e4f6a8b0c1d"
+
+	request := func(method, path string, body []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), method, path, bytes.NewReader(body))
+		router.ServeHTTP(w, req)
+
+		return w
+	}
+
+	// Store three versions of the metadata, noting a time between each.
+	var times []time.Time
+
+	for _, hostname := range []string{"v1", "v2", "v3"} {
+		times = append(times, time.Now())
+
+		time.Sleep(10 * time.Millisecond)
+
+		reqBody, err := json.Marshal(&v1api.UpsertMetadataRequest{
+			ID:          instanceID,
+			Metadata:    json.RawMessage(fmt.Sprintf(`{"hostname": %q}`, hostname)),
+			IPAddresses: []string{"192.168.80.1"},
+		})
+		require.NoError(t, err)
+
+		w := request(http.MethodPost, v1api.GetInternalMetadataPath(), reqBody)
+		require.Contains(t, []int{http.StatusOK, http.StatusCreated}, w.Code)
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	times = append(times, time.Now())
+
+	time.Sleep(10 * time.Millisecond)
+
+	w := request(http.MethodDelete, v1api.GetInternalMetadataByIDPath(instanceID), nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	time.Sleep(10 * time.Millisecond)
+
+	times = append(times, time.Now())
+
+	type testCase struct {
+		testName       string
+		asOf           string
+		expectedStatus int
+		expectedBody   string
+	}
+
+	testCases := []testCase{
+		{"before the first version", times[0].Format(time.RFC3339Nano), http.StatusNotFound, ""},
+		{"first version", times[1].Format(time.RFC3339Nano), http.StatusOK, `{"hostname": "v1"}`},
+		{"second version", times[2].Format(time.RFC3339Nano), http.StatusOK, `{"hostname": "v2"}`},
+		{"third version", times[3].Format(time.RFC3339Nano), http.StatusOK, `{"hostname": "v3"}`},
+		{"after deletion", times[4].Format(time.RFC3339Nano), http.StatusNotFound, ""},
+		{"invalid timestamp", "yesterday", http.StatusBadRequest, ""},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := request(http.MethodGet, v1api.GetInternalMetadataByIDPath(instanceID)+"?as_of="+url.QueryEscape(testcase.asOf), nil)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+
+			if testcase.expectedStatus == http.StatusOK {
+				assert.JSONEq(t, testcase.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
+
+// TestWriteAuditLog tests that creates, updates, and deletes made through the
+// internal endpoints are recorded in the audit log.
+func TestWriteAuditLog(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+
+	auditLogger, err := audit.NewLogger(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := *testHTTPServerWithConfig(t, TestServerConfig{AuditLogger: auditLogger})
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	instanceID := "9b8a7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d"
+
+	reqBody, err := json.Marshal(&v1api.UpsertMetadataRequest{
+		ID:          instanceID,
+		Metadata:    json.RawMessage(`{"some": "json"}`),
+		IPAddresses: []string{"192.168.40.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := []struct {
+		method string
+		path   string
+		body   []byte
+	}{
+		{http.MethodPost, v1api.GetInternalMetadataPath(), reqBody},
+		{http.MethodPost, v1api.GetInternalMetadataPath(), reqBody},
+		{http.MethodDelete, v1api.GetInternalMetadataByIDPath(instanceID), nil},
+		// Failed writes aren't recorded
+		{http.MethodDelete, v1api.GetInternalMetadataByIDPath(instanceID), nil},
+	}
+
+	for _, request := range requests {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), request.method, request.path, bytes.NewReader(request.body))
+		router.ServeHTTP(w, req)
+	}
+
+	if err := auditLogger.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var actions []string
+
+	for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+		var entry map[string]string
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, instanceID, entry["instance_id"])
+		assert.NotEmpty(t, entry["timestamp"])
+
+		actions = append(actions, entry["action"])
+	}
+
+	assert.Equal(t, []string{audit.ActionMetadataCreate, audit.ActionMetadataUpdate, audit.ActionMetadataDelete}, actions)
+}
+
+// TestGetMetadataVerifyIPOwnership tests that with VerifyIPOwnership set,
+// metadata is only served to request IPs which are both associated to the
+// instance and listed in its metadata.
+func TestGetMetadataVerifyIPOwnership(t *testing.T) {
+	type testCase struct {
+		testName          string
+		verifyIPOwnership bool
+		requestIP         string
+		expectedStatus    int
+	}
+
+	// Instance A is associated to 10.70.17.8/31, but its metadata only lists
+	// 10.70.17.9, and likewise for 2604:1380:4641:1f00::9/127.
+	testCases := []testCase{
+		{"listed IPv4 address", true, "139.178.82.3", http.StatusOK},
+		{"listed address within an associated CIDR", true, "10.70.17.9", http.StatusOK},
+		{"listed IPv6 address", true, "2604:1380:4641:1f00::9", http.StatusOK},
+		{"unlisted address within an associated CIDR", true, "10.70.17.8", http.StatusNotFound},
+		{"unlisted IPv6 address within an associated CIDR", true, "2604:1380:4641:1f00::8", http.StatusNotFound},
+		{"unlisted address without verification", false, "10.70.17.8", http.StatusOK},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			router := *testHTTPServerWithConfig(t, TestServerConfig{VerifyIPOwnership: testcase.verifyIPOwnership})
+
+			for _, path := range []string{v1api.GetMetadataPath(), v1api.GetEc2MetadataPath()} {
+				w := httptest.NewRecorder()
+
+				req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+				req.RemoteAddr = net.JoinHostPort(testcase.requestIP, "0")
+				router.ServeHTTP(w, req)
+
+				assert.Equal(t, testcase.expectedStatus, w.Code, path)
+			}
+		})
+	}
+}
+
+func TestTrimStringValues(t *testing.T) {
+	type testCase struct {
+		testName string
+		raw      string
+		expected string
+	}
+
+	testCases := []testCase{
+		{"trailing newline", `{"hostname": "instance-a\n", "plan": "c3.small.x86"}`, `{"hostname":"instance-a","plan":"c3.small.x86"}`},
+		{"surrounding whitespace", `{"hostname": " \tinstance-a \r\n"}`, `{"hostname":"instance-a"}`},
+		{"nested values untouched", `{"hostname": "instance-a\n", "customdata": {"note": "keep\n"}, "tags": ["keep\n"]}`, `{"customdata":{"note":"keep\n"},"hostname":"instance-a","tags":["keep\n"]}`},
+		{"html characters unescaped", `{"hostname": "instance-a\n", "note": "<a&b>"}`, `{"hostname":"instance-a","note":"<a&b>"}`},
+		{"nothing to trim", `{"hostname": "instance-a", "spot": {}}`, `{"hostname": "instance-a", "spot": {}}`},
+		{"array", `["instance-a\n"]`, `["instance-a\n"]`},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			trimmed, err := v1api.TrimStringValues(json.RawMessage(testcase.raw))
+			require.NoError(t, err)
+			assert.Equal(t, testcase.expected, string(trimmed))
+		})
+	}
+}
+
+// TestSetMetadataTrimStringValues tests that, when enabled, the whitespace
+// surrounding top-level metadata string values is trimmed before they're
+// stored, so it doesn't end up in the EC2 item responses.
+func TestSetMetadataTrimStringValues(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{MetadataTrimStringValues: true})
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	instanceID := "6d8f0a2c-4e6b-4c8d-9f1a-3b5d7f9a1c2e"
+	instanceIP := "192.168.110.1"
+
+	reqBody, err := json.Marshal(&v1api.UpsertMetadataRequest{
+		ID:          instanceID,
+		Metadata:    json.RawMessage(`{"hostname": "instance-a\n", "plan": " c3.small.x86 "}`),
+		IPAddresses: []string{instanceIP},
+	})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	stored, err := models.FindInstanceMetadatum(context.TODO(), dbtools.TestDB(), instanceID)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"hostname": "instance-a", "plan": "c3.small.x86"}`, stored.Metadata.String())
+
+	w = httptest.NewRecorder()
+
+	req, _ = http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetEc2MetadataItemPath("hostname"), nil)
+	req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "instance-a", w.Body.String())
+}
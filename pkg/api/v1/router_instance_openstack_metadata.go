@@ -0,0 +1,63 @@
+package metadataservice
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/pkg/api/v1/ec2"
+	"go.hollow.sh/metadataservice/pkg/api/v1/openstack"
+)
+
+// instanceOpenstackMetadataGet returns the OpenStack-style meta_data.json
+// document for the instance, built from its metadata.
+func (r *Router) instanceOpenstackMetadataGet(c *gin.Context) {
+	instanceMetadata, err := r.getMetadata(c)
+
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			r.instanceNotFoundResponse(c)
+		} else {
+			r.metadataErrorResponse(c, err)
+		}
+
+		return
+	}
+
+	metadata, err := ec2.ParseMetadata([]byte(instanceMetadata.Metadata), r.EC2SchemaVersion)
+
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, &ErrorResponse{Errors: []string{"Invalid metadata for instance"}})
+		return
+	}
+
+	// The record may not include its own ID, but we always know it.
+	metadata = ec2.WithInstanceIDFallback(metadata, instanceMetadata.ID)
+
+	setInstanceIDHeader(c, instanceMetadata.ID)
+	c.JSON(http.StatusOK, openstack.NewOpenstackMetadata(metadata))
+}
+
+// instanceOpenstackUserdataGet returns the instance's userdata. cloud-init
+// treats the OpenStack userdata as optional, so instances without any get a
+// 404.
+func (r *Router) instanceOpenstackUserdataGet(c *gin.Context) {
+	if r.maintenanceUserdataResponse(c) {
+		return
+	}
+
+	userdata, err := r.getUserdata(c)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			r.instanceNotFoundResponse(c)
+		} else {
+			r.dbErrorResponse(c, err)
+		}
+
+		return
+	}
+
+	setInstanceIDHeader(c, userdata.ID)
+	r.userdataResponse(c, userdata.ID, userdata.Userdata.Bytes)
+}
@@ -0,0 +1,95 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+	"go.hollow.sh/metadataservice/pkg/api/v1/openstack"
+)
+
+func TestGetOpenstackMetadata(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	type testCase struct {
+		testName       string
+		instanceIP     string
+		expectedStatus int
+	}
+
+	testCases := []testCase{
+		{"unknown IPv4 address", "1.2.3.4", http.StatusNotFound},
+		{"instance A", dbtools.FixtureInstanceA.HostIPs[0], http.StatusOK},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetOpenstackMetadataPath(), nil)
+			req.RemoteAddr = net.JoinHostPort(testcase.instanceIP, "0")
+			router.ServeHTTP(w, req)
+
+			require.Equal(t, testcase.expectedStatus, w.Code)
+
+			if testcase.expectedStatus != http.StatusOK {
+				return
+			}
+
+			doc := openstack.OpenstackMetadata{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+
+			assert.Equal(t, dbtools.FixtureInstanceA.InstanceID, doc.UUID)
+			assert.Equal(t, "instance-a", doc.Name)
+			assert.Equal(t, "instance-a", doc.Hostname)
+			assert.Equal(t, "da11", doc.AvailabilityZone)
+
+			// Both of instance A's keys have the same comment, so they're
+			// named by their index instead.
+			assert.Len(t, doc.PublicKeys, 2)
+			assert.Contains(t, doc.PublicKeys, "key-0")
+			assert.Contains(t, doc.PublicKeys, "key-1")
+		})
+	}
+}
+
+func TestGetOpenstackUserdata(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	type testCase struct {
+		testName       string
+		instanceIP     string
+		expectedStatus int
+		expectedBody   string
+	}
+
+	testCases := []testCase{
+		{"unknown IPv4 address", "1.2.3.4", http.StatusNotFound, ""},
+		{"instance A", dbtools.FixtureInstanceA.HostIPs[0], http.StatusOK, string(dbtools.FixtureInstanceA.InstanceUserdata.Userdata.Bytes)},
+		{"instance B without userdata", dbtools.FixtureInstanceB.HostIPs[0], http.StatusNotFound, ""},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetOpenstackUserdataPath(), nil)
+			req.RemoteAddr = net.JoinHostPort(testcase.instanceIP, "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+
+			if testcase.expectedStatus == http.StatusOK {
+				assert.Equal(t, testcase.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
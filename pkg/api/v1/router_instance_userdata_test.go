@@ -2,19 +2,30 @@ package metadataservice_test
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
+	"strings"
 	"testing"
+	"text/template"
+	"time"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.hollow.sh/toolbox/ginjwt"
+	"go.uber.org/zap"
 
 	"go.hollow.sh/metadataservice/internal/dbtools"
 	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/variants"
 	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
 )
 
@@ -113,6 +124,133 @@ func TestGetUserDataByIP(t *testing.T) {
 	}
 }
 
+// TestGetUserdataGeneratedFromTemplate tests that userdata is generated from
+// the configured template for instances with metadata but no stored userdata.
+func TestGetUserdataGeneratedFromTemplate(t *testing.T) {
+	userdataTmpl, err := template.New("userdata").Parse("#cloud-config\nhostname: {{.hostname}}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := *testHTTPServerWithConfig(t, TestServerConfig{UserdataTemplate: userdataTmpl})
+
+	type testCase struct {
+		testName           string
+		instanceIP         string
+		expectedStatus     int
+		expectedInstanceID string
+		expectedBody       string
+	}
+
+	testCases := []testCase{
+		{
+			"unknown IP address",
+			"1.2.3.4",
+			http.StatusNotFound,
+			"",
+			"",
+		},
+		{
+			"stored userdata takes precedence",
+			dbtools.FixtureInstanceA.HostIPs[0],
+			http.StatusOK,
+			dbtools.FixtureInstanceA.InstanceID,
+			string(dbtools.FixtureInstanceA.InstanceUserdata.Userdata.Bytes),
+		},
+		{
+			"metadata without userdata",
+			dbtools.FixtureInstanceB.HostIPs[0],
+			http.StatusOK,
+			dbtools.FixtureInstanceB.InstanceID,
+			"#cloud-config\nhostname: instance-b\n",
+		},
+		{
+			"userdata without metadata",
+			dbtools.FixtureInstanceE.HostIPs[0],
+			http.StatusOK,
+			dbtools.FixtureInstanceE.InstanceID,
+			string(dbtools.FixtureInstanceE.InstanceUserdata.Userdata.Bytes),
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetUserdataPath(), nil)
+			req.RemoteAddr = net.JoinHostPort(testcase.instanceIP, "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+
+			if testcase.expectedStatus == http.StatusOK {
+				assert.Equal(t, testcase.expectedInstanceID, w.Header().Get(v1api.InstanceIDHeader))
+				assert.Equal(t, testcase.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
+
+// TestGetDefaultUserdata tests that the default userdata is served to known
+// instances without stored userdata, on both the /userdata and EC2-style
+// endpoints, while unknown instances still get a 404.
+func TestGetDefaultUserdata(t *testing.T) {
+	defaultUserdata := "#cloud-config\npackage_upgrade: true\n"
+
+	router := *testHTTPServerWithConfig(t, TestServerConfig{DefaultUserdata: []byte(defaultUserdata)})
+
+	type testCase struct {
+		testName           string
+		instanceIP         string
+		expectedStatus     int
+		expectedInstanceID string
+		expectedBody       string
+	}
+
+	testCases := []testCase{
+		{
+			"unknown IP address",
+			"1.2.3.4",
+			http.StatusNotFound,
+			"",
+			"",
+		},
+		{
+			"stored userdata takes precedence",
+			dbtools.FixtureInstanceA.HostIPs[0],
+			http.StatusOK,
+			dbtools.FixtureInstanceA.InstanceID,
+			string(dbtools.FixtureInstanceA.InstanceUserdata.Userdata.Bytes),
+		},
+		{
+			"known instance without userdata",
+			dbtools.FixtureInstanceB.HostIPs[0],
+			http.StatusOK,
+			dbtools.FixtureInstanceB.InstanceID,
+			defaultUserdata,
+		},
+	}
+
+	for _, testcase := range testCases {
+		for _, path := range []string{v1api.GetUserdataPath(), v1api.GetEc2UserdataPath()} {
+			t.Run(testcase.testName+" "+path, func(t *testing.T) {
+				w := httptest.NewRecorder()
+
+				req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+				req.RemoteAddr = net.JoinHostPort(testcase.instanceIP, "0")
+				router.ServeHTTP(w, req)
+
+				assert.Equal(t, testcase.expectedStatus, w.Code)
+
+				if testcase.expectedStatus == http.StatusOK {
+					assert.Equal(t, testcase.expectedInstanceID, w.Header().Get(v1api.InstanceIDHeader))
+					assert.Equal(t, testcase.expectedBody, w.Body.String())
+				}
+			})
+		}
+	}
+}
+
 // TestSetUserdataRequestValidations tests the different validations performed
 // on the request body
 func TestSetUserdataRequestValidations(t *testing.T) {
@@ -195,6 +333,72 @@ func TestSetUserdataRequestValidations(t *testing.T) {
 	}
 }
 
+// TestSetUserdataRequireUTF8 tests that, when enabled, userdata that isn't
+// valid UTF-8 is rejected unless it's gzip'd.
+func TestSetUserdataRequireUTF8(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{UserdataRequireUTF8: true})
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	var gzipped bytes.Buffer
+
+	zw := gzip.NewWriter(&gzipped)
+
+	if _, err := zw.Write([]byte(userdata1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	type testCase struct {
+		testName       string
+		userdata       []byte
+		expectedStatus int
+	}
+
+	testCases := []testCase{
+		{
+			"valid UTF-8",
+			[]byte("#cloud-config\nwrite_files:\n  - content: héllo wörld ✓\n"),
+			http.StatusCreated,
+		},
+		{
+			"invalid UTF-8",
+			[]byte{'#', '!', 0xff, 0xfe, 0xfd},
+			http.StatusBadRequest,
+		},
+		{
+			"gzip'd userdata",
+			gzipped.Bytes(),
+			http.StatusOK,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			reqBody, err := json.Marshal(&v1api.UpsertUserdataRequest{
+				ID:          "0b5f6a43-5a1c-4b0e-8f3e-7d1c2b9a6e54",
+				Userdata:    testcase.userdata,
+				IPAddresses: []string{"192.168.20.1"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalUserdataPath(), bytes.NewReader(reqBody))
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+		})
+	}
+}
+
 // TestSetUserdataIPAddressConflict tests the actions performed when the
 // incoming request specifies an IP address (or multiple IP addresses) that are
 // currently associated to another instance.
@@ -285,7 +489,7 @@ func TestSetUserdataIPAddressConflict(t *testing.T) {
 			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalUserdataPath(), bytes.NewReader(reqBody))
 			router.ServeHTTP(w, req)
 
-			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, http.StatusCreated, w.Code)
 
 			// Check that the conflicting InstanceIPAddress row has been deleted
 			for id, conflictIPs := range testcase.conflictInstanceIDToIPs {
@@ -332,7 +536,7 @@ func TestSetUserdataCreateUserdata(t *testing.T) {
 
 	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalUserdataPath(), bytes.NewReader(reqBody))
 	router.ServeHTTP(w, req)
-	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusCreated, w.Code)
 
 	instanceUserdata, _ := models.InstanceUserdata(models.InstanceUserdatumWhere.ID.EQ(requestBody.ID)).One(context.TODO(), testDB)
 	assert.NotNil(t, instanceUserdata)
@@ -493,6 +697,377 @@ func TestGetUserdataInternal(t *testing.T) {
 	}
 }
 
+// TestGetUserdataInternalDecompress tests that the internal userdata endpoint
+// only decompresses gzip'd userdata when asked to, and leaves plain userdata
+// untouched either way.
+func TestGetUserdataInternalDecompress(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	var gzipped bytes.Buffer
+
+	zw := gzip.NewWriter(&gzipped)
+
+	if _, err := zw.Write([]byte(userdata1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	gzippedID := "8a5a3e4a-3c9e-4b5e-9a4c-0f2c4d7b9e11"
+
+	reqBody, err := json.Marshal(&v1api.UpsertUserdataRequest{
+		ID:          gzippedID,
+		Userdata:    gzipped.Bytes(),
+		IPAddresses: []string{"192.168.10.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalUserdataPath(), bytes.NewReader(reqBody))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	type testCase struct {
+		testName     string
+		path         string
+		expectedBody string
+	}
+
+	testCases := []testCase{
+		{
+			"gzip'd userdata, raw",
+			v1api.GetInternalUserdataByIDPath(gzippedID),
+			gzipped.String(),
+		},
+		{
+			"gzip'd userdata, decompressed",
+			v1api.GetInternalUserdataByIDPath(gzippedID) + "?decompress=true",
+			userdata1,
+		},
+		{
+			"plain userdata, decompressed",
+			v1api.GetInternalUserdataByIDPath(dbtools.FixtureInstanceA.InstanceID) + "?decompress=true",
+			string(dbtools.FixtureInstanceA.InstanceUserdata.Userdata.Bytes),
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, testcase.path, nil)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, testcase.expectedBody, w.Body.String())
+		})
+	}
+}
+
+// TestUserdataInternalHeadMatchesGet tests that the Content-Length of a HEAD
+// request for gzip'd userdata matches the length of the body a GET request
+// gets, whether the userdata ends up compressed or decompressed.
+func TestUserdataInternalHeadMatchesGet(t *testing.T) {
+	var gzipped bytes.Buffer
+
+	zw := gzip.NewWriter(&gzipped)
+
+	if _, err := zw.Write([]byte(userdata1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	type testCase struct {
+		testName                string
+		gzipPassthrough         bool
+		query                   string
+		acceptEncoding          string
+		expectedContentEncoding string
+		expectedBody            string
+	}
+
+	testCases := []testCase{
+		{"as stored, accepts gzip", false, "", "gzip", "", gzipped.String()},
+		{"as stored, no Accept-Encoding", false, "", "", "", gzipped.String()},
+		{"decompress requested", false, "?decompress=true", "gzip", "", userdata1},
+		{"passthrough, accepts gzip", true, "", "gzip", "gzip", gzipped.String()},
+		{"passthrough, no Accept-Encoding", true, "", "", "", userdata1},
+		{"passthrough, refuses gzip", true, "", "gzip;q=0", "", userdata1},
+		{"passthrough, decompress requested", true, "?decompress=true", "gzip", "", userdata1},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			router := *testHTTPServerWithConfig(t, TestServerConfig{UserdataGzipPassthrough: testcase.gzipPassthrough})
+
+			instanceID := "5c7e9a1b-3d5f-4a7c-9e1b-3d5f7a9c1e3b"
+
+			reqBody, err := json.Marshal(&v1api.UpsertUserdataRequest{
+				ID:          instanceID,
+				Userdata:    gzipped.Bytes(),
+				IPAddresses: []string{"192.168.71.1"},
+			})
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalUserdataPath(), bytes.NewReader(reqBody))
+			router.ServeHTTP(w, req)
+			require.Equal(t, http.StatusCreated, w.Code)
+
+			path := v1api.GetInternalUserdataByIDPath(instanceID) + testcase.query
+
+			getW := httptest.NewRecorder()
+			req, _ = http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+			req.Header.Set("Accept-Encoding", testcase.acceptEncoding)
+			router.ServeHTTP(getW, req)
+
+			require.Equal(t, http.StatusOK, getW.Code)
+			assert.Equal(t, testcase.expectedBody, getW.Body.String())
+			assert.Equal(t, testcase.expectedContentEncoding, getW.Header().Get("Content-Encoding"))
+
+			headW := httptest.NewRecorder()
+			req, _ = http.NewRequestWithContext(context.TODO(), http.MethodHead, path, nil)
+			req.Header.Set("Accept-Encoding", testcase.acceptEncoding)
+			router.ServeHTTP(headW, req)
+
+			response := headW.Result()
+			defer response.Body.Close()
+
+			require.Equal(t, http.StatusOK, headW.Code)
+			assert.Equal(t, int64(getW.Body.Len()), response.ContentLength)
+			assert.Equal(t, testcase.expectedContentEncoding, headW.Header().Get("Content-Encoding"))
+		})
+	}
+}
+
+// TestGetUserdataGzipPassthrough tests that, when enabled, gzip'd userdata is
+// served as-is with a Content-Encoding header to clients that accept gzip, and
+// decompressed for clients that don't.
+func TestGetUserdataGzipPassthrough(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{UserdataGzipPassthrough: true})
+
+	var gzipped bytes.Buffer
+
+	zw := gzip.NewWriter(&gzipped)
+
+	if _, err := zw.Write([]byte(userdata1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	instanceIP := "192.168.70.1"
+
+	reqBody, err := json.Marshal(&v1api.UpsertUserdataRequest{
+		ID:          "2d4f6a8c-1b3e-4d5f-a7b9-c1d3e5f7a9b1",
+		Userdata:    gzipped.Bytes(),
+		IPAddresses: []string{instanceIP},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalUserdataPath(), bytes.NewReader(reqBody))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	type testCase struct {
+		testName                string
+		path                    string
+		acceptEncoding          string
+		expectedContentEncoding string
+		expectedBody            string
+	}
+
+	testCases := []testCase{
+		{
+			"client accepts gzip",
+			v1api.GetUserdataPath(),
+			"gzip, deflate",
+			"gzip",
+			gzipped.String(),
+		},
+		{
+			"client doesn't send Accept-Encoding",
+			v1api.GetUserdataPath(),
+			"",
+			"",
+			userdata1,
+		},
+		{
+			"client refuses gzip",
+			v1api.GetUserdataPath(),
+			"gzip;q=0, identity",
+			"",
+			userdata1,
+		},
+		{
+			"ec2 client accepts gzip",
+			v1api.GetEc2UserdataPath(),
+			"gzip",
+			"gzip",
+			gzipped.String(),
+		},
+		{
+			"ec2 client doesn't accept gzip",
+			v1api.GetEc2UserdataPath(),
+			"identity",
+			"",
+			userdata1,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, testcase.path, nil)
+			req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+
+			if testcase.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", testcase.acceptEncoding)
+			}
+
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, testcase.expectedContentEncoding, w.Header().Get("Content-Encoding"))
+			assert.Equal(t, []string{"Accept", "Accept-Encoding"}, w.Header().Values("Vary"))
+			assert.Equal(t, testcase.expectedBody, w.Body.String())
+		})
+	}
+}
+
+// TestUserdataNormalizeLineEndings tests that CRLF line endings in userdata are
+// converted to LF when it's stored or when it's served, depending on the
+// configured mode, and that gzip'd userdata is left untouched.
+func TestUserdataNormalizeLineEndings(t *testing.T) {
+	// One server per mode, sharing the test database
+	routers := map[string]http.Handler{}
+	for _, mode := range []string{"", v1api.UserdataLineEndingsStore, v1api.UserdataLineEndingsServe} {
+		routers[mode] = *testHTTPServerWithConfig(t, TestServerConfig{UserdataLineEndingsMode: mode})
+	}
+
+	crlfUserdata := "#!/bin/bash\r\necho hello\r\nexit 0\r\n"
+	lfUserdata := "#!/bin/bash\necho hello\nexit 0\n"
+
+	var gzipped bytes.Buffer
+
+	zw := gzip.NewWriter(&gzipped)
+
+	if _, err := zw.Write([]byte(crlfUserdata)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	type testCase struct {
+		testName       string
+		mode           string
+		instanceID     string
+		instanceIP     string
+		userdata       string
+		expectedStored string
+		expectedServed string
+	}
+
+	testCases := []testCase{
+		{
+			"disabled",
+			"",
+			"4a1c7e2b-8d3f-4b6a-9e5c-1f2a3b4c5d01",
+			"192.168.71.1",
+			crlfUserdata,
+			crlfUserdata,
+			crlfUserdata,
+		},
+		{
+			"normalized on store",
+			v1api.UserdataLineEndingsStore,
+			"4a1c7e2b-8d3f-4b6a-9e5c-1f2a3b4c5d02",
+			"192.168.71.2",
+			crlfUserdata,
+			lfUserdata,
+			lfUserdata,
+		},
+		{
+			"normalized on serve",
+			v1api.UserdataLineEndingsServe,
+			"4a1c7e2b-8d3f-4b6a-9e5c-1f2a3b4c5d03",
+			"192.168.71.3",
+			crlfUserdata,
+			crlfUserdata,
+			lfUserdata,
+		},
+		{
+			"gzip'd userdata on store",
+			v1api.UserdataLineEndingsStore,
+			"4a1c7e2b-8d3f-4b6a-9e5c-1f2a3b4c5d04",
+			"192.168.71.4",
+			gzipped.String(),
+			gzipped.String(),
+			gzipped.String(),
+		},
+		{
+			"gzip'd userdata on serve",
+			v1api.UserdataLineEndingsServe,
+			"4a1c7e2b-8d3f-4b6a-9e5c-1f2a3b4c5d05",
+			"192.168.71.5",
+			gzipped.String(),
+			gzipped.String(),
+			gzipped.String(),
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			reqBody, err := json.Marshal(&v1api.UpsertUserdataRequest{
+				ID:          testcase.instanceID,
+				Userdata:    []byte(testcase.userdata),
+				IPAddresses: []string{testcase.instanceIP},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalUserdataPath(), bytes.NewReader(reqBody))
+			routers[testcase.mode].ServeHTTP(w, req)
+			assert.Equal(t, http.StatusCreated, w.Code)
+
+			userdata, err := models.FindInstanceUserdatum(context.TODO(), dbtools.TestDB(), testcase.instanceID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, testcase.expectedStored, string(userdata.Userdata.Bytes))
+
+			for _, path := range []string{v1api.GetUserdataPath(), v1api.GetEc2UserdataPath()} {
+				w = httptest.NewRecorder()
+
+				req, _ = http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+				req.RemoteAddr = net.JoinHostPort(testcase.instanceIP, "0")
+				routers[testcase.mode].ServeHTTP(w, req)
+
+				assert.Equal(t, http.StatusOK, w.Code, path)
+				assert.Equal(t, testcase.expectedServed, w.Body.String(), path)
+			}
+		})
+	}
+}
+
 func TestDeleteUserdata(t *testing.T) {
 	router := *testHTTPServer(t)
 	testDB := dbtools.TestDB()
@@ -591,3 +1166,339 @@ func TestDeleteUserdata(t *testing.T) {
 		})
 	}
 }
+
+// TestGetUserdataVerifyIPOwnership tests that with VerifyIPOwnership set,
+// userdata is only served to request IPs which are listed in the instance's
+// stored metadata.
+func TestGetUserdataVerifyIPOwnership(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{VerifyIPOwnership: true})
+
+	type testCase struct {
+		testName       string
+		requestIP      string
+		expectedStatus int
+	}
+
+	testCases := []testCase{
+		{"listed address", "10.70.17.9", http.StatusOK},
+		// Instance A is associated to 10.70.17.8/31, but its metadata only
+		// lists 10.70.17.9.
+		{"unlisted address within an associated CIDR", "10.70.17.8", http.StatusNotFound},
+		// Instance E has userdata, but no metadata to verify against.
+		{"instance without metadata", dbtools.FixtureInstanceE.HostIPs[0], http.StatusNotFound},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetUserdataPath(), nil)
+			req.RemoteAddr = net.JoinHostPort(testcase.requestIP, "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+		})
+	}
+}
+
+// TestUserdataCompressedAtRest tests that userdata compressed at rest is
+// served by the public and internal endpoints as it was upserted.
+func TestUserdataCompressedAtRest(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	viper.Set("userdata.compress_threshold", 1024)
+	defer viper.Set("userdata.compress_threshold", 0)
+
+	instanceID := "5e0c1d2a-7b3f-4c8d-9e1f-2a3b4c5d6e7f"
+	instanceIP := "192.168.70.1"
+	userdata := bytes.Repeat([]byte("#!/bin/sh\necho 'provisioning step'\n"), 1000)
+
+	reqBody, err := json.Marshal(&v1api.UpsertUserdataRequest{
+		ID:          instanceID,
+		Userdata:    userdata,
+		IPAddresses: []string{instanceIP},
+	})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalUserdataPath(), bytes.NewReader(reqBody))
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	stored, err := models.FindInstanceUserdatum(context.TODO(), dbtools.TestDB(), instanceID)
+	require.NoError(t, err)
+	assert.True(t, stored.Compressed)
+	assert.Less(t, len(stored.Userdata.Bytes), len(userdata))
+
+	w = httptest.NewRecorder()
+
+	req, _ = http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalUserdataByIDPath(instanceID), nil)
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, userdata, w.Body.Bytes())
+
+	w = httptest.NewRecorder()
+
+	req, _ = http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetUserdataPath(), nil)
+	req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, userdata, w.Body.Bytes())
+}
+
+// TestGetUserdataBase64 tests that the public userdata endpoints base64-encode
+// the stored userdata bytes when asked to, and serve them raw otherwise.
+func TestGetUserdataBase64(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	instanceID := "7a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d"
+	instanceIP := "192.168.80.1"
+
+	// Userdata which isn't valid UTF-8, so it would be mangled by anything
+	// treating it as text.
+	userdata := []byte{0x00, 0xff, 0xfe, 0x80, 0x7f, '\r', '\n', 0x01, 0xc3}
+
+	reqBody, err := json.Marshal(&v1api.UpsertUserdataRequest{
+		ID:          instanceID,
+		Userdata:    userdata,
+		IPAddresses: []string{instanceIP},
+	})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalUserdataPath(), bytes.NewReader(reqBody))
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	type testCase struct {
+		testName       string
+		query          string
+		accept         string
+		expectedBase64 bool
+	}
+
+	testCases := []testCase{
+		{"no encoding requested", "", "", false},
+		{"encoding query parameter", "?encoding=base64", "", true},
+		{"accept header", "", v1api.Base64UserdataContentType, true},
+		{"accept header with other media types", "", "text/plain;q=0.5, text/base64", true},
+		{"other accepted media type", "", "text/plain", false},
+	}
+
+	for _, testcase := range testCases {
+		for _, path := range []string{v1api.GetUserdataPath(), v1api.GetEc2UserdataPath()} {
+			t.Run(testcase.testName+" "+path, func(t *testing.T) {
+				w := httptest.NewRecorder()
+
+				req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path+testcase.query, nil)
+				req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+
+				if testcase.accept != "" {
+					req.Header.Set("Accept", testcase.accept)
+				}
+
+				router.ServeHTTP(w, req)
+
+				require.Equal(t, http.StatusOK, w.Code)
+
+				// Both encodings are served from the same URL
+				assert.Equal(t, "Accept", w.Header().Get("Vary"))
+
+				if !testcase.expectedBase64 {
+					assert.Equal(t, userdata, w.Body.Bytes())
+					return
+				}
+
+				assert.Equal(t, v1api.Base64UserdataContentType, w.Header().Get("Content-Type"))
+
+				decoded, err := base64.StdEncoding.DecodeString(w.Body.String())
+				require.NoError(t, err)
+				assert.Equal(t, userdata, decoded)
+			})
+		}
+	}
+}
+
+// TestUserdataVariants tests that named userdata variants are stored and
+// served alongside an instance's default userdata.
+func TestUserdataVariants(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	instanceID := "3c9a8b7d-6e5f-4d3c-8b2a-1f0e9d8c7b6a"
+	instanceIP := "192.168.90.1"
+
+	userdata := map[string]string{
+		"":             "#cloud-config\nhostname: default\n",
+		"ignition":     `{"ignition":{"version":"3.3.0"}}`,
+		"cloud-config": "#cloud-config\nhostname: variant\n",
+	}
+
+	for variant, data := range userdata {
+		reqBody, err := json.Marshal(&v1api.UpsertUserdataRequest{
+			ID:          instanceID,
+			Userdata:    []byte(data),
+			IPAddresses: []string{instanceIP},
+			Variant:     variant,
+		})
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalUserdataPath(), bytes.NewReader(reqBody))
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusCreated, w.Code, variant)
+	}
+
+	for variant, data := range userdata {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetUserdataPath()+"?variant="+variant, nil)
+		req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+		router.ServeHTTP(w, req)
+
+		require.Equal(t, http.StatusOK, w.Code, variant)
+		assert.Equal(t, data, w.Body.String(), variant)
+	}
+
+	// Variants which weren't upserted aren't found, even though the instance
+	// has default userdata.
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetUserdataPath()+"?variant=missing", nil)
+	req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+
+	req, _ = http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetUserdataPath()+"?variant=not/valid", nil)
+	req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Deleting the userdata deletes its variants too.
+	w = httptest.NewRecorder()
+
+	req, _ = http.NewRequestWithContext(context.TODO(), http.MethodDelete, v1api.GetInternalUserdataByIDPath(instanceID), nil)
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	_, err := variants.Find(context.TODO(), dbtools.TestDB(), instanceID, "ignition")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+// TestUserdataVariantsWithoutDefaultUserdata tests that an instance with
+// userdata variants, but no default userdata, keeps its IP addresses when its
+// metadata is deleted, and that its variants can be deleted.
+func TestUserdataVariantsWithoutDefaultUserdata(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	instanceID := "5d7e9f1a-2b3c-4d5e-8f9a-0b1c2d3e4f5a"
+	instanceIP := "192.168.91.1"
+
+	metadataBody, err := json.Marshal(&v1api.UpsertMetadataRequest{
+		ID:          instanceID,
+		Metadata:    json.RawMessage(`{"hostname": "variants-only"}`),
+		IPAddresses: []string{instanceIP},
+	})
+	require.NoError(t, err)
+
+	userdataBody, err := json.Marshal(&v1api.UpsertUserdataRequest{
+		ID:          instanceID,
+		Userdata:    []byte(`{"ignition":{"version":"3.3.0"}}`),
+		IPAddresses: []string{instanceIP},
+		Variant:     "ignition",
+	})
+	require.NoError(t, err)
+
+	for path, body := range map[string][]byte{v1api.GetInternalMetadataPath(): metadataBody, v1api.GetInternalUserdataPath(): userdataBody} {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, path, bytes.NewReader(body))
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusCreated, w.Code, path)
+	}
+
+	getVariant := func() int {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetUserdataPath()+"?variant=ignition", nil)
+		req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+		router.ServeHTTP(w, req)
+
+		return w.Code
+	}
+
+	// The variant was pushed with the IP address, so deleting the metadata
+	// leaves it in place.
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodDelete, v1api.GetInternalMetadataByIDPath(instanceID), nil)
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, http.StatusOK, getVariant())
+
+	// Deleting the userdata deletes the variants, and then the IP addresses.
+	w = httptest.NewRecorder()
+
+	req, _ = http.NewRequestWithContext(context.TODO(), http.MethodDelete, v1api.GetInternalUserdataByIDPath(instanceID), nil)
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, http.StatusNotFound, getVariant())
+
+	exists, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).Exists(context.TODO(), dbtools.TestDB())
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// With nothing left, there's no userdata to delete.
+	w = httptest.NewRecorder()
+
+	req, _ = http.NewRequestWithContext(context.TODO(), http.MethodDelete, v1api.GetInternalUserdataByIDPath(instanceID), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestUpsertUserdataInvalidVariant(t *testing.T) {
+	authMW, err := ginjwt.NewAuthMiddleware(ginjwt.AuthConfig{})
+	require.NoError(t, err)
+
+	router := testRouter(v1api.NewRouter(zap.NewNop(), nil, authMW, nil))
+
+	for _, variant := range []string{"not/valid", "with space", strings.Repeat("a", 65)} {
+		reqBody, err := json.Marshal(&v1api.UpsertUserdataRequest{
+			ID:          "3c9a8b7d-6e5f-4d3c-8b2a-1f0e9d8c7b6a",
+			Userdata:    []byte("#cloud-config\n"),
+			IPAddresses: []string{"192.168.90.1"},
+			Variant:     variant,
+		})
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalUserdataPath(), bytes.NewReader(reqBody))
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, variant)
+	}
+}
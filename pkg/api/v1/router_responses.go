@@ -6,13 +6,21 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"text/template"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"github.com/volatiletech/sqlboiler/v4/types"
 	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+
+	"go.hollow.sh/metadataservice/internal/upserter"
 )
 
 // ErrorResponse represents an error response record
@@ -21,20 +29,129 @@ type ErrorResponse struct {
 	Errors  []string `json:"errors,omitempty"`
 }
 
-func dbErrorResponse(logger *zap.Logger, c *gin.Context, err error) {
-	if errors.Is(err, sql.ErrNoRows) {
+func (r *Router) dbErrorResponse(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
 		notFoundResponse(c)
-	} else {
-		logger.Error("database error", zap.Error(err))
+	default:
+		r.Logger.Error("database error", zap.Error(err))
+
+		r.internalErrorResponse(c, err)
+	}
+}
+
+// metadataErrorResponse responds to a failure to get the requesting
+// instance's metadata with getMetadata: a 403 if the request didn't present
+// the instance's fingerprint, or the dbErrorResponse otherwise.
+func (r *Router) metadataErrorResponse(c *gin.Context, err error) {
+	if errors.Is(err, errFingerprintMismatch) {
+		c.AbortWithStatusJSON(http.StatusForbidden, &ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	r.dbErrorResponse(c, err)
+}
+
+// upsertErrorResponse responds to a failed metadata or userdata upsert: a 409
+// if it was rejected per crdb.ip_conflict_policy, or the dbErrorResponse
+// otherwise.
+func (r *Router) upsertErrorResponse(c *gin.Context, err error) {
+	if errors.Is(err, upserter.ErrIPConflictNotNewer) {
+		c.AbortWithStatusJSON(http.StatusConflict, &ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	r.dbErrorResponse(c, err)
+}
+
+// internalErrorResponse responds with a generic 500. The error itself is only
+// included in the response when ExposeErrors is set, for debugging.
+func (r *Router) internalErrorResponse(c *gin.Context, err error) {
+	errMsgs := []string{"internal server error"}
 
-		c.JSON(http.StatusInternalServerError, &ErrorResponse{Errors: []string{"internal server error"}})
+	if r.ExposeErrors && err != nil {
+		errMsgs = append(errMsgs, err.Error())
 	}
+
+	c.AbortWithStatusJSON(http.StatusInternalServerError, &ErrorResponse{Errors: errMsgs})
 }
 
 func notFoundResponse(c *gin.Context) {
 	c.AbortWithStatusJSON(http.StatusNotFound, &ErrorResponse{Message: "resource not found"})
 }
 
+// instanceNotFoundResponse is used by the public (instance-facing) endpoints
+// when no data could be found for the requesting instance. Its message differs
+// from the one returned for unknown routes, so clients can tell the two apart.
+// If configured, a Retry-After header is included so clients racing the
+// provisioning system back off and retry instead of giving up.
+func (r *Router) instanceNotFoundResponse(c *gin.Context) {
+	r.setNotFoundRetryAfter(c)
+
+	message := r.NotFoundMessage
+	if message == "" {
+		message = DefaultInstanceNotFoundMessage
+	}
+
+	c.AbortWithStatusJSON(http.StatusNotFound, &ErrorResponse{Message: message})
+}
+
+// ec2NotFoundResponse is instanceNotFoundResponse for the EC2-style
+// endpoints. Real IMDS returns plain-text 404s, which some clients rely on,
+// so requests preferring text/plain get a plain "Not Found" body instead.
+// Everything else, including requests without an Accept header, still gets
+// the JSON ErrorResponse.
+func (r *Router) ec2NotFoundResponse(c *gin.Context) {
+	if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEPlain) != gin.MIMEPlain {
+		r.instanceNotFoundResponse(c)
+		return
+	}
+
+	r.setNotFoundRetryAfter(c)
+
+	c.Abort()
+	c.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+}
+
+// setNotFoundRetryAfter sets the Retry-After header on a 404 for an unknown
+// instance, if NotFoundRetryAfter is configured.
+func (r *Router) setNotFoundRetryAfter(c *gin.Context) {
+	if r.NotFoundRetryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(r.NotFoundRetryAfter.Seconds()))))
+	}
+}
+
+// setInstanceIDHeader sets the resolved instance ID on the response, for
+// client-side debugging and caching.
+func setInstanceIDHeader(c *gin.Context, instanceID string) {
+	if instanceID != "" {
+		c.Header(InstanceIDHeader, instanceID)
+	}
+}
+
+// setTimestampHeaders sets when a record was first stored and last updated on
+// the response, in RFC 3339 format.
+func setTimestampHeaders(c *gin.Context, createdAt, updatedAt time.Time) {
+	c.Header(CreatedAtHeader, createdAt.UTC().Format(time.RFC3339Nano))
+	c.Header(UpdatedAtHeader, updatedAt.UTC().Format(time.RFC3339Nano))
+}
+
+// upsertResponse responds to a successful upsert with the status from
+// upsertStatus.
+func upsertResponse(c *gin.Context, created bool) {
+	c.Status(upsertStatus(created))
+}
+
+// upsertStatus returns 201 when an upsert created a new record, or 200 when it
+// updated an existing one.
+func upsertStatus(created bool) int {
+	if created {
+		return http.StatusCreated
+	}
+
+	return http.StatusOK
+}
+
 func badRequestResponse(c *gin.Context, message string, err error) {
 	var errMsgs []string
 	if err != nil {
@@ -89,11 +206,109 @@ func getErrorMessageFromError(err error) string {
 	return errMsg
 }
 
+// metadataResponse writes the metadata as JSON, or as YAML when the client asks
+// for it with a "format=yaml" query parameter or an Accept header. YAML map
+// keys are always sorted, so the output is deterministic.
+func (r *Router) metadataResponse(c *gin.Context, metadata interface{}) {
+	if !wantsYAML(c) {
+		c.JSON(http.StatusOK, metadata)
+		return
+	}
+
+	// Raw JSON has to be decoded first, or it would be encoded as a byte slice.
+	if raw, ok := metadata.(types.JSON); ok {
+		var decoded interface{}
+
+		if err := json.Unmarshal(raw, &decoded); err != nil {
+			r.internalErrorResponse(c, err)
+			return
+		}
+
+		metadata = decoded
+	}
+
+	out, err := yaml.Marshal(metadata)
+	if err != nil {
+		r.internalErrorResponse(c, err)
+		return
+	}
+
+	c.Data(http.StatusOK, YAMLContentType, out)
+}
+
+// wantsYAML reports whether the client asked for a YAML response.
+func wantsYAML(c *gin.Context) bool {
+	if format := c.Query("format"); format != "" {
+		return format == "yaml"
+	}
+
+	switch c.NegotiateFormat(gin.MIMEJSON, mimeYAML, gin.MIMEYAML) {
+	case mimeYAML, gin.MIMEYAML:
+		return true
+	default:
+		return false
+	}
+}
+
+// renameFields renames top-level metadata keys for output, according to the
+// old name -> new name map. An existing key with the new name is overwritten.
+func renameFields(metadata map[string]interface{}, renames map[string]string) {
+	for from, to := range renames {
+		if value, ok := metadata[from]; ok && from != to {
+			delete(metadata, from)
+			metadata[to] = value
+		}
+	}
+}
+
+// isEmptyJSONObject reports whether the given metadata is an empty JSON object
+// (that is, `{}`, ignoring whitespace).
+func isEmptyJSONObject(metadata types.JSON) bool {
+	var obj map[string]json.RawMessage
+
+	if err := json.Unmarshal(metadata, &obj); err != nil {
+		return false
+	}
+
+	return obj != nil && len(obj) == 0
+}
+
+// disallowedMetadataKeys returns the sorted top-level keys of the given
+// metadata JSON object which aren't in the allowlist.
+func disallowedMetadataKeys(metadata string, allowedKeys []string) ([]string, error) {
+	var obj map[string]json.RawMessage
+
+	if err := json.Unmarshal([]byte(metadata), &obj); err != nil {
+		return nil, err
+	}
+
+	allowed := make(map[string]bool, len(allowedKeys))
+	for _, key := range allowedKeys {
+		allowed[key] = true
+	}
+
+	var disallowed []string
+
+	for key := range obj {
+		if !allowed[key] {
+			disallowed = append(disallowed, key)
+		}
+	}
+
+	sort.Strings(disallowed)
+
+	return disallowed, nil
+}
+
 // addTemplateFields will unmarshal the raw JSON and attempt to augment it with
 // the configured template fields.
-// If an error occurs unmarshalling the json, or an error occurs while
+// Fields with a condition in TemplateFieldConditions are only added when the
+// condition is met.
+// If a template references a missing metadata key, the field is handled
+// according to the configured TemplateMissingKeyMode, if it's set.
+// If an error occurs unmarshalling the json, or any other error occurs while
 // executing a template, we'll just return nil, err.
-func addTemplateFields(metadata types.JSON, templateFields map[string]template.Template) (map[string]interface{}, error) {
+func (r *Router) addTemplateFields(metadata types.JSON) (map[string]interface{}, error) {
 	// Attempt to unmarshal the stored json for the instance.
 	resp := make(map[string]interface{})
 	err := json.Unmarshal(metadata, &resp)
@@ -103,21 +318,111 @@ func addTemplateFields(metadata types.JSON, templateFields map[string]template.T
 	}
 
 	// Now that we've unmarshaled the raw json message, augment it with the templated fields
-	for k, v := range templateFields {
+	for k, v := range r.TemplateFields {
 		// If the metadata already has a field with a matching name, just use what was provided.
 		if _, ok := resp[k]; ok {
 			continue
 		}
 
-		templateBuf := new(bytes.Buffer)
+		// Some fields only apply to certain instances.
+		if condition, ok := r.TemplateFieldConditions[k]; ok {
+			met, err := templateConditionMet(&condition, resp)
+			if err != nil {
+				return nil, err
+			}
+
+			if !met {
+				continue
+			}
+		}
 
-		err = v.Execute(templateBuf, resp)
+		rendered, err := executeTemplateField(&v, resp)
 		if err != nil {
-			return nil, err
+			if r.TemplateMissingKeyMode == "" || !isMissingKeyError(err) {
+				return nil, err
+			}
+
+			value, ok := r.templateMissingKeyValue(k)
+			if !ok {
+				continue
+			}
+
+			resp[k] = value
+
+			continue
 		}
 
-		resp[k] = templateBuf.String()
+		resp[k] = rendered
 	}
 
 	return resp, nil
 }
+
+// RenderTemplateField renders a template field against the given metadata,
+// the same way template fields are added to metadata responses.
+func RenderTemplateField(tmpl *template.Template, metadata types.JSON) (string, error) {
+	resp := make(map[string]interface{})
+
+	if err := json.Unmarshal(metadata, &resp); err != nil {
+		return "", err
+	}
+
+	return executeTemplateField(tmpl, resp)
+}
+
+// executeTemplateField executes a template field against the unmarshaled
+// metadata.
+func executeTemplateField(tmpl *template.Template, metadata map[string]interface{}) (string, error) {
+	buf := new(bytes.Buffer)
+
+	if err := tmpl.Execute(buf, metadata); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// templateConditionMet executes a template field condition against the
+// metadata and reports whether it rendered a truthy value. Anything other
+// than empty output (ignoring whitespace), "false", "0", or "<no value>" is
+// truthy.
+func templateConditionMet(condition *template.Template, metadata map[string]interface{}) (bool, error) {
+	buf := new(bytes.Buffer)
+
+	if err := condition.Execute(buf, metadata); err != nil {
+		return false, err
+	}
+
+	switch strings.TrimSpace(buf.String()) {
+	case "", "false", "0", "<no value>":
+		return false, nil
+	default:
+		return true, nil
+	}
+}
+
+// templateMissingKeyValue returns the value to render for a template field
+// whose template referenced a missing metadata key, or false if the field
+// should be dropped, as it is in TemplateMissingKeyDrop mode.
+func (r *Router) templateMissingKeyValue(field string) (string, bool) {
+	switch r.TemplateMissingKeyMode {
+	case TemplateMissingKeyEmpty:
+		return "", true
+	case TemplateMissingKeyDefault:
+		if value, ok := r.TemplateMissingKeyDefaults[field]; ok {
+			return value, true
+		}
+
+		return r.TemplateMissingKeyDefaultValue, true
+	default:
+		return "", false
+	}
+}
+
+// isMissingKeyError reports whether err is the error returned when a template
+// parsed with "missingkey=error" references a missing map key.
+func isMissingKeyError(err error) bool {
+	var execErr template.ExecError
+
+	return errors.As(err, &execErr) && strings.Contains(execErr.Error(), "map has no entry for key")
+}
@@ -2,22 +2,68 @@ package metadataservice_test
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
 	"testing"
 	"text/template"
+	"time"
 
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.hollow.sh/toolbox/ginjwt"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 
+	"go.hollow.sh/metadataservice/internal/audit"
 	"go.hollow.sh/metadataservice/internal/dbtools"
 	"go.hollow.sh/metadataservice/internal/httpsrv"
 	"go.hollow.sh/metadataservice/internal/lookup"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
 )
 
 type TestServerConfig struct {
-	LookupEnabled  bool
-	LookupClient   lookup.Client
-	TemplateFields map[string]template.Template
+	LookupEnabled                  bool
+	LookupClient                   lookup.Client
+	LookupSkipCIDRs                []netip.Prefix
+	AllowedIPCIDRs                 []netip.Prefix
+	AuditLogger                    *audit.Logger
+	TemplateFields                 map[string]template.Template
+	TemplateFieldConditions        map[string]template.Template
+	TemplateMissingKeyMode         string
+	TemplateMissingKeyDefaults     map[string]string
+	TemplateMissingKeyDefaultValue string
+	UserdataTemplate               *template.Template
+	DefaultUserdata                []byte
+	MaintenanceUserdata            []byte
+	UserdataMaintenance            bool
+	UserdataGzipPassthrough        bool
+	NotFoundRetryAfter             time.Duration
+	EmptyMetadataNotFound          bool
+	UnresolvedClientIPStatus       int
+	NotFoundMessage                string
+	IncludeDebugFields             bool
+	FieldRenames                   map[string]string
+	MetadataFallbacks              []v1api.MetadataFallback
+	EC2AlwaysAdvertisedItems       []string
+	ExposeErrors                   bool
+	VerifyIPOwnership              bool
+	ServerTiming                   bool
+	SignedURLSecret                string
+	FingerprintHeader              string
+	FingerprintField               string
+	MetadataTrimStringValues       bool
+	UserdataLineEndingsMode        string
+	MetadataIPMismatchMode         string
+	MetadataAllowedKeys            []string
+	UserdataRequireUTF8            bool
 }
 
 func testHTTPServer(t *testing.T) *http.Handler {
@@ -40,13 +86,173 @@ func testHTTPServerWithConfig(t *testing.T, config TestServerConfig) *http.Handl
 
 	hs.LookupEnabled = config.LookupEnabled
 	hs.LookupClient = config.LookupClient
+	hs.LookupSkipCIDRs = config.LookupSkipCIDRs
+	hs.AllowedIPCIDRs = config.AllowedIPCIDRs
+	hs.AuditLogger = config.AuditLogger
 	hs.TemplateFields = config.TemplateFields
+	hs.TemplateFieldConditions = config.TemplateFieldConditions
+	hs.TemplateMissingKeyMode = config.TemplateMissingKeyMode
+	hs.TemplateMissingKeyDefaults = config.TemplateMissingKeyDefaults
+	hs.TemplateMissingKeyDefaultValue = config.TemplateMissingKeyDefaultValue
+	hs.UserdataTemplate = config.UserdataTemplate
+	hs.DefaultUserdata = config.DefaultUserdata
+	hs.MaintenanceUserdata = config.MaintenanceUserdata
+	hs.UserdataMaintenance = config.UserdataMaintenance
+	hs.UserdataGzipPassthrough = config.UserdataGzipPassthrough
+	hs.NotFoundRetryAfter = config.NotFoundRetryAfter
+	hs.EmptyMetadataNotFound = config.EmptyMetadataNotFound
+	hs.UnresolvedClientIPStatus = config.UnresolvedClientIPStatus
+	hs.NotFoundMessage = config.NotFoundMessage
+	hs.IncludeDebugFields = config.IncludeDebugFields
+	hs.FieldRenames = config.FieldRenames
+	hs.MetadataFallbacks = config.MetadataFallbacks
+	hs.EC2AlwaysAdvertisedItems = config.EC2AlwaysAdvertisedItems
+	hs.ExposeErrors = config.ExposeErrors
+	hs.VerifyIPOwnership = config.VerifyIPOwnership
+	hs.ServerTiming = config.ServerTiming
+	hs.SignedURLSecret = config.SignedURLSecret
+	hs.FingerprintHeader = config.FingerprintHeader
+	hs.FingerprintField = config.FingerprintField
+	hs.MetadataTrimStringValues = config.MetadataTrimStringValues
+	hs.UserdataLineEndingsMode = config.UserdataLineEndingsMode
+	hs.MetadataIPMismatchMode = config.MetadataIPMismatchMode
+	hs.MetadataAllowedKeys = config.MetadataAllowedKeys
+	hs.UserdataRequireUTF8 = config.UserdataRequireUTF8
 
 	s := hs.NewServer()
 
 	return &s.Handler
 }
 
+// testRouter returns a handler serving just the routes of the given router,
+// without the rest of the HTTP server.
+func testRouter(rtr *v1api.Router) http.Handler {
+	r := gin.New()
+
+	rtr.Routes(r.Group(v1api.V1URI))
+	rtr.Ec2Routes(r.Group(v1api.V20090404URI))
+
+	return r
+}
+
+// unreachableDBURL is the URL of a database nothing is listening on, so every
+// query fails to connect.
+const unreachableDBURL = "postgres://root@localhost:12341/defaultdb?sslmode=disable"
+
+// setViper sets the config key for the rest of the test, then restores its
+// previous value, leaving the defaults set by other tests in effect.
+func setViper(t *testing.T, key string, value interface{}) {
+	t.Helper()
+
+	previous := viper.Get(key)
+	viper.Set(key, value)
+
+	t.Cleanup(func() { viper.Set(key, previous) })
+}
+
+// TestNewRouter tests that a router built with NewRouter serves requests
+// without a full HTTP server, or a database for requests which don't need
+// one.
+func TestNewRouter(t *testing.T) {
+	authMW, err := ginjwt.NewAuthMiddleware(ginjwt.AuthConfig{})
+	require.NoError(t, err)
+
+	rtr := v1api.NewRouter(zap.NewNop(), nil, authMW, nil)
+	assert.False(t, rtr.LookupEnabled)
+
+	rtr.UnresolvedClientIPStatus = http.StatusBadRequest
+
+	router := testRouter(rtr)
+
+	for _, path := range []string{v1api.GetMetadataPath(), v1api.GetUserdataPath(), v1api.GetEc2MetadataPath()} {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+		req.RemoteAddr = ""
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+	}
+
+	assert.True(t, v1api.NewRouter(zap.NewNop(), nil, authMW, newMockLookupClient()).LookupEnabled)
+}
+
+// TestInternalErrorResponses tests that the underlying error is only included
+// in 500 responses when ExposeErrors is set.
+func TestInternalErrorResponses(t *testing.T) {
+	authMW, err := ginjwt.NewAuthMiddleware(ginjwt.AuthConfig{})
+	require.NoError(t, err)
+
+	db, err := sqlx.Open("postgres", unreachableDBURL)
+	require.NoError(t, err)
+
+	type testCase struct {
+		testName     string
+		exposeErrors bool
+	}
+
+	testCases := []testCase{
+		{"errors hidden", false},
+		{"errors exposed", true},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			rtr := v1api.NewRouter(zap.NewNop(), db, authMW, nil)
+			rtr.ExposeErrors = testcase.exposeErrors
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalMetadataByIDPath(uuid.NewString()), nil)
+			testRouter(rtr).ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+			resp := v1api.ErrorResponse{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+			assert.Equal(t, "internal server error", resp.Errors[0])
+
+			if testcase.exposeErrors {
+				assert.Len(t, resp.Errors, 2)
+			} else {
+				assert.Len(t, resp.Errors, 1)
+			}
+		})
+	}
+}
+
+// TestWriteRetryBudget tests that the internal write endpoints give each
+// request the configured retry budget.
+func TestWriteRetryBudget(t *testing.T) {
+	setViper(t, "crdb.max_retries", 1000)
+	setViper(t, "crdb.retry_interval", 10*time.Millisecond)
+	setViper(t, "crdb.retry_budget_attempts", 2)
+	setViper(t, "crdb.tx_timeout", time.Second)
+
+	authMW, err := ginjwt.NewAuthMiddleware(ginjwt.AuthConfig{})
+	require.NoError(t, err)
+
+	db, err := sqlx.Open("postgres", unreachableDBURL)
+	require.NoError(t, err)
+
+	core, logs := observer.New(zap.InfoLevel)
+
+	router := testRouter(v1api.NewRouter(zap.New(core), db, authMW, nil))
+
+	body := fmt.Sprintf(`{"id": %q, "metadata": "{}", "ipAddresses": ["10.0.0.1"]}`, uuid.NewString())
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), strings.NewReader(body))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	// The first attempt, and the 2 retries allowed by the budget.
+	assert.Equal(t, 3, logs.FilterMessageSnippet("doUpsert starting").Len())
+}
+
 type lookupResponse struct {
 	metadataResponse lookup.MetadataLookupResponse
 	userdataResponse lookup.UserdataLookupResponse
@@ -55,6 +261,11 @@ type lookupResponse struct {
 
 type mockLookupClient struct {
 	responses map[string]lookupResponse
+	// calls counts the requests made to the mock lookup service.
+	calls int
+	// byIDClientIP is the client IP carried by the context of the last
+	// lookup by ID.
+	byIDClientIP string
 }
 
 func newMockLookupClient() *mockLookupClient {
@@ -66,6 +277,8 @@ func (m *mockLookupClient) setResponse(key string, resp lookupResponse) {
 }
 
 func (m *mockLookupClient) getMetadataResponse(key string) (*lookup.MetadataLookupResponse, error) {
+	m.calls++
+
 	resp, exists := m.responses[key]
 	if !exists {
 		return nil, lookup.ErrNotFound
@@ -75,6 +288,8 @@ func (m *mockLookupClient) getMetadataResponse(key string) (*lookup.MetadataLook
 }
 
 func (m *mockLookupClient) getUserdataResponse(key string) (*lookup.UserdataLookupResponse, error) {
+	m.calls++
+
 	resp, exists := m.responses[key]
 	if !exists {
 		return nil, lookup.ErrNotFound
@@ -83,7 +298,9 @@ func (m *mockLookupClient) getUserdataResponse(key string) (*lookup.UserdataLook
 	return &resp.userdataResponse, resp.Error
 }
 
-func (m *mockLookupClient) GetMetadataByID(_ context.Context, id string) (*lookup.MetadataLookupResponse, error) {
+func (m *mockLookupClient) GetMetadataByID(ctx context.Context, id string) (*lookup.MetadataLookupResponse, error) {
+	m.byIDClientIP, _ = lookup.ClientIPFromContext(ctx)
+
 	return m.getMetadataResponse(id)
 }
 
@@ -91,10 +308,52 @@ func (m *mockLookupClient) GetMetadataByIP(_ context.Context, ip string) (*looku
 	return m.getMetadataResponse(ip)
 }
 
-func (m *mockLookupClient) GetUserdataByID(_ context.Context, id string) (*lookup.UserdataLookupResponse, error) {
+func (m *mockLookupClient) GetUserdataByID(ctx context.Context, id string) (*lookup.UserdataLookupResponse, error) {
+	m.byIDClientIP, _ = lookup.ClientIPFromContext(ctx)
+
 	return m.getUserdataResponse(id)
 }
 
 func (m *mockLookupClient) GetUserdataByIP(_ context.Context, ip string) (*lookup.UserdataLookupResponse, error) {
 	return m.getUserdataResponse(ip)
 }
+
+// TestOversizedAuthorizationHeader tests that requests to the internal
+// endpoints with an Authorization header over the configured size get a 431,
+// while smaller headers are passed along to the auth middleware.
+func TestOversizedAuthorizationHeader(t *testing.T) {
+	authMW, err := ginjwt.NewAuthMiddleware(ginjwt.AuthConfig{})
+	require.NoError(t, err)
+
+	rtr := v1api.NewRouter(zap.NewNop(), nil, authMW, nil)
+	rtr.MaxAuthorizationHeaderSize = 1024
+
+	router := testRouter(rtr)
+
+	type testCase struct {
+		testName       string
+		method         string
+		tokenSize      int
+		expectedStatus int
+	}
+
+	// The instance ID is invalid, so requests that get past the auth
+	// middleware get a 404 without needing a database.
+	testCases := []testCase{
+		{"small header read", http.MethodGet, 512, http.StatusNotFound},
+		{"oversized header read", http.MethodGet, 1024, http.StatusRequestHeaderFieldsTooLarge},
+		{"oversized header delete", http.MethodDelete, 1024, http.StatusRequestHeaderFieldsTooLarge},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), testcase.method, v1api.GetInternalMetadataByIDPath("not-a-uuid"), nil)
+			req.Header.Set("Authorization", "Bearer "+strings.Repeat("a", testcase.tokenSize))
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package metadataservice
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errNoMaintenanceUserdata = errors.New("no maintenance userdata is configured")
+
+// UserdataMaintenanceRequest is the body of a request starting or stopping
+// serving the maintenance userdata.
+type UserdataMaintenanceRequest struct {
+	Enabled *bool `json:"enabled" binding:"required"`
+}
+
+// UserdataMaintenanceResponse reports whether the maintenance userdata is
+// being served.
+type UserdataMaintenanceResponse struct {
+	Enabled bool `json:"enabled"`
+}
+
+// SetUserdataMaintenance sets whether the MaintenanceUserdata is served in
+// place of the instances' userdata by the public endpoints. It's ignored
+// without any MaintenanceUserdata.
+func (r *Router) SetUserdataMaintenance(enabled bool) {
+	r.maintenance.Store(enabled && r.MaintenanceUserdata != nil)
+}
+
+// UserdataMaintenance reports whether the MaintenanceUserdata is being served.
+func (r *Router) UserdataMaintenance() bool {
+	return r.maintenance.Load()
+}
+
+// maintenanceUserdataResponse serves the maintenance userdata, if it's
+// active, and reports whether it did. Like the default userdata, it's only
+// served to instances with userdata or metadata, so unknown instances still
+// get a 404 from the regular handlers.
+func (r *Router) maintenanceUserdataResponse(c *gin.Context) bool {
+	if !r.UserdataMaintenance() {
+		return false
+	}
+
+	instanceID := ""
+
+	userdata, err := r.getUserdata(c)
+	if err != nil && !errors.Is(err, errNotFound) {
+		r.dbErrorResponse(c, err)
+		return true
+	}
+
+	if userdata != nil {
+		instanceID = userdata.ID
+	} else {
+		metadata, err := r.getMetadata(c)
+		if err != nil && !errors.Is(err, errNotFound) {
+			r.metadataErrorResponse(c, err)
+			return true
+		}
+
+		if metadata == nil {
+			return false
+		}
+
+		instanceID = metadata.ID
+	}
+
+	setInstanceIDHeader(c, instanceID)
+	plainUserdataResponse(c, r.MaintenanceUserdata)
+
+	return true
+}
+
+// userdataMaintenanceGet reports whether the maintenance userdata is being
+// served.
+func (r *Router) userdataMaintenanceGet(c *gin.Context) {
+	c.JSON(http.StatusOK, UserdataMaintenanceResponse{Enabled: r.UserdataMaintenance()})
+}
+
+// userdataMaintenanceSet starts or stops serving the maintenance userdata in
+// place of the instances' userdata. Nothing stored is changed, so stopping
+// it serves the instances' own userdata again.
+func (r *Router) userdataMaintenanceSet(c *gin.Context) {
+	var params UserdataMaintenanceRequest
+	if err := c.ShouldBindJSON(&params); err != nil {
+		badRequestResponse(c, "invalid request body", err)
+		return
+	}
+
+	if *params.Enabled && r.MaintenanceUserdata == nil {
+		badRequestResponse(c, errNoMaintenanceUserdata.Error(), errNoMaintenanceUserdata)
+		return
+	}
+
+	r.SetUserdataMaintenance(*params.Enabled)
+	r.Logger.Sugar().Info("Maintenance userdata enabled: ", *params.Enabled)
+
+	c.JSON(http.StatusOK, UserdataMaintenanceResponse{Enabled: r.UserdataMaintenance()})
+}
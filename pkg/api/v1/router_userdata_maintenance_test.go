@@ -0,0 +1,133 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.hollow.sh/toolbox/ginjwt"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func setUserdataMaintenanceRequest(router http.Handler, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPut, v1api.GetInternalUserdataMaintenancePath(), strings.NewReader(body))
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+// TestSetUserdataMaintenance tests toggling the maintenance userdata through
+// the internal endpoint.
+func TestSetUserdataMaintenance(t *testing.T) {
+	authMW, err := ginjwt.NewAuthMiddleware(ginjwt.AuthConfig{})
+	require.NoError(t, err)
+
+	rtr := v1api.NewRouter(zap.NewNop(), nil, authMW, nil)
+	router := testRouter(rtr)
+
+	// Without any maintenance userdata, there's nothing to enable.
+	w := setUserdataMaintenanceRequest(router, `{"enabled": true}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.False(t, rtr.UserdataMaintenance())
+
+	rtr.MaintenanceUserdata = []byte("#!/bin/sh\nexit 0\n")
+
+	w = setUserdataMaintenanceRequest(router, `{}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = setUserdataMaintenanceRequest(router, `{"enabled": true}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"enabled": true}`, w.Body.String())
+	assert.True(t, rtr.UserdataMaintenance())
+
+	w = httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalUserdataMaintenancePath(), nil)
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := v1api.UserdataMaintenanceResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, resp.Enabled)
+
+	w = setUserdataMaintenanceRequest(router, `{"enabled": false}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, rtr.UserdataMaintenance())
+}
+
+// TestGetUserdataMaintenance tests that while maintenance is enabled, the
+// public userdata endpoints serve the maintenance userdata to known
+// instances, while the internal endpoint still serves the stored userdata.
+func TestGetUserdataMaintenance(t *testing.T) {
+	maintenanceUserdata := "#!/bin/sh\necho 'holding for maintenance'\nsleep infinity\n"
+
+	router := *testHTTPServerWithConfig(t, TestServerConfig{
+		MaintenanceUserdata: []byte(maintenanceUserdata),
+		UserdataMaintenance: true,
+	})
+
+	type testCase struct {
+		testName           string
+		instanceIP         string
+		expectedStatus     int
+		expectedInstanceID string
+	}
+
+	testCases := []testCase{
+		{"unknown IP address", "1.2.3.4", http.StatusNotFound, ""},
+		{"instance with userdata", dbtools.FixtureInstanceA.HostIPs[0], http.StatusOK, dbtools.FixtureInstanceA.InstanceID},
+		{"instance with only metadata", dbtools.FixtureInstanceB.HostIPs[0], http.StatusOK, dbtools.FixtureInstanceB.InstanceID},
+	}
+
+	for _, testcase := range testCases {
+		for _, path := range []string{v1api.GetUserdataPath(), v1api.GetEc2UserdataPath()} {
+			t.Run(testcase.testName+" "+path, func(t *testing.T) {
+				w := httptest.NewRecorder()
+
+				req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+				req.RemoteAddr = net.JoinHostPort(testcase.instanceIP, "0")
+				router.ServeHTTP(w, req)
+
+				assert.Equal(t, testcase.expectedStatus, w.Code)
+
+				if testcase.expectedStatus == http.StatusOK {
+					assert.Equal(t, testcase.expectedInstanceID, w.Header().Get(v1api.InstanceIDHeader))
+					assert.Equal(t, maintenanceUserdata, w.Body.String())
+				}
+			})
+		}
+	}
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalUserdataByIDPath(dbtools.FixtureInstanceA.InstanceID), nil)
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "holding for maintenance")
+
+	// Once maintenance is over, the stored userdata is served again.
+	w = setUserdataMaintenanceRequest(router, `{"enabled": false}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+
+	req, _ = http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetUserdataPath(), nil)
+	req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, string(dbtools.FixtureInstanceA.InstanceUserdata.Userdata.Bytes), w.Body.String())
+}
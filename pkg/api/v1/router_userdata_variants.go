@@ -0,0 +1,105 @@
+package metadataservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/volatiletech/null/v8"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/upserter"
+	"go.hollow.sh/metadataservice/internal/variants"
+)
+
+// UserdataVariantParam is the query parameter selecting a named userdata
+// variant, like "ignition", instead of the instance's default userdata.
+const UserdataVariantParam = "variant"
+
+var (
+	errInvalidUserdataVariant = errors.New("userdata variant names must be 1 to 64 letters, digits, '.', '_', or '-'")
+
+	userdataVariantPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+)
+
+// validateUserdataVariant returns an error if the variant isn't a valid
+// variant name. The empty variant, for the default userdata, is valid.
+func validateUserdataVariant(variant string) error {
+	if variant != "" && !userdataVariantPattern.MatchString(variant) {
+		return errInvalidUserdataVariant
+	}
+
+	return nil
+}
+
+// findInstanceUserdataVariant finds the named userdata variant stored for an
+// instance, decompressed if it was compressed at rest.
+func findInstanceUserdataVariant(ctx context.Context, db *sqlx.DB, instanceID, variant string) (*models.InstanceUserdatum, error) {
+	stored, err := variants.Find(ctx, db, instanceID, variant)
+	if err != nil {
+		return nil, err
+	}
+
+	userdata := &models.InstanceUserdatum{
+		ID:         instanceID,
+		Userdata:   null.BytesFrom(stored.Userdata),
+		Compressed: stored.Compressed,
+		UpdatedAt:  stored.UpdatedAt,
+	}
+
+	if err := upserter.DecompressUserdata(userdata); err != nil {
+		return nil, err
+	}
+
+	return userdata, nil
+}
+
+// userdataVariantGet serves the userdata variant named by the variant query
+// parameter. Variants are only ever stored locally, so unlike the default
+// userdata, a missing variant isn't looked up from the upstream lookup
+// service, nor replaced by generated or default userdata.
+func (r *Router) userdataVariantGet(c *gin.Context, variant string) {
+	if err := validateUserdataVariant(variant); err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	instanceID := c.GetString(middleware.ContextKeyInstanceID)
+	if instanceID == "" {
+		r.instanceNotFoundResponse(c)
+		return
+	}
+
+	if err := r.verifyUserdataIPOwnership(c, instanceID); err != nil {
+		if errors.Is(err, errNotFound) {
+			r.instanceNotFoundResponse(c)
+			return
+		}
+
+		r.dbErrorResponse(c, err)
+
+		return
+	}
+
+	dbStart := time.Now()
+	userdata, err := findInstanceUserdataVariant(c.Request.Context(), r.DB, instanceID, variant)
+	recordServerTiming(c, serverTimingDB, dbStart)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		r.instanceNotFoundResponse(c)
+		return
+	}
+
+	if err != nil {
+		r.dbErrorResponse(c, err)
+		return
+	}
+
+	setInstanceIDHeader(c, instanceID)
+	r.userdataResponse(c, instanceID, userdata.Userdata.Bytes)
+}
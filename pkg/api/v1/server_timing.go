@@ -0,0 +1,118 @@
+package metadataservice
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// ServerTimingHeader is the response header breaking down where the time
+	// serving a public read request went, when ServerTiming is set.
+	ServerTimingHeader = "Server-Timing"
+
+	// contextKeyServerTiming is the gin.Context key holding the request's
+	// *serverTiming.
+	contextKeyServerTiming = "server-timing"
+
+	// The Server-Timing metric names: identifying the instance, querying the
+	// DB for its data, calling the upstream lookup service, and rendering
+	// template fields or userdata templates.
+	serverTimingIdentify = "identify"
+	serverTimingDB       = "db"
+	serverTimingLookup   = "lookup"
+	serverTimingTemplate = "template"
+)
+
+// serverTiming accumulates the time spent on each metric of a request.
+type serverTiming struct {
+	mu        sync.Mutex
+	metrics   []string
+	durations map[string]time.Duration
+}
+
+func (st *serverTiming) add(metric string, d time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, ok := st.durations[metric]; !ok {
+		st.metrics = append(st.metrics, metric)
+	}
+
+	st.durations[metric] += d
+}
+
+// header formats the metrics as a Server-Timing header value, in the order
+// they were first recorded, with durations in milliseconds.
+func (st *serverTiming) header() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	entries := make([]string, 0, len(st.metrics))
+
+	for _, metric := range st.metrics {
+		ms := float64(st.durations[metric]) / float64(time.Millisecond)
+		entries = append(entries, metric+";dur="+strconv.FormatFloat(ms, 'f', 3, 64))
+	}
+
+	return strings.Join(entries, ", ")
+}
+
+// serverTimingMiddleware collects the timings recorded with
+// recordServerTiming for the rest of the request, and sets them as the
+// ServerTimingHeader just before the response is written. It does nothing
+// unless ServerTiming is set.
+func (r *Router) serverTimingMiddleware(c *gin.Context) {
+	if !r.ServerTiming {
+		return
+	}
+
+	st := &serverTiming{durations: map[string]time.Duration{}}
+
+	c.Set(contextKeyServerTiming, st)
+	c.Writer = &serverTimingWriter{ResponseWriter: c.Writer, timing: st}
+}
+
+// recordServerTiming adds the time since start to the request's metric, if
+// server timing is being collected.
+func recordServerTiming(c *gin.Context, metric string, start time.Time) {
+	if st, ok := c.Value(contextKeyServerTiming).(*serverTiming); ok {
+		st.add(metric, time.Since(start))
+	}
+}
+
+// serverTimingWriter sets the Server-Timing header when the response starts
+// being written, as headers can't be changed afterwards.
+type serverTimingWriter struct {
+	gin.ResponseWriter
+
+	timing *serverTiming
+}
+
+func (w *serverTimingWriter) setHeader() {
+	if w.Written() {
+		return
+	}
+
+	if value := w.timing.header(); value != "" {
+		w.Header().Set(ServerTimingHeader, value)
+	}
+}
+
+func (w *serverTimingWriter) WriteHeaderNow() {
+	w.setHeader()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *serverTimingWriter) Write(data []byte) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *serverTimingWriter) WriteString(s string) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.WriteString(s)
+}
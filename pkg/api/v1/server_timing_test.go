@@ -0,0 +1,89 @@
+package metadataservice_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"text/template"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.hollow.sh/toolbox/ginjwt"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+// TestServerTimingHeader tests that the Server-Timing header is only added
+// when enabled, including to error responses.
+func TestServerTimingHeader(t *testing.T) {
+	authMW, err := ginjwt.NewAuthMiddleware(ginjwt.AuthConfig{})
+	require.NoError(t, err)
+
+	db, err := sqlx.Open("postgres", unreachableDBURL)
+	require.NoError(t, err)
+
+	type testCase struct {
+		testName       string
+		serverTiming   bool
+		expectedHeader string
+	}
+
+	testCases := []testCase{
+		{"disabled", false, ""},
+		{"enabled", true, `^identify;dur=\d+\.\d{3}, db;dur=\d+\.\d{3}$`},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			rtr := v1api.NewRouter(zap.NewNop(), db, authMW, nil)
+			rtr.InstanceIDHeader = "X-Instance-ID"
+			rtr.TrustedProxies = []string{"10.0.0.1"}
+			rtr.DisableIPIdentification = true
+			rtr.ServerTiming = testcase.serverTiming
+
+			router := testRouter(rtr)
+
+			for _, path := range []string{v1api.GetMetadataPath(), v1api.GetUserdataPath(), v1api.GetEc2MetadataPath()} {
+				w := httptest.NewRecorder()
+
+				req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+				req.RemoteAddr = net.JoinHostPort("10.0.0.1", "0")
+				req.Header.Set("X-Instance-ID", uuid.NewString())
+				router.ServeHTTP(w, req)
+
+				assert.Equal(t, http.StatusInternalServerError, w.Code, path)
+
+				if testcase.expectedHeader == "" {
+					assert.Empty(t, w.Header().Get(v1api.ServerTimingHeader), path)
+				} else {
+					assert.Regexp(t, testcase.expectedHeader, w.Header().Get(v1api.ServerTimingHeader), path)
+				}
+			}
+		})
+	}
+}
+
+func TestGetMetadataServerTiming(t *testing.T) {
+	hostnameTmpl, err := template.New("hostname").Parse("{{ .hostname }}.example.com")
+	require.NoError(t, err)
+
+	router := *testHTTPServerWithConfig(t, TestServerConfig{
+		ServerTiming:   true,
+		TemplateFields: map[string]template.Template{"fqdn": *hostnameTmpl},
+	})
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataPath(), nil)
+	req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Regexp(t, `^identify;dur=\d+\.\d{3}, db;dur=\d+\.\d{3}, template;dur=\d+\.\d{3}$`, w.Header().Get(v1api.ServerTimingHeader))
+}
@@ -0,0 +1,91 @@
+package metadataservice
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+)
+
+var (
+	errInvalidSignedURL = errors.New("invalid or missing signature")
+	errExpiredSignedURL = errors.New("signed URL has expired")
+	errSignedURLTooLong = errors.New("signed URL expires too far in the future")
+)
+
+// SignMetadataURL returns the path, including the "sig" and "exp" query
+// parameters, of a signed URL serving the instance's metadata without
+// identifying the instance by its IP address. The URL is valid until expires.
+func SignMetadataURL(secret, instanceID string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+
+	query := url.Values{}
+	query.Set("exp", exp)
+	query.Set("sig", signedURLSignature(secret, instanceID, exp))
+
+	return GetMetadataSignedPath(instanceID) + "?" + query.Encode()
+}
+
+// signedURLSignature returns the hex-encoded HMAC-SHA256 of the instance ID
+// and expiry timestamp, using the secret as the key.
+func signedURLSignature(secret, instanceID, exp string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(instanceID + "\n" + exp))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignedURL identifies the instance from the path of a signed metadata
+// URL, after checking that the URL's signature was made with SignedURLSecret
+// and that it hasn't expired. Requests with invalid or expired signatures, or
+// expiring later than SignedURLMaxLifetime from now, get a 403.
+func (r *Router) verifySignedURL(c *gin.Context) {
+	instanceID, err := getUUIDParam(c, "instance-id")
+	if err != nil {
+		invalidUUIDResponse(c, err)
+		return
+	}
+
+	exp := c.Query("exp")
+
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, &ErrorResponse{Message: errInvalidSignedURL.Error()})
+		return
+	}
+
+	expected := signedURLSignature(r.SignedURLSecret, instanceID, exp)
+	if !hmac.Equal([]byte(c.Query("sig")), []byte(expected)) {
+		c.AbortWithStatusJSON(http.StatusForbidden, &ErrorResponse{Message: errInvalidSignedURL.Error()})
+		return
+	}
+
+	// The expiry is only checked once the signature is known to be valid, so
+	// it can't be forged.
+	now := r.now()
+
+	if now.Unix() > expires {
+		c.AbortWithStatusJSON(http.StatusForbidden, &ErrorResponse{Message: errExpiredSignedURL.Error()})
+		return
+	}
+
+	maxLifetime := r.SignedURLMaxLifetime
+	if maxLifetime <= 0 {
+		maxLifetime = DefaultSignedURLMaxLifetime
+	}
+
+	if expires > now.Add(maxLifetime).Unix() {
+		c.AbortWithStatusJSON(http.StatusForbidden, &ErrorResponse{Message: errSignedURLTooLong.Error()})
+		return
+	}
+
+	c.Set(middleware.ContextKeyInstanceID, instanceID)
+}
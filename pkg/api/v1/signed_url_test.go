@@ -0,0 +1,131 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.hollow.sh/toolbox/ginjwt"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+const testSignedURLSecret = "not-so-secret"
+
+// TestSignedURLValidation tests that signed metadata URLs are rejected unless
+// their signature was made with the right secret and hasn't expired.
+func TestSignedURLValidation(t *testing.T) {
+	authMW, err := ginjwt.NewAuthMiddleware(ginjwt.AuthConfig{})
+	require.NoError(t, err)
+
+	rtr := v1api.NewRouter(zap.NewNop(), nil, authMW, nil)
+	rtr.SignedURLSecret = testSignedURLSecret
+
+	router := testRouter(rtr)
+
+	instanceID := uuid.NewString()
+	otherID := uuid.NewString()
+	valid := v1api.SignMetadataURL(testSignedURLSecret, instanceID, time.Now().Add(time.Hour))
+	query := valid[strings.Index(valid, "?"):]
+
+	type testCase struct {
+		testName       string
+		url            string
+		expectedStatus int
+	}
+
+	testCases := []testCase{
+		{"wrong secret", v1api.SignMetadataURL("some-other-secret", instanceID, time.Now().Add(time.Hour)), http.StatusForbidden},
+		{"expired", v1api.SignMetadataURL(testSignedURLSecret, instanceID, time.Now().Add(-time.Minute)), http.StatusForbidden},
+		{"expires beyond the max lifetime", v1api.SignMetadataURL(testSignedURLSecret, instanceID, time.Now().Add(v1api.DefaultSignedURLMaxLifetime+time.Hour)), http.StatusForbidden},
+		{"signed for another instance", v1api.GetMetadataSignedPath(otherID) + query, http.StatusForbidden},
+		{"tampered expiry", strings.Replace(valid, "exp=", "exp=9", 1), http.StatusForbidden},
+		{"missing signature", v1api.GetMetadataSignedPath(instanceID) + "?exp=9999999999", http.StatusForbidden},
+		{"missing expiry", v1api.GetMetadataSignedPath(instanceID) + "?sig=abcd", http.StatusForbidden},
+		{"invalid instance ID", v1api.GetMetadataSignedPath("not-a-uuid") + query, http.StatusNotFound},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, testcase.url, nil)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+		})
+	}
+}
+
+// TestSignedURLDisabled tests that the signed metadata URLs aren't served
+// unless a secret is configured.
+func TestSignedURLDisabled(t *testing.T) {
+	authMW, err := ginjwt.NewAuthMiddleware(ginjwt.AuthConfig{})
+	require.NoError(t, err)
+
+	router := testRouter(v1api.NewRouter(zap.NewNop(), nil, authMW, nil))
+
+	w := httptest.NewRecorder()
+
+	// Signed with an empty secret, which must not be accepted either.
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.SignMetadataURL("", uuid.NewString(), time.Now().Add(time.Hour)), nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// TestGetMetadataSignedURL tests that a valid signed URL serves the instance's
+// metadata without the request coming from one of its IP addresses.
+func TestGetMetadataSignedURL(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{SignedURLSecret: testSignedURLSecret})
+
+	w := httptest.NewRecorder()
+
+	url := v1api.SignMetadataURL(testSignedURLSecret, dbtools.FixtureInstanceA.InstanceID, time.Now().Add(time.Hour))
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, url, nil)
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	metadata := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &metadata))
+	assert.Equal(t, dbtools.FixtureInstanceA.InstanceID, metadata["id"])
+}
+
+// TestSignedURLRateLimited tests that the signed metadata URLs are rate
+// limited like the other public endpoints.
+func TestSignedURLRateLimited(t *testing.T) {
+	authMW, err := ginjwt.NewAuthMiddleware(ginjwt.AuthConfig{})
+	require.NoError(t, err)
+
+	rtr := v1api.NewRouter(zap.NewNop(), nil, authMW, nil)
+	rtr.SignedURLSecret = testSignedURLSecret
+	rtr.PublicRateLimit = 1
+	rtr.PublicRateBurst = 1
+
+	router := testRouter(rtr)
+
+	// Signed with the wrong secret, so the requests never reach the database.
+	url := v1api.SignMetadataURL("some-other-secret", uuid.NewString(), time.Now().Add(time.Hour))
+
+	expectedStatuses := []int{http.StatusForbidden, http.StatusTooManyRequests}
+
+	for _, expectedStatus := range expectedStatuses {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, url, nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, expectedStatus, w.Code)
+	}
+}